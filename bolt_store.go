@@ -0,0 +1,812 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/mailru/easyjson"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltUsersBucket          = []byte("users")
+	boltLocationsBucket      = []byte("locations")
+	boltVisitsBucket         = []byte("visits")
+	boltEmailsBucket         = []byte("emails")
+	boltUserVisitsBucket     = []byte("user_visits")
+	boltLocationVisitsBucket = []byte("location_visits")
+)
+
+var boltBuckets = [][]byte{
+	boltUsersBucket,
+	boltLocationsBucket,
+	boltVisitsBucket,
+	boltEmailsBucket,
+	boltUserVisitsBucket,
+	boltLocationVisitsBucket,
+}
+
+// BoltStore keeps data in a bbolt database file. Entities are stored as
+// JSON keyed by big-endian id. Visits are indexed by user and by location
+// with owner|visited_at|id composite keys, so date ranges map to cursor scans.
+type BoltStore struct {
+	db          *bolt.DB
+	uniqueEmail bool
+	cascade     bool
+}
+
+func NewBoltStore(db *bolt.DB) (*BoltStore, error) {
+	if err := db.Update(createBoltBuckets); err != nil {
+		return nil, err
+	}
+	return &BoltStore{db: db, uniqueEmail: true}, nil
+}
+
+// SetUniqueEmail switches the unique user email constraint, it is on by
+// default. Blank emails are never considered duplicates. Turning it on
+// fails with ErrDup if existing users share an email. It must not be
+// called concurrently with other methods.
+func (s *BoltStore) SetUniqueEmail(unique bool) error {
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// rebuild emails index from scratch
+		if err := tx.DeleteBucket(boltEmailsBucket); err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		emails, err := tx.CreateBucket(boltEmailsBucket)
+		if err != nil || !unique {
+			return err
+		}
+		return boltEach(tx.Bucket(boltUsersBucket), func(data []byte) (bool, error) {
+			var u User
+			if err := easyjson.Unmarshal(data, &u); err != nil {
+				return false, err
+			}
+			if u.Email == "" {
+				return true, nil
+			}
+			if emails.Get([]byte(u.Email)) != nil {
+				return false, ErrDup
+			}
+			return true, emails.Put([]byte(u.Email), boltID(u.ID))
+		})
+	})
+	if err == nil {
+		s.uniqueEmail = unique
+	}
+	return err
+}
+
+// SetCascade switches delete of users and locations to remove their visits
+// too. Otherwise delete of an entity referenced by visits fails with
+// ErrHasVisits. It must not be called concurrently with other methods.
+func (s *BoltStore) SetCascade(cascade bool) {
+	s.cascade = cascade
+}
+
+func createBoltBuckets(tx *bolt.Tx) error {
+	for _, name := range boltBuckets {
+		if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// User methods
+func (s *BoltStore) CreateUser(ctx context.Context, u *User) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		return boltCreateUser(tx, u, s.uniqueEmail)
+	})
+}
+
+func (s *BoltStore) CreateUsers(ctx context.Context, us []User) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		for i := range us {
+			if err := boltCreateUser(tx, &us[i], s.uniqueEmail); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func boltCreateUser(tx *bolt.Tx, u *User, uniqueEmail bool) error {
+	if u.ID == 0 {
+		return ErrMissingID
+	}
+	key := boltID(u.ID)
+	if tx.Bucket(boltUsersBucket).Get(key) != nil {
+		return ErrDup
+	}
+	if boltEmailTaken(tx, u.Email, key) {
+		return ErrDup
+	}
+	if err := boltReindexEmail(tx, key, "", u.Email, uniqueEmail); err != nil {
+		return err
+	}
+	return boltPut(tx.Bucket(boltUsersBucket), key, u)
+}
+
+func (s *BoltStore) UpdateUser(ctx context.Context, id uint, u *User) error {
+	if id != u.ID {
+		return ErrUpdateID
+	}
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		key := boltID(id)
+		var prev User
+		if err := boltGet(tx.Bucket(boltUsersBucket), key, &prev); err != nil {
+			return err
+		}
+		if prev.Email != u.Email {
+			if boltEmailTaken(tx, u.Email, key) {
+				return ErrDup
+			}
+			if err := boltReindexEmail(tx, key, prev.Email, u.Email, s.uniqueEmail); err != nil {
+				return err
+			}
+		}
+		return boltPut(tx.Bucket(boltUsersBucket), key, u)
+	})
+}
+
+func (s *BoltStore) GetUser(ctx context.Context, id uint, u *User) error {
+	return s.view(ctx, func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltUsersBucket), boltID(id), u)
+	})
+}
+
+func (s *BoltStore) GetUsers(ctx context.Context, ids []uint, users *[]User) error {
+	results := make([]User, 0, len(ids))
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		b := tx.Bucket(boltUsersBucket)
+		for _, id := range ids {
+			var u User
+			if err := boltGet(b, boltID(id), &u); err == ErrNotFound {
+				continue
+			} else if err != nil {
+				return err
+			}
+			results = append(results, u)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	*users = results
+	return nil
+}
+
+func (s *BoltStore) GetUserVisits(ctx context.Context, id uint, q *UserVisitsQuery, visits *[]UserVisit) (int, error) {
+	var results []UserVisit
+	if err := s.userLocationVisits(ctx, id, q, func(v *Visit, location *Location) {
+		results = append(results, UserVisit{
+			Mark:      v.Mark,
+			VisitedAt: v.VisitedAt,
+			Place:     location.Place,
+		})
+	}); err != nil {
+		return 0, err
+	}
+	total := len(results)
+	if q.Desc {
+		for i, j := 0, len(results)-1; i < j; i, j = i+1, j-1 {
+			results[i], results[j] = results[j], results[i]
+		}
+	}
+	if q.Offset < len(results) {
+		results = results[q.Offset:]
+	} else {
+		results = results[:0]
+	}
+	if q.Limit > 0 && len(results) > q.Limit {
+		results = results[:q.Limit]
+	}
+	*visits = append(make([]UserVisit, 0, len(results)), results...)
+	return total, nil
+}
+
+func (s *BoltStore) GetUserAvg(ctx context.Context, id uint, q *UserVisitsQuery) (float64, error) {
+	var sum, cnt int
+	if err := s.userLocationVisits(ctx, id, q, func(v *Visit, _ *Location) {
+		sum += v.Mark
+		cnt++
+	}); err != nil {
+		return 0, err
+	}
+	var avg float64
+	if cnt > 0 {
+		avg = float64(sum) / float64(cnt)
+	}
+	return avg, nil
+}
+
+// userLocationVisits calls f with user visits matching the query and their
+// locations in ascending visit time order
+func (s *BoltStore) userLocationVisits(ctx context.Context, id uint, q *UserVisitsQuery, f func(v *Visit, location *Location)) error {
+	return s.view(ctx, func(tx *bolt.Tx) error {
+		if tx.Bucket(boltUsersBucket).Get(boltID(id)) == nil {
+			return ErrNotFound
+		}
+		locations := tx.Bucket(boltLocationsBucket)
+		return boltScanVisits(ctx, tx, boltUserVisitsBucket, id, q.FromDate, q.ToDate, func(v *Visit) error {
+			var location Location
+			if err := boltGet(locations, boltID(v.LocationID), &location); err == ErrNotFound {
+				return nil // location was deleted
+			} else if err != nil {
+				return err
+			}
+			if (q.Country != "" && location.Country != q.Country) || !q.matchDistance(location.Distance) {
+				return nil
+			}
+			f(v, &location)
+			return nil
+		})
+	})
+}
+
+func (s *BoltStore) DeleteUser(ctx context.Context, id uint) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		key := boltID(id)
+		var user User
+		if err := boltGet(tx.Bucket(boltUsersBucket), key, &user); err != nil {
+			return err
+		}
+		if err := boltDeleteVisitsOf(tx, boltUserVisitsBucket, id, s.cascade); err != nil {
+			return err
+		}
+		if err := boltReindexEmail(tx, key, user.Email, "", s.uniqueEmail); err != nil {
+			return err
+		}
+		return tx.Bucket(boltUsersBucket).Delete(key)
+	})
+}
+
+// Location methods
+func (s *BoltStore) CreateLocation(ctx context.Context, l *Location) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		return boltCreateLocation(tx, l)
+	})
+}
+
+func (s *BoltStore) CreateLocations(ctx context.Context, ls []Location) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		for i := range ls {
+			if err := boltCreateLocation(tx, &ls[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func boltCreateLocation(tx *bolt.Tx, l *Location) error {
+	if l.ID == 0 {
+		return ErrMissingID
+	}
+	key := boltID(l.ID)
+	locations := tx.Bucket(boltLocationsBucket)
+	if locations.Get(key) != nil {
+		return ErrDup
+	}
+	return boltPut(locations, key, l)
+}
+
+func (s *BoltStore) UpdateLocation(ctx context.Context, id uint, l *Location) error {
+	if id != l.ID {
+		return ErrUpdateID
+	}
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		key := boltID(id)
+		locations := tx.Bucket(boltLocationsBucket)
+		if locations.Get(key) == nil {
+			return ErrNotFound
+		}
+		return boltPut(locations, key, l)
+	})
+}
+
+func (s *BoltStore) GetLocation(ctx context.Context, id uint, l *Location) error {
+	return s.view(ctx, func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltLocationsBucket), boltID(id), l)
+	})
+}
+
+func (s *BoltStore) GetLocationAvg(ctx context.Context, id uint, q *LocationAvgQuery) (float64, int, error) {
+	var sum, cnt int
+	if err := s.locationMarks(ctx, id, q, func(mark int) {
+		sum += mark
+		cnt++
+	}); err != nil {
+		return 0, 0, err
+	}
+	var avg float64
+	if cnt > 0 {
+		avg = float64(sum) / float64(cnt)
+	}
+	return avg, cnt, nil
+}
+
+func (s *BoltStore) GetLocationHistogram(ctx context.Context, id uint, q *LocationAvgQuery, h *MarkHistogram) error {
+	*h = MarkHistogram{}
+	return s.locationMarks(ctx, id, q, h.add)
+}
+
+// locationMarks calls f with marks of location visits matching the query
+func (s *BoltStore) GetLocationAvgByAge(ctx context.Context, id uint, q *LocationAvgQuery, buckets []AgeBucket) error {
+	a := newAgeBucketsAvg(buckets, time.Now())
+	if err := s.locationUserMarks(ctx, id, q, true, func(mark int, user *User) {
+		a.add(mark, user.BirthDate)
+	}); err != nil {
+		return err
+	}
+	a.done()
+	return nil
+}
+
+func (s *BoltStore) locationMarks(ctx context.Context, id uint, q *LocationAvgQuery, f func(mark int)) error {
+	return s.locationUserMarks(ctx, id, q, false, func(mark int, _ *User) {
+		f(mark)
+	})
+}
+
+// locationUserMarks is like MemoryStore.locationUserMarks
+func (s *BoltStore) locationUserMarks(ctx context.Context, id uint, q *LocationAvgQuery, withUsers bool, f func(mark int, user *User)) error {
+	filterUsers := q.FromAge != nil || q.ToAge != nil || q.Gender != ""
+	withUsers = withUsers || filterUsers
+	fromBirth := q.FromBirth()
+	toBirth := q.ToBirth()
+	return s.view(ctx, func(tx *bolt.Tx) error {
+		if tx.Bucket(boltLocationsBucket).Get(boltID(id)) == nil {
+			return ErrNotFound
+		}
+		users := tx.Bucket(boltUsersBucket)
+		return boltScanVisits(ctx, tx, boltLocationVisitsBucket, id, q.FromDate, q.ToDate, func(v *Visit) error {
+			if (q.FromMark != nil && v.Mark <= *q.FromMark) ||
+				(q.ToMark != nil && v.Mark >= *q.ToMark) {
+				return nil
+			}
+			if !withUsers {
+				f(v.Mark, nil)
+				return nil
+			}
+			var user User
+			if err := boltGet(users, boltID(v.UserID), &user); err == ErrNotFound {
+				return nil // user was deleted
+			} else if err != nil {
+				return err
+			}
+			if (fromBirth != nil && user.BirthDate <= *fromBirth) ||
+				(toBirth != nil && user.BirthDate >= *toBirth) ||
+				(q.Gender != "" && q.Gender != user.Gender) {
+				return nil
+			}
+			f(v.Mark, &user)
+			return nil
+		})
+	})
+}
+
+// GetLocationVisitors returns ids of users visited the location in ascending order
+func (s *BoltStore) GetLocationVisitors(ctx context.Context, id uint, q *LocationVisitorsQuery, users *[]uint) error {
+	results := make([]uint, 0)
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		if tx.Bucket(boltLocationsBucket).Get(boltID(id)) == nil {
+			return ErrNotFound
+		}
+		usersBucket := tx.Bucket(boltUsersBucket)
+		seen := make(map[uint]struct{})
+		return boltScanVisits(ctx, tx, boltLocationVisitsBucket, id, q.FromDate, q.ToDate, func(v *Visit) error {
+			if _, ok := seen[v.UserID]; ok {
+				return nil
+			}
+			seen[v.UserID] = struct{}{}
+			if usersBucket.Get(boltID(v.UserID)) != nil {
+				results = append(results, v.UserID)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return err
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i] < results[j] })
+	*users = results
+	return nil
+}
+
+func (s *BoltStore) DeleteLocation(ctx context.Context, id uint) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		key := boltID(id)
+		locations := tx.Bucket(boltLocationsBucket)
+		if locations.Get(key) == nil {
+			return ErrNotFound
+		}
+		if err := boltDeleteVisitsOf(tx, boltLocationVisitsBucket, id, s.cascade); err != nil {
+			return err
+		}
+		return locations.Delete(key)
+	})
+}
+
+// Visit methods
+func (s *BoltStore) CreateVisit(ctx context.Context, v *Visit) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		return boltCreateVisit(tx, v)
+	})
+}
+
+func (s *BoltStore) CreateVisits(ctx context.Context, vs []Visit) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		for i := range vs {
+			if err := boltCreateVisit(tx, &vs[i]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func boltCreateVisit(tx *bolt.Tx, v *Visit) error {
+	if v.ID == 0 {
+		return ErrMissingID
+	}
+	key := boltID(v.ID)
+	visits := tx.Bucket(boltVisitsBucket)
+	if visits.Get(key) != nil {
+		return ErrDup
+	}
+	if err := boltCheckVisitRefs(tx, v); err != nil {
+		return err
+	}
+	if err := boltPutVisitIndexes(tx, v); err != nil {
+		return err
+	}
+	return boltPut(visits, key, v)
+}
+
+func (s *BoltStore) UpdateVisit(ctx context.Context, id uint, v *Visit) error {
+	if id != v.ID {
+		return ErrUpdateID
+	}
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		return boltUpdateVisit(tx, v)
+	})
+}
+
+// UpdateVisits applies all updates in a single transaction
+func (s *BoltStore) UpdateVisits(ctx context.Context, vs []Visit) []error {
+	errs := make([]error, len(vs))
+	err := s.update(ctx, func(tx *bolt.Tx) error {
+		for i := range vs {
+			errs[i] = boltUpdateVisit(tx, &vs[i])
+		}
+		return nil
+	})
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	return errs
+}
+
+func boltUpdateVisit(tx *bolt.Tx, v *Visit) error {
+	key := boltID(v.ID)
+	visits := tx.Bucket(boltVisitsBucket)
+	var cur Visit
+	if err := boltGet(visits, key, &cur); err != nil {
+		return err
+	}
+	if err := boltCheckVisitRefs(tx, v); err != nil {
+		return err
+	}
+	if err := boltDeleteVisitIndexes(tx, &cur); err != nil {
+		return err
+	}
+	if err := boltPutVisitIndexes(tx, v); err != nil {
+		return err
+	}
+	return boltPut(visits, key, v)
+}
+
+func (s *BoltStore) GetVisit(ctx context.Context, id uint, v *Visit) error {
+	return s.view(ctx, func(tx *bolt.Tx) error {
+		return boltGet(tx.Bucket(boltVisitsBucket), boltID(id), v)
+	})
+}
+
+// QueryVisits scans the user index if the user is queried, the location
+// index otherwise
+func (s *BoltStore) QueryVisits(ctx context.Context, q *VisitsQuery, visits *[]Visit) error {
+	if q.UserID == 0 && q.LocationID == 0 {
+		return ErrMissingID
+	}
+	results := []Visit{}
+	err := s.view(ctx, func(tx *bolt.Tx) error {
+		if (q.UserID != 0 && tx.Bucket(boltUsersBucket).Get(boltID(q.UserID)) == nil) ||
+			(q.LocationID != 0 && tx.Bucket(boltLocationsBucket).Get(boltID(q.LocationID)) == nil) {
+			return ErrNotFound
+		}
+		index, owner := boltUserVisitsBucket, q.UserID
+		if q.UserID == 0 {
+			index, owner = boltLocationVisitsBucket, q.LocationID
+		}
+		var matched int
+		return boltScanVisits(ctx, tx, index, owner, q.FromDate, q.ToDate, func(v *Visit) error {
+			if q.LocationID != 0 && v.LocationID != q.LocationID {
+				return nil
+			}
+			matched++
+			if matched <= q.Offset {
+				return nil
+			}
+			results = append(results, *v)
+			if q.Limit > 0 && len(results) >= q.Limit {
+				return errBoltScanDone
+			}
+			return nil
+		})
+	})
+	if err != nil && err != errBoltScanDone {
+		return err
+	}
+	*visits = results
+	return nil
+}
+
+func (s *BoltStore) DeleteVisit(ctx context.Context, id uint) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		return boltDeleteVisit(tx, id)
+	})
+}
+
+func boltDeleteVisit(tx *bolt.Tx, id uint) error {
+	key := boltID(id)
+	visits := tx.Bucket(boltVisitsBucket)
+	var cur Visit
+	if err := boltGet(visits, key, &cur); err != nil {
+		return err
+	}
+	if err := boltDeleteVisitIndexes(tx, &cur); err != nil {
+		return err
+	}
+	return visits.Delete(key)
+}
+
+// Ping fails once the database is closed
+func (s *BoltStore) Ping(ctx context.Context) error {
+	return s.view(ctx, func(tx *bolt.Tx) error {
+		return nil
+	})
+}
+
+func (s *BoltStore) Count(ctx context.Context, c *StoreCounts) error {
+	return s.view(ctx, func(tx *bolt.Tx) error {
+		*c = StoreCounts{
+			Users:     tx.Bucket(boltUsersBucket).Stats().KeyN,
+			Locations: tx.Bucket(boltLocationsBucket).Stats().KeyN,
+			Visits:    tx.Bucket(boltVisitsBucket).Stats().KeyN,
+		}
+		return nil
+	})
+}
+
+// EachUser calls f for every user in id order until f returns false. The
+// whole iteration runs in a single read transaction.
+func (s *BoltStore) EachUser(ctx context.Context, f func(u *User) bool) error {
+	return s.view(ctx, func(tx *bolt.Tx) error {
+		return boltEach(tx.Bucket(boltUsersBucket), func(data []byte) (bool, error) {
+			var u User
+			if err := easyjson.Unmarshal(data, &u); err != nil {
+				return false, err
+			}
+			return f(&u), nil
+		})
+	})
+}
+
+// EachLocation calls f for every location like EachUser
+func (s *BoltStore) EachLocation(ctx context.Context, f func(l *Location) bool) error {
+	return s.view(ctx, func(tx *bolt.Tx) error {
+		return boltEach(tx.Bucket(boltLocationsBucket), func(data []byte) (bool, error) {
+			var l Location
+			if err := easyjson.Unmarshal(data, &l); err != nil {
+				return false, err
+			}
+			return f(&l), nil
+		})
+	})
+}
+
+// EachVisit calls f for every visit like EachUser
+func (s *BoltStore) EachVisit(ctx context.Context, f func(v *Visit) bool) error {
+	return s.view(ctx, func(tx *bolt.Tx) error {
+		return boltEach(tx.Bucket(boltVisitsBucket), func(data []byte) (bool, error) {
+			var v Visit
+			if err := easyjson.Unmarshal(data, &v); err != nil {
+				return false, err
+			}
+			return f(&v), nil
+		})
+	})
+}
+
+func (s *BoltStore) Clear(ctx context.Context) error {
+	return s.update(ctx, func(tx *bolt.Tx) error {
+		for _, name := range boltBuckets {
+			if err := tx.DeleteBucket(name); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return createBoltBuckets(tx)
+	})
+}
+
+func (s *BoltStore) view(ctx context.Context, f func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.View(f)
+}
+
+func (s *BoltStore) update(ctx context.Context, f func(tx *bolt.Tx) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.db.Update(f)
+}
+
+// errBoltScanDone is returned by boltScanVisits callback to stop the scan
+var errBoltScanDone = errors.New("scan done")
+
+// boltScanVisits calls f for visits of the given owner from index bucket
+// with from < visited_at < to in visited_at order.
+func boltScanVisits(ctx context.Context, tx *bolt.Tx, index []byte, owner uint, from, to *int64, f func(v *Visit) error) error {
+	prefix := boltID(owner)
+	seek := prefix
+	if from != nil {
+		// smallest key with visited_at > from
+		seek = boltVisitKey(owner, *from, ^uint(0))
+	}
+	visits := tx.Bucket(boltVisitsBucket)
+	c := tx.Bucket(index).Cursor()
+	var n int
+	for k, _ := c.Seek(seek); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if n%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		n++
+		visitedAt := int64(binary.BigEndian.Uint64(k[8:16]) ^ 1<<63)
+		if from != nil && visitedAt <= *from {
+			continue
+		}
+		if to != nil && visitedAt >= *to {
+			break
+		}
+		var v Visit
+		if err := boltGet(visits, k[16:], &v); err != nil {
+			return err
+		}
+		if err := f(&v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func boltCheckVisitRefs(tx *bolt.Tx, v *Visit) error {
+	if tx.Bucket(boltUsersBucket).Get(boltID(v.UserID)) == nil ||
+		tx.Bucket(boltLocationsBucket).Get(boltID(v.LocationID)) == nil {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// boltEmailTaken reports whether email belongs to user other than the one
+// with the given key. Only emails indexed by boltReindexEmail are taken.
+func boltEmailTaken(tx *bolt.Tx, email string, key []byte) bool {
+	owner := tx.Bucket(boltEmailsBucket).Get([]byte(email))
+	return owner != nil && !bytes.Equal(owner, key)
+}
+
+// boltReindexEmail replaces prev email of the user with the given key with
+// email in the index. Blank emails and all emails in non-unique mode are
+// not indexed.
+func boltReindexEmail(tx *bolt.Tx, key []byte, prev, email string, unique bool) error {
+	emails := tx.Bucket(boltEmailsBucket)
+	if owner := emails.Get([]byte(prev)); owner != nil && bytes.Equal(owner, key) {
+		if err := emails.Delete([]byte(prev)); err != nil {
+			return err
+		}
+	}
+	if !unique || email == "" {
+		return nil
+	}
+	return emails.Put([]byte(email), key)
+}
+
+func boltPutVisitIndexes(tx *bolt.Tx, v *Visit) error {
+	if err := tx.Bucket(boltUserVisitsBucket).Put(boltVisitKey(v.UserID, v.VisitedAt, v.ID), nil); err != nil {
+		return err
+	}
+	return tx.Bucket(boltLocationVisitsBucket).Put(boltVisitKey(v.LocationID, v.VisitedAt, v.ID), nil)
+}
+
+func boltDeleteVisitIndexes(tx *bolt.Tx, v *Visit) error {
+	if err := tx.Bucket(boltUserVisitsBucket).Delete(boltVisitKey(v.UserID, v.VisitedAt, v.ID)); err != nil {
+		return err
+	}
+	return tx.Bucket(boltLocationVisitsBucket).Delete(boltVisitKey(v.LocationID, v.VisitedAt, v.ID))
+}
+
+// boltDeleteVisitsOf removes visits of the owner from index bucket along
+// with all their indexes if cascade is set, otherwise it fails with
+// ErrHasVisits if there are any.
+func boltDeleteVisitsOf(tx *bolt.Tx, index []byte, owner uint, cascade bool) error {
+	prefix := boltID(owner)
+	var ids []uint
+	c := tx.Bucket(index).Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		if !cascade {
+			return ErrHasVisits
+		}
+		ids = append(ids, uint(binary.BigEndian.Uint64(k[16:])))
+	}
+	// index is not modified while iterating over it
+	for _, id := range ids {
+		if err := boltDeleteVisit(tx, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// boltEach calls f for every value of the bucket until f returns false
+func boltEach(b *bolt.Bucket, f func(data []byte) (bool, error)) error {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		more, err := f(v)
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+func boltGet(b *bolt.Bucket, key []byte, v easyjson.Unmarshaler) error {
+	data := b.Get(key)
+	if data == nil {
+		return ErrNotFound
+	}
+	return easyjson.Unmarshal(data, v)
+}
+
+func boltPut(b *bolt.Bucket, key []byte, v easyjson.Marshaler) error {
+	data, err := easyjson.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put(key, data)
+}
+
+// boltID encodes id as big-endian key, so keys are ordered by id
+func boltID(id uint) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+// boltVisitKey builds owner|visited_at|id index key. Sign bit of visited_at
+// is flipped to keep negative timestamps ordered before positive ones.
+func boltVisitKey(owner uint, visitedAt int64, id uint) []byte {
+	key := make([]byte, 24)
+	binary.BigEndian.PutUint64(key, uint64(owner))
+	binary.BigEndian.PutUint64(key[8:], uint64(visitedAt)^1<<63)
+	binary.BigEndian.PutUint64(key[16:], uint64(id))
+	return key
+}
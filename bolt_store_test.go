@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	bolt "go.etcd.io/bbolt"
+)
+
+// testBoltStore opens store in a temporary database file. The returned
+// function closes the database and removes the file.
+func testBoltStore(t *testing.T) (*BoltStore, func()) {
+	dir, err := ioutil.TempDir("", "hlcup-bolt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := bolt.Open(filepath.Join(dir, "test.db"), 0600, nil)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("could not open db: %v", err)
+	}
+	s, err := NewBoltStore(db)
+	if err != nil {
+		db.Close()
+		os.RemoveAll(dir)
+		t.Fatalf("could not create store: %v", err)
+	}
+	return s, func() {
+		db.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	ctx := context.Background()
+	s, cleanup := testBoltStore(t)
+	defer cleanup()
+
+	// create and get
+	u1 := User{ID: 1, Email: "u1@hlcup.com", FirstName: "User1", Gender: "m", BirthDate: -100}
+	assert.NoError(t, s.CreateUser(ctx, &u1))
+	assert.NoError(t, s.CreateUsers(ctx, []User{
+		{ID: 2, Email: "u2@hlcup.com", Gender: "f", BirthDate: 500000000},
+	}))
+	assert.Equal(t, ErrDup, s.CreateUser(ctx, &User{ID: 1, Email: "other@hlcup.com"}))
+	assert.Equal(t, ErrDup, s.CreateUser(ctx, &User{ID: 3, Email: "u1@hlcup.com"}))
+	var u User
+	assert.NoError(t, s.GetUser(ctx, 1, &u))
+	assert.Equal(t, u1, u)
+	assert.Equal(t, ErrNotFound, s.GetUser(ctx, 3, &u))
+	var users []User
+	assert.NoError(t, s.GetUsers(ctx, []uint{2, 3, 1}, &users))
+	assert.Equal(t, []uint{2, 1}, []uint{users[0].ID, users[1].ID})
+	assert.Len(t, users, 2)
+
+	assert.NoError(t, s.CreateLocations(ctx, []Location{
+		{ID: 1, Place: "Place1", Country: "Russia", Distance: 10},
+		{ID: 2, Place: "Place2", Country: "France", Distance: 20},
+	}))
+	assert.NoError(t, s.CreateVisits(ctx, []Visit{
+		{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 300, Mark: 5},
+		{ID: 2, UserID: 1, LocationID: 2, VisitedAt: 100, Mark: 3},
+		{ID: 3, UserID: 2, LocationID: 1, VisitedAt: -50, Mark: 1},
+	}))
+	assert.Equal(t, ErrNotFound, s.CreateVisit(ctx, &Visit{ID: 4, UserID: 3, LocationID: 1}))
+	assert.Equal(t, ErrDup, s.CreateVisit(ctx, &Visit{ID: 1, UserID: 1, LocationID: 1}))
+
+	// update
+	u1.Email = "new@hlcup.com"
+	assert.NoError(t, s.UpdateUser(ctx, 1, &u1))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 3, Email: "u1@hlcup.com"}))
+	assert.Equal(t, ErrDup, s.UpdateUser(ctx, 1, &User{ID: 1, Email: "u2@hlcup.com"}))
+	assert.Equal(t, ErrUpdateID, s.UpdateUser(ctx, 1, &User{ID: 2}))
+	assert.NoError(t, s.UpdateLocation(ctx, 2, &Location{ID: 2, Place: "NewPlace2", Country: "France", Distance: 20}))
+
+	// user visits
+	var visits []UserVisit
+	total, err := s.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, []UserVisit{
+		{Mark: 3, VisitedAt: 100, Place: "NewPlace2"},
+		{Mark: 5, VisitedAt: 300, Place: "Place1"},
+	}, visits)
+	from, to := int64(100), int64(300)
+	_, err = s.GetUserVisits(ctx, 1, &UserVisitsQuery{FromDate: &from}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, []UserVisit{{Mark: 5, VisitedAt: 300, Place: "Place1"}}, visits)
+	_, err = s.GetUserVisits(ctx, 1, &UserVisitsQuery{ToDate: &to}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, []UserVisit{{Mark: 3, VisitedAt: 100, Place: "NewPlace2"}}, visits)
+	_, err = s.GetUserVisits(ctx, 1, &UserVisitsQuery{Country: "Russia"}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, []UserVisit{{Mark: 5, VisitedAt: 300, Place: "Place1"}}, visits)
+	total, err = s.GetUserVisits(ctx, 1, &UserVisitsQuery{Desc: true, Limit: 1}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, []UserVisit{{Mark: 5, VisitedAt: 300, Place: "Place1"}}, visits)
+	_, err = s.GetUserVisits(ctx, 5, &UserVisitsQuery{}, &visits)
+	assert.Equal(t, ErrNotFound, err)
+
+	// location avg
+	avg, _, err := s.GetLocationAvg(ctx, 1, &LocationAvgQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3.0, avg)
+	zero := int64(0)
+	avg, _, err = s.GetLocationAvg(ctx, 1, &LocationAvgQuery{FromDate: &zero})
+	assert.NoError(t, err)
+	assert.Equal(t, 5.0, avg)
+	avg, _, err = s.GetLocationAvg(ctx, 1, &LocationAvgQuery{Gender: "f"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, avg)
+	_, _, err = s.GetLocationAvg(ctx, 5, &LocationAvgQuery{})
+	assert.Equal(t, ErrNotFound, err)
+
+	// location avg by age
+	buckets := newAgeBuckets([]int{0, 50})
+	assert.NoError(t, s.GetLocationAvgByAge(ctx, 1, &LocationAvgQuery{}, buckets))
+	assert.Equal(t, 1.0, buckets[0].Avg) // user born in 1985
+	assert.Equal(t, 5.0, buckets[1].Avg) // user born in 1969
+
+	// location histogram
+	var h MarkHistogram
+	assert.NoError(t, s.GetLocationHistogram(ctx, 1, &LocationAvgQuery{}, &h))
+	assert.Equal(t, MarkHistogram{0, 1, 0, 0, 0, 1}, h)
+	assert.NoError(t, s.GetLocationHistogram(ctx, 1, &LocationAvgQuery{Gender: "m"}, &h))
+	assert.Equal(t, MarkHistogram{0, 0, 0, 0, 0, 1}, h)
+
+	// location visitors
+	var visitors []uint
+	assert.NoError(t, s.GetLocationVisitors(ctx, 1, &LocationVisitorsQuery{}, &visitors))
+	assert.Equal(t, []uint{1, 2}, visitors)
+	assert.NoError(t, s.GetLocationVisitors(ctx, 1, &LocationVisitorsQuery{FromDate: &zero}, &visitors))
+	assert.Equal(t, []uint{1}, visitors)
+	assert.Equal(t, ErrNotFound, s.GetLocationVisitors(ctx, 5, &LocationVisitorsQuery{}, &visitors))
+
+	// move visit to another user and location
+	assert.NoError(t, s.UpdateVisit(ctx, 1, &Visit{ID: 1, UserID: 2, LocationID: 2, VisitedAt: 200, Mark: 4}))
+	assert.Equal(t, ErrNotFound, s.UpdateVisit(ctx, 1, &Visit{ID: 1, UserID: 5, LocationID: 2}))
+	_, err = s.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, []UserVisit{{Mark: 3, VisitedAt: 100, Place: "NewPlace2"}}, visits)
+	avg, _, err = s.GetLocationAvg(ctx, 2, &LocationAvgQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3.5, avg)
+	var v Visit
+	assert.NoError(t, s.GetVisit(ctx, 1, &v))
+	assert.Equal(t, Visit{ID: 1, UserID: 2, LocationID: 2, VisitedAt: 200, Mark: 4}, v)
+
+	// delete and count
+	assert.NoError(t, s.DeleteVisit(ctx, 2))
+	assert.Equal(t, ErrNotFound, s.DeleteVisit(ctx, 2))
+	avg, _, err = s.GetLocationAvg(ctx, 2, &LocationAvgQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 4.0, avg)
+	var c StoreCounts
+	assert.NoError(t, s.Count(ctx, &c))
+	assert.Equal(t, StoreCounts{Users: 3, Locations: 2, Visits: 2}, c)
+
+	// referenced entities are deleted only in cascade mode
+	assert.Equal(t, ErrHasVisits, s.DeleteUser(ctx, 2))
+	assert.Equal(t, ErrHasVisits, s.DeleteLocation(ctx, 1))
+	s.SetCascade(true)
+	assert.NoError(t, s.DeleteLocation(ctx, 1))
+	assert.Equal(t, ErrNotFound, s.GetVisit(ctx, 3, &v))
+	assert.NoError(t, s.DeleteUser(ctx, 2))
+	assert.Equal(t, ErrNotFound, s.GetVisit(ctx, 1, &v))
+	avg, _, err = s.GetLocationAvg(ctx, 2, &LocationAvgQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, avg)
+	assert.NoError(t, s.Count(ctx, &c))
+	assert.Equal(t, StoreCounts{Users: 2, Locations: 1, Visits: 0}, c)
+
+	assert.NoError(t, s.Clear(ctx))
+	assert.NoError(t, s.Count(ctx, &c))
+	assert.Equal(t, StoreCounts{}, c)
+	assert.Equal(t, ErrNotFound, s.GetUser(ctx, 1, &u))
+
+	assert.NoError(t, s.Ping(ctx))
+	s.db.Close()
+	assert.Error(t, s.Ping(ctx))
+}
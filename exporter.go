@@ -0,0 +1,64 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"context"
+	"io"
+
+	"github.com/mailru/easyjson"
+)
+
+// entityFunc calls f for every entity of a single kind until f returns false
+type entityFunc func(f func(v easyjson.Marshaler) bool) error
+
+// exportData writes all store entities to w as zip archive with a data file
+// per entity kind in the format loadData consumes. Entities are streamed
+// one by one, so the dataset never resides in memory entirely.
+func exportData(ctx context.Context, store Store, w io.Writer) error {
+	zw := zip.NewWriter(w)
+	if err := exportFile(zw, "users", func(f func(v easyjson.Marshaler) bool) error {
+		return store.EachUser(ctx, func(u *User) bool { return f(u) })
+	}); err != nil {
+		return err
+	}
+	if err := exportFile(zw, "locations", func(f func(v easyjson.Marshaler) bool) error {
+		return store.EachLocation(ctx, func(l *Location) bool { return f(l) })
+	}); err != nil {
+		return err
+	}
+	if err := exportFile(zw, "visits", func(f func(v easyjson.Marshaler) bool) error {
+		return store.EachVisit(ctx, func(v *Visit) bool { return f(v) })
+	}); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// exportFile writes {"<kind>":[...]} data file to the archive
+func exportFile(zw *zip.Writer, kind string, each entityFunc) error {
+	fw, err := zw.Create(kind + "_1.json")
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(fw)
+	bw.WriteString(`{"` + kind + `":[`)
+	first := true
+	var writeErr error
+	err = each(func(v easyjson.Marshaler) bool {
+		if !first {
+			bw.WriteByte(',')
+		}
+		first = false
+		_, writeErr = easyjson.MarshalToWriter(v, bw)
+		return writeErr == nil
+	})
+	if err != nil {
+		return err
+	}
+	if writeErr != nil {
+		return writeErr
+	}
+	bw.WriteString("]}\n")
+	return bw.Flush()
+}
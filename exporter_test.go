@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// storeDump holds all store entities ordered by id
+type storeDump struct {
+	users     []User
+	locations []Location
+	visits    []Visit
+}
+
+func dumpStore(t *testing.T, s Store) storeDump {
+	ctx := context.Background()
+	var d storeDump
+	assert.NoError(t, s.EachUser(ctx, func(u *User) bool {
+		d.users = append(d.users, *u)
+		return true
+	}))
+	assert.NoError(t, s.EachLocation(ctx, func(l *Location) bool {
+		d.locations = append(d.locations, *l)
+		return true
+	}))
+	assert.NoError(t, s.EachVisit(ctx, func(v *Visit) bool {
+		d.visits = append(d.visits, *v)
+		return true
+	}))
+	sort.Slice(d.users, func(i, j int) bool { return d.users[i].ID < d.users[j].ID })
+	sort.Slice(d.locations, func(i, j int) bool { return d.locations[i].ID < d.locations[j].ID })
+	sort.Slice(d.visits, func(i, j int) bool { return d.visits[i].ID < d.visits[j].ID })
+	return d
+}
+
+func fillExportStore(t *testing.T, s Store) {
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUsers(ctx, []User{
+		{ID: 1, Email: "u1@hlcup.com", FirstName: "User1", LastName: "Last", Gender: "m", BirthDate: -100},
+		{ID: 5, Email: "u5@hlcup.com", FirstName: "Юзер", LastName: "\"Quoted\"", Gender: "f", BirthDate: 500000000},
+	}))
+	assert.NoError(t, s.CreateLocations(ctx, []Location{
+		{ID: 2, Place: "Place2", Country: "Russia", City: "Moscow", Distance: 10},
+		{ID: 3, Place: "Place3", Country: "France", City: "Paris", Distance: 20},
+	}))
+	assert.NoError(t, s.CreateVisits(ctx, []Visit{
+		{ID: 1, UserID: 1, LocationID: 2, VisitedAt: 100, Mark: 4},
+		{ID: 7, UserID: 5, LocationID: 3, VisitedAt: -50, Mark: 0},
+		{ID: 8, UserID: 5, LocationID: 2, VisitedAt: 300, Mark: 5},
+	}))
+}
+
+// testExportRoundTrip exports s into zip file and loads it into a fresh
+// memory store
+func testExportRoundTrip(t *testing.T, s Store) {
+	logrus.SetOutput(ioutil.Discard)
+	fillExportStore(t, s)
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "data.zip")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assert.NoError(t, exportData(context.Background(), s, f))
+	f.Close()
+
+	loaded := NewMemoryStore()
+	assert.NoError(t, loadData(loaded, filename, 2))
+	expected := dumpStore(t, s)
+	assert.Len(t, expected.visits, 3)
+	assert.Equal(t, expected, dumpStore(t, loaded))
+}
+
+func TestExportData(t *testing.T) {
+	testExportRoundTrip(t, NewMemoryStoreWithOptions(MemoryStoreOptions{Shards: 3}))
+}
+
+func TestBoltExportData(t *testing.T) {
+	s, cleanup := testBoltStore(t)
+	defer cleanup()
+	testExportRoundTrip(t, s)
+}
+
+func TestExportEmpty(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, exportData(context.Background(), NewMemoryStore(), &buf))
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	contents := make(map[string]string)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(rc)
+		rc.Close()
+		contents[f.Name] = string(data)
+	}
+	assert.Equal(t, map[string]string{
+		"users_1.json":     "{\"users\":[]}\n",
+		"locations_1.json": "{\"locations\":[]}\n",
+		"visits_1.json":    "{\"visits\":[]}\n",
+	}, contents)
+}
+
+func TestExportError(t *testing.T) {
+	store := new(MockStore)
+	store.On("EachUser", mock.Anything).Return(nil)
+	store.On("EachLocation", mock.Anything).Return(errors.New("db is down"))
+	var buf bytes.Buffer
+	assert.EqualError(t, exportData(context.Background(), store, &buf), "db is down")
+	store.AssertNotCalled(t, "EachVisit", mock.Anything)
+}
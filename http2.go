@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"github.com/valyala/fasthttp"
+)
+
+// EnableHTTP2 makes Listen serve requests with net/http server accepting
+// both HTTP/1.1 and cleartext HTTP/2 (h2c) instead of fasthttp server.
+// Requests are dispatched by the same handler through an adapter, which
+// copies request and response, so plain HTTP/1.1 clients get slower.
+// Create and update handlers close HTTP/1.1 connections after response,
+// HTTP/2 has no such notion: Connection header is dropped and the stream
+// is just finished, so h2c clients keep multiplexing over one connection.
+func (s *Server) EnableHTTP2() {
+	s.http2 = true
+}
+
+func (s *Server) h2cServer(addr string) *http.Server {
+	var handler http.Handler = s.httpHandler()
+	if s.timeout > 0 {
+		handler = http.TimeoutHandler(handler, s.timeout, "Request timeout")
+	}
+	var protocols http.Protocols
+	protocols.SetHTTP1(true)
+	protocols.SetUnencryptedHTTP2(true)
+	return &http.Server{
+		Addr:         addr,
+		Handler:      handler,
+		Protocols:    &protocols,
+		ReadTimeout:  s.readTimeout,
+		WriteTimeout: s.writeTimeout,
+	}
+}
+
+// httpHandler adapts fasthttp handler to net/http
+func (s *Server) httpHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, int64(s.maxBodySize)))
+		if err != nil {
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		var req fasthttp.Request
+		req.Header.SetMethod(r.Method)
+		req.SetRequestURI(r.URL.RequestURI())
+		req.Header.SetHost(r.Host)
+		for k, vs := range r.Header {
+			for _, v := range vs {
+				req.Header.Add(k, v)
+			}
+		}
+		req.SetBody(body)
+
+		var ctx fasthttp.RequestCtx
+		var remoteAddr net.Addr
+		if addr, err := net.ResolveTCPAddr("tcp", r.RemoteAddr); err == nil {
+			remoteAddr = addr
+		}
+		ctx.Init(&req, remoteAddr, nil)
+		s.handler(&ctx)
+
+		ctx.Response.Header.VisitAll(func(k, v []byte) {
+			// connection specific and computed by net/http
+			if bytes.EqualFold(k, []byte("Connection")) ||
+				bytes.EqualFold(k, []byte("Content-Length")) {
+				return
+			}
+			w.Header().Add(string(k), string(v))
+		})
+		w.WriteHeader(ctx.Response.StatusCode())
+		w.Write(ctx.Response.Body())
+	})
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mailru/easyjson"
+	log "github.com/sirupsen/logrus"
+)
+
+// number of entities inserted into the store at once during import
+const importChunkSize = 10000
+
+// max length of a single line in JSON Lines file
+const maxImportLineSize = 1024 * 1024
+
+// importStore is the part of Store data is imported into. Store
+// implementations satisfy it, dryRunStore only validates the data.
+type importStore interface {
+	Clear(ctx context.Context) error
+	CreateUsers(ctx context.Context, us []User) error
+	CreateLocations(ctx context.Context, ls []Location) error
+	CreateVisits(ctx context.Context, vs []Visit) error
+}
+
+// elementsFunc calls f for every raw JSON element of data source and returns
+// number of processed elements
+type elementsFunc func(f func(data []byte) error) (int, error)
+
+// importFile streams data file contents into the store. The file is decoded
+// element by element and inserted in chunks so it never resides in memory
+// entirely.
+func importFile(store importStore, r io.Reader) error {
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return err
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		var n int
+		switch key {
+		case "users":
+			n, err = importUsers(store, arrayElements(dec))
+		case "locations":
+			n, err = importLocations(store, arrayElements(dec))
+		case "visits":
+			n, err = importVisits(store, arrayElements(dec))
+		default:
+			var skip json.RawMessage
+			err = dec.Decode(&skip)
+		}
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			log.Infof("Imported %d %s", n, key)
+		}
+	}
+	return expectDelim(dec, '}')
+}
+
+// importLines streams JSON Lines file contents into the store. Every line
+// holds a single entity of the given kind: users, locations or visits.
+func importLines(store importStore, r io.Reader, kind string) error {
+	var (
+		n   int
+		err error
+	)
+	switch kind {
+	case "users":
+		n, err = importUsers(store, lineElements(r))
+	case "locations":
+		n, err = importLocations(store, lineElements(r))
+	case "visits":
+		n, err = importVisits(store, lineElements(r))
+	default:
+		return fmt.Errorf("unknown entity kind %q", kind)
+	}
+	if n > 0 {
+		log.Infof("Imported %d %s", n, kind)
+	}
+	return err
+}
+
+func importUsers(store importStore, elements elementsFunc) (int, error) {
+	chunk := make([]User, 0, importChunkSize)
+	flush := func() {
+		if err := store.CreateUsers(context.Background(), chunk); err != nil {
+			log.Warnf("Import error %v", err)
+		}
+		chunk = chunk[:0]
+	}
+	n, err := elements(func(data []byte) error {
+		chunk = append(chunk, User{})
+		if err := easyjson.Unmarshal(data, &chunk[len(chunk)-1]); err != nil {
+			return err
+		}
+		if len(chunk) == importChunkSize {
+			flush()
+		}
+		return nil
+	})
+	if len(chunk) > 0 {
+		flush()
+	}
+	return n, err
+}
+
+func importLocations(store importStore, elements elementsFunc) (int, error) {
+	chunk := make([]Location, 0, importChunkSize)
+	flush := func() {
+		if err := store.CreateLocations(context.Background(), chunk); err != nil {
+			log.Warnf("Import error %v", err)
+		}
+		chunk = chunk[:0]
+	}
+	n, err := elements(func(data []byte) error {
+		chunk = append(chunk, Location{})
+		if err := easyjson.Unmarshal(data, &chunk[len(chunk)-1]); err != nil {
+			return err
+		}
+		if len(chunk) == importChunkSize {
+			flush()
+		}
+		return nil
+	})
+	if len(chunk) > 0 {
+		flush()
+	}
+	return n, err
+}
+
+func importVisits(store importStore, elements elementsFunc) (int, error) {
+	chunk := make([]Visit, 0, importChunkSize)
+	flush := func() {
+		if err := store.CreateVisits(context.Background(), chunk); err != nil {
+			log.Warnf("Import error %v", err)
+		}
+		chunk = chunk[:0]
+	}
+	n, err := elements(func(data []byte) error {
+		chunk = append(chunk, Visit{})
+		if err := easyjson.Unmarshal(data, &chunk[len(chunk)-1]); err != nil {
+			return err
+		}
+		if len(chunk) == importChunkSize {
+			flush()
+		}
+		return nil
+	})
+	if len(chunk) > 0 {
+		flush()
+	}
+	return n, err
+}
+
+// arrayElements iterates over the next JSON array in dec
+func arrayElements(dec *json.Decoder) elementsFunc {
+	return func(f func(data []byte) error) (int, error) {
+		return decodeArray(dec, f)
+	}
+}
+
+// lineElements iterates over non-empty lines of r
+func lineElements(r io.Reader) elementsFunc {
+	return func(f func(data []byte) error) (int, error) {
+		sc := bufio.NewScanner(r)
+		sc.Buffer(nil, maxImportLineSize)
+		var n int
+		for sc.Scan() {
+			line := bytes.TrimSpace(sc.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			if err := f(line); err != nil {
+				return n, fmt.Errorf("line %d: %v", n+1, err)
+			}
+			n++
+		}
+		return n, sc.Err()
+	}
+}
+
+// decodeArray calls f for every raw element of the next JSON array in dec
+func decodeArray(dec *json.Decoder, f func(data []byte) error) (int, error) {
+	if err := expectDelim(dec, '['); err != nil {
+		return 0, err
+	}
+	var (
+		n   int
+		raw json.RawMessage
+	)
+	for dec.More() {
+		raw = raw[:0]
+		if err := dec.Decode(&raw); err != nil {
+			return n, err
+		}
+		if err := f(raw); err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, expectDelim(dec, ']')
+}
+
+func expectDelim(dec *json.Decoder, delim json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := tok.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("unexpected token %v, expected %v", tok, delim)
+	}
+	return nil
+}
+
+// interval between import progress log lines
+const importProgressInterval = 5 * time.Second
+
+// importProgress tracks entities stored and data files processed during
+// import. It is safe for concurrent use.
+type importProgress struct {
+	start    time.Time
+	files    int
+	entities int64
+	done     int32
+}
+
+func newImportProgress(files int) *importProgress {
+	return &importProgress{start: time.Now(), files: files}
+}
+
+func (p *importProgress) fileDone() int {
+	return int(atomic.AddInt32(&p.done, 1))
+}
+
+// logEvery logs progress every interval until stop is closed
+func (p *importProgress) logEvery(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.log()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func (p *importProgress) log() {
+	elapsed := time.Since(p.start)
+	done := int(atomic.LoadInt32(&p.done))
+	percent, eta := importEstimate(done, p.files, elapsed)
+	etaText := "unknown"
+	if done > 0 {
+		etaText = eta.Round(time.Second).String()
+	}
+	log.Infof("Imported %d entities, %d/%d files (%.1f%%) in %v, ETA %s",
+		atomic.LoadInt64(&p.entities), done, p.files, percent,
+		elapsed.Round(time.Second), etaText)
+}
+
+// importEstimate returns percent of done files out of total and estimated
+// time left assuming the rest of files take as long as the done ones did
+// in elapsed. Time left is unknown until some file is done, zero is
+// returned then.
+func importEstimate(done, total int, elapsed time.Duration) (float64, time.Duration) {
+	if total <= 0 {
+		return 100, 0
+	}
+	if done > total {
+		done = total
+	}
+	percent := float64(done) * 100 / float64(total)
+	if done == 0 {
+		return percent, 0
+	}
+	return percent, time.Duration(float64(elapsed) * float64(total-done) / float64(done))
+}
+
+// progressStore counts entities stored by the wrapped store into progress
+type progressStore struct {
+	importStore
+	progress *importProgress
+}
+
+func (s *progressStore) CreateUsers(ctx context.Context, us []User) error {
+	return s.count(len(us), s.importStore.CreateUsers(ctx, us))
+}
+
+func (s *progressStore) CreateLocations(ctx context.Context, ls []Location) error {
+	return s.count(len(ls), s.importStore.CreateLocations(ctx, ls))
+}
+
+func (s *progressStore) CreateVisits(ctx context.Context, vs []Visit) error {
+	return s.count(len(vs), s.importStore.CreateVisits(ctx, vs))
+}
+
+// count adds n stored entities unless create failed with err
+func (s *progressStore) count(n int, err error) error {
+	if err == nil {
+		atomic.AddInt64(&s.progress.entities, int64(n))
+	}
+	return err
+}
+
+// dryRunStore validates imported entities instead of storing them. It
+// counts entities and validation failures by entity kind and reason, and
+// data files which failed to open or parse. It is safe for concurrent use.
+type dryRunStore struct {
+	mu         sync.Mutex
+	counts     map[string]int
+	failures   map[string]map[string]int
+	fileErrors int
+}
+
+func newDryRunStore() *dryRunStore {
+	return &dryRunStore{
+		counts:   make(map[string]int),
+		failures: make(map[string]map[string]int),
+	}
+}
+
+// Clear does nothing, there is no data to remove
+func (s *dryRunStore) Clear(ctx context.Context) error {
+	return nil
+}
+
+func (s *dryRunStore) CreateUsers(ctx context.Context, us []User) error {
+	s.mu.Lock()
+	for _, u := range us {
+		s.check("users", u.Validate())
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *dryRunStore) CreateLocations(ctx context.Context, ls []Location) error {
+	s.mu.Lock()
+	for _, l := range ls {
+		s.check("locations", l.Validate())
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *dryRunStore) CreateVisits(ctx context.Context, vs []Visit) error {
+	s.mu.Lock()
+	for _, v := range vs {
+		s.check("visits", v.Validate())
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// check counts entity of the kind, failed if err is not nil. It must be
+// called with mu held.
+func (s *dryRunStore) check(kind string, err error) {
+	s.counts[kind]++
+	if err == nil {
+		return
+	}
+	reason := err.Error()
+	reasons := s.failures[kind]
+	if reasons == nil {
+		reasons = make(map[string]int)
+		s.failures[kind] = reasons
+	}
+	reasons[reason]++
+}
+
+// fileFailed counts data file which could not be read completely
+func (s *dryRunStore) fileFailed() {
+	s.mu.Lock()
+	s.fileErrors++
+	s.mu.Unlock()
+}
+
+// Failed returns total number of invalid entities and unreadable files
+func (s *dryRunStore) Failed() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := s.fileErrors
+	for _, reasons := range s.failures {
+		for _, cnt := range reasons {
+			n += cnt
+		}
+	}
+	return n
+}
+
+// logReport logs entity counts and failures by kind and reason
+func (s *dryRunStore) logReport() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, kind := range dataFileKinds {
+		log.Infof("Checked %d %s", s.counts[kind], kind)
+		reasons := make([]string, 0, len(s.failures[kind]))
+		for reason := range s.failures[kind] {
+			reasons = append(reasons, reason)
+		}
+		sort.Strings(reasons)
+		for _, reason := range reasons {
+			log.Warnf("Invalid %s: %s: %d", kind, reason, s.failures[kind][reason])
+		}
+	}
+	if s.fileErrors > 0 {
+		log.Warnf("Failed to read %d data files", s.fileErrors)
+	}
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mailru/easyjson"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestImportFile(t *testing.T) {
+	ctx := context.Background()
+	logrus.SetOutput(ioutil.Discard)
+	s := NewMemoryStore()
+	err := importFile(s, strings.NewReader(`{
+		"unknown": {"key": [1, 2, 3]},
+		"users": [{"id":1,"email":"u1@hlcup.com","first_name":"User1","last_name":"Last","gender":"m","birth_date":100}],
+		"locations": [{"id":1,"place":"Place1","country":"Russia","city":"Moscow","distance":10}],
+		"visits": [{"id":1,"user":1,"location":1,"visited_at":100,"mark":4}]
+	}`))
+	assert.NoError(t, err)
+	assert.NoError(t, s.GetUser(ctx, 1, &User{}))
+	assert.NoError(t, s.GetLocation(ctx, 1, &Location{}))
+	assert.NoError(t, s.GetVisit(ctx, 1, &Visit{}))
+
+	err = importFile(s, strings.NewReader(`{"users": [{"id":2,`))
+	assert.Error(t, err)
+}
+
+func TestImportFileChunks(t *testing.T) {
+	ctx := context.Background()
+	logrus.SetOutput(ioutil.Discard)
+	cnt := importChunkSize*2 + 1
+	var buf bytes.Buffer
+	buf.WriteString(`{"users":[`)
+	for i := 1; i <= cnt; i++ {
+		if i > 1 {
+			buf.WriteByte(',')
+		}
+		fmt.Fprintf(&buf, `{"id":%d,"email":"u%d@hlcup.com"}`, i, i)
+	}
+	buf.WriteString(`]}`)
+
+	s := NewMemoryStore()
+	assert.NoError(t, importFile(s, &buf))
+	for _, id := range []uint{1, importChunkSize, importChunkSize + 1, uint(cnt)} {
+		var u User
+		assert.NoError(t, s.GetUser(ctx, id, &u))
+		assert.Equal(t, fmt.Sprintf("u%d@hlcup.com", id), u.Email)
+	}
+}
+
+func TestImportLines(t *testing.T) {
+	ctx := context.Background()
+	logrus.SetOutput(ioutil.Discard)
+	s := NewMemoryStore()
+	assert.NoError(t, importLines(s, strings.NewReader(`{"id":1,"email":"u1@hlcup.com"}
+{"id":2,"email":"u2@hlcup.com"}`), "users"))
+	assert.NoError(t, importLines(s, strings.NewReader(`{"id":1,"place":"Place1"}`+"\n"), "locations"))
+	assert.NoError(t, importLines(s, strings.NewReader(`{"id":1,"user":2,"location":1,"visited_at":100,"mark":4}`), "visits"))
+	assert.NoError(t, s.GetUser(ctx, 2, &User{}))
+	assert.NoError(t, s.GetLocation(ctx, 1, &Location{}))
+	assert.NoError(t, s.GetVisit(ctx, 1, &Visit{}))
+
+	err := importLines(s, strings.NewReader(`{"id":3,"email":"u3@hlcup.com"}
+{"id":4,`), "users")
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "line 2:")
+	}
+	assert.NoError(t, s.GetUser(ctx, 3, &User{}))
+
+	assert.Error(t, importLines(s, strings.NewReader(`{}`), "options"))
+}
+
+func TestImportDryRun(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"users_1.json": `{"users":[
+			{"id":1,"email":"u1@hlcup.com","first_name":"User1","last_name":"Last","gender":"m","birth_date":100},
+			{"id":2,"email":"u2@hlcup.com","first_name":"User2","last_name":"Last","gender":"x","birth_date":100},
+			{"id":3,"email":"","first_name":"User3","last_name":"Last","gender":"f","birth_date":100}
+		]}`,
+		"locations_1.json": `{"locations":[
+			{"id":1,"place":"Place1","country":"Russia","city":"Moscow","distance":10},
+			{"id":2,"place":"Place2","country":"Russia","city":"Moscow","distance":0}
+		]}`,
+		"visits_1.json": `{"visits":[
+			{"id":1,"user":1,"location":1,"visited_at":1000000000,"mark":4},
+			{"id":2,"user":1,"location":1,"visited_at":1000000000,"mark":7},
+			{"id":3,"user":2,"location":2,"visited_at":1000000000,"mark":8}
+		]}`,
+		"visits_2.json": `{"visits":[{"id":4,`,
+	}
+	for name, data := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s := newDryRunStore()
+	assert.NoError(t, loadData(s, dir, 2))
+	assert.Equal(t, map[string]int{"users": 3, "locations": 2, "visits": 3}, s.counts)
+	assert.Equal(t, map[string]map[string]int{
+		"users":     {"invalid gender": 1, "invalid email": 1},
+		"locations": {"invalid distance": 1},
+		"visits":    {"invalid mark": 2},
+	}, s.failures)
+	assert.Equal(t, 1, s.fileErrors)
+	assert.Equal(t, 6, s.Failed())
+}
+
+func TestImportEstimate(t *testing.T) {
+	tt := []struct {
+		done, total int
+		elapsed     time.Duration
+		percent     float64
+		eta         time.Duration
+	}{
+		{0, 4, time.Minute, 0, 0},
+		{1, 4, time.Minute, 25, 3 * time.Minute},
+		{3, 4, 30 * time.Second, 75, 10 * time.Second},
+		{4, 4, time.Minute, 100, 0},
+		{5, 4, time.Minute, 100, 0},
+		{0, 0, 0, 100, 0},
+	}
+	for _, tc := range tt {
+		percent, eta := importEstimate(tc.done, tc.total, tc.elapsed)
+		assert.Equal(t, tc.percent, percent, "%d/%d", tc.done, tc.total)
+		assert.Equal(t, tc.eta, eta, "%d/%d", tc.done, tc.total)
+	}
+
+	p := newImportProgress(2)
+	s := &progressStore{importStore: NewMemoryStore(), progress: p}
+	assert.NoError(t, s.CreateUsers(context.Background(), []User{{ID: 1}, {ID: 2}}))
+	assert.NoError(t, s.CreateLocations(context.Background(), []Location{{ID: 1}}))
+	assert.Equal(t, int64(3), p.entities)
+	assert.Equal(t, 1, p.fileDone())
+}
+
+// writeBenchData writes data file of count entities of the kind with ids
+// starting from first. Visits refer to benchUsers users and benchLocations
+// locations.
+func writeBenchData(w io.Writer, kind string, first, count int) {
+	rnd := rand.New(rand.NewSource(int64(first)))
+	fmt.Fprintf(w, `{"%s":[`, kind)
+	for id := first; id < first+count; id++ {
+		if id > first {
+			io.WriteString(w, ",")
+		}
+		switch kind {
+		case "users":
+			fmt.Fprintf(w, `{"id":%d,"email":"u%d@hlcup.com","first_name":"First","last_name":"Last","gender":"m","birth_date":%d}`,
+				id, id, -631152000+rnd.Int63n(1577836800))
+		case "locations":
+			fmt.Fprintf(w, `{"id":%d,"place":"Place%d","country":"Country%d","city":"City","distance":%d}`,
+				id, id, rnd.Intn(benchCountries), rnd.Intn(100)+1)
+		case "visits":
+			fmt.Fprintf(w, `{"id":%d,"user":%d,"location":%d,"visited_at":%d,"mark":%d}`,
+				id, rnd.Intn(benchUsers)+1, rnd.Intn(benchLocations)+1, 946684800+rnd.Int63n(473385600), rnd.Intn(6))
+		}
+	}
+	io.WriteString(w, "]}")
+}
+
+// peakHeapStore discards imported entities, it records peak heap size seen
+// when chunks arrive
+type peakHeapStore struct {
+	peak uint64
+}
+
+func (s *peakHeapStore) sample() {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if m.HeapAlloc > s.peak {
+		s.peak = m.HeapAlloc
+	}
+}
+
+func (s *peakHeapStore) Clear(ctx context.Context) error { return nil }
+
+func (s *peakHeapStore) CreateUsers(ctx context.Context, us []User) error {
+	s.sample()
+	return nil
+}
+
+func (s *peakHeapStore) CreateLocations(ctx context.Context, ls []Location) error {
+	s.sample()
+	return nil
+}
+
+func (s *peakHeapStore) CreateVisits(ctx context.Context, vs []Visit) error {
+	s.sample()
+	return nil
+}
+
+// benchmarkImportHeap runs import of data and reports peak heap growth
+// above the heap holding the data itself
+func benchmarkImportHeap(b *testing.B, data []byte, load func(s importStore, r io.Reader) error) {
+	b.SetBytes(int64(len(data)))
+	var peak uint64
+	for n := 0; n < b.N; n++ {
+		b.StopTimer()
+		runtime.GC()
+		var m runtime.MemStats
+		runtime.ReadMemStats(&m)
+		s := &peakHeapStore{peak: m.HeapAlloc}
+		b.StartTimer()
+		if err := load(s, bytes.NewReader(data)); err != nil {
+			b.Fatal(err)
+		}
+		if s.peak-m.HeapAlloc > peak {
+			peak = s.peak - m.HeapAlloc
+		}
+	}
+	b.ReportMetric(float64(peak)/(1<<20), "peak-MB")
+}
+
+// BenchmarkImportFile compares decoding of the whole file at once with
+// streaming import of a large generated visits file
+func BenchmarkImportFile(b *testing.B) {
+	logrus.SetOutput(ioutil.Discard)
+	var buf bytes.Buffer
+	writeBenchData(&buf, "visits", 1, 500000)
+	data := buf.Bytes()
+	b.Run("Unmarshal", func(b *testing.B) {
+		benchmarkImportHeap(b, data, func(s importStore, r io.Reader) error {
+			var fd FileData
+			if err := easyjson.UnmarshalFromReader(r, &fd); err != nil {
+				return err
+			}
+			return s.CreateVisits(context.Background(), fd.Visits)
+		})
+	})
+	b.Run("Stream", func(b *testing.B) {
+		benchmarkImportHeap(b, data, importFile)
+	})
+}
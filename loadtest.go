@@ -0,0 +1,158 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"github.com/valyala/fasthttp"
+)
+
+const loadTestRequestTimeout = 5 * time.Second
+
+// loadTest runs "loadtest" subcommand: it sends requests from warmUpRequests
+// templates to the server with given concurrency and rate for a fixed time
+// and reports latency percentiles and error rate
+func loadTest(args []string) {
+	fs := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	url := fs.String("url", "http://localhost"+defaultListenAddr, "target server url")
+	concurrency := fs.Int("concurrency", 16, "number of concurrent workers")
+	duration := fs.Duration("duration", 30*time.Second, "test duration")
+	rps := fs.Int("rps", 0, "max requests per second, 0 means no limit")
+	fs.Parse(args)
+	if *concurrency <= 0 || *duration <= 0 || *rps < 0 {
+		fmt.Fprintln(os.Stderr, "concurrency and duration must be positive, rps must not be negative")
+		os.Exit(2)
+	}
+	baseURL := strings.TrimSuffix(*url, "/")
+
+	ids, err := warmUpIDs(baseURL)
+	if err != nil {
+		log.Fatalf("Failed to get entity ids: %v", err)
+	}
+	if ids.empty() {
+		log.Fatal("No data to test")
+	}
+
+	log.Infof("Start load test of %s: concurrency=%d, duration=%v, rps=%d",
+		baseURL, *concurrency, *duration, *rps)
+	client := &fasthttp.Client{MaxConnsPerHost: *concurrency}
+	limiter := newRateLimiter(*rps)
+	results := make([]loadTestResult, *concurrency)
+	start := time.Now()
+	deadline := start.Add(*duration)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func(res *loadTestResult, rnd *rand.Rand) {
+			defer wg.Done()
+			for {
+				limiter.wait()
+				if time.Now().After(deadline) {
+					return
+				}
+				req := warmUpRequests[rnd.Intn(len(warmUpRequests))]
+				id, ok := warmUpID(req, ids)
+				if !ok {
+					continue
+				}
+				reqStart := time.Now()
+				status, _, err := client.GetTimeout(nil, baseURL+fmt.Sprintf(req, id), loadTestRequestTimeout)
+				res.add(time.Since(reqStart), err != nil || status >= fasthttp.StatusInternalServerError)
+			}
+		}(&results[i], rand.New(rand.NewSource(start.UnixNano()+int64(i))))
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	var total loadTestResult
+	for i := range results {
+		total.latencies = append(total.latencies, results[i].latencies...)
+		total.errors += results[i].errors
+	}
+	n := len(total.latencies)
+	if n == 0 {
+		log.Info("No requests were sent")
+		return
+	}
+	sort.Slice(total.latencies, func(i, j int) bool {
+		return total.latencies[i] < total.latencies[j]
+	})
+	log.Infof("Done %d requests in %v (%.1f rps)\np50 = %v\np90 = %v\np99 = %v\nErrors = %d (%.2f%%)",
+		n, elapsed, float64(n)/elapsed.Seconds(),
+		percentile(total.latencies, 50), percentile(total.latencies, 90), percentile(total.latencies, 99),
+		total.errors, 100*float64(total.errors)/float64(n))
+}
+
+// loadTestResult collects stats of a single worker. Transport errors and
+// 5xx responses are counted as errors, 4xx are valid answers.
+type loadTestResult struct {
+	latencies []time.Duration
+	errors    int
+}
+
+func (r *loadTestResult) add(latency time.Duration, failed bool) {
+	r.latencies = append(r.latencies, latency)
+	if failed {
+		r.errors++
+	}
+}
+
+// percentile returns p-th percentile of sorted latencies by nearest rank
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// rateLimiter spreads events evenly in time. It is safe for concurrent use.
+type rateLimiter struct {
+	mu       sync.Mutex
+	interval time.Duration // zero means no limit
+	next     time.Time
+}
+
+// newRateLimiter makes limiter allowing rate events per second, zero rate
+// disables the limit
+func newRateLimiter(rate int) *rateLimiter {
+	var l rateLimiter
+	if rate > 0 {
+		l.interval = time.Second / time.Duration(rate)
+	}
+	return &l
+}
+
+// reserve takes the next slot and returns time when the event is allowed.
+// Unused slots are not accumulated, so there are no bursts after idle time.
+func (l *rateLimiter) reserve(now time.Time) time.Time {
+	if l.interval == 0 {
+		return now
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	t := l.next
+	l.next = t.Add(l.interval)
+	return t
+}
+
+// wait blocks until the next event is allowed
+func (l *rateLimiter) wait() {
+	now := time.Now()
+	if t := l.reserve(now); t.After(now) {
+		time.Sleep(t.Sub(now))
+	}
+}
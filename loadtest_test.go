@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1000, 0)
+	l := newRateLimiter(4)
+	assert.Equal(t, now, l.reserve(now))
+	assert.Equal(t, now.Add(250*time.Millisecond), l.reserve(now))
+	assert.Equal(t, now.Add(500*time.Millisecond), l.reserve(now.Add(100*time.Millisecond)))
+
+	// no burst after idle time
+	later := now.Add(10 * time.Second)
+	assert.Equal(t, later, l.reserve(later))
+	assert.Equal(t, later.Add(250*time.Millisecond), l.reserve(later))
+
+	// no limit
+	l = newRateLimiter(0)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, now, l.reserve(now))
+	}
+
+	// actual waiting
+	l = newRateLimiter(100)
+	start := time.Now()
+	for i := 0; i < 6; i++ {
+		l.wait()
+	}
+	assert.True(t, time.Since(start) >= 50*time.Millisecond)
+}
+
+func TestPercentile(t *testing.T) {
+	var latencies []time.Duration
+	for i := 1; i <= 200; i++ {
+		latencies = append(latencies, time.Duration(i)*time.Millisecond)
+	}
+	assert.Equal(t, 100*time.Millisecond, percentile(latencies, 50))
+	assert.Equal(t, 180*time.Millisecond, percentile(latencies, 90))
+	assert.Equal(t, 198*time.Millisecond, percentile(latencies, 99))
+	assert.Equal(t, 1*time.Millisecond, percentile(latencies, 0))
+	assert.Equal(t, 5*time.Millisecond, percentile(latencies[4:5], 99))
+	assert.Equal(t, time.Duration(0), percentile(nil, 50))
+}
@@ -3,52 +3,413 @@ package main
 import (
 	"archive/zip"
 	"bufio"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"math/rand"
+	"net"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path"
+	"path/filepath"
 	"runtime"
+	"runtime/debug"
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/mailru/easyjson"
 	log "github.com/sirupsen/logrus"
 	"github.com/valyala/fasthttp"
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/mgo.v2"
 )
 
-const datapath = "/tmp/data/data.zip"
-const optionspath = "/tmp/data/options.txt"
-const listenAddr = ":80"
+const defaultDataPath = "/tmp/data/data.zip"
+const defaultOptionsPath = "/tmp/data/options.txt"
+const defaultListenAddr = ":80"
+const defaultStore = "memory"
+const defaultMongoURL = "mongodb://localhost/hlcup"
+
+const defaultBoltPath = "hlcup.db"
+
+var listenFlag = flag.String("listen", "", "address to listen on (overrides HLCUP_LISTEN, default \""+defaultListenAddr+"\")")
+
+var (
+	dataFlag    = flag.String("data", "", "data zip archive or directory to import (overrides HLCUP_DATA, default \""+defaultDataPath+"\")")
+	optionsFlag = flag.String("options", "", "options file path (overrides HLCUP_OPTIONS, default \""+defaultOptionsPath+"\")")
+)
+
+var importWorkersFlag = flag.Int("import-workers", runtime.NumCPU(), "max number of data files imported concurrently")
+
+var importDryRunFlag = flag.Bool("import-dry-run", false, "validate data files and report invalid entities without storing them or starting the server")
+
+var importUpsertFlag = flag.Bool("import-upsert", false, "overwrite entities with duplicate ids during import (memory store only)")
+
+var uniqueEmailFlag = flag.Bool("unique-email", true, "reject users with email of another user, blank emails never conflict")
+
+var cascadeFlag = flag.Bool("cascade", false, "delete visits along with their user or location instead of refusing the delete with 409")
+
+var snapshotFlag = flag.String("snapshot", "", "snapshot file to restore data from on start and to save on shutdown")
+
+var (
+	compressFlag        = flag.Bool("compress", false, "compress responses according to Accept-Encoding header")
+	compressMinSizeFlag = flag.Int("compress-min-size", 512, "minimal response body size to compress")
+	maxBodySizeFlag     = flag.Int("max-body-size", defaultMaxBodySize, "max request body size in bytes")
+	strictFlag          = flag.Bool("strict", false, "reject unknown fields in request body")
+	lenientNumbersFlag  = flag.Bool("lenient-numbers", false, "accept numeric fields of request body encoded as strings, e.g. \"id\":\"1\"")
+	fieldCaseFlag       = flag.String("field-case", "snake", "default case of response field names: snake or camel, X-Field-Case request header overrides it")
+	strictQueryFlag     = flag.Bool("strict-query", false, "reject unknown query parameters of read requests")
+	accessLogFlag       = flag.Bool("access-log", false, "log every served request")
+	logLevelFlag        = flag.String("log-level", "info", "min level of logged messages: debug, info, warn or error")
+	logFormatFlag       = flag.String("log-format", "text", "log format: text or json")
+	adminFlag           = flag.Bool("admin", false, "enable administrative endpoints")
+	http2Flag           = flag.Bool("http2", false, "serve cleartext HTTP/2 (h2c) along with HTTP/1.1 using net/http server")
+	corsFlag            = flag.Bool("cors", false, "answer CORS preflight requests and send CORS headers")
+	corsOriginFlag      = flag.String("cors-origin", "*", "allowed CORS origin")
+	errorBodyFlag       = flag.Bool("error-body", false, "describe validation errors in 400 response body")
+	textErrorsFlag      = flag.Bool("text-errors", false, "send short text/plain message in error responses to clients accepting text/plain")
+	maxVisitsFlag       = flag.Int("max-visits", 0, "max number of visits in user visits response, longer responses are truncated, 0 means no limit")
+	avgPrecisionFlag    = flag.Int("avg-precision", defaultAvgPrecision, "number of decimal places in location average")
+	nullEmptyAvgFlag    = flag.Bool("null-empty-avg", false, "respond null location average when no visits match instead of 0")
+	gcPercentFlag       = flag.Int("gc-percent", defaultServingGCPercent, "GC target percentage during serving, negative disables automatic GC")
+	timeoutFlag         = flag.Duration("timeout", 10*time.Second, "max request handling time, 0 disables the limit")
+	maxConnsFlag        = flag.Int("max-conns", 0, "max number of concurrently served connections, 0 means fasthttp default")
+	readTimeoutFlag     = flag.Duration("read-timeout", 0, "max time to read request including keep-alive idle time, 0 disables the limit")
+	writeTimeoutFlag    = flag.Duration("write-timeout", 0, "max time to write response, 0 disables the limit")
+)
+
+var (
+	minBirthDateFlag = flag.Int64("min-birth-date", minBirthDate, "min allowed user birth date (unix timestamp)")
+	maxBirthDateFlag = flag.Int64("max-birth-date", maxBirthDate, "max allowed user birth date (unix timestamp, default is start time)")
+	minVisitedAtFlag = flag.Int64("min-visited-at", minVisitedAt, "min allowed visit time (unix timestamp)")
+	maxVisitedAtFlag = flag.Int64("max-visited-at", maxVisitedAt, "max allowed visit time (unix timestamp)")
+	gendersFlag      = flag.String("genders", strings.Join(genders, ","), "comma separated list of allowed user gender codes")
+)
+
+var (
+	storeFlag                = flag.String("store", "", "store backend: memory, mongo or bolt (overrides HLCUP_STORE, default \""+defaultStore+"\")")
+	mongoURLFlag             = flag.String("mongo-url", "", "mongo connection url (overrides HLCUP_MONGO_URL, default \""+defaultMongoURL+"\")")
+	mongoRetriesFlag         = flag.Int("mongo-retries", 3, "max number of retries of mongo operations failed with network errors")
+	mongoRetryTimeFlag       = flag.Duration("mongo-retry-time", time.Second, "max total time spent on retries of a single mongo operation, 0 is unlimited")
+	mongoBreakerFailuresFlag = flag.Int("mongo-breaker-failures", 5, "number of consecutive failed mongo operations after which requests fail fast with 503, 0 disables the breaker")
+	mongoBreakerCooldownFlag = flag.Duration("mongo-breaker-cooldown", 5*time.Second, "time requests fail fast before mongo is probed again")
+	mongoWriteConcernFlag    = flag.String("mongo-write-concern", "", "mongo write concern: unacknowledged, acknowledged, journaled, majority or number of nodes, empty keeps the connection default")
+	mongoImportConcernFlag   = flag.String("mongo-import-write-concern", "", "mongo write concern of data import, empty means the serving one")
+	mongoReadPreferenceFlag  = flag.String("mongo-read-preference", "", "mongo read preference: primary, primaryPreferred, secondary, secondaryPreferred or nearest, empty keeps the connection default")
+	mongoMaxQueryTimeFlag    = flag.Duration("mongo-max-query-time", 5*time.Second, "max time mongo spends on aggregations of a query, exceeding it responds 504, 0 disables the limit")
+	shardsFlag               = flag.Int("memory-shards", defaultMemoryShards, "number of independently locked memory store shards")
+	capacityFlag             = flag.Int("memory-capacity", defaultMemoryCapacity, "initial number of entities of every kind memory store has room for")
+	growthFlag               = flag.Float64("memory-growth", defaultMemoryGrowth, "factor memory store grows entity slices by, must be greater than 1")
+	boltPathFlag             = flag.String("bolt-path", defaultBoltPath, "bolt database file path")
+)
+
+var listenAddr string
+
+type storeConstructor func() (Store, error)
+
+var storeConstructors = map[string]storeConstructor{
+	"memory": func() (Store, error) {
+		return NewMemoryStoreWithOptions(MemoryStoreOptions{
+			Shards:   *shardsFlag,
+			Capacity: *capacityFlag,
+			Growth:   *growthFlag,
+		}), nil
+	},
+	"mongo": func() (Store, error) {
+		url := stringOption(*mongoURLFlag, "HLCUP_MONGO_URL", defaultMongoURL)
+		session, err := mgo.DialWithTimeout(url, 5*time.Second)
+		if err != nil {
+			return nil, err
+		}
+		store, err := NewMongoStore(session)
+		if err != nil {
+			return nil, err
+		}
+		store.SetRetry(*mongoRetriesFlag, *mongoRetryTimeFlag)
+		store.SetBreaker(*mongoBreakerFailuresFlag, *mongoBreakerCooldownFlag)
+		if *mongoWriteConcernFlag != "" {
+			safe, err := parseWriteConcern(*mongoWriteConcernFlag)
+			if err != nil {
+				return nil, err
+			}
+			store.SetWriteConcern(safe)
+		}
+		if *mongoImportConcernFlag != "" {
+			safe, err := parseWriteConcern(*mongoImportConcernFlag)
+			if err != nil {
+				return nil, err
+			}
+			store.SetImportWriteConcern(safe)
+		}
+		store.SetMaxQueryTime(*mongoMaxQueryTimeFlag)
+		if *mongoReadPreferenceFlag != "" {
+			mode, err := parseReadPreference(*mongoReadPreferenceFlag)
+			if err != nil {
+				return nil, err
+			}
+			store.SetReadPreference(mode)
+		}
+		return store, nil
+	},
+	"bolt": func() (Store, error) {
+		db, err := bolt.Open(*boltPathFlag, 0600, &bolt.Options{Timeout: 5 * time.Second})
+		if err != nil {
+			return nil, err
+		}
+		return NewBoltStore(db)
+	},
+}
 
 func main() {
 	if len(os.Args) > 1 && os.Args[1] == "warm-up" {
+		flag.CommandLine.Parse(os.Args[2:])
+		setupLogging()
+		setupListenAddr()
 		warmUp()
 		return
 	}
+	if len(os.Args) > 1 && os.Args[1] == "loadtest" {
+		loadTest(os.Args[2:])
+		return
+	}
+	flag.Parse()
+	setupLogging()
+	setupListenAddr()
+	allowedGenders, err := parseGenders(*gendersFlag)
+	if err != nil {
+		log.Fatalf("Invalid genders: %v", err)
+	}
+	if *fieldCaseFlag != "snake" && *fieldCaseFlag != "camel" {
+		log.Fatalf("Invalid field case %q", *fieldCaseFlag)
+	}
+
+	dataPath, optionsPath := resolveDataPaths(*dataFlag, *optionsFlag)
+	checkDataPaths(dataPath, optionsPath)
+
+	if *importDryRunFlag {
+		dryRunImport(dataPath, allowedGenders)
+		return
+	}
 
-	genTs, env := loadOptions(optionspath)
+	genTs, env := loadOptions(optionsPath)
 	log.Infof("Options: genTs=%d, env=%d", genTs, env)
 
-	var store Store
-	store = NewMemoryStore()
+	storeName := stringOption(*storeFlag, "HLCUP_STORE", defaultStore)
+	store := newStore(storeName, storeConstructors)
+	if uniquer, ok := store.(uniqueEmailStore); ok {
+		if err := uniquer.SetUniqueEmail(*uniqueEmailFlag); err != nil {
+			log.Fatalf("Failed to set email uniqueness: %v", err)
+		}
+	} else if !*uniqueEmailFlag {
+		log.Fatalf("Store %q doesn't support non-unique emails", storeName)
+	}
+	if cascader, ok := store.(cascadeStore); ok {
+		cascader.SetCascade(*cascadeFlag)
+	} else if *cascadeFlag {
+		log.Fatalf("Store %q doesn't support cascade delete", storeName)
+	}
 
-	if err := loadData(store, datapath); err != nil {
-		log.Fatal(err)
+	srv := NewServer(store)
+	srv.SetMaxBodySize(*maxBodySizeFlag)
+	srv.SetAvgPrecision(*avgPrecisionFlag)
+	srv.SetMaxVisits(*maxVisitsFlag)
+	srv.SetTimeout(*timeoutFlag)
+	srv.SetConcurrency(*maxConnsFlag)
+	srv.SetIOTimeouts(*readTimeoutFlag, *writeTimeoutFlag)
+	if *compressFlag {
+		srv.EnableCompression(*compressMinSizeFlag)
+	}
+	if *accessLogFlag {
+		srv.EnableAccessLog()
+	}
+	if *http2Flag {
+		srv.EnableHTTP2()
+	}
+	if *corsFlag {
+		srv.EnableCORS(*corsOriginFlag)
+	}
+	if *errorBodyFlag {
+		srv.EnableErrorBody()
+	}
+	if *textErrorsFlag {
+		srv.EnableTextErrors()
+	}
+	if *nullEmptyAvgFlag {
+		srv.EnableNullEmptyAvg()
+	}
+	if *adminFlag {
+		srv.EnableAdmin()
+	}
+	if *strictQueryFlag {
+		srv.EnableStrictQuery()
+	}
+
+	// liveness probe is answered while data is loading
+	srv.SetLoading(true)
+	log.Infof("Start listening on address %s", listenAddr)
+	listenErr := make(chan error, 1)
+	go func() {
+		listenErr <- srv.Listen(listenAddr)
+	}()
+
+	if !restoreSnapshot(store, *snapshotFlag) {
+		upserter, _ := store.(upsertStore)
+		if *importUpsertFlag {
+			if upserter == nil {
+				log.Fatalf("Store %q doesn't support upsert on import", storeName)
+			}
+			upserter.SetUpsert(true)
+		}
+		importer, _ := store.(importModeStore)
+		if importer != nil {
+			importer.SetImportMode(true)
+		}
+		if err := loadData(store, dataPath, *importWorkersFlag); err != nil {
+			log.Fatal(err)
+		}
+		if importer != nil {
+			importer.SetImportMode(false)
+		}
+		if rebuilder, ok := store.(IndexRebuilder); ok {
+			start := time.Now()
+			indexed, orphaned := rebuilder.RebuildIndexes()
+			log.Infof("Rebuilt indexes of %d visits in %v, %d orphaned visits left out",
+				indexed, time.Since(start), orphaned)
+		}
+		if upserter != nil {
+			upserter.SetUpsert(false)
+		}
+	}
+	if *snapshotFlag != "" {
+		go saveSnapshotOnExit(store, *snapshotFlag)
 	}
 	runtime.GC()
 	printMemoryStats()
 
-	srv := NewServer(store)
+	// data files are trusted, so strict mode is enabled only after import
+	strictFields = *strictFlag
+	lenientNumbers = *lenientNumbersFlag
+	camelFields = *fieldCaseFlag == "camel"
+	minBirthDate, maxBirthDate = *minBirthDateFlag, *maxBirthDateFlag
+	minVisitedAt, maxVisitedAt = *minVisitedAtFlag, *maxVisitedAtFlag
+	genders = allowedGenders
+	srv.SetLoading(false)
 
+	// warm-up lowers the target until it is done
+	debug.SetGCPercent(*gcPercentFlag)
 	if env == 1 { // rating fire
 		go runWarmUp(srv)
 	}
 
-	log.Infof("Start listening on address %s", listenAddr)
-	log.Fatal(srv.Listen(listenAddr))
+	log.Fatal(<-listenErr)
+}
+
+// dryRunImport validates data files with the limits applied to requests and
+// exits with non-zero code if any entity is invalid or file is unreadable
+func dryRunImport(dataPath string, allowedGenders []string) {
+	minBirthDate, maxBirthDate = *minBirthDateFlag, *maxBirthDateFlag
+	minVisitedAt, maxVisitedAt = *minVisitedAtFlag, *maxVisitedAtFlag
+	genders = allowedGenders
+	store := newDryRunStore()
+	if err := loadData(store, dataPath, *importWorkersFlag); err != nil {
+		log.Fatal(err)
+	}
+	store.logReport()
+	if failed := store.Failed(); failed > 0 {
+		log.Errorf("Dry run import failed: %d errors", failed)
+		os.Exit(1)
+	}
+	log.Info("Dry run import succeeded")
+}
+
+func setupLogging() {
+	if err := configureLogging(*logLevelFlag, *logFormatFlag); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// configureLogging sets min level and format of the standard logger
+func configureLogging(level, format string) error {
+	lvl, err := log.ParseLevel(level)
+	if err != nil {
+		return fmt.Errorf("Invalid log level %q", level)
+	}
+	switch format {
+	case "text":
+		log.SetFormatter(&log.TextFormatter{})
+	case "json":
+		log.SetFormatter(&log.JSONFormatter{})
+	default:
+		return fmt.Errorf("Invalid log format %q", format)
+	}
+	log.SetLevel(lvl)
+	return nil
+}
+
+func setupListenAddr() {
+	listenAddr = stringOption(*listenFlag, "HLCUP_LISTEN", defaultListenAddr)
+	if _, _, err := net.SplitHostPort(listenAddr); err != nil {
+		log.Fatalf("Invalid listen address %q: %v", listenAddr, err)
+	}
+	log.Infof("Listen address: %s", listenAddr)
+}
+
+// resolveDataPaths returns data and options paths set by flags, environment
+// variables or defaults in that order.
+func resolveDataPaths(dataFlagValue, optionsFlagValue string) (dataPath, optionsPath string) {
+	dataPath = stringOption(dataFlagValue, "HLCUP_DATA", defaultDataPath)
+	optionsPath = stringOption(optionsFlagValue, "HLCUP_OPTIONS", defaultOptionsPath)
+	return
+}
+
+// checkDataPaths logs effective paths. Missing files are not fatal as the
+// server starts empty then, but a warning is logged to catch typos.
+func checkDataPaths(dataPath, optionsPath string) {
+	log.Infof("Data path: %s, options path: %s", dataPath, optionsPath)
+	if _, err := os.Stat(dataPath); err != nil {
+		log.Warnf("Data path %q is not accessible: %v", dataPath, err)
+	}
+	if _, err := os.Stat(optionsPath); err != nil {
+		log.Warnf("Options path %q is not accessible: %v", optionsPath, err)
+	}
+}
+
+// newStore constructs store backend by name. Memory store is used if backend
+// is unknown or fails to initialize.
+func newStore(name string, constructors map[string]storeConstructor) Store {
+	constructor, ok := constructors[name]
+	if !ok {
+		log.Warnf("Unknown store %q, fall back to memory store", name)
+		return NewMemoryStore()
+	}
+	store, err := constructor()
+	if err != nil {
+		log.Warnf("Failed to initialize %s store: %v, fall back to memory store", name, err)
+		return NewMemoryStore()
+	}
+	log.Infof("Using %s store", name)
+	return store
+}
+
+// stringOption returns flag value if it was set, then environment variable
+// value and default value otherwise.
+func stringOption(flagValue, envKey, def string) string {
+	if flagValue != "" {
+		return flagValue
+	}
+	if val := os.Getenv(envKey); val != "" {
+		return val
+	}
+	return def
 }
 
 func loadOptions(filepath string) (ts int64, env int) {
@@ -76,94 +437,297 @@ func loadOptions(filepath string) (ts int64, env int) {
 	return
 }
 
-func loadData(store Store, filepath string) error {
-	if _, err := os.Stat(filepath); os.IsNotExist(err) {
+// dataFile is a single data file either inside zip archive or in directory
+type dataFile struct {
+	Name string
+	Open func() (io.ReadCloser, error)
+}
+
+// upsertStore is implemented by stores able to overwrite existing entities
+// on create.
+type upsertStore interface {
+	SetUpsert(upsert bool)
+}
+
+// importModeStore is implemented by stores tuning their operations for
+// data import
+type importModeStore interface {
+	SetImportMode(importing bool)
+}
+
+// uniqueEmailStore is implemented by stores able to switch the unique user
+// email constraint.
+type uniqueEmailStore interface {
+	SetUniqueEmail(unique bool) error
+}
+
+// cascadeStore is implemented by stores able to delete visits along with
+// their user or location.
+type cascadeStore interface {
+	SetCascade(cascade bool)
+}
+
+func loadData(store importStore, dataPath string, workers int) error {
+	info, err := os.Stat(dataPath)
+	if os.IsNotExist(err) {
 		log.Info("No data to load")
 		return nil
+	} else if err != nil {
+		return err
 	}
 
-	log.Infof("Load data from file %s", filepath)
+	log.Infof("Load data from %s", dataPath)
 	start := time.Now()
 
-	if err := store.Clear(); err != nil {
+	if err := store.Clear(context.Background()); err != nil {
 		return fmt.Errorf("Failed to clear database: %v", err)
 	}
 
-	r, err := zip.OpenReader(filepath)
-	if err != nil {
-		return err
+	var files []dataFile
+	if info.IsDir() {
+		files, err = dirDataFiles(dataPath)
+		if err != nil {
+			return err
+		}
+	} else {
+		r, err := zip.OpenReader(dataPath)
+		if err != nil {
+			return err
+		}
+		defer r.Close()
+		files = zipDataFiles(r)
 	}
-	defer r.Close()
+	sortDataFiles(files)
 
-	var files []*zip.File
-	for _, f := range r.File {
-		// process only .json files
-		if !strings.HasSuffix(f.Name, ".json") {
-			continue
+	progress := newImportProgress(len(files))
+	stop := make(chan struct{})
+	go progress.logEvery(importProgressInterval, stop)
+	tracked := &progressStore{importStore: store, progress: progress}
+
+	// users and locations must exist before visits, so files are loaded
+	// concurrently only within a single phase
+	for len(files) > 0 {
+		phase := dataFileOrder(files[0].Name)
+		n := 1
+		for n < len(files) && dataFileOrder(files[n].Name) == phase {
+			n++
 		}
-		files = append(files, f)
+		importFiles(tracked, files[:n], workers, progress)
+		files = files[n:]
 	}
+	close(stop)
+	progress.log()
 
-	sort.SliceStable(files, func(i, j int) bool {
-		order := func(idx int) int {
-			base := path.Base(files[idx].Name)
-			if strings.HasPrefix(base, "users") {
-				return 0
-			} else if strings.HasPrefix(base, "locations") {
-				return 1
-			} else if strings.HasPrefix(base, "visits") {
-				return 2
-			}
-			return 3
-		}
-		return order(i) < order(j)
-	})
+	log.Infof("Done in %v", time.Now().Sub(start))
 
-	for i, f := range files {
-		log.Infof("Processing file %s", f.Name)
-		rc, err := f.Open()
-		if err != nil {
-			log.Warnf("Failed to open data file %s: %v", f.Name, err)
+	return nil
+}
+
+func zipDataFiles(r *zip.ReadCloser) []dataFile {
+	var files []dataFile
+	for _, f := range r.File {
+		if !isDataFile(f.Name) {
 			continue
 		}
+		files = append(files, dataFile{Name: f.Name, Open: f.Open})
+	}
+	return files
+}
 
-		var data FileData
-		err = easyjson.UnmarshalFromReader(rc, &data)
-		rc.Close()
-		if err != nil {
-			log.Warnf("Failed to read data: %v", err)
+func dirDataFiles(dir string) ([]dataFile, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []dataFile
+	for _, e := range entries {
+		if e.IsDir() || !isDataFile(e.Name()) {
 			continue
 		}
+		name := filepath.Join(dir, e.Name())
+		files = append(files, dataFile{
+			Name: name,
+			Open: func() (io.ReadCloser, error) { return os.Open(name) },
+		})
+	}
+	return files, nil
+}
 
-		if len(data.Users) > 0 {
-			log.Infof("Import %d users", len(data.Users))
-			if err := store.CreateUsers(data.Users); err != nil {
-				log.Warnf("Import error %v", err)
-			}
-			log.Infof("Done")
-		}
-		if len(data.Visits) > 0 {
-			log.Infof("Import %d visits", len(data.Visits))
-			if err := store.CreateVisits(data.Visits); err != nil {
-				log.Warnf("Import error %v", err)
-			}
-			log.Infof("Done")
-		}
-		if len(data.Locations) > 0 {
-			log.Infof("Import %d locations", len(data.Locations))
-			if err := store.CreateLocations(data.Locations); err != nil {
-				log.Warnf("Import error %v", err)
+// importFiles loads files using up to workers goroutines
+func importFiles(store importStore, files []dataFile, workers int, progress *importProgress) {
+	if workers < 1 {
+		workers = 1
+	}
+	ch := make(chan dataFile)
+	var wg sync.WaitGroup
+	for w := 0; w < workers && w < len(files); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for f := range ch {
+				importDataFile(store, f)
+				if progress.fileDone()%10 == 1 {
+					runtime.GC()
+				}
 			}
-			log.Infof("Done")
+		}()
+	}
+	for _, f := range files {
+		ch <- f
+	}
+	close(ch)
+	wg.Wait()
+}
+
+// isDataFile reports whether file contains JSON or JSON Lines data,
+// possibly gzip compressed
+func isDataFile(name string) bool {
+	name = strings.TrimSuffix(name, ".gz")
+	return strings.HasSuffix(name, ".json") || strings.HasSuffix(name, ".jsonl")
+}
+
+// gzipFile decompresses data file, closing it closes the file too
+type gzipFile struct {
+	*gzip.Reader
+	file io.Closer
+}
+
+func (f gzipFile) Close() error {
+	f.Reader.Close()
+	return f.file.Close()
+}
+
+// openDataFile opens data file, gzip compressed files are decompressed
+// on the fly
+func openDataFile(f dataFile) (io.ReadCloser, error) {
+	rc, err := f.Open()
+	if err != nil || !strings.HasSuffix(f.Name, ".gz") {
+		return rc, err
+	}
+	zr, err := gzip.NewReader(rc)
+	if err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return gzipFile{Reader: zr, file: rc}, nil
+}
+
+func importDataFile(store importStore, f dataFile) {
+	log.Infof("Processing file %s", f.Name)
+	rc, err := openDataFile(f)
+	if err != nil {
+		log.Warnf("Failed to open data file %s: %v", f.Name, err)
+		fileFailed(store)
+		return
+	}
+	if strings.HasSuffix(strings.TrimSuffix(f.Name, ".gz"), ".jsonl") {
+		// entity kind is defined by file name
+		if order := dataFileOrder(f.Name); order < len(dataFileKinds) {
+			err = importLines(store, rc, dataFileKinds[order])
+		} else {
+			err = errors.New("unknown entity kind")
 		}
-		if i%10 == 0 {
-			runtime.GC()
+	} else {
+		err = importFile(store, rc)
+	}
+	rc.Close()
+	if err != nil {
+		log.Warnf("Failed to read data from %s: %v", f.Name, err)
+		fileFailed(store)
+	}
+}
+
+// fileFailed counts unreadable data file when store is a dry run
+func fileFailed(store importStore) {
+	if s, ok := store.(*progressStore); ok {
+		store = s.importStore
+	}
+	if s, ok := store.(*dryRunStore); ok {
+		s.fileFailed()
+	}
+}
+
+// sortDataFiles orders files so users are loaded first, then locations and visits
+func sortDataFiles(files []dataFile) {
+	sort.SliceStable(files, func(i, j int) bool {
+		return dataFileOrder(files[i].Name) < dataFileOrder(files[j].Name)
+	})
+}
+
+// entity kinds in order their data files must be loaded
+var dataFileKinds = []string{"users", "locations", "visits"}
+
+func dataFileOrder(name string) int {
+	base := path.Base(name)
+	for i, kind := range dataFileKinds {
+		if strings.HasPrefix(base, kind) {
+			return i
 		}
 	}
+	return len(dataFileKinds)
+}
 
+// restoreSnapshot loads store state from snapshot file if it exists and valid
+func restoreSnapshot(store Store, filename string) bool {
+	if filename == "" {
+		return false
+	}
+	ss, ok := store.(Snapshotter)
+	if !ok {
+		log.Warn("Store does not support snapshots")
+		return false
+	}
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return false
+	} else if err != nil {
+		log.Warnf("Failed to open snapshot: %v", err)
+		return false
+	}
+	defer f.Close()
+
+	log.Infof("Restore data from snapshot %s", filename)
+	start := time.Now()
+	if err := ss.Restore(f); err != nil {
+		log.Warnf("Failed to restore snapshot: %v", err)
+		return false
+	}
 	log.Infof("Done in %v", time.Now().Sub(start))
+	return true
+}
 
-	return nil
+func saveSnapshotOnExit(store Store, filename string) {
+	ss, ok := store.(Snapshotter)
+	if !ok {
+		return
+	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	<-sig
+	log.Infof("Save snapshot to %s", filename)
+	if err := saveSnapshot(ss, filename); err != nil {
+		log.Errorf("Failed to save snapshot: %v", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func saveSnapshot(ss Snapshotter, filename string) error {
+	tmp := filename + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := ss.Snapshot(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
 }
 
 func printMemoryStats() {
@@ -174,7 +738,8 @@ func printMemoryStats() {
 }
 
 func runWarmUp(srv *Server) {
-	cmd := exec.Command(os.Args[0], "warm-up")
+	cmd := exec.Command(os.Args[0], "warm-up", "-listen", listenAddr)
+	debug.SetGCPercent(warmUpGCPercent)
 	log.Infof("Start warm up")
 	start := time.Now()
 	err := cmd.Run()
@@ -184,35 +749,50 @@ func runWarmUp(srv *Server) {
 	runtime.GC()
 	log.Infof("Done warm up in %v", time.Now().Sub(start))
 	printMemoryStats()
-	srv.EnableStageGC()
+	srv.EnableStageGC(*gcPercentFlag)
+}
+
+// warmUpRequests are path templates of requests sent by warm-up and load
+// test, %d is replaced with random id
+var warmUpRequests = []string{
+	"/users/%d",
+	"/locations/%d",
+	"/visits/%d",
+	"/users/%d/visits",
+	"/users/%d/visits?fromDate=1203861305",
+	"/users/%d/visits?toDate=1503861305",
+	"/users/%d/visits?country=Russia",
+	"/users/%d/visits?toDistance=4200",
+	"/locations/%d/avg",
+	"/locations/%d/avg?fromDate=1203861305",
+	"/locations/%d/avg?toDate=1503861306",
+	"/locations/%d/avg?fromAge=20",
+	"/locations/%d/avg?toAge=60",
+	"/locations/%d/avg?gender=f",
+	"/locations/%d/avg?gender=m",
 }
 
 func warmUp() {
-	requests := []string{
-		"/users/%d",
-		"/locations/%d",
-		"/visits/%d",
-		"/users/%d/visits",
-		"/users/%d/visits?fromDate=1203861305",
-		"/users/%d/visits?toDate=1503861305",
-		"/users/%d/visits?country=Russia",
-		"/users/%d/visits?toDistance=4200",
-		"/locations/%d/avg",
-		"/locations/%d/avg?fromDate=1203861305",
-		"/locations/%d/avg?toDate=1503861306",
-		"/locations/%d/avg?fromAge=20",
-		"/locations/%d/avg?toAge=60",
-		"/locations/%d/avg?gender=f",
-		"/locations/%d/avg?gender=m",
-	}
 	time.Sleep(1 * time.Second)
 	log.Info("Start warm up")
 	start := time.Now()
 	rand.Seed(start.Unix())
 
+	ids, err := warmUpIDs(localURL(""))
+	if err != nil {
+		log.Warnf("Failed to get entity ids: %v", err)
+		return
+	}
+	if ids.empty() {
+		log.Info("No data to warm up")
+		return
+	}
 	for i := 0; i < 500000; i++ {
-		req := requests[rand.Intn(len(requests))]
-		id := rand.Intn(1000000) + 1
+		req := warmUpRequests[rand.Intn(len(warmUpRequests))]
+		id, ok := warmUpID(req, ids)
+		if !ok {
+			continue
+		}
 		path := fmt.Sprintf(req, id)
 		request(path)
 	}
@@ -222,8 +802,61 @@ func warmUp() {
 	printMemoryStats()
 }
 
+// number of ids of each entity kind sampled for warm-up and load test
+const warmUpSampleSize = 10000
+
+// warmUpSample holds ids of entities loaded by the server
+type warmUpSample struct {
+	users     []uint
+	locations []uint
+	visits    []uint
+}
+
+func (s *warmUpSample) empty() bool {
+	return len(s.users) == 0 && len(s.locations) == 0 && len(s.visits) == 0
+}
+
+// warmUpIDs requests random sample of entity ids loaded by the server at
+// baseURL
+func warmUpIDs(baseURL string) (*warmUpSample, error) {
+	status, body, err := fasthttp.Get(nil, fmt.Sprintf("%s/stats?sample=%d", baseURL, warmUpSampleSize))
+	if err != nil {
+		return nil, err
+	}
+	if status != fasthttp.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", status)
+	}
+	var stats StatsResult
+	if err := easyjson.Unmarshal(body, &stats); err != nil {
+		return nil, err
+	}
+	return &warmUpSample{users: stats.UserIDs, locations: stats.LocationIDs, visits: stats.VisitIDs}, nil
+}
+
+// warmUpID picks random id of the entity requested by path template from
+// the sample. It returns false if there are no entities of that kind.
+func warmUpID(req string, ids *warmUpSample) (uint, bool) {
+	var sample []uint
+	if strings.HasPrefix(req, "/users/") {
+		sample = ids.users
+	} else if strings.HasPrefix(req, "/locations/") {
+		sample = ids.locations
+	} else if strings.HasPrefix(req, "/visits/") {
+		sample = ids.visits
+	}
+	if len(sample) == 0 {
+		return 0, false
+	}
+	return sample[rand.Intn(len(sample))], true
+}
+
 func request(path string) {
-	if _, _, err := fasthttp.Get(nil, "http://localhost"+listenAddr+path); err != nil {
+	if _, _, err := fasthttp.Get(nil, localURL(path)); err != nil {
 		log.Errorf("Request '%s' error: %v", path, err)
 	}
 }
+
+func localURL(path string) string {
+	_, port, _ := net.SplitHostPort(listenAddr)
+	return "http://localhost:" + port + path
+}
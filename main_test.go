@@ -0,0 +1,274 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+var testDataFiles = map[string]string{
+	"visits_1.json":    `{"visits":[{"id":1,"user":1,"location":1,"visited_at":100,"mark":4},{"id":2,"user":2,"location":1,"visited_at":200,"mark":5}]}`,
+	"locations_1.json": `{"locations":[{"id":1,"place":"Place1","country":"Russia","city":"Moscow","distance":10}]}`,
+	"users_1.json":     `{"users":[{"id":1,"email":"u1@hlcup.com","first_name":"User1","last_name":"Last","gender":"m","birth_date":100}]}`,
+	"users_2.json":     `{"users":[{"id":2,"email":"u2@hlcup.com","first_name":"User2","last_name":"Last","gender":"f","birth_date":200}]}`,
+	"options.txt":      "1503695452\n1\n",
+}
+
+// the same data as testDataFiles with users and visits in JSON Lines format
+var testDataLinesFiles = map[string]string{
+	"visits_1.jsonl": `{"id":1,"user":1,"location":1,"visited_at":100,"mark":4}
+
+{"id":2,"user":2,"location":1,"visited_at":200,"mark":5}
+`,
+	"locations_1.json": testDataFiles["locations_1.json"],
+	"users_1.jsonl": `{"id":1,"email":"u1@hlcup.com","first_name":"User1","last_name":"Last","gender":"m","birth_date":100}
+{"id":2,"email":"u2@hlcup.com","first_name":"User2","last_name":"Last","gender":"f","birth_date":200}`,
+	"options.txt": testDataFiles["options.txt"],
+}
+
+func TestLoadDataDir(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for name, content := range testDataFiles {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testLoadData(t, dir)
+}
+
+func TestLoadDataLines(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	for name, content := range testDataLinesFiles {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testLoadData(t, dir)
+}
+
+func TestLoadDataGzip(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	files := map[string]string{
+		"users_1.json.gz":    testDataFiles["users_1.json"],
+		"users_2.json":       testDataFiles["users_2.json"],
+		"locations_1.json":   testDataFiles["locations_1.json"],
+		"visits_1.jsonl.gz":  testDataLinesFiles["visits_1.jsonl"],
+		"visits_2.jsonl.gz~": "garbage",
+	}
+	for name, content := range files {
+		data := []byte(content)
+		if strings.HasSuffix(name, ".gz") {
+			var buf bytes.Buffer
+			zw := gzip.NewWriter(&buf)
+			zw.Write(data)
+			zw.Close()
+			data = buf.Bytes()
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testLoadData(t, dir)
+
+	// corrupted file is skipped
+	if err := ioutil.WriteFile(filepath.Join(dir, "visits_2.json.gz"), []byte("not gzip"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	testLoadData(t, dir)
+}
+
+func TestLoadDataZip(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "data.zip")
+	f, err := os.Create(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for name, content := range testDataFiles {
+		w, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(content))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+	testLoadData(t, filename)
+}
+
+func testLoadData(t *testing.T, dataPath string) {
+	ctx := context.Background()
+	logrus.SetOutput(ioutil.Discard)
+	s := NewMemoryStore()
+	assert.NoError(t, loadData(s, dataPath, 2))
+
+	var u User
+	assert.NoError(t, s.GetUser(ctx, 2, &u))
+	assert.Equal(t, "u2@hlcup.com", u.Email)
+	var l Location
+	assert.NoError(t, s.GetLocation(ctx, 1, &l))
+	assert.Equal(t, "Place1", l.Place)
+	var visits []UserVisit
+	_, err := s.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, []UserVisit{{Mark: 4, VisitedAt: 100, Place: "Place1"}}, visits)
+	avg, _, err := s.GetLocationAvg(ctx, 1, &LocationAvgQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 4.5, avg)
+}
+
+func tempDir(t testing.TB) string {
+	dir, err := ioutil.TempDir("", "hlcup-data")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestNewStore(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	mockStore := new(MockStore)
+	constructors := map[string]storeConstructor{
+		"mock": func() (Store, error) {
+			return mockStore, nil
+		},
+		"broken": func() (Store, error) {
+			return nil, errors.New("connection refused")
+		},
+	}
+	assert.Equal(t, mockStore, newStore("mock", constructors))
+	assert.IsType(t, &MemoryStore{}, newStore("broken", constructors))
+	assert.IsType(t, &MemoryStore{}, newStore("unknown", constructors))
+	assert.IsType(t, &MemoryStore{}, newStore("memory", storeConstructors))
+}
+
+func TestResolveDataPaths(t *testing.T) {
+	for _, key := range []string{"HLCUP_DATA", "HLCUP_OPTIONS"} {
+		if prev, ok := os.LookupEnv(key); ok {
+			defer os.Setenv(key, prev)
+		} else {
+			defer os.Unsetenv(key)
+		}
+		os.Unsetenv(key)
+	}
+
+	// defaults
+	data, options := resolveDataPaths("", "")
+	assert.Equal(t, defaultDataPath, data)
+	assert.Equal(t, defaultOptionsPath, options)
+
+	// environment overrides defaults
+	os.Setenv("HLCUP_DATA", "/env/data")
+	os.Setenv("HLCUP_OPTIONS", "/env/options.txt")
+	data, options = resolveDataPaths("", "")
+	assert.Equal(t, "/env/data", data)
+	assert.Equal(t, "/env/options.txt", options)
+
+	// flags override environment, each path independently
+	data, options = resolveDataPaths("/flag/data.zip", "")
+	assert.Equal(t, "/flag/data.zip", data)
+	assert.Equal(t, "/env/options.txt", options)
+	data, options = resolveDataPaths("", "/flag/options.txt")
+	assert.Equal(t, "/env/data", data)
+	assert.Equal(t, "/flag/options.txt", options)
+}
+
+func TestWarmUpID(t *testing.T) {
+	ids := &warmUpSample{users: []uint{3, 17, 1000000}, locations: []uint{42}}
+	seen := make(map[uint]bool)
+	for i := 0; i < 1000; i++ {
+		id, ok := warmUpID("/users/%d/visits", ids)
+		assert.True(t, ok)
+		assert.Contains(t, ids.users, id)
+		seen[id] = true
+		id, ok = warmUpID("/locations/%d/avg?gender=f", ids)
+		assert.True(t, ok)
+		assert.Equal(t, uint(42), id)
+	}
+	assert.Len(t, seen, 3)
+	_, ok := warmUpID("/visits/%d", ids)
+	assert.False(t, ok)
+	_, ok = warmUpID("/unknown/%d", ids)
+	assert.False(t, ok)
+	assert.False(t, ids.empty())
+	assert.True(t, (&warmUpSample{}).empty())
+}
+
+func TestConfigureLogging(t *testing.T) {
+	var buf bytes.Buffer
+	logrus.SetOutput(&buf)
+	defer func() {
+		logrus.SetOutput(os.Stderr)
+		configureLogging("info", "text")
+	}()
+
+	assert.NoError(t, configureLogging("warn", "json"))
+	logrus.Debug("debug message")
+	logrus.Info("info message")
+	logrus.Warn("warn message")
+	var entry map[string]interface{}
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	assert.Equal(t, "warning", entry["level"])
+	assert.Equal(t, "warn message", entry["msg"])
+
+	buf.Reset()
+	assert.NoError(t, configureLogging("debug", "text"))
+	logrus.Debug("debug message")
+	assert.Contains(t, buf.String(), `level=debug msg="debug message"`)
+
+	assert.EqualError(t, configureLogging("verbose", "text"), `Invalid log level "verbose"`)
+	assert.EqualError(t, configureLogging("info", "xml"), `Invalid log format "xml"`)
+}
+
+// BenchmarkLoadData compares sequential and concurrent import of users and
+// locations followed by eight visits files
+func BenchmarkLoadData(b *testing.B) {
+	const visitFiles, visitsPerFile = 8, 100000
+	logrus.SetOutput(ioutil.Discard)
+	dir := tempDir(b)
+	defer os.RemoveAll(dir)
+	write := func(name, kind string, first, count int) {
+		f, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			b.Fatal(err)
+		}
+		writeBenchData(f, kind, first, count)
+		if err := f.Close(); err != nil {
+			b.Fatal(err)
+		}
+	}
+	write("users_1.json", "users", 1, benchUsers)
+	write("locations_1.json", "locations", 1, benchLocations)
+	for i := 0; i < visitFiles; i++ {
+		write(fmt.Sprintf("visits_%d.json", i+1), "visits", i*visitsPerFile+1, visitsPerFile)
+	}
+
+	for _, workers := range []int{1, 4} {
+		b.Run(fmt.Sprintf("Workers%d", workers), func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				if err := loadData(NewMemoryStore(), dir, workers); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"sync/atomic"
+)
+
+// ChangeTracker is implemented by stores keeping entity versions for
+// incremental sync. Every create or update assigns the entity the next
+// value of a store-wide sequence. Deleted entities are not reported.
+// Only MemoryStore tracks changes so far, versions are not persisted in
+// snapshots, so clients have to sync from scratch after restart.
+type ChangeTracker interface {
+	// ChangedUsers, ChangedLocations and ChangedVisits set ids to entities
+	// of the kind with version greater than since in ascending order and
+	// return the current version to pass as since next time
+	ChangedUsers(ctx context.Context, since uint64, ids *[]uint) (uint64, error)
+	ChangedLocations(ctx context.Context, since uint64, ids *[]uint) (uint64, error)
+	ChangedVisits(ctx context.Context, since uint64, ids *[]uint) (uint64, error)
+}
+
+func (s *MemoryStore) ChangedUsers(ctx context.Context, since uint64, ids *[]uint) (uint64, error) {
+	return s.changed(since, ids, func(sh *memoryShard) []uint64 { return sh.userVersions })
+}
+
+func (s *MemoryStore) ChangedLocations(ctx context.Context, since uint64, ids *[]uint) (uint64, error) {
+	return s.changed(since, ids, func(sh *memoryShard) []uint64 { return sh.locationVersions })
+}
+
+func (s *MemoryStore) ChangedVisits(ctx context.Context, since uint64, ids *[]uint) (uint64, error) {
+	return s.changed(since, ids, func(sh *memoryShard) []uint64 { return sh.visitVersions })
+}
+
+// changed scans entity versions of all shards. Versions are assigned under
+// shard write lock, so once all shards are read locked every version up to
+// the current sequence value is in place and none is missed.
+func (s *MemoryStore) changed(since uint64, ids *[]uint, versions func(sh *memoryShard) []uint64) (uint64, error) {
+	s.rlockAll()
+	version := atomic.LoadUint64(&s.seq)
+	results := []uint{}
+	if since < version {
+		for n, sh := range s.shards {
+			for i, v := range versions(sh) {
+				if v > since {
+					results = append(results, uint(i*len(s.shards)+n))
+				}
+			}
+		}
+	}
+	s.runlockAll()
+	sort.Slice(results, func(i, j int) bool { return results[i] < results[j] })
+	*ids = results
+	return version, nil
+}
+
+// nextVersion returns version for created or updated entity, it must be
+// called with acquired lock of the entity shard
+func (s *MemoryStore) nextVersion() uint64 {
+	return atomic.AddUint64(&s.seq, 1)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChanged(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStoreWithOptions(MemoryStoreOptions{Shards: 3})
+	changed := func(f func(ctx context.Context, since uint64, ids *[]uint) (uint64, error), since uint64) ([]uint, uint64) {
+		var ids []uint
+		version, err := f(ctx, since, &ids)
+		assert.NoError(t, err)
+		return ids, version
+	}
+
+	ids, version := changed(s.ChangedUsers, 0)
+	assert.Equal(t, []uint{}, ids)
+	assert.Equal(t, uint64(0), version)
+
+	assert.NoError(t, s.CreateUsers(ctx, []User{{ID: 5, Email: "u5@hlcup.com"}, {ID: 1, Email: "u1@hlcup.com"}}))
+	assert.NoError(t, s.CreateLocations(ctx, []Location{{ID: 2, Place: "Place2"}, {ID: 7, Place: "Place7"}}))
+	assert.NoError(t, s.CreateVisits(ctx, []Visit{
+		{ID: 1, UserID: 1, LocationID: 2},
+		{ID: 4, UserID: 5, LocationID: 7},
+	}))
+	ids, version = changed(s.ChangedUsers, 0)
+	assert.Equal(t, []uint{1, 5}, ids)
+	assert.Equal(t, uint64(6), version)
+	ids, _ = changed(s.ChangedLocations, 0)
+	assert.Equal(t, []uint{2, 7}, ids)
+	ids, _ = changed(s.ChangedVisits, 0)
+	assert.Equal(t, []uint{1, 4}, ids)
+	ids, _ = changed(s.ChangedLocations, 3)
+	assert.Equal(t, []uint{7}, ids)
+
+	// updates bump versions, deleted entities are not reported
+	assert.NoError(t, s.UpdateUser(ctx, 5, &User{ID: 5, Email: "new@hlcup.com"}))
+	assert.NoError(t, s.UpdateLocation(ctx, 2, &Location{ID: 2, Place: "NewPlace2"}))
+	assert.NoError(t, s.UpdateVisit(ctx, 1, &Visit{ID: 1, UserID: 1, LocationID: 2, Mark: 5}))
+	assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: 9, UserID: 5, LocationID: 2}))
+	assert.NoError(t, s.DeleteVisit(ctx, 4))
+	ids, version = changed(s.ChangedUsers, 6)
+	assert.Equal(t, []uint{5}, ids)
+	assert.Equal(t, uint64(10), version)
+	ids, _ = changed(s.ChangedLocations, 6)
+	assert.Equal(t, []uint{2}, ids)
+	ids, _ = changed(s.ChangedVisits, 6)
+	assert.Equal(t, []uint{1, 9}, ids)
+	ids, _ = changed(s.ChangedVisits, 0)
+	assert.Equal(t, []uint{1, 9}, ids)
+	ids, _ = changed(s.ChangedUsers, 10)
+	assert.Equal(t, []uint{}, ids)
+
+	// upsert is an update
+	s.SetUpsert(true)
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com"}))
+	s.SetUpsert(false)
+	ids, version = changed(s.ChangedUsers, 10)
+	assert.Equal(t, []uint{1}, ids)
+	assert.Equal(t, uint64(11), version)
+
+	// restored entities are all changed, versions never go back
+	var buf bytes.Buffer
+	assert.NoError(t, s.Snapshot(&buf))
+	assert.NoError(t, s.Restore(&buf))
+	ids, version = changed(s.ChangedUsers, 11)
+	assert.Equal(t, []uint{1, 5}, ids)
+	assert.Equal(t, uint64(17), version)
+	assert.NoError(t, s.Clear(ctx))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 3, Email: "u3@hlcup.com"}))
+	ids, version = changed(s.ChangedUsers, 17)
+	assert.Equal(t, []uint{3}, ids)
+	assert.Equal(t, uint64(18), version)
+}
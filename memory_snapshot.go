@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync/atomic"
+)
+
+// Snapshotter is implemented by stores able to dump and load their state
+type Snapshotter interface {
+	Snapshot(w io.Writer) error
+	Restore(r io.Reader) error
+}
+
+var snapshotMagic = []byte("HLCS\x01")
+
+// upper limit for a single string length to detect corrupted snapshots
+const maxSnapshotString = 1 << 20
+
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// Snapshot writes users, locations and visits in compact binary format:
+// magic header followed by varint-encoded entity lists. Email and visit
+// indexes are not stored, they are rebuilt on restore.
+func (s *MemoryStore) Snapshot(w io.Writer) error {
+	s.rlockAll()
+	defer s.runlockAll()
+
+	var counts StoreCounts
+	for _, sh := range s.shards {
+		counts.Users += sh.counts.Users
+		counts.Locations += sh.counts.Locations
+		counts.Visits += sh.counts.Visits
+	}
+
+	sw := snapshotWriter{w: bufio.NewWriter(w)}
+	sw.bytes(snapshotMagic)
+
+	sw.uvarint(uint64(counts.Users))
+	for _, sh := range s.shards {
+		for _, u := range sh.users {
+			if u == nil {
+				continue
+			}
+			sw.uvarint(uint64(u.ID))
+			sw.string(u.FirstName)
+			sw.string(u.LastName)
+			sw.string(u.Email)
+			sw.string(u.Gender)
+			sw.varint(u.BirthDate)
+		}
+	}
+
+	sw.uvarint(uint64(counts.Locations))
+	for _, sh := range s.shards {
+		for _, l := range sh.locations {
+			if l == nil {
+				continue
+			}
+			sw.uvarint(uint64(l.ID))
+			sw.string(l.City)
+			sw.string(l.Country)
+			sw.string(l.Place)
+			sw.varint(int64(l.Distance))
+		}
+	}
+
+	sw.uvarint(uint64(counts.Visits))
+	for _, sh := range s.shards {
+		for _, v := range sh.visits {
+			if v == nil {
+				continue
+			}
+			sw.uvarint(uint64(v.ID))
+			sw.uvarint(uint64(v.UserID))
+			sw.uvarint(uint64(v.LocationID))
+			sw.varint(v.VisitedAt)
+			sw.varint(int64(v.Mark))
+		}
+	}
+
+	if sw.err != nil {
+		return sw.err
+	}
+	return sw.w.Flush()
+}
+
+// Restore replaces store contents with the snapshot data. Store is left
+// untouched if snapshot is malformed.
+func (s *MemoryStore) Restore(r io.Reader) error {
+	sr := snapshotReader{r: bufio.NewReader(r)}
+	magic := make([]byte, len(snapshotMagic))
+	if _, err := io.ReadFull(sr.r, magic); err != nil || string(magic) != string(snapshotMagic) {
+		return ErrInvalidSnapshot
+	}
+
+	fresh := NewMemoryStoreWithOptions(s.opts)
+	fresh.uniqueEmail = s.uniqueEmail
+	fresh.seq = atomic.LoadUint64(&s.seq) // restored entities are reported as changed
+	for n := sr.uvarint(); n > 0 && sr.err == nil; n-- {
+		u := User{
+			ID:        uint(sr.uvarint()),
+			FirstName: sr.string(),
+			LastName:  sr.string(),
+			Email:     sr.string(),
+			Gender:    sr.string(),
+			BirthDate: sr.varint(),
+		}
+		if sr.err == nil {
+			sr.err = fresh.createUser(&u)
+		}
+	}
+	for n := sr.uvarint(); n > 0 && sr.err == nil; n-- {
+		l := Location{
+			ID:       uint(sr.uvarint()),
+			City:     sr.string(),
+			Country:  sr.string(),
+			Place:    sr.string(),
+			Distance: int(sr.varint()),
+		}
+		if sr.err == nil {
+			sr.err = fresh.createLocation(&l)
+		}
+	}
+	for n := sr.uvarint(); n > 0 && sr.err == nil; n-- {
+		v := Visit{
+			ID:         uint(sr.uvarint()),
+			UserID:     uint(sr.uvarint()),
+			LocationID: uint(sr.uvarint()),
+			VisitedAt:  sr.varint(),
+			Mark:       int(sr.varint()),
+		}
+		if sr.err == nil {
+			sr.err = fresh.createVisit(&v)
+		}
+	}
+	if sr.err != nil {
+		return ErrInvalidSnapshot
+	}
+
+	s.lockAll()
+	s.replace(fresh)
+	s.unlockAll()
+	return nil
+}
+
+type snapshotWriter struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+	err error
+}
+
+func (sw *snapshotWriter) bytes(b []byte) {
+	if sw.err == nil {
+		_, sw.err = sw.w.Write(b)
+	}
+}
+
+func (sw *snapshotWriter) uvarint(x uint64) {
+	sw.bytes(sw.buf[:binary.PutUvarint(sw.buf[:], x)])
+}
+
+func (sw *snapshotWriter) varint(x int64) {
+	sw.bytes(sw.buf[:binary.PutVarint(sw.buf[:], x)])
+}
+
+func (sw *snapshotWriter) string(s string) {
+	sw.uvarint(uint64(len(s)))
+	if sw.err == nil {
+		_, sw.err = sw.w.WriteString(s)
+	}
+}
+
+type snapshotReader struct {
+	r   *bufio.Reader
+	err error
+}
+
+func (sr *snapshotReader) uvarint() uint64 {
+	if sr.err != nil {
+		return 0
+	}
+	var x uint64
+	x, sr.err = binary.ReadUvarint(sr.r)
+	return x
+}
+
+func (sr *snapshotReader) varint() int64 {
+	if sr.err != nil {
+		return 0
+	}
+	var x int64
+	x, sr.err = binary.ReadVarint(sr.r)
+	return x
+}
+
+func (sr *snapshotReader) string() string {
+	n := sr.uvarint()
+	if sr.err != nil {
+		return ""
+	}
+	if n > maxSnapshotString {
+		sr.err = ErrInvalidSnapshot
+		return ""
+	}
+	b := make([]byte, n)
+	_, sr.err = io.ReadFull(sr.r, b)
+	return string(b)
+}
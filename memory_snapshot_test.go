@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUsers(ctx, []User{
+		{ID: 1, FirstName: "User1", LastName: "Last1", Email: "u1@hlcup.com", Gender: "m", BirthDate: -100},
+		{ID: 20000, FirstName: "User2", LastName: "Last2", Email: "u2@hlcup.com", Gender: "f", BirthDate: 200},
+	}))
+	assert.NoError(t, s.CreateLocations(ctx, []Location{
+		{ID: 1, City: "Moscow", Country: "Russia", Place: "Place1", Distance: 10},
+		{ID: 2, City: "Paris", Country: "France", Place: "Place2", Distance: 20},
+	}))
+	assert.NoError(t, s.CreateVisits(ctx, []Visit{
+		{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 4},
+		{ID: 2, UserID: 1, LocationID: 2, VisitedAt: 200, Mark: 1},
+		{ID: 3, UserID: 20000, LocationID: 2, VisitedAt: 300, Mark: 5},
+	}))
+
+	var buf bytes.Buffer
+	assert.NoError(t, s.Snapshot(&buf))
+
+	r := NewMemoryStore()
+	assert.NoError(t, r.Restore(&buf))
+
+	for _, id := range []uint{1, 20000} {
+		var u1, u2 User
+		assert.NoError(t, s.GetUser(ctx, id, &u1))
+		assert.NoError(t, r.GetUser(ctx, id, &u2))
+		assert.Equal(t, u1, u2)
+	}
+	for _, id := range []uint{1, 2} {
+		var l1, l2 Location
+		assert.NoError(t, s.GetLocation(ctx, id, &l1))
+		assert.NoError(t, r.GetLocation(ctx, id, &l2))
+		assert.Equal(t, l1, l2)
+	}
+	for _, id := range []uint{1, 2, 3} {
+		var v1, v2 Visit
+		assert.NoError(t, s.GetVisit(ctx, id, &v1))
+		assert.NoError(t, r.GetVisit(ctx, id, &v2))
+		assert.Equal(t, v1, v2)
+	}
+	assert.Equal(t, s.emails, r.emails)
+
+	// indexes are rebuilt
+	var visits []UserVisit
+	_, err := r.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, []UserVisit{{Mark: 4, VisitedAt: 100, Place: "Place1"}, {Mark: 1, VisitedAt: 200, Place: "Place2"}}, visits)
+	avg, _, err := r.GetLocationAvg(ctx, 2, &LocationAvgQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3.0, avg)
+}
+
+func TestRestoreInvalid(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com"}))
+
+	var buf bytes.Buffer
+	assert.NoError(t, s.Snapshot(&buf))
+	data := buf.Bytes()
+
+	r := NewMemoryStore()
+	assert.NoError(t, r.CreateUser(ctx, &User{ID: 5, Email: "u5@hlcup.com"}))
+	assert.Equal(t, ErrInvalidSnapshot, r.Restore(bytes.NewReader([]byte("garbage"))))
+	assert.Equal(t, ErrInvalidSnapshot, r.Restore(bytes.NewReader(data[:len(data)-3])))
+	// store is left untouched
+	assert.NoError(t, r.GetUser(ctx, 5, &User{}))
+	assert.Equal(t, ErrNotFound, r.GetUser(ctx, 1, &User{}))
+}
+
+func TestRestoreNonUniqueEmail(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	assert.NoError(t, s.SetUniqueEmail(false))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u@hlcup.com"}))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 2, Email: "u@hlcup.com"}))
+	var buf bytes.Buffer
+	assert.NoError(t, s.Snapshot(&buf))
+	data := buf.Bytes()
+
+	// uniqueness of the restoring store is kept
+	r := NewMemoryStore()
+	assert.Equal(t, ErrInvalidSnapshot, r.Restore(bytes.NewReader(data)))
+	assert.NoError(t, r.SetUniqueEmail(false))
+	assert.NoError(t, r.Restore(bytes.NewReader(data)))
+	assert.NoError(t, r.CreateUser(ctx, &User{ID: 3, Email: "u@hlcup.com"}))
+}
@@ -1,372 +1,1446 @@
 package main
 
 import (
+	"context"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/emirpasic/gods/trees/redblacktree"
 )
 
+// default number of MemoryStore shards
+const defaultMemoryShards = 16
+
+// default initial MemoryStore capacity and growth factor
+const (
+	defaultMemoryCapacity = 10000
+	defaultMemoryGrowth   = 2.0
+)
+
+// number of visits processed between context cancellation checks
+const ctxCheckInterval = 1024
+
+// MemoryStore keeps all data in memory. It is safe for concurrent use.
+// State is split into shards by entity id modulo number of shards, every
+// shard has its own lock, so requests to different shards don't contend.
+// Visit indexes live in the shard of their owning user or location.
+// Operations touching several shards lock them in shard order. The emails
+// map is shared and guarded by emailsMu, which is taken after shard locks.
+//
+// Besides the index of all user visits, visits are indexed per user by
+// country of their location, so country filtered user visits don't look up
+// locations of other countries. It costs one more tree node per visit and a
+// map per user with visits. Country change of a location with visits locks
+// all shards to reindex the visits.
+//
+// Location visits index keeps gender and birth date of the visitor along
+// with the visit, so location avg filtered by them doesn't look up users
+// in other shards. Change of them by user with visits locks all shards to
+// restamp the visits.
 type MemoryStore struct {
+	seq    uint64 // last assigned entity version, see ChangeTracker
+	shards []*memoryShard
+
+	// emails is shared by users of all shards, shard locks don't guard it.
+	// Every access holds emailsMu, so the duplicate check, indexing of the
+	// new email and removal of the previous one are atomic.
+	emailsMu sync.Mutex
+	emails   map[string]uint
+
+	uniqueEmail bool
+	upsert      bool
+	cascade     bool
+	opts        MemoryStoreOptions
+}
+
+// MemoryStoreOptions tune MemoryStore layout. Entities are kept in slices
+// indexed by id, so every slice grows when an entity with id beyond its
+// length is created: new length is Growth times the current one, or just
+// enough to fit the id. Capacity is the initial number of entities of every
+// kind, it saves reallocations if the expected data size is known.
+type MemoryStoreOptions struct {
+	Shards   int
+	Capacity int
+	Growth   float64
+}
+
+// memoryShard holds entities with id%len(shards) equal to the shard number.
+// Entities are indexed by id/len(shards) within the shard.
+type memoryShard struct {
 	mu               sync.RWMutex
 	users            []*User
 	locations        []*Location
 	visits           []*Visit
-	emails           map[string]uint
 	visitsByUser     []*redblacktree.Tree
+	visitsByCountry  []map[string]*redblacktree.Tree // user visits by location country
 	visitsByLocation []*redblacktree.Tree
+	userVersions     []uint64
+	locationVersions []uint64
+	visitVersions    []uint64
+	counts           StoreCounts
 }
 
 func NewMemoryStore() *MemoryStore {
-	return &MemoryStore{
-		users:            make([]*User, 10000),
-		locations:        make([]*Location, 10000),
-		visits:           make([]*Visit, 10000),
-		emails:           make(map[string]uint, 10000),
-		visitsByUser:     make([]*redblacktree.Tree, 10000),
-		visitsByLocation: make([]*redblacktree.Tree, 10000),
+	return NewShardedMemoryStore(defaultMemoryShards)
+}
+
+// NewShardedMemoryStore creates MemoryStore split into the given number of shards.
+func NewShardedMemoryStore(shards int) *MemoryStore {
+	return NewMemoryStoreWithOptions(MemoryStoreOptions{
+		Shards:   shards,
+		Capacity: defaultMemoryCapacity,
+		Growth:   defaultMemoryGrowth,
+	})
+}
+
+// NewMemoryStoreWithOptions creates MemoryStore with the given layout.
+// Invalid options are replaced with defaults.
+func NewMemoryStoreWithOptions(opts MemoryStoreOptions) *MemoryStore {
+	if opts.Shards < 1 {
+		opts.Shards = 1
+	}
+	if opts.Capacity < 0 {
+		opts.Capacity = defaultMemoryCapacity
+	}
+	if opts.Growth <= 1 {
+		opts.Growth = defaultMemoryGrowth
+	}
+	s := &MemoryStore{
+		shards:      make([]*memoryShard, opts.Shards),
+		emails:      make(map[string]uint, opts.Capacity),
+		uniqueEmail: true,
+		opts:        opts,
+	}
+	size := opts.Capacity / opts.Shards
+	for i := range s.shards {
+		s.shards[i] = &memoryShard{
+			users:            make([]*User, size),
+			locations:        make([]*Location, size),
+			visits:           make([]*Visit, size),
+			visitsByUser:     make([]*redblacktree.Tree, size),
+			visitsByCountry:  make([]map[string]*redblacktree.Tree, size),
+			visitsByLocation: make([]*redblacktree.Tree, size),
+			userVersions:     make([]uint64, size),
+			locationVersions: make([]uint64, size),
+			visitVersions:    make([]uint64, size),
+		}
+	}
+	return s
+}
+
+// SetUpsert switches create methods to overwrite entities with existing
+// ids instead of failing with ErrDup. It must not be called concurrently
+// with other methods.
+func (s *MemoryStore) SetUpsert(upsert bool) {
+	s.upsert = upsert
+}
+
+// SetUniqueEmail switches the unique user email constraint, it is on by
+// default. Blank emails are never considered duplicates. Turning it on
+// fails with ErrDup if existing users share an email.
+func (s *MemoryStore) SetUniqueEmail(unique bool) error {
+	s.lockAll()
+	defer s.unlockAll()
+	emails := make(map[string]uint)
+	if unique {
+		for _, sh := range s.shards {
+			for _, u := range sh.users {
+				if u == nil || u.Email == "" {
+					continue
+				}
+				if _, exists := emails[u.Email]; exists {
+					return ErrDup
+				}
+				emails[u.Email] = u.ID
+			}
+		}
 	}
+	s.emailsMu.Lock()
+	s.emails = emails
+	s.emailsMu.Unlock()
+	s.uniqueEmail = unique
+	return nil
+}
+
+// SetCascade switches delete of users and locations to remove their visits
+// too. Otherwise delete of an entity referenced by visits fails with
+// ErrHasVisits. It must not be called concurrently with other methods.
+func (s *MemoryStore) SetCascade(cascade bool) {
+	s.cascade = cascade
 }
 
 // User methods
-func (s *MemoryStore) CreateUser(u *User) error {
-	s.mu.Lock()
+func (s *MemoryStore) CreateUser(ctx context.Context, u *User) error {
+	all := s.lockUser(u.ID, u)
 	err := s.createUser(u)
-	s.mu.Unlock()
+	s.unlockUser(u.ID, all)
 	return err
 }
 
-func (s *MemoryStore) CreateUsers(us []User) error {
-	s.mu.Lock()
-	var err error
+func (s *MemoryStore) CreateUsers(ctx context.Context, us []User) error {
 	for _, u := range us {
-		err = s.createUser(&u)
-		if err != nil {
-			break
+		if err := s.CreateUser(ctx, &u); err != nil {
+			return err
 		}
 	}
-	s.mu.Unlock()
-	return err
+	return nil
 }
 
 func (s *MemoryStore) createUser(u *User) error {
-	// called with acquired mu lock
+	// called with acquired user shard lock, all shards are locked if
+	// existing user changes gender or birth date in upsert mode
 	if u.ID == 0 {
 		return ErrMissingID
 	}
-	curLen := len(s.users)
-	intID := int(u.ID)
-	if curLen <= intID {
-		newLen := curLen
-		if intID > newLen {
-			newLen = intID
-		}
-		s.users = append(s.users, make([]*User, newLen+1000)...)
-		s.visitsByUser = append(s.visitsByUser, make([]*redblacktree.Tree, newLen+1000)...)
+	sh, i := s.shard(u.ID), s.index(u.ID)
+	if len(sh.users) <= i {
+		// visit indexes grow in lockstep
+		n := s.grownLen(len(sh.users), i)
+		users := make([]*User, n)
+		copy(users, sh.users)
+		sh.users = users
+		visitsByUser := make([]*redblacktree.Tree, n)
+		copy(visitsByUser, sh.visitsByUser)
+		sh.visitsByUser = visitsByUser
+		visitsByCountry := make([]map[string]*redblacktree.Tree, n)
+		copy(visitsByCountry, sh.visitsByCountry)
+		sh.visitsByCountry = visitsByCountry
+		userVersions := make([]uint64, n)
+		copy(userVersions, sh.userVersions)
+		sh.userVersions = userVersions
 	}
-	if s.users[u.ID] != nil {
+	if sh.users[i] != nil {
+		if s.upsert {
+			return s.updateUser(u.ID, u)
+		}
 		return ErrDup
 	}
-	if _, exists := s.emails[u.Email]; exists {
+	s.emailsMu.Lock()
+	defer s.emailsMu.Unlock()
+	if s.emailTaken(u.Email, u.ID) {
 		return ErrDup
 	}
 	uCopy := *u
-	s.users[u.ID] = &uCopy
-	s.emails[u.Email] = u.ID
-	s.visitsByUser[u.ID] = redblacktree.NewWith(timestampComparator)
+	sh.users[i] = &uCopy
+	s.reindexEmail(u.ID, "", u.Email)
+	sh.visitsByUser[i] = redblacktree.NewWith(visitKeyComparator)
+	sh.userVersions[i] = s.nextVersion()
+	sh.counts.Users++
 	return nil
 }
 
-func (s *MemoryStore) UpdateUser(id uint, u *User) error {
-	s.mu.Lock()
+func (s *MemoryStore) UpdateUser(ctx context.Context, id uint, u *User) error {
+	all := s.lockUser(id, u)
 	err := s.updateUser(id, u)
-	s.mu.Unlock()
+	s.unlockUser(id, all)
 	return err
 }
 
 func (s *MemoryStore) updateUser(id uint, u *User) error {
-	// called with acquired mu lock
+	// called with acquired user shard lock, all shards are locked if
+	// gender or birth date of user with visits changes
 	if id != u.ID {
 		return ErrUpdateID
 	}
-	if len(s.users) <= int(id) || s.users[id] == nil {
+	prev := s.user(id)
+	if prev == nil {
 		return ErrNotFound
 	}
-	if eid, exists := s.emails[u.Email]; exists && eid != id {
+	s.emailsMu.Lock()
+	defer s.emailsMu.Unlock()
+	if s.emailTaken(u.Email, id) {
 		return ErrDup
 	}
-	prev := s.users[id]
 	if prev.Email != u.Email {
-		delete(s.emails, prev.Email)
-		s.emails[u.Email] = u.ID
+		s.reindexEmail(id, prev.Email, u.Email)
 	}
-	*s.users[u.ID] = *u
+	restamp := prev.Gender != u.Gender || prev.BirthDate != u.BirthDate
+	*prev = *u
+	if restamp {
+		for _, v := range s.userVisits(id).Values() {
+			visit := v.(*Visit)
+			if lv, ok := s.locationVisits(visit.LocationID).Get(keyOf(visit)); ok {
+				s.stampVisitor(lv.(*locationVisit), id)
+			}
+		}
+	}
+	s.shard(id).userVersions[s.index(id)] = s.nextVersion()
 	return nil
 }
 
-func (s *MemoryStore) GetUser(id uint, u *User) error {
-	s.mu.RLock()
-	if len(s.users) <= int(id) || s.users[id] == nil {
-		s.mu.RUnlock()
+// lockUser write locks shard of the user with the given id. If u changes
+// gender or birth date of the user with visits, all shards are locked
+// instead, as the visits are restamped in shards of their locations. It
+// reports whether all shards are locked.
+func (s *MemoryStore) lockUser(id uint, u *User) bool {
+	sh := s.shard(id)
+	sh.mu.Lock()
+	user := s.user(id)
+	if user == nil || (user.Gender == u.Gender && user.BirthDate == u.BirthDate) ||
+		s.userVisits(id).Empty() {
+		return false
+	}
+	// user may change again meanwhile, updateUser handles any change
+	sh.mu.Unlock()
+	s.lockAll()
+	return true
+}
+
+func (s *MemoryStore) unlockUser(id uint, all bool) {
+	if all {
+		s.unlockAll()
+		return
+	}
+	s.shard(id).mu.Unlock()
+}
+
+func (s *MemoryStore) GetUser(ctx context.Context, id uint, u *User) error {
+	sh := s.shard(id)
+	sh.mu.RLock()
+	user := s.user(id)
+	if user == nil {
+		sh.mu.RUnlock()
 		return ErrNotFound
 	}
-	*u = *s.users[id]
-	s.mu.RUnlock()
+	*u = *user
+	sh.mu.RUnlock()
 	return nil
 }
 
-func (s *MemoryStore) GetUserVisits(id uint, q *UserVisitsQuery, visits *[]UserVisit) error {
-	s.mu.RLock()
-	if len(s.visitsByUser) <= int(id) || s.visitsByUser[id] == nil {
-		s.mu.RUnlock()
+func (s *MemoryStore) GetUsers(ctx context.Context, ids []uint, users *[]User) error {
+	results := make([]User, 0, len(ids))
+	for _, id := range ids {
+		sh := s.shard(id)
+		sh.mu.RLock()
+		if user := s.user(id); user != nil {
+			results = append(results, *user)
+		}
+		sh.mu.RUnlock()
+	}
+	*users = results
+	return nil
+}
+
+func (s *MemoryStore) GetUserVisits(ctx context.Context, id uint, q *UserVisitsQuery, visits *[]UserVisit) (int, error) {
+	results := []UserVisit{}
+	var total int
+	if err := s.userLocationVisits(ctx, id, q, func(visit *userVisitRef, place string) bool {
+		total++
+		if total <= q.Offset {
+			return true
+		}
+		if q.Limit > 0 && len(results) >= q.Limit {
+			// the rest is only counted, which is skipped unless requested
+			return q.WithTotal
+		}
+		results = append(results, UserVisit{
+			Mark:      visit.mark,
+			VisitedAt: visit.key.visitedAt,
+			Place:     place,
+		})
+		return true
+	}); err != nil {
+		return 0, err
+	}
+	*visits = results
+	return total, nil
+}
+
+func (s *MemoryStore) GetUserAvg(ctx context.Context, id uint, q *UserVisitsQuery) (float64, error) {
+	var sum, cnt int
+	if err := s.userLocationVisits(ctx, id, q, func(visit *userVisitRef, _ string) bool {
+		sum += visit.mark
+		cnt++
+		return true
+	}); err != nil {
+		return 0, err
+	}
+	var avg float64
+	if cnt > 0 {
+		avg = float64(sum) / float64(cnt)
+	}
+	return avg, nil
+}
+
+// userVisitRef is the part of user visit userLocationVisits needs once
+// user shard lock is released
+type userVisitRef struct {
+	key        visitKey
+	locationID uint
+	mark       int
+}
+
+// userLocationVisits calls f with user visits matching the query and place
+// of their locations in the query order until f returns false. Offset and
+// Limit are left to the caller.
+func (s *MemoryStore) userLocationVisits(ctx context.Context, id uint, q *UserVisitsQuery, f func(visit *userVisitRef, place string) bool) error {
+	// collect visits under user shard lock, locations are in other shards
+	sh := s.shard(id)
+	sh.mu.RLock()
+	userVisits := s.userVisits(id)
+	if userVisits == nil {
+		sh.mu.RUnlock()
 		return ErrNotFound
 	}
-	userVisits := s.visitsByUser[id]
-	results := make([]UserVisit, 0, userVisits.Size())
+	if q.Country != "" {
+		userVisits = s.countryVisits(id, q.Country)
+		if userVisits == nil {
+			sh.mu.RUnlock()
+			return nil
+		}
+	}
+	candidates := make([]userVisitRef, 0, userVisits.Size())
 	iterator := userVisits.Iterator()
-	for iterator.Next() {
-		visitedAt := iterator.Key().(int64)
-		if (q.FromDate != nil && visitedAt <= *q.FromDate) ||
-			(q.ToDate != nil && visitedAt >= *q.ToDate) {
+	next := iterator.Next
+	if q.Desc {
+		iterator.End()
+		next = iterator.Prev
+	}
+	for next() {
+		key := iterator.Key().(visitKey)
+		if (q.FromDate != nil && key.visitedAt <= *q.FromDate) ||
+			(q.ToDate != nil && key.visitedAt >= *q.ToDate) {
 			continue
 		}
 		visit := iterator.Value().(*Visit)
-		location := s.locations[visit.LocationID]
-		if (q.Country != "" && location.Country != q.Country) ||
-			(q.ToDistance != nil && location.Distance >= *q.ToDistance) {
+		candidates = append(candidates, userVisitRef{key: key, locationID: visit.LocationID, mark: visit.Mark})
+	}
+	sh.mu.RUnlock()
+
+	for i := range candidates {
+		if i%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		visit := &candidates[i]
+		place, country, distance, ok := s.locationFields(visit.locationID)
+		if !ok {
+			continue // deleted concurrently
+		}
+		if (q.Country != "" && country != q.Country) || !q.matchDistance(distance) {
 			continue
 		}
-		results = append(results, UserVisit{
-			Mark:      visit.Mark,
-			VisitedAt: visit.VisitedAt,
-			Place:     location.Place,
-		})
+		if !f(visit, place) {
+			break
+		}
 	}
-	*visits = results
-	s.mu.RUnlock()
 	return nil
 }
 
+// locationFields returns location fields user visits are filtered and
+// listed by, ok is false if there is no such location
+func (s *MemoryStore) locationFields(id uint) (place, country string, distance int, ok bool) {
+	sh := s.shard(id)
+	sh.mu.RLock()
+	if location := s.location(id); location != nil {
+		place, country, distance, ok = location.Place, location.Country, location.Distance, true
+	}
+	sh.mu.RUnlock()
+	return
+}
+
+func (s *MemoryStore) DeleteUser(ctx context.Context, id uint) error {
+	if s.cascade {
+		// visits and their location indexes may be in any shard
+		s.lockAll()
+		err := s.deleteUser(id)
+		s.unlockAll()
+		return err
+	}
+	sh := s.shard(id)
+	sh.mu.Lock()
+	err := s.deleteUser(id)
+	sh.mu.Unlock()
+	return err
+}
+
+func (s *MemoryStore) deleteUser(id uint) error {
+	// called with acquired user shard lock, all shards are locked in
+	// cascade mode
+	user := s.user(id)
+	if user == nil {
+		return ErrNotFound
+	}
+	if err := s.deleteVisitsOf(s.userVisits(id)); err != nil {
+		return err
+	}
+	s.emailsMu.Lock()
+	s.reindexEmail(id, user.Email, "")
+	s.emailsMu.Unlock()
+	sh, i := s.shard(id), s.index(id)
+	sh.users[i] = nil
+	sh.visitsByUser[i] = nil
+	sh.visitsByCountry[i] = nil
+	sh.userVersions[i] = 0
+	sh.counts.Users--
+	return nil
+}
+
+// emailTaken reports whether email belongs to another user. Only emails
+// indexed by reindexEmail are taken. Called with emailsMu held.
+func (s *MemoryStore) emailTaken(email string, id uint) bool {
+	eid, exists := s.emails[email]
+	return exists && eid != id
+}
+
+// reindexEmail replaces prev email of the user with email in the index.
+// Blank emails and all emails in non-unique mode are not indexed. Called
+// with emailsMu held.
+func (s *MemoryStore) reindexEmail(id uint, prev, email string) {
+	if eid, exists := s.emails[prev]; exists && eid == id {
+		delete(s.emails, prev)
+	}
+	if s.uniqueEmail && email != "" {
+		s.emails[email] = id
+	}
+}
+
+func (s *MemoryStore) userExists(id uint) bool {
+	sh := s.shard(id)
+	sh.mu.RLock()
+	exists := s.user(id) != nil
+	sh.mu.RUnlock()
+	return exists
+}
+
 // Location methods
-func (s *MemoryStore) CreateLocation(l *Location) error {
-	s.mu.Lock()
+func (s *MemoryStore) CreateLocation(ctx context.Context, l *Location) error {
+	// existing location is updated in upsert mode
+	all := s.lockLocation(l.ID, l)
 	err := s.createLocation(l)
-	s.mu.Unlock()
+	s.unlockLocation(l.ID, all)
 	return err
 }
 
-func (s *MemoryStore) CreateLocations(ls []Location) error {
-	s.mu.Lock()
-	var err error
+func (s *MemoryStore) CreateLocations(ctx context.Context, ls []Location) error {
 	for _, l := range ls {
-		err = s.createLocation(&l)
-		if err != nil {
-			break
+		if err := s.CreateLocation(ctx, &l); err != nil {
+			return err
 		}
 	}
-	s.mu.Unlock()
-	return err
+	return nil
 }
 
 func (s *MemoryStore) createLocation(l *Location) error {
-	// called with acquired mu lock
+	// called with acquired location shard lock, all shards are locked if
+	// existing location changes country in upsert mode
 	if l.ID == 0 {
 		return ErrMissingID
 	}
-	curLen := len(s.locations)
-	intID := int(l.ID)
-	if curLen <= intID {
-		newLen := curLen
-		if intID > newLen {
-			newLen = intID
-		}
-		s.locations = append(s.locations, make([]*Location, newLen+1000)...)
-		s.visitsByLocation = append(s.visitsByLocation, make([]*redblacktree.Tree, newLen+1000)...)
+	sh, i := s.shard(l.ID), s.index(l.ID)
+	if len(sh.locations) <= i {
+		// visit indexes grow in lockstep
+		n := s.grownLen(len(sh.locations), i)
+		locations := make([]*Location, n)
+		copy(locations, sh.locations)
+		sh.locations = locations
+		visitsByLocation := make([]*redblacktree.Tree, n)
+		copy(visitsByLocation, sh.visitsByLocation)
+		sh.visitsByLocation = visitsByLocation
+		locationVersions := make([]uint64, n)
+		copy(locationVersions, sh.locationVersions)
+		sh.locationVersions = locationVersions
 	}
-	if s.locations[l.ID] != nil {
+	if sh.locations[i] != nil {
+		if s.upsert {
+			return s.updateLocation(l.ID, l)
+		}
 		return ErrDup
 	}
 	lCopy := *l
-	s.locations[l.ID] = &lCopy
-	s.visitsByLocation[l.ID] = redblacktree.NewWith(timestampComparator)
+	sh.locations[i] = &lCopy
+	sh.visitsByLocation[i] = redblacktree.NewWith(visitKeyComparator)
+	sh.locationVersions[i] = s.nextVersion()
+	sh.counts.Locations++
 	return nil
 }
 
-func (s *MemoryStore) UpdateLocation(id uint, l *Location) error {
-	s.mu.Lock()
+func (s *MemoryStore) UpdateLocation(ctx context.Context, id uint, l *Location) error {
+	all := s.lockLocation(id, l)
 	err := s.updateLocation(id, l)
-	s.mu.Unlock()
+	s.unlockLocation(id, all)
 	return err
 }
 
 func (s *MemoryStore) updateLocation(id uint, l *Location) error {
-	// called with acquired mu lock
+	// called with acquired location shard lock, all shards are locked if
+	// country of location with visits changes
 	if id != l.ID {
 		return ErrUpdateID
 	}
-	if len(s.locations) <= int(id) || s.locations[id] == nil {
+	location := s.location(id)
+	if location == nil {
 		return ErrNotFound
 	}
-	*s.locations[l.ID] = *l
+	if location.Country != l.Country {
+		for _, v := range s.locationVisits(id).Values() {
+			s.unindexCountry(v.(*locationVisit).visit, location.Country)
+			s.indexCountry(v.(*locationVisit).visit, l.Country)
+		}
+	}
+	*location = *l
+	s.shard(id).locationVersions[s.index(id)] = s.nextVersion()
 	return nil
 }
 
-func (s *MemoryStore) GetLocation(id uint, l *Location) error {
-	s.mu.RLock()
-	if len(s.locations) <= int(id) || s.locations[id] == nil {
-		s.mu.RUnlock()
+// lockLocation write locks shard of the location with the given id. If l
+// changes country of the location with visits, all shards are locked
+// instead, as the visits are reindexed in shards of their users. It reports
+// whether all shards are locked.
+func (s *MemoryStore) lockLocation(id uint, l *Location) bool {
+	sh := s.shard(id)
+	sh.mu.Lock()
+	location := s.location(id)
+	if location == nil || location.Country == l.Country || s.locationVisits(id).Empty() {
+		return false
+	}
+	// country may change again meanwhile, updateLocation handles any change
+	sh.mu.Unlock()
+	s.lockAll()
+	return true
+}
+
+func (s *MemoryStore) unlockLocation(id uint, all bool) {
+	if all {
+		s.unlockAll()
+		return
+	}
+	s.shard(id).mu.Unlock()
+}
+
+func (s *MemoryStore) GetLocation(ctx context.Context, id uint, l *Location) error {
+	sh := s.shard(id)
+	sh.mu.RLock()
+	location := s.location(id)
+	if location == nil {
+		sh.mu.RUnlock()
 		return ErrNotFound
 	}
-	*l = *s.locations[id]
-	s.mu.RUnlock()
+	*l = *location
+	sh.mu.RUnlock()
+	return nil
+}
+
+func (s *MemoryStore) GetLocationAvg(ctx context.Context, id uint, q *LocationAvgQuery) (float64, int, error) {
+	var sum, cnt int
+	if err := s.locationMarks(ctx, id, q, func(mark int) {
+		sum += mark
+		cnt++
+	}); err != nil {
+		return 0, 0, err
+	}
+	var avg float64
+	if cnt > 0 {
+		avg = float64(sum) / float64(cnt)
+	}
+	return avg, cnt, nil
+}
+
+func (s *MemoryStore) GetLocationAvgByAge(ctx context.Context, id uint, q *LocationAvgQuery, buckets []AgeBucket) error {
+	a := newAgeBucketsAvg(buckets, time.Now())
+	if err := s.locationVisitorMarks(ctx, id, q, a.add); err != nil {
+		return err
+	}
+	a.done()
 	return nil
 }
 
-func (s *MemoryStore) GetLocationAvg(id uint, q *LocationAvgQuery) (float64, error) {
-	s.mu.RLock()
-	if len(s.visitsByLocation) <= int(id) || s.visitsByLocation[id] == nil {
-		s.mu.RUnlock()
-		return 0, ErrNotFound
+func (s *MemoryStore) GetLocationHistogram(ctx context.Context, id uint, q *LocationAvgQuery, h *MarkHistogram) error {
+	*h = MarkHistogram{}
+	return s.locationMarks(ctx, id, q, h.add)
+}
+
+// locationMarks calls f with marks of location visits matching the query
+func (s *MemoryStore) locationMarks(ctx context.Context, id uint, q *LocationAvgQuery, f func(mark int)) error {
+	return s.locationVisitorMarks(ctx, id, q, func(mark int, _ int64) {
+		f(mark)
+	})
+}
+
+// locationVisitorMarks calls f with marks of location visits matching the
+// query and birth dates of their visitors. Visitors are filtered by gender
+// and birth date stamped in the index, users are not looked up. f is called
+// under location shard read lock.
+func (s *MemoryStore) locationVisitorMarks(ctx context.Context, id uint, q *LocationAvgQuery, f func(mark int, birthDate int64)) error {
+	sh := s.shard(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	locationVisits := s.locationVisits(id)
+	if locationVisits == nil {
+		return ErrNotFound
 	}
-	locationVisits := s.visitsByLocation[id]
+	fromBirth := q.FromBirth()
+	toBirth := q.ToBirth()
+	iterator := locationVisits.Iterator()
+	for n := 0; iterator.Next(); n++ {
+		if n%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		visitedAt := iterator.Key().(visitKey).visitedAt
+		if (q.FromDate != nil && visitedAt <= *q.FromDate) ||
+			(q.ToDate != nil && visitedAt >= *q.ToDate) {
+			continue
+		}
+		lv := iterator.Value().(*locationVisit)
+		if (q.FromMark != nil && lv.visit.Mark <= *q.FromMark) ||
+			(q.ToMark != nil && lv.visit.Mark >= *q.ToMark) ||
+			(fromBirth != nil && lv.birthDate <= *fromBirth) ||
+			(toBirth != nil && lv.birthDate >= *toBirth) ||
+			(q.Gender != "" && q.Gender != lv.gender) {
+			continue
+		}
+		f(lv.visit.Mark, lv.birthDate)
+	}
+	return nil
+}
+
+// GetLocationVisitors returns ids of users visited the location in ascending order
+func (s *MemoryStore) GetLocationVisitors(ctx context.Context, id uint, q *LocationVisitorsQuery, users *[]uint) error {
+	sh := s.shard(id)
+	sh.mu.RLock()
+	locationVisits := s.locationVisits(id)
+	if locationVisits == nil {
+		sh.mu.RUnlock()
+		return ErrNotFound
+	}
+	seen := make(map[uint]struct{})
+	var candidates []uint
 	iterator := locationVisits.Iterator()
-	var sum, cnt int
 	for iterator.Next() {
-		visitedAt := iterator.Key().(int64)
+		visitedAt := iterator.Key().(visitKey).visitedAt
 		if (q.FromDate != nil && visitedAt <= *q.FromDate) ||
 			(q.ToDate != nil && visitedAt >= *q.ToDate) {
 			continue
 		}
-		visit := iterator.Value().(*Visit)
-		if q.FromAge != nil || q.ToAge != nil || q.Gender != "" {
-			user := s.users[visit.UserID]
-			fromBirth := q.FromBirth()
-			toBirth := q.ToBirth()
-			if (fromBirth != nil && user.BirthDate <= *fromBirth) ||
-				(toBirth != nil && user.BirthDate >= *toBirth) ||
-				(q.Gender != "" && q.Gender != user.Gender) {
-				continue
-			}
+		userID := iterator.Value().(*locationVisit).visit.UserID
+		if _, ok := seen[userID]; !ok {
+			seen[userID] = struct{}{}
+			candidates = append(candidates, userID)
 		}
+	}
+	sh.mu.RUnlock()
 
-		sum += visit.Mark
-		cnt++
+	results := make([]uint, 0, len(candidates))
+	for i, userID := range candidates {
+		if i%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if s.userExists(userID) {
+			results = append(results, userID)
+		}
 	}
-	s.mu.RUnlock()
+	sort.Slice(results, func(i, j int) bool { return results[i] < results[j] })
+	*users = results
+	return nil
+}
 
-	var avg float64
-	if cnt > 0 {
-		avg = float64(sum) / float64(cnt)
+func (s *MemoryStore) DeleteLocation(ctx context.Context, id uint) error {
+	if s.cascade {
+		// visits and their user indexes may be in any shard
+		s.lockAll()
+		err := s.deleteLocation(id)
+		s.unlockAll()
+		return err
 	}
-	return avg, nil
+	sh := s.shard(id)
+	sh.mu.Lock()
+	err := s.deleteLocation(id)
+	sh.mu.Unlock()
+	return err
+}
+
+func (s *MemoryStore) deleteLocation(id uint) error {
+	// called with acquired location shard lock, all shards are locked in
+	// cascade mode
+	if s.location(id) == nil {
+		return ErrNotFound
+	}
+	if err := s.deleteVisitsOf(s.locationVisits(id)); err != nil {
+		return err
+	}
+	sh, i := s.shard(id), s.index(id)
+	sh.locations[i] = nil
+	sh.visitsByLocation[i] = nil
+	sh.locationVersions[i] = 0
+	sh.counts.Locations--
+	return nil
 }
 
 // Visit methods
-func (s *MemoryStore) CreateVisit(v *Visit) error {
-	s.mu.Lock()
+func (s *MemoryStore) CreateVisit(ctx context.Context, v *Visit) error {
+	var locked []int
+	if s.upsert {
+		// existing visit may reference other user and location
+		locked = s.lockVisitShards(v.ID, v)
+	} else {
+		locked = s.lockShards(v.ID, v.UserID, v.LocationID)
+	}
 	err := s.createVisit(v)
-	s.mu.Unlock()
+	s.unlockShards(locked)
 	return err
 }
 
-func (s *MemoryStore) CreateVisits(vs []Visit) error {
-	s.mu.Lock()
-	var err error
+func (s *MemoryStore) CreateVisits(ctx context.Context, vs []Visit) error {
 	for _, v := range vs {
-		err = s.createVisit(&v)
+		if err := s.CreateVisit(ctx, &v); err != nil {
+			return err
+		}
 	}
-	s.mu.Unlock()
-	return err
+	return nil
 }
 
 func (s *MemoryStore) createVisit(v *Visit) error {
-	// called with acquired mu lock
+	// called with acquired visit, user and location shard locks, in upsert
+	// mode shards of existing visit user and location are locked as well
 	if v.ID == 0 {
 		return ErrMissingID
 	}
-	curLen := len(s.visits)
-	intID := int(v.ID)
-	if curLen <= intID {
-		newLen := curLen
-		if intID > newLen {
-			newLen = intID
-		}
-		s.visits = append(s.visits, make([]*Visit, newLen+1000)...)
+	sh, i := s.shard(v.ID), s.index(v.ID)
+	if len(sh.visits) <= i {
+		n := s.grownLen(len(sh.visits), i)
+		visits := make([]*Visit, n)
+		copy(visits, sh.visits)
+		sh.visits = visits
+		visitVersions := make([]uint64, n)
+		copy(visitVersions, sh.visitVersions)
+		sh.visitVersions = visitVersions
 	}
-	if s.visits[v.ID] != nil {
+	if sh.visits[i] != nil {
+		if s.upsert {
+			return s.updateVisit(v.ID, v)
+		}
 		return ErrDup
 	}
-	if len(s.visitsByUser) <= int(v.UserID) || s.visitsByUser[v.UserID] == nil {
+	userVisits := s.userVisits(v.UserID)
+	if userVisits == nil {
 		return ErrNotFound
 	}
-	if len(s.visitsByLocation) <= int(v.LocationID) || s.visitsByLocation[v.LocationID] == nil {
+	locationVisits := s.locationVisits(v.LocationID)
+	if locationVisits == nil {
 		return ErrNotFound
 	}
 	vCopy := *v
-	s.visits[v.ID] = &vCopy
-	s.visitsByUser[v.UserID].Put(v.VisitedAt, &vCopy)
-	s.visitsByLocation[v.LocationID].Put(v.VisitedAt, &vCopy)
+	sh.visits[i] = &vCopy
+	userVisits.Put(keyOf(&vCopy), &vCopy)
+	locationVisits.Put(keyOf(&vCopy), s.newLocationVisit(&vCopy, v.UserID))
+	s.indexCountry(&vCopy, s.location(v.LocationID).Country)
+	sh.visitVersions[i] = s.nextVersion()
+	sh.counts.Visits++
 	return nil
 }
 
-func (s *MemoryStore) UpdateVisit(id uint, v *Visit) error {
-	s.mu.Lock()
+func (s *MemoryStore) UpdateVisit(ctx context.Context, id uint, v *Visit) error {
+	if id != v.ID {
+		return ErrUpdateID
+	}
+	locked := s.lockVisitShards(id, v)
 	err := s.updateVisit(id, v)
-	s.mu.Unlock()
+	s.unlockShards(locked)
 	return err
 }
 
+// UpdateVisits locks the whole store once for all updates
+func (s *MemoryStore) UpdateVisits(ctx context.Context, vs []Visit) []error {
+	errs := make([]error, len(vs))
+	s.lockAll()
+	for i := range vs {
+		errs[i] = s.updateVisit(vs[i].ID, &vs[i])
+	}
+	s.unlockAll()
+	return errs
+}
+
 func (s *MemoryStore) updateVisit(id uint, v *Visit) error {
-	// called with acquired mu lock
+	// called with acquired visit shard lock and shard locks of both
+	// current and new visit user and location
 	if id != v.ID {
 		return ErrUpdateID
 	}
-	if len(s.visits) <= int(id) || s.visits[id] == nil {
+	cur := s.visit(id)
+	if cur == nil {
+		return ErrNotFound
+	}
+	newUserVisits := s.userVisits(v.UserID)
+	newLocationVisits := s.locationVisits(v.LocationID)
+	if newUserVisits == nil || newLocationVisits == nil {
 		return ErrNotFound
 	}
 	// update references
-	cur := s.visits[v.ID]
 	if cur.UserID != v.UserID ||
 		cur.VisitedAt != v.VisitedAt {
 		// user index changed
-		userVisits := s.visitsByUser[cur.UserID]
-		userVisits.Remove(cur.VisitedAt)
-		if cur.UserID != v.UserID {
-			userVisits = s.visitsByUser[v.UserID]
+		if userVisits := s.userVisits(cur.UserID); userVisits != nil {
+			userVisits.Remove(keyOf(cur))
 		}
-		userVisits.Put(v.VisitedAt, cur)
+		newUserVisits.Put(keyOf(v), cur)
 	}
 	if cur.LocationID != v.LocationID ||
 		cur.VisitedAt != v.VisitedAt {
 		// location index changed
-		locationVisits := s.visitsByLocation[cur.LocationID]
-		locationVisits.Remove(cur.VisitedAt)
-		if cur.LocationID != v.LocationID {
-			locationVisits = s.visitsByLocation[v.LocationID]
+		if locationVisits := s.locationVisits(cur.LocationID); locationVisits != nil {
+			locationVisits.Remove(keyOf(cur))
+		}
+		newLocationVisits.Put(keyOf(v), s.newLocationVisit(cur, v.UserID))
+	} else if cur.UserID != v.UserID {
+		// visitor changed
+		if lv, ok := newLocationVisits.Get(keyOf(cur)); ok {
+			s.stampVisitor(lv.(*locationVisit), v.UserID)
+		}
+	}
+	if cur.UserID != v.UserID || cur.LocationID != v.LocationID ||
+		cur.VisitedAt != v.VisitedAt {
+		// country index changed
+		if location := s.location(cur.LocationID); location != nil {
+			s.unindexCountry(cur, location.Country)
 		}
-		locationVisits.Put(v.VisitedAt, cur)
+		country := s.location(v.LocationID).Country
+		*cur = *v
+		s.indexCountry(cur, country)
+	} else {
+		*cur = *v
 	}
-	*s.visits[v.ID] = *v
+	s.shard(id).visitVersions[s.index(id)] = s.nextVersion()
 	return nil
 }
 
-func (s *MemoryStore) GetVisit(id uint, v *Visit) error {
-	s.mu.RLock()
-	if len(s.visits) <= int(id) || s.visits[id] == nil {
-		s.mu.RUnlock()
+func (s *MemoryStore) GetVisit(ctx context.Context, id uint, v *Visit) error {
+	sh := s.shard(id)
+	sh.mu.RLock()
+	visit := s.visit(id)
+	if visit == nil {
+		sh.mu.RUnlock()
 		return ErrNotFound
 	}
-	*v = *s.visits[id]
-	s.mu.RUnlock()
+	*v = *visit
+	sh.mu.RUnlock()
+	return nil
+}
+
+// QueryVisits scans visits index of the queried user or location. If both
+// are queried, the smaller index is scanned and filtered by the other one.
+func (s *MemoryStore) QueryVisits(ctx context.Context, q *VisitsQuery, visits *[]Visit) error {
+	id, index := q.UserID, s.userVisits
+	if q.UserID == 0 {
+		id, index = q.LocationID, s.locationVisits
+	} else if q.LocationID != 0 {
+		userSize, ok := s.visitsIndexSize(q.UserID, s.userVisits)
+		if !ok {
+			return ErrNotFound
+		}
+		locationSize, ok := s.visitsIndexSize(q.LocationID, s.locationVisits)
+		if !ok {
+			return ErrNotFound
+		}
+		if locationSize < userSize {
+			id, index = q.LocationID, s.locationVisits
+		}
+	}
+	if id == 0 {
+		return ErrMissingID
+	}
+
+	sh := s.shard(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	tree := index(id)
+	if tree == nil {
+		return ErrNotFound
+	}
+	results := []Visit{}
+	var matched int
+	iterator := tree.Iterator()
+	for n := 0; iterator.Next(); n++ {
+		if n%ctxCheckInterval == 0 && ctx.Err() != nil {
+			return ctx.Err()
+		}
+		visitedAt := iterator.Key().(visitKey).visitedAt
+		if q.FromDate != nil && visitedAt <= *q.FromDate {
+			continue
+		}
+		if q.ToDate != nil && visitedAt >= *q.ToDate {
+			break
+		}
+		visit := indexedVisit(iterator.Value())
+		if (q.UserID != 0 && visit.UserID != q.UserID) ||
+			(q.LocationID != 0 && visit.LocationID != q.LocationID) {
+			continue
+		}
+		matched++
+		if matched <= q.Offset {
+			continue
+		}
+		results = append(results, *visit)
+		if q.Limit > 0 && len(results) >= q.Limit {
+			break
+		}
+	}
+	*visits = results
+	return nil
+}
+
+// visitsIndexSize returns number of visits in the index of the given user
+// or location, false if it doesn't exist
+func (s *MemoryStore) visitsIndexSize(id uint, index func(id uint) *redblacktree.Tree) (int, bool) {
+	sh := s.shard(id)
+	sh.mu.RLock()
+	defer sh.mu.RUnlock()
+	tree := index(id)
+	if tree == nil {
+		return 0, false
+	}
+	return tree.Size(), true
+}
+
+func (s *MemoryStore) DeleteVisit(ctx context.Context, id uint) error {
+	locked := s.lockVisitShards(id, nil)
+	err := s.deleteVisit(id)
+	s.unlockShards(locked)
+	return err
+}
+
+func (s *MemoryStore) deleteVisit(id uint) error {
+	// called with acquired visit, user and location shard locks
+	cur := s.visit(id)
+	if cur == nil {
+		return ErrNotFound
+	}
+	if userVisits := s.userVisits(cur.UserID); userVisits != nil {
+		userVisits.Remove(keyOf(cur))
+	}
+	if locationVisits := s.locationVisits(cur.LocationID); locationVisits != nil {
+		locationVisits.Remove(keyOf(cur))
+	}
+	if location := s.location(cur.LocationID); location != nil {
+		s.unindexCountry(cur, location.Country)
+	}
+	sh, i := s.shard(id), s.index(id)
+	sh.visits[i] = nil
+	sh.visitVersions[i] = 0
+	sh.counts.Visits--
+	return nil
+}
+
+// deleteVisitsOf removes visits of the user or location index from all
+// indexes in cascade mode, otherwise it fails if there are any visits.
+// Called with all shards locked in cascade mode.
+func (s *MemoryStore) deleteVisitsOf(visits *redblacktree.Tree) error {
+	if visits == nil || visits.Empty() {
+		return nil
+	}
+	if !s.cascade {
+		return ErrHasVisits
+	}
+	// Values returns a copy, so the index may be modified while walking
+	for _, v := range visits.Values() {
+		if err := s.deleteVisit(indexedVisit(v).ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// lockVisitShards write locks shards of visit with the given id, its current
+// user and location and, if v is not nil, user and location referenced by v.
+func (s *MemoryStore) lockVisitShards(id uint, v *Visit) []int {
+	if v == nil {
+		v = &Visit{}
+	}
+	for {
+		var cur Visit
+		sh := s.shard(id)
+		sh.mu.RLock()
+		prev := s.visit(id)
+		if prev != nil {
+			cur = *prev
+		}
+		sh.mu.RUnlock()
+		locked := s.lockShards(id, cur.UserID, cur.LocationID, v.UserID, v.LocationID)
+		visit := s.visit(id)
+		if (visit == nil && prev == nil) || (visit != nil && prev != nil &&
+			visit.UserID == cur.UserID && visit.LocationID == cur.LocationID) {
+			return locked
+		}
+		// visit was changed while shards were not locked
+		s.unlockShards(locked)
+	}
+}
+
+// Ping always succeeds, data is in the process memory
+func (s *MemoryStore) Ping(ctx context.Context) error {
+	return nil
+}
+
+func (s *MemoryStore) Count(ctx context.Context, c *StoreCounts) error {
+	*c = StoreCounts{}
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+		c.Users += sh.counts.Users
+		c.Locations += sh.counts.Locations
+		c.Visits += sh.counts.Visits
+		sh.mu.RUnlock()
+	}
+	return nil
+}
+
+// EachUser calls f for a copy of every user until f returns false. Shards
+// are read locked one at a time while f runs, so slow f delays writers.
+func (s *MemoryStore) EachUser(ctx context.Context, f func(u *User) bool) error {
+	return s.eachShard(ctx, func(sh *memoryShard) bool {
+		for _, u := range sh.users {
+			if u == nil {
+				continue
+			}
+			user := *u
+			if !f(&user) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// EachLocation calls f for a copy of every location like EachUser
+func (s *MemoryStore) EachLocation(ctx context.Context, f func(l *Location) bool) error {
+	return s.eachShard(ctx, func(sh *memoryShard) bool {
+		for _, l := range sh.locations {
+			if l == nil {
+				continue
+			}
+			location := *l
+			if !f(&location) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// EachVisit calls f for a copy of every visit like EachUser
+func (s *MemoryStore) EachVisit(ctx context.Context, f func(v *Visit) bool) error {
+	return s.eachShard(ctx, func(sh *memoryShard) bool {
+		for _, v := range sh.visits {
+			if v == nil {
+				continue
+			}
+			visit := *v
+			if !f(&visit) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+// eachShard calls f for every shard under its read lock until f returns
+// false
+func (s *MemoryStore) eachShard(ctx context.Context, f func(sh *memoryShard) bool) error {
+	for _, sh := range s.shards {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		sh.mu.RLock()
+		more := f(sh)
+		sh.mu.RUnlock()
+		if !more {
+			break
+		}
+	}
 	return nil
 }
 
-func (s *MemoryStore) Clear() error {
-	// Memory store is empty at start
+func (s *MemoryStore) Clear(ctx context.Context) error {
+	fresh := NewMemoryStoreWithOptions(s.opts)
+	s.lockAll()
+	fresh.seq = atomic.LoadUint64(&s.seq) // versions never go back
+	s.replace(fresh)
+	s.unlockAll()
 	return nil
 }
 
-func timestampComparator(a, b interface{}) int {
-	aTimestamp := a.(int64)
-	bTimestamp := b.(int64)
-	return int(aTimestamp - bTimestamp)
+// IndexRebuilder is implemented by stores able to re-derive visit indexes
+// from the visits themselves.
+type IndexRebuilder interface {
+	// RebuildIndexes reindexes all visits and returns the number of
+	// indexed visits and of visits left out as their user or location
+	// doesn't exist
+	RebuildIndexes() (indexed, orphaned int)
+}
+
+// RebuildIndexes drops user, country and location visit indexes and fills
+// them again from visits of all shards. All shards are locked meanwhile.
+func (s *MemoryStore) RebuildIndexes() (indexed, orphaned int) {
+	s.lockAll()
+	defer s.unlockAll()
+	for _, sh := range s.shards {
+		for i, u := range sh.users {
+			sh.visitsByUser[i] = nil
+			sh.visitsByCountry[i] = nil
+			if u != nil {
+				sh.visitsByUser[i] = redblacktree.NewWith(visitKeyComparator)
+			}
+		}
+		for i, l := range sh.locations {
+			sh.visitsByLocation[i] = nil
+			if l != nil {
+				sh.visitsByLocation[i] = redblacktree.NewWith(visitKeyComparator)
+			}
+		}
+	}
+	for _, sh := range s.shards {
+		for _, v := range sh.visits {
+			if v == nil {
+				continue
+			}
+			userVisits := s.userVisits(v.UserID)
+			locationVisits := s.locationVisits(v.LocationID)
+			if userVisits == nil || locationVisits == nil {
+				orphaned++
+				continue
+			}
+			userVisits.Put(keyOf(v), v)
+			locationVisits.Put(keyOf(v), s.newLocationVisit(v, v.UserID))
+			s.indexCountry(v, s.location(v.LocationID).Country)
+			indexed++
+		}
+	}
+	return indexed, orphaned
+}
+
+func (s *MemoryStore) replace(from *MemoryStore) {
+	// called with all shards locked, from must have the same number of shards
+	for i, sh := range s.shards {
+		fsh := from.shards[i]
+		sh.users = fsh.users
+		sh.locations = fsh.locations
+		sh.visits = fsh.visits
+		sh.visitsByUser = fsh.visitsByUser
+		sh.visitsByCountry = fsh.visitsByCountry
+		sh.visitsByLocation = fsh.visitsByLocation
+		sh.userVersions = fsh.userVersions
+		sh.locationVersions = fsh.locationVersions
+		sh.visitVersions = fsh.visitVersions
+		sh.counts = fsh.counts
+	}
+	s.emailsMu.Lock()
+	s.emails = from.emails
+	s.emailsMu.Unlock()
+	atomic.StoreUint64(&s.seq, atomic.LoadUint64(&from.seq))
+}
+
+// shard returns shard owning entity with the given id
+func (s *MemoryStore) shard(id uint) *memoryShard {
+	return s.shards[id%uint(len(s.shards))]
+}
+
+// index returns position of entity with the given id within its shard
+func (s *MemoryStore) index(id uint) int {
+	return int(id / uint(len(s.shards)))
+}
+
+// grownLen returns new length of a shard slice of length n to fit index i
+func (s *MemoryStore) grownLen(n, i int) int {
+	grown := int(float64(n) * s.opts.Growth)
+	if grown <= i {
+		grown = i + 1
+	}
+	return grown
+}
+
+// Entity accessors return nil if entity does not exist.
+// They must be called with acquired lock of the entity shard.
+func (s *MemoryStore) user(id uint) *User {
+	sh, i := s.shard(id), s.index(id)
+	if i >= len(sh.users) {
+		return nil
+	}
+	return sh.users[i]
+}
+
+func (s *MemoryStore) userVisits(id uint) *redblacktree.Tree {
+	sh, i := s.shard(id), s.index(id)
+	if i >= len(sh.visitsByUser) {
+		return nil
+	}
+	return sh.visitsByUser[i]
+}
+
+// countryVisits returns index of user visits to locations of the country
+func (s *MemoryStore) countryVisits(id uint, country string) *redblacktree.Tree {
+	sh, i := s.shard(id), s.index(id)
+	if i >= len(sh.visitsByCountry) {
+		return nil
+	}
+	return sh.visitsByCountry[i][country]
+}
+
+// indexCountry adds visit to country index of its user. It must be called
+// with acquired lock of the user shard.
+func (s *MemoryStore) indexCountry(v *Visit, country string) {
+	sh, i := s.shard(v.UserID), s.index(v.UserID)
+	if i >= len(sh.visitsByCountry) || sh.users[i] == nil {
+		return
+	}
+	byCountry := sh.visitsByCountry[i]
+	if byCountry == nil {
+		byCountry = make(map[string]*redblacktree.Tree)
+		sh.visitsByCountry[i] = byCountry
+	}
+	visits := byCountry[country]
+	if visits == nil {
+		visits = redblacktree.NewWith(visitKeyComparator)
+		byCountry[country] = visits
+	}
+	visits.Put(keyOf(v), v)
+}
+
+// unindexCountry removes visit from country index of its user, empty
+// indexes are dropped. It must be called with acquired lock of the user
+// shard.
+func (s *MemoryStore) unindexCountry(v *Visit, country string) {
+	visits := s.countryVisits(v.UserID, country)
+	if visits == nil {
+		return
+	}
+	visits.Remove(keyOf(v))
+	if visits.Empty() {
+		delete(s.shard(v.UserID).visitsByCountry[s.index(v.UserID)], country)
+	}
+}
+
+func (s *MemoryStore) location(id uint) *Location {
+	sh, i := s.shard(id), s.index(id)
+	if i >= len(sh.locations) {
+		return nil
+	}
+	return sh.locations[i]
+}
+
+func (s *MemoryStore) locationVisits(id uint) *redblacktree.Tree {
+	sh, i := s.shard(id), s.index(id)
+	if i >= len(sh.visitsByLocation) {
+		return nil
+	}
+	return sh.visitsByLocation[i]
+}
+
+func (s *MemoryStore) visit(id uint) *Visit {
+	sh, i := s.shard(id), s.index(id)
+	if i >= len(sh.visits) {
+		return nil
+	}
+	return sh.visits[i]
+}
+
+// lockShards write locks shards owning given ids in ascending shard order
+// and returns their numbers for unlockShards.
+func (s *MemoryStore) lockShards(ids ...uint) []int {
+	locked := make([]int, 0, len(ids))
+	for _, id := range ids {
+		n := int(id % uint(len(s.shards)))
+		dup := false
+		for _, l := range locked {
+			if l == n {
+				dup = true
+				break
+			}
+		}
+		if !dup {
+			locked = append(locked, n)
+		}
+	}
+	sort.Ints(locked)
+	for _, n := range locked {
+		s.shards[n].mu.Lock()
+	}
+	return locked
+}
+
+func (s *MemoryStore) unlockShards(locked []int) {
+	for i := len(locked) - 1; i >= 0; i-- {
+		s.shards[locked[i]].mu.Unlock()
+	}
+}
+
+func (s *MemoryStore) lockAll() {
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+	}
+}
+
+func (s *MemoryStore) unlockAll() {
+	for i := len(s.shards) - 1; i >= 0; i-- {
+		s.shards[i].mu.Unlock()
+	}
+}
+
+func (s *MemoryStore) rlockAll() {
+	for _, sh := range s.shards {
+		sh.mu.RLock()
+	}
+}
+
+func (s *MemoryStore) runlockAll() {
+	for i := len(s.shards) - 1; i >= 0; i-- {
+		s.shards[i].mu.RUnlock()
+	}
+}
+
+// visitKey orders visits in indexes by visit time. Visit id distinguishes
+// visits made at the same time, so they don't overwrite each other.
+type visitKey struct {
+	visitedAt int64
+	id        uint
+}
+
+// locationVisit is location visits index value: the visit stamped with
+// gender and birth date of its user
+type locationVisit struct {
+	visit     *Visit
+	gender    string
+	birthDate int64
+}
+
+// newLocationVisit returns v stamped with the user with the given id, it
+// is called with the user shard lock acquired
+func (s *MemoryStore) newLocationVisit(v *Visit, userID uint) *locationVisit {
+	lv := &locationVisit{visit: v}
+	s.stampVisitor(lv, userID)
+	return lv
+}
+
+// stampVisitor copies gender and birth date of the user with the given id
+// into lv, it is called with the user and lv location shard locks acquired
+func (s *MemoryStore) stampVisitor(lv *locationVisit, userID uint) {
+	if u := s.user(userID); u != nil {
+		lv.gender, lv.birthDate = u.Gender, u.BirthDate
+	}
+}
+
+// indexedVisit returns visit of user or location visits index value
+func indexedVisit(value interface{}) *Visit {
+	if lv, ok := value.(*locationVisit); ok {
+		return lv.visit
+	}
+	return value.(*Visit)
+}
+
+func keyOf(v *Visit) visitKey {
+	return visitKey{v.VisitedAt, v.ID}
+}
+
+func visitKeyComparator(a, b interface{}) int {
+	aKey := a.(visitKey)
+	bKey := b.(visitKey)
+	switch {
+	case aKey.visitedAt < bKey.visitedAt:
+		return -1
+	case aKey.visitedAt > bKey.visitedAt:
+		return 1
+	case aKey.id < bKey.id:
+		return -1
+	case aKey.id > bKey.id:
+		return 1
+	}
+	return 0
 }
@@ -1,16 +1,27 @@
 package main
 
-import "testing"
-import "github.com/stretchr/testify/assert"
+import (
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
 
 func TestUsers(t *testing.T) {
+	ctx := context.Background()
 	s := NewMemoryStore()
 	u1 := User{ID: 1, Email: "foo@bar.com"}
 
 	// test create
-	err := s.CreateUser(&u1)
+	err := s.CreateUser(ctx, &u1)
 	assert.NoError(t, err)
-	err = s.CreateUsers([]User{
+	err = s.CreateUsers(ctx, []User{
 		User{ID: 2, Email: "user2@hlcup.com", FirstName: "User2"},
 		User{ID: 3, Email: "user3@hlcup.com", FirstName: "User3"},
 		User{ID: 4, Email: "user4@hlcup.com", FirstName: "User4"},
@@ -20,19 +31,61 @@ func TestUsers(t *testing.T) {
 
 	// test get
 	var u User
-	err = s.GetUser(1, &u)
+	err = s.GetUser(ctx, 1, &u)
 	assert.NoError(t, err)
 	assert.Equal(t, &u1, &u)
 
 	// test update
 	u.Email = "updated@user.com"
-	err = s.UpdateUser(1, &u)
+	err = s.UpdateUser(ctx, 1, &u)
 	assert.NoError(t, err)
-	err = s.GetUser(1, &u)
+	err = s.GetUser(ctx, 1, &u)
 	assert.NoError(t, err)
 	assert.Equal(t, "updated@user.com", u.Email)
 }
 
+func TestEmptyEmails(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+
+	// import path doesn't validate users, so emails may be missing
+	assert.NoError(t, s.CreateUsers(ctx, []User{
+		{ID: 1, FirstName: "User1"},
+		{ID: 2, FirstName: "User2"},
+	}))
+	var u User
+	assert.NoError(t, s.GetUser(ctx, 2, &u))
+	assert.Equal(t, User{ID: 2, FirstName: "User2"}, u)
+
+	// emptying and setting emails on update
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 3, Email: "user3@hlcup.com"}))
+	assert.NoError(t, s.UpdateUser(ctx, 3, &User{ID: 3}))
+	assert.NoError(t, s.UpdateUser(ctx, 1, &User{ID: 1, Email: "user3@hlcup.com"}))
+	assert.Equal(t, ErrDup, s.UpdateUser(ctx, 2, &User{ID: 2, Email: "user3@hlcup.com"}))
+	assert.NoError(t, s.DeleteUser(ctx, 3))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 4}))
+}
+
+func TestGetUsers(t *testing.T) {
+	ctx := context.Background()
+	s := NewShardedMemoryStore(4)
+	assert.NoError(t, s.CreateUsers(ctx, []User{
+		{ID: 1, Email: "user1@hlcup.com"},
+		{ID: 2, Email: "user2@hlcup.com"},
+		{ID: 7, Email: "user7@hlcup.com"},
+	}))
+
+	var users []User
+	assert.NoError(t, s.GetUsers(ctx, []uint{7, 3, 1, 7}, &users))
+	assert.Equal(t, []User{
+		{ID: 7, Email: "user7@hlcup.com"},
+		{ID: 1, Email: "user1@hlcup.com"},
+		{ID: 7, Email: "user7@hlcup.com"},
+	}, users)
+	assert.NoError(t, s.GetUsers(ctx, []uint{3}, &users))
+	assert.Equal(t, []User{}, users)
+}
+
 func TestLocations(t *testing.T) {
 
 }
@@ -42,6 +95,7 @@ func TestVisits(t *testing.T) {
 }
 
 func TestUpdateVisit(t *testing.T) {
+	ctx := context.Background()
 	u1 := User{ID: 1, FirstName: "User1", Email: "foo@bar.com"}
 	u2 := User{ID: 2, FirstName: "User2", Email: "foo@baz.com"}
 
@@ -49,23 +103,1247 @@ func TestUpdateVisit(t *testing.T) {
 	l2 := Location{ID: 2, Place: "Place2"}
 	l3 := Location{ID: 3, Place: "Place3"}
 
-	v1 := Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: &[]int64{100}[0], Mark: &[]int{2}[0]}
-	v2 := Visit{ID: 2, UserID: 2, LocationID: 2, VisitedAt: &[]int64{200}[0], Mark: &[]int{3}[0]}
-	v3 := Visit{ID: 3, UserID: 1, LocationID: 3, VisitedAt: &[]int64{300}[0], Mark: &[]int{4}[0]}
+	v1 := Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 2}
+	v2 := Visit{ID: 2, UserID: 2, LocationID: 2, VisitedAt: 200, Mark: 3}
+	v3 := Visit{ID: 3, UserID: 1, LocationID: 3, VisitedAt: 300, Mark: 4}
 
 	s := NewMemoryStore()
-	assert.NoError(t, s.CreateUser(&u1))
-	assert.NoError(t, s.CreateUser(&u2))
-	assert.NoError(t, s.CreateLocation(&l1))
-	assert.NoError(t, s.CreateLocation(&l2))
-	assert.NoError(t, s.CreateLocation(&l3))
-	assert.NoError(t, s.CreateVisit(&v1))
-	assert.NoError(t, s.CreateVisit(&v2))
-	assert.NoError(t, s.CreateVisit(&v3))
+	assert.NoError(t, s.CreateUser(ctx, &u1))
+	assert.NoError(t, s.CreateUser(ctx, &u2))
+	assert.NoError(t, s.CreateLocation(ctx, &l1))
+	assert.NoError(t, s.CreateLocation(ctx, &l2))
+	assert.NoError(t, s.CreateLocation(ctx, &l3))
+	assert.NoError(t, s.CreateVisit(ctx, &v1))
+	assert.NoError(t, s.CreateVisit(ctx, &v2))
+	assert.NoError(t, s.CreateVisit(ctx, &v3))
 
-	v3u := Visit{ID: 3, UserID: 2, LocationID: 3, VisitedAt: &[]int64{300}[0], Mark: &[]int{2}[0]}
-	assert.NoError(t, s.UpdateVisit(3, &v3u))
+	v3u := Visit{ID: 3, UserID: 2, LocationID: 3, VisitedAt: 300, Mark: 2}
+	assert.NoError(t, s.UpdateVisit(ctx, 3, &v3u))
 
-	v2u := Visit{ID: 2, UserID: 2, LocationID: 1, VisitedAt: &[]int64{150}[0], Mark: &[]int{2}[0]}
+	v2u := Visit{ID: 2, UserID: 2, LocationID: 1, VisitedAt: 150, Mark: 2}
 	assert.NoError(t, s.updateVisit(2, &v2u))
 }
+
+func TestUpdateVisits(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+	assert.NoError(t, s.CreateVisits(ctx, []Visit{
+		{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 1},
+		{ID: 2, UserID: 1, LocationID: 1, VisitedAt: 200, Mark: 2},
+	}))
+
+	errs := s.UpdateVisits(ctx, []Visit{
+		{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 5},
+		{ID: 3, UserID: 1, LocationID: 1, VisitedAt: 300, Mark: 3},
+		{ID: 2, UserID: 1, LocationID: 2, VisitedAt: 200, Mark: 4},
+	})
+	assert.Equal(t, []error{nil, ErrNotFound, ErrNotFound}, errs)
+
+	var v Visit
+	assert.NoError(t, s.GetVisit(ctx, 1, &v))
+	assert.Equal(t, 5, v.Mark)
+	assert.NoError(t, s.GetVisit(ctx, 2, &v))
+	assert.Equal(t, 2, v.Mark)
+	avg, _, err := s.GetLocationAvg(ctx, 1, &LocationAvgQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3.5, avg)
+}
+
+func TestDelete(t *testing.T) {
+	ctx := context.Background()
+	u1 := User{ID: 1, FirstName: "User1", Email: "foo@bar.com"}
+	l1 := Location{ID: 1, Place: "Place1"}
+	v1 := Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 2}
+	v2 := Visit{ID: 2, UserID: 1, LocationID: 1, VisitedAt: 200, Mark: 4}
+
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUser(ctx, &u1))
+	assert.NoError(t, s.CreateLocation(ctx, &l1))
+	assert.NoError(t, s.CreateVisit(ctx, &v1))
+	assert.NoError(t, s.CreateVisit(ctx, &v2))
+
+	// delete visit removes it from both indexes
+	assert.NoError(t, s.DeleteVisit(ctx, 1))
+	assert.Equal(t, ErrNotFound, s.DeleteVisit(ctx, 1))
+	assert.Equal(t, ErrNotFound, s.GetVisit(ctx, 1, &Visit{}))
+	var visits []UserVisit
+	_, err := s.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, []UserVisit{{Mark: 4, VisitedAt: 200, Place: "Place1"}}, visits)
+	avg, _, err := s.GetLocationAvg(ctx, 1, &LocationAvgQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 4.0, avg)
+
+	// referenced user and location are kept
+	assert.Equal(t, ErrHasVisits, s.DeleteUser(ctx, 1))
+	assert.Equal(t, ErrHasVisits, s.DeleteLocation(ctx, 1))
+	assert.NoError(t, s.GetUser(ctx, 1, &User{}))
+	assert.NoError(t, s.GetLocation(ctx, 1, &Location{}))
+	assert.NoError(t, s.DeleteVisit(ctx, 2))
+
+	// delete user frees email
+	assert.NoError(t, s.DeleteUser(ctx, 1))
+	assert.Equal(t, ErrNotFound, s.DeleteUser(ctx, 1))
+	assert.Equal(t, ErrNotFound, s.GetUser(ctx, 1, &User{}))
+	_, err = s.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.Equal(t, ErrNotFound, err)
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 2, Email: "foo@bar.com"}))
+
+	// delete location
+	assert.NoError(t, s.DeleteLocation(ctx, 1))
+	assert.Equal(t, ErrNotFound, s.DeleteLocation(ctx, 1))
+	assert.Equal(t, ErrNotFound, s.GetLocation(ctx, 1, &Location{}))
+	_, _, err = s.GetLocationAvg(ctx, 1, &LocationAvgQuery{})
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestCascadeDelete(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStoreWithOptions(MemoryStoreOptions{Shards: 3})
+	s.SetCascade(true)
+	for id := uint(1); id <= 2; id++ {
+		assert.NoError(t, s.CreateUser(ctx, &User{ID: id, Email: fmt.Sprintf("u%d@hlcup.com", id)}))
+		assert.NoError(t, s.CreateLocation(ctx, &Location{ID: id, Place: fmt.Sprintf("Place%d", id)}))
+	}
+	assert.NoError(t, s.CreateVisits(ctx, []Visit{
+		{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 1},
+		{ID: 2, UserID: 1, LocationID: 2, VisitedAt: 200, Mark: 2},
+		{ID: 3, UserID: 2, LocationID: 1, VisitedAt: 300, Mark: 3},
+		{ID: 4, UserID: 2, LocationID: 2, VisitedAt: 400, Mark: 4},
+	}))
+
+	// user visits are removed from location indexes too
+	assert.NoError(t, s.DeleteUser(ctx, 1))
+	assert.Equal(t, ErrNotFound, s.GetVisit(ctx, 1, &Visit{}))
+	assert.Equal(t, ErrNotFound, s.GetVisit(ctx, 2, &Visit{}))
+	avg, _, err := s.GetLocationAvg(ctx, 1, &LocationAvgQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3.0, avg)
+	var users []uint
+	assert.NoError(t, s.GetLocationVisitors(ctx, 2, &LocationVisitorsQuery{}, &users))
+	assert.Equal(t, []uint{2}, users)
+
+	// location visits are removed from user indexes too
+	assert.NoError(t, s.DeleteLocation(ctx, 2))
+	assert.Equal(t, ErrNotFound, s.GetVisit(ctx, 4, &Visit{}))
+	var visits []UserVisit
+	total, err := s.GetUserVisits(ctx, 2, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, []UserVisit{{Mark: 3, VisitedAt: 300, Place: "Place1"}}, visits)
+
+	var c StoreCounts
+	assert.NoError(t, s.Count(ctx, &c))
+	assert.Equal(t, StoreCounts{Users: 1, Locations: 1, Visits: 1}, c)
+	assert.Equal(t, ErrNotFound, s.DeleteUser(ctx, 1))
+	assert.Equal(t, ErrNotFound, s.DeleteLocation(ctx, 2))
+}
+
+func TestCreateVisitsError(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "foo@bar.com"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+
+	err := s.CreateVisits(ctx, []Visit{
+		{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 2},
+		{ID: 2, UserID: 1, LocationID: 2, VisitedAt: 200, Mark: 3}, // unknown location
+		{ID: 3, UserID: 1, LocationID: 1, VisitedAt: 300, Mark: 4},
+	})
+	assert.Equal(t, ErrNotFound, err)
+
+	// visits before the invalid one are kept, import stops at the first error
+	assert.NoError(t, s.GetVisit(ctx, 1, &Visit{}))
+	assert.Equal(t, ErrNotFound, s.GetVisit(ctx, 2, &Visit{}))
+	assert.Equal(t, ErrNotFound, s.GetVisit(ctx, 3, &Visit{}))
+}
+
+func TestLocationAvgAge(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	birth := func(years, days int) int64 {
+		return now.AddDate(-years, 0, days).Unix()
+	}
+	users := []User{
+		{ID: 1, Email: "u1@hlcup.com", Gender: "m", BirthDate: birth(30, 1)},  // just under 30
+		{ID: 2, Email: "u2@hlcup.com", Gender: "m", BirthDate: birth(30, -1)}, // just over 30
+		{ID: 3, Email: "u3@hlcup.com", Gender: "f", BirthDate: birth(40, 1)},  // just under 40
+		{ID: 4, Email: "u4@hlcup.com", Gender: "m", BirthDate: birth(40, -1)}, // just over 40
+	}
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUsers(ctx, users))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+	for i, u := range users {
+		assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: u.ID, UserID: u.ID, LocationID: 1, VisitedAt: int64(i + 1), Mark: int(u.ID)}))
+	}
+
+	age := func(a int) *int { return &a }
+	tt := []struct {
+		name  string
+		query LocationAvgQuery
+		avg   float64
+	}{
+		{"All", LocationAvgQuery{}, 2.5},
+		{"FromAge", LocationAvgQuery{FromAge: age(30)}, 3},
+		{"ToAge", LocationAvgQuery{ToAge: age(40)}, 2},
+		{"FromAgeToAge", LocationAvgQuery{FromAge: age(30), ToAge: age(40)}, 2.5},
+		{"FromAgeToAgeGender", LocationAvgQuery{FromAge: age(30), ToAge: age(40), Gender: "m"}, 2},
+		{"Empty", LocationAvgQuery{FromAge: age(40), ToAge: age(30)}, 0},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			avg, _, err := s.GetLocationAvg(ctx, 1, &tc.query)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.avg, avg)
+		})
+	}
+}
+
+func TestConcurrentCreateUsers(t *testing.T) {
+	ctx := context.Background()
+	const (
+		workers   = 8
+		perWorker = 5000
+	)
+	s := NewMemoryStore()
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			users := make([]User, perWorker)
+			for i := range users {
+				// interleave ids across workers to force concurrent slice growth
+				id := uint(i*workers + w + 1)
+				users[i] = User{ID: id, Email: fmt.Sprintf("user%d@hlcup.com", id)}
+			}
+			assert.NoError(t, s.CreateUsers(ctx, users))
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Len(t, s.emails, workers*perWorker)
+	for id := uint(1); id <= workers*perWorker; id++ {
+		var u User
+		if assert.NoError(t, s.GetUser(ctx, id, &u)) {
+			assert.Equal(t, fmt.Sprintf("user%d@hlcup.com", id), u.Email)
+			assert.Equal(t, id, s.emails[u.Email])
+		}
+	}
+}
+
+// TestConcurrentEmails is meant to be run with the race detector. Users of
+// every shard are created, renamed and read concurrently while all workers
+// compete for the same email.
+func TestConcurrentEmails(t *testing.T) {
+	ctx := context.Background()
+	const (
+		workers   = 8
+		perWorker = 200
+	)
+	s := NewShardedMemoryStore(4)
+	var wg sync.WaitGroup
+	var taken uint32
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			users := make([]User, perWorker)
+			for i := range users {
+				id := uint(i*workers + w + 1)
+				users[i] = User{ID: id, Email: fmt.Sprintf("user%d@hlcup.com", id)}
+			}
+			assert.NoError(t, s.CreateUsers(ctx, users))
+			for i := range users {
+				u := users[i]
+				u.Email = fmt.Sprintf("new%d@hlcup.com", u.ID)
+				assert.NoError(t, s.UpdateUser(ctx, u.ID, &u))
+				var got User
+				assert.NoError(t, s.GetUser(ctx, users[(i+1)%perWorker].ID, &got))
+			}
+			u := users[0]
+			u.Email = "shared@hlcup.com"
+			if err := s.UpdateUser(ctx, u.ID, &u); err == nil {
+				atomic.AddUint32(&taken, 1)
+			} else {
+				assert.Equal(t, ErrDup, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	assert.Equal(t, uint32(1), taken)
+	assert.Len(t, s.emails, workers*perWorker)
+	for id := uint(1); id <= workers*perWorker; id++ {
+		var u User
+		if assert.NoError(t, s.GetUser(ctx, id, &u)) {
+			assert.Equal(t, id, s.emails[u.Email])
+		}
+	}
+}
+
+func TestUserVisitsDistance(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com"}))
+	for i, d := range []int{5, 10, 15, 20, 25} {
+		id := uint(i + 1)
+		assert.NoError(t, s.CreateLocation(ctx, &Location{ID: id, Place: fmt.Sprintf("Place%d", d), Distance: d}))
+		assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: id, UserID: 1, LocationID: id, VisitedAt: int64(id)}))
+	}
+
+	dist := func(d int) *int { return &d }
+	tt := []struct {
+		name   string
+		query  UserVisitsQuery
+		places []string
+	}{
+		{"FromDistance", UserVisitsQuery{FromDistance: dist(15)}, []string{"Place20", "Place25"}},
+		{"ToDistance", UserVisitsQuery{ToDistance: dist(15)}, []string{"Place5", "Place10"}},
+		{"Range", UserVisitsQuery{FromDistance: dist(5), ToDistance: dist(25)}, []string{"Place10", "Place15", "Place20"}},
+		{"EmptyRange", UserVisitsQuery{FromDistance: dist(10), ToDistance: dist(15)}, nil},
+		{"Exact", UserVisitsQuery{Distance: dist(20)}, []string{"Place20"}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var visits []UserVisit
+			_, err := s.GetUserVisits(ctx, 1, &tc.query, &visits)
+			assert.NoError(t, err)
+			var places []string
+			for _, v := range visits {
+				places = append(places, v.Place)
+			}
+			assert.Equal(t, tc.places, places)
+		})
+	}
+}
+
+func TestUserVisitsCountry(t *testing.T) {
+	ctx := context.Background()
+	s := NewShardedMemoryStore(3)
+	for id := uint(1); id <= 2; id++ {
+		assert.NoError(t, s.CreateUser(ctx, &User{ID: id, Email: fmt.Sprintf("u%d@hlcup.com", id)}))
+	}
+	assert.NoError(t, s.CreateLocations(ctx, []Location{
+		{ID: 1, Place: "Moscow", Country: "Russia"},
+		{ID: 2, Place: "Paris", Country: "France"},
+		{ID: 3, Place: "Kazan", Country: "Russia"},
+	}))
+	assert.NoError(t, s.CreateVisits(ctx, []Visit{
+		{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 10},
+		{ID: 2, UserID: 1, LocationID: 2, VisitedAt: 20},
+		{ID: 3, UserID: 1, LocationID: 3, VisitedAt: 30},
+		{ID: 4, UserID: 2, LocationID: 1, VisitedAt: 40},
+	}))
+	places := func(user uint, country string) []string {
+		var visits []UserVisit
+		total, err := s.GetUserVisits(ctx, user, &UserVisitsQuery{Country: country}, &visits)
+		assert.NoError(t, err)
+		assert.Len(t, visits, total)
+		result := []string{}
+		for _, v := range visits {
+			result = append(result, v.Place)
+		}
+		return result
+	}
+	assert.Equal(t, []string{"Moscow", "Kazan"}, places(1, "Russia"))
+	assert.Equal(t, []string{"Paris"}, places(1, "France"))
+	assert.Equal(t, []string{}, places(1, "Spain"))
+	assert.Equal(t, []string{"Moscow"}, places(2, "Russia"))
+
+	// visit moved to another time, location and user
+	assert.NoError(t, s.UpdateVisit(ctx, 3, &Visit{ID: 3, UserID: 1, LocationID: 3, VisitedAt: 5}))
+	assert.Equal(t, []string{"Kazan", "Moscow"}, places(1, "Russia"))
+	assert.NoError(t, s.UpdateVisit(ctx, 3, &Visit{ID: 3, UserID: 1, LocationID: 2, VisitedAt: 5}))
+	assert.Equal(t, []string{"Moscow"}, places(1, "Russia"))
+	assert.Equal(t, []string{"Paris", "Paris"}, places(1, "France"))
+	assert.NoError(t, s.UpdateVisit(ctx, 3, &Visit{ID: 3, UserID: 2, LocationID: 2, VisitedAt: 5}))
+	assert.Equal(t, []string{"Paris"}, places(1, "France"))
+	assert.Equal(t, []string{"Paris"}, places(2, "France"))
+
+	// location moved to another country with its visits
+	assert.NoError(t, s.UpdateLocation(ctx, 2, &Location{ID: 2, Place: "Paris", Country: "Russia"}))
+	assert.Equal(t, []string{}, places(1, "France"))
+	assert.Equal(t, []string{"Moscow", "Paris"}, places(1, "Russia"))
+	assert.Equal(t, []string{"Paris", "Moscow"}, places(2, "Russia"))
+
+	// deleted visits leave the index
+	assert.NoError(t, s.DeleteVisit(ctx, 1))
+	assert.Equal(t, []string{"Paris"}, places(1, "Russia"))
+	s.SetCascade(true)
+	assert.NoError(t, s.DeleteLocation(ctx, 2))
+	assert.Equal(t, []string{}, places(1, "Russia"))
+	assert.Equal(t, []string{"Moscow"}, places(2, "Russia"))
+
+	// upserted location changes country as well
+	s.SetUpsert(true)
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Moscow", Country: "USSR"}))
+	assert.Equal(t, []string{}, places(2, "Russia"))
+	assert.Equal(t, []string{"Moscow"}, places(2, "USSR"))
+}
+
+func TestUserVisitsPaging(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Country: "Russia", Place: "Near"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 2, Country: "France", Place: "Far"}))
+	for i := 1; i <= 5; i++ {
+		assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: uint(i), UserID: 1, LocationID: uint(i%2 + 1), VisitedAt: int64(i), Mark: i}))
+	}
+
+	tt := []struct {
+		name  string
+		query UserVisitsQuery
+		marks []int
+		total int
+	}{
+		{"All", UserVisitsQuery{}, []int{1, 2, 3, 4, 5}, 5},
+		{"FirstPage", UserVisitsQuery{Limit: 2, WithTotal: true}, []int{1, 2}, 5},
+		{"SecondPage", UserVisitsQuery{Offset: 2, Limit: 2, WithTotal: true}, []int{3, 4}, 5},
+		{"LastPage", UserVisitsQuery{Offset: 4, Limit: 2, WithTotal: true}, []int{5}, 5},
+		{"BeyondEnd", UserVisitsQuery{Offset: 10, Limit: 2, WithTotal: true}, nil, 5},
+		{"Filtered", UserVisitsQuery{Country: "Russia", Offset: 1, Limit: 1, WithTotal: true}, []int{4}, 2},
+		{"Desc", UserVisitsQuery{Desc: true}, []int{5, 4, 3, 2, 1}, 5},
+		{"DescPage", UserVisitsQuery{Desc: true, Offset: 1, Limit: 2, WithTotal: true}, []int{4, 3}, 5},
+		{"DescFiltered", UserVisitsQuery{Desc: true, Country: "Russia"}, []int{4, 2}, 2},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var visits []UserVisit
+			total, err := s.GetUserVisits(ctx, 1, &tc.query, &visits)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.total, total)
+			var marks []int
+			for _, v := range visits {
+				marks = append(marks, v.Mark)
+			}
+			assert.Equal(t, tc.marks, marks)
+
+			// the page is the same when total is not requested
+			if tc.query.WithTotal {
+				q := tc.query
+				q.WithTotal = false
+				var page []UserVisit
+				_, err := s.GetUserVisits(ctx, 1, &q, &page)
+				assert.NoError(t, err)
+				assert.Equal(t, visits, page)
+			}
+		})
+	}
+}
+
+func TestSameTimestampVisits(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 2, Place: "Place2"}))
+	assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 1}))
+	assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: 2, UserID: 1, LocationID: 2, VisitedAt: 100, Mark: 2}))
+	assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: 3, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 3}))
+
+	var visits []UserVisit
+	_, err := s.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, []UserVisit{
+		{Mark: 1, VisitedAt: 100, Place: "Place1"},
+		{Mark: 2, VisitedAt: 100, Place: "Place2"},
+		{Mark: 3, VisitedAt: 100, Place: "Place1"},
+	}, visits)
+	avg, _, err := s.GetLocationAvg(ctx, 1, &LocationAvgQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2.0, avg)
+
+	// moving one of colliding visits keeps the other one indexed
+	assert.NoError(t, s.UpdateVisit(ctx, 3, &Visit{ID: 3, UserID: 1, LocationID: 2, VisitedAt: 100, Mark: 3}))
+	avg, _, err = s.GetLocationAvg(ctx, 1, &LocationAvgQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, avg)
+	avg, _, err = s.GetLocationAvg(ctx, 2, &LocationAvgQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2.5, avg)
+
+	assert.NoError(t, s.DeleteVisit(ctx, 1))
+	_, err = s.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	assert.Len(t, visits, 2)
+}
+
+func TestVisitKeyComparator(t *testing.T) {
+	// differences don't fit into 32 bits, and some into 64 bits either
+	tt := []struct {
+		a, b     visitKey
+		expected int
+	}{
+		{visitKey{1 << 32, 1}, visitKey{0, 2}, 1},
+		{visitKey{0, 2}, visitKey{1 << 32, 1}, -1},
+		{visitKey{-1 << 40, 1}, visitKey{1 << 40, 1}, -1},
+		{visitKey{math.MaxInt64, 1}, visitKey{math.MinInt64, 1}, 1},
+		{visitKey{math.MinInt64, 1}, visitKey{math.MaxInt64, 1}, -1},
+		{visitKey{5, 1 << 33}, visitKey{5, 1}, 1},
+		{visitKey{5, 1}, visitKey{5, 1}, 0},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.expected, visitKeyComparator(tc.a, tc.b), "%v vs %v", tc.a, tc.b)
+	}
+
+	ctx := context.Background()
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+	timestamps := []int64{1 << 40, math.MinInt64, 0, -1 << 33, math.MaxInt64, 1 << 31}
+	for i, ts := range timestamps {
+		assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: uint(i + 1), UserID: 1, LocationID: 1, VisitedAt: ts}))
+	}
+	var visits []UserVisit
+	_, err := s.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	var got []int64
+	for _, v := range visits {
+		got = append(got, v.VisitedAt)
+	}
+	assert.Equal(t, []int64{math.MinInt64, -1 << 33, 0, 1 << 31, 1 << 40, math.MaxInt64}, got)
+
+	// index lookups find far apart keys
+	assert.NoError(t, s.DeleteVisit(ctx, 2))
+	assert.NoError(t, s.DeleteVisit(ctx, 5))
+	total, err := s.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, 4, total)
+	assert.Equal(t, int64(-1<<33), visits[0].VisitedAt)
+	assert.Equal(t, int64(1<<40), visits[3].VisitedAt)
+}
+
+func TestLocationAvgMarks(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+	for mark := 0; mark <= 5; mark++ {
+		id := uint(mark + 1)
+		assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: id, UserID: 1, LocationID: 1, VisitedAt: int64(id), Mark: mark}))
+	}
+
+	mark := func(m int) *int { return &m }
+	tt := []struct {
+		name  string
+		query LocationAvgQuery
+		avg   float64
+	}{
+		{"All", LocationAvgQuery{}, 2.5},
+		{"FromMark", LocationAvgQuery{FromMark: mark(3)}, 4.5},
+		{"FromMarkLowest", LocationAvgQuery{FromMark: mark(0)}, 3},
+		{"ToMark", LocationAvgQuery{ToMark: mark(2)}, 0.5},
+		{"ToMarkHighest", LocationAvgQuery{ToMark: mark(5)}, 2},
+		{"FromMarkToMark", LocationAvgQuery{FromMark: mark(1), ToMark: mark(4)}, 2.5},
+		{"Empty", LocationAvgQuery{FromMark: mark(2), ToMark: mark(3)}, 0},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			avg, _, err := s.GetLocationAvg(ctx, 1, &tc.query)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.avg, avg)
+		})
+	}
+}
+
+func TestLocationAvgByAge(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	born := func(age int) int64 { return time.Now().AddDate(-age, 0, -1).Unix() }
+	assert.NoError(t, s.CreateUsers(ctx, []User{
+		{ID: 1, Email: "u1@hlcup.com", Gender: "m", BirthDate: born(10)},
+		{ID: 2, Email: "u2@hlcup.com", Gender: "f", BirthDate: born(18)},
+		{ID: 3, Email: "u3@hlcup.com", Gender: "m", BirthDate: born(34)},
+		{ID: 4, Email: "u4@hlcup.com", Gender: "f", BirthDate: born(70)},
+	}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+	assert.NoError(t, s.CreateVisits(ctx, []Visit{
+		{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 5},
+		{ID: 2, UserID: 2, LocationID: 1, VisitedAt: 200, Mark: 4},
+		{ID: 3, UserID: 3, LocationID: 1, VisitedAt: 300, Mark: 1},
+		{ID: 4, UserID: 4, LocationID: 1, VisitedAt: 400, Mark: 2},
+		{ID: 5, UserID: 4, LocationID: 1, VisitedAt: 500, Mark: 3},
+	}))
+
+	avgs := func(buckets []AgeBucket) []float64 {
+		var result []float64
+		for _, b := range buckets {
+			result = append(result, b.Avg)
+		}
+		return result
+	}
+	buckets := newAgeBuckets(defaultAgeBuckets)
+	assert.NoError(t, s.GetLocationAvgByAge(ctx, 1, &LocationAvgQuery{}, buckets))
+	assert.Equal(t, []float64{5, 2.5, 0, 2.5}, avgs(buckets))
+
+	assert.NoError(t, s.GetLocationAvgByAge(ctx, 1, &LocationAvgQuery{Gender: "f", ToDate: &[]int64{500}[0]}, buckets))
+	assert.Equal(t, []float64{0, 4, 0, 2}, avgs(buckets))
+
+	assert.Equal(t, ErrNotFound, s.GetLocationAvgByAge(ctx, 2, &LocationAvgQuery{}, buckets))
+}
+
+func TestNewAgeBuckets(t *testing.T) {
+	to := func(v int) *int { return &v }
+	assert.Equal(t, []AgeBucket{
+		{From: 0, To: to(17)},
+		{From: 18, To: to(34)},
+		{From: 35, To: to(49)},
+		{From: 50},
+	}, newAgeBuckets(defaultAgeBuckets))
+}
+
+func TestLocationHistogram(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com", Gender: "m"}))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 2, Email: "u2@hlcup.com", Gender: "f"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 2, Place: "Place2"}))
+	assert.NoError(t, s.CreateVisits(ctx, []Visit{
+		{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 5},
+		{ID: 2, UserID: 2, LocationID: 1, VisitedAt: 200, Mark: 5},
+		{ID: 3, UserID: 2, LocationID: 1, VisitedAt: 300, Mark: 2},
+		{ID: 4, UserID: 1, LocationID: 1, VisitedAt: 400, Mark: 0},
+	}))
+
+	ts := func(v int64) *int64 { return &v }
+	tt := []struct {
+		name      string
+		id        uint
+		query     LocationAvgQuery
+		histogram MarkHistogram
+	}{
+		{"All", 1, LocationAvgQuery{}, MarkHistogram{1, 0, 1, 0, 0, 2}},
+		{"Gender", 1, LocationAvgQuery{Gender: "f"}, MarkHistogram{0, 0, 1, 0, 0, 1}},
+		{"Dates", 1, LocationAvgQuery{FromDate: ts(100), ToDate: ts(400)}, MarkHistogram{0, 0, 1, 0, 0, 1}},
+		{"Empty", 2, LocationAvgQuery{}, MarkHistogram{}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			h := MarkHistogram{9, 9, 9, 9, 9, 9}
+			assert.NoError(t, s.GetLocationHistogram(ctx, tc.id, &tc.query, &h))
+			assert.Equal(t, tc.histogram, h)
+		})
+	}
+	var h MarkHistogram
+	assert.Equal(t, ErrNotFound, s.GetLocationHistogram(ctx, 3, &LocationAvgQuery{}, &h))
+}
+
+func TestLocationVisitors(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	for id := uint(1); id <= 3; id++ {
+		assert.NoError(t, s.CreateUser(ctx, &User{ID: id, Email: fmt.Sprintf("u%d@hlcup.com", id)}))
+	}
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 2, Place: "Place2"}))
+	assert.NoError(t, s.CreateVisits(ctx, []Visit{
+		{ID: 1, UserID: 3, LocationID: 1, VisitedAt: 100},
+		{ID: 2, UserID: 1, LocationID: 1, VisitedAt: 200},
+		{ID: 3, UserID: 3, LocationID: 1, VisitedAt: 300},
+		{ID: 4, UserID: 2, LocationID: 2, VisitedAt: 400},
+	}))
+
+	ts := func(v int64) *int64 { return &v }
+	tt := []struct {
+		name  string
+		id    uint
+		query LocationVisitorsQuery
+		users []uint
+	}{
+		{"All", 1, LocationVisitorsQuery{}, []uint{1, 3}},
+		{"FromDate", 1, LocationVisitorsQuery{FromDate: ts(100)}, []uint{1, 3}},
+		{"ToDate", 1, LocationVisitorsQuery{ToDate: ts(200)}, []uint{3}},
+		{"Empty", 1, LocationVisitorsQuery{FromDate: ts(300)}, []uint{}},
+		{"OtherLocation", 2, LocationVisitorsQuery{}, []uint{2}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var users []uint
+			assert.NoError(t, s.GetLocationVisitors(ctx, tc.id, &tc.query, &users))
+			assert.Equal(t, tc.users, users)
+		})
+	}
+
+	var users []uint
+	assert.Equal(t, ErrNotFound, s.GetLocationVisitors(ctx, 3, &LocationVisitorsQuery{}, &users))
+	s.SetCascade(true)
+	assert.NoError(t, s.DeleteUser(ctx, 1))
+	assert.NoError(t, s.GetLocationVisitors(ctx, 1, &LocationVisitorsQuery{}, &users))
+	assert.Equal(t, []uint{3}, users)
+}
+
+func TestGrowth(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStoreWithOptions(MemoryStoreOptions{Shards: 3, Capacity: 0, Growth: 1.5})
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+	for id := uint(1); id <= 200; id++ {
+		assert.NoError(t, s.CreateUser(ctx, &User{ID: id, Email: fmt.Sprintf("u%d@hlcup.com", id)}))
+		assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: id, UserID: id, LocationID: 1, VisitedAt: int64(id)}))
+	}
+	// sparse ids
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 5000, Place: "Place5000"}))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 10000, Email: "u10000@hlcup.com"}))
+
+	for _, sh := range s.shards {
+		assert.Equal(t, len(sh.users), len(sh.visitsByUser))
+		assert.Equal(t, len(sh.locations), len(sh.visitsByLocation))
+	}
+	for id := uint(1); id <= 200; id++ {
+		var u User
+		assert.NoError(t, s.GetUser(ctx, id, &u))
+		assert.Equal(t, fmt.Sprintf("u%d@hlcup.com", id), u.Email)
+		var visits []UserVisit
+		_, err := s.GetUserVisits(ctx, id, &UserVisitsQuery{}, &visits)
+		assert.NoError(t, err)
+		assert.Equal(t, []UserVisit{{VisitedAt: int64(id), Place: "Place1"}}, visits)
+	}
+	var l Location
+	assert.NoError(t, s.GetLocation(ctx, 5000, &l))
+	var c StoreCounts
+	assert.NoError(t, s.Count(ctx, &c))
+	assert.Equal(t, StoreCounts{Users: 201, Locations: 2, Visits: 200}, c)
+
+	// options survive clear
+	assert.NoError(t, s.Clear(ctx))
+	assert.Equal(t, MemoryStoreOptions{Shards: 3, Capacity: 0, Growth: 1.5}, s.opts)
+	assert.Equal(t, 0, len(s.shards[0].users))
+}
+
+func TestPing(t *testing.T) {
+	assert.NoError(t, NewMemoryStore().Ping(context.Background()))
+}
+
+func TestClear(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+	assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 3}))
+
+	assert.NoError(t, s.Clear(ctx))
+	assert.Equal(t, ErrNotFound, s.GetUser(ctx, 1, &User{}))
+	assert.Equal(t, ErrNotFound, s.GetLocation(ctx, 1, &Location{}))
+	assert.Equal(t, ErrNotFound, s.GetVisit(ctx, 1, &Visit{}))
+	var visits []UserVisit
+	_, err := s.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.Equal(t, ErrNotFound, err)
+	_, _, err = s.GetLocationAvg(ctx, 1, &LocationAvgQuery{})
+	assert.Equal(t, ErrNotFound, err)
+	var counts StoreCounts
+	assert.NoError(t, s.Count(ctx, &counts))
+	assert.Equal(t, StoreCounts{}, counts)
+
+	// store is reusable after clear
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+	assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 3}))
+}
+
+func TestShardedConcurrentAccess(t *testing.T) {
+	ctx := context.Background()
+	const users = 64
+	s := NewShardedMemoryStore(4)
+	for i := uint(1); i <= users; i++ {
+		assert.NoError(t, s.CreateUser(ctx, &User{ID: i, Email: fmt.Sprintf("u%d@hlcup.com", i)}))
+		assert.NoError(t, s.CreateLocation(ctx, &Location{ID: i, Place: fmt.Sprintf("Place%d", i)}))
+	}
+
+	// every worker creates and moves its own visits across users and
+	// locations living in different shards while others read them
+	var wg sync.WaitGroup
+	for w := uint(0); w < 8; w++ {
+		wg.Add(1)
+		go func(w uint) {
+			defer wg.Done()
+			for i := uint(0); i < 100; i++ {
+				id := w*100 + i + 1
+				v := Visit{ID: id, UserID: id%users + 1, LocationID: (id*7)%users + 1, VisitedAt: int64(id), Mark: int(id % 6)}
+				assert.NoError(t, s.CreateVisit(ctx, &v))
+				v.UserID = (id*3)%users + 1
+				v.LocationID = (id*5)%users + 1
+				assert.NoError(t, s.UpdateVisit(ctx, id, &v))
+				var visits []UserVisit
+				_, err := s.GetUserVisits(ctx, v.UserID, &UserVisitsQuery{}, &visits)
+				assert.NoError(t, err)
+				_, _, err = s.GetLocationAvg(ctx, v.LocationID, &LocationAvgQuery{Gender: "m"})
+				assert.NoError(t, err)
+				if i%2 == 0 {
+					assert.NoError(t, s.DeleteVisit(ctx, id))
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	var counts StoreCounts
+	assert.NoError(t, s.Count(ctx, &counts))
+	assert.Equal(t, StoreCounts{Users: users, Locations: users, Visits: 400}, counts)
+	var total int
+	for i := uint(1); i <= users; i++ {
+		var visits []UserVisit
+		n, err := s.GetUserVisits(ctx, i, &UserVisitsQuery{}, &visits)
+		assert.NoError(t, err)
+		total += n
+	}
+	assert.Equal(t, 400, total)
+}
+
+func TestUpdateVisitUnknownRefs(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+	assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 3}))
+	assert.Equal(t, ErrNotFound, s.UpdateVisit(ctx, 1, &Visit{ID: 1, UserID: 2, LocationID: 1, VisitedAt: 100}))
+	assert.Equal(t, ErrNotFound, s.UpdateVisit(ctx, 1, &Visit{ID: 1, UserID: 1, LocationID: 2, VisitedAt: 100}))
+	var v Visit
+	assert.NoError(t, s.GetVisit(ctx, 1, &v))
+	assert.Equal(t, Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 3}, v)
+}
+
+func TestLocationVisitorStamps(t *testing.T) {
+	ctx := context.Background()
+	s := NewShardedMemoryStore(3)
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com", Gender: "m", BirthDate: 0}))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 2, Email: "u2@hlcup.com", Gender: "f", BirthDate: 0}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 2, Place: "Place2"}))
+	assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 2}))
+	assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: 2, UserID: 1, LocationID: 2, VisitedAt: 200, Mark: 4}))
+	assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: 3, UserID: 2, LocationID: 1, VisitedAt: 300, Mark: 5}))
+
+	assertAvg := func(id uint, q *LocationAvgQuery, expected float64) {
+		t.Helper()
+		avg, _, err := s.GetLocationAvg(ctx, id, q)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, avg)
+	}
+	toAge := 30
+	assertAvg(1, &LocationAvgQuery{Gender: "m"}, 2)
+	assertAvg(1, &LocationAvgQuery{Gender: "f"}, 5)
+
+	// gender and birth date changes are stamped into visits of all locations
+	assert.NoError(t, s.UpdateUser(ctx, 1, &User{ID: 1, Email: "u1@hlcup.com", Gender: "f", BirthDate: time.Now().Unix()}))
+	assertAvg(1, &LocationAvgQuery{Gender: "m"}, 0)
+	assertAvg(1, &LocationAvgQuery{Gender: "f"}, 3.5)
+	assertAvg(2, &LocationAvgQuery{Gender: "f", ToAge: &toAge}, 4)
+	assertAvg(1, &LocationAvgQuery{ToAge: &toAge}, 2)
+
+	// upsert restamps too
+	s.SetUpsert(true)
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 2, Email: "u2@hlcup.com", Gender: "m", BirthDate: 0}))
+	s.SetUpsert(false)
+	assertAvg(1, &LocationAvgQuery{Gender: "m"}, 5)
+
+	// visit moved to another user is stamped with the new one
+	assert.NoError(t, s.UpdateVisit(ctx, 3, &Visit{ID: 3, UserID: 1, LocationID: 1, VisitedAt: 300, Mark: 5}))
+	assertAvg(1, &LocationAvgQuery{Gender: "m"}, 0)
+	assertAvg(1, &LocationAvgQuery{Gender: "f"}, 3.5)
+	assert.NoError(t, s.UpdateVisit(ctx, 3, &Visit{ID: 3, UserID: 2, LocationID: 2, VisitedAt: 300, Mark: 5}))
+	assertAvg(2, &LocationAvgQuery{Gender: "m"}, 5)
+
+	// rebuilt index is stamped from users
+	s.RebuildIndexes()
+	assertAvg(1, &LocationAvgQuery{Gender: "f"}, 2)
+	assertAvg(2, &LocationAvgQuery{Gender: "m"}, 5)
+	assertAvg(2, &LocationAvgQuery{Gender: "f", ToAge: &toAge}, 4)
+}
+
+func TestRebuildIndexes(t *testing.T) {
+	ctx := context.Background()
+	s := NewShardedMemoryStore(2)
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1", Country: "Russia"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 2, Place: "Place2", Country: "France"}))
+	assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 3}))
+	assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: 2, UserID: 1, LocationID: 2, VisitedAt: 200, Mark: 4}))
+
+	// store API keeps indexes complete, so drop them directly
+	sh, i := s.shard(1), s.index(1)
+	sh.visitsByUser[i].Clear()
+	sh.visitsByCountry[i] = nil
+	s.shard(2).visitsByLocation[s.index(2)].Clear()
+	// visit of missing user
+	vsh, vi := s.shard(3), s.index(3)
+	vsh.visits[vi] = &Visit{ID: 3, UserID: 9, LocationID: 1, VisitedAt: 300, Mark: 5}
+
+	var visits []UserVisit
+	total, err := s.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, total)
+
+	indexed, orphaned := s.RebuildIndexes()
+	assert.Equal(t, 2, indexed)
+	assert.Equal(t, 1, orphaned)
+	total, err = s.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, total)
+	assert.Equal(t, []UserVisit{
+		{Mark: 3, VisitedAt: 100, Place: "Place1"},
+		{Mark: 4, VisitedAt: 200, Place: "Place2"},
+	}, visits)
+	_, err = s.GetUserVisits(ctx, 1, &UserVisitsQuery{Country: "France"}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, []UserVisit{{Mark: 4, VisitedAt: 200, Place: "Place2"}}, visits)
+	avg, _, err := s.GetLocationAvg(ctx, 2, &LocationAvgQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 4.0, avg)
+	avg, _, err = s.GetLocationAvg(ctx, 1, &LocationAvgQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 3.0, avg)
+
+	// rebuild of complete indexes changes nothing
+	indexed, orphaned = s.RebuildIndexes()
+	assert.Equal(t, 2, indexed)
+	assert.Equal(t, 1, orphaned)
+	total, err = s.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, total)
+}
+
+func TestUserVisitsMissingLocation(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 2, Place: "Place2"}))
+	assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 3}))
+	assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: 2, UserID: 1, LocationID: 2, VisitedAt: 200, Mark: 4}))
+
+	// store API doesn't leave dangling references, so drop location directly
+	sh, i := s.shard(2), s.index(2)
+	sh.locations[i] = nil
+
+	var visits []UserVisit
+	total, err := s.GetUserVisits(ctx, 1, &UserVisitsQuery{Country: "Russia"}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, total)
+	total, err = s.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, total)
+	assert.Equal(t, []UserVisit{{Mark: 3, VisitedAt: 100, Place: "Place1"}}, visits)
+}
+
+func TestCanceledContext(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com", Gender: "m"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+	assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 3}))
+
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	var visits []UserVisit
+	_, err := s.GetUserVisits(canceled, 1, &UserVisitsQuery{}, &visits)
+	assert.Equal(t, context.Canceled, err)
+	_, _, err = s.GetLocationAvg(canceled, 1, &LocationAvgQuery{Gender: "m"})
+	assert.Equal(t, context.Canceled, err)
+
+	_, err = s.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	assert.Len(t, visits, 1)
+}
+
+func TestUpsert(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com"}))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 2, Email: "u2@hlcup.com"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 2, Place: "Place2"}))
+	assert.NoError(t, s.CreateVisit(ctx, &Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 3}))
+	assert.Equal(t, ErrDup, s.CreateUser(ctx, &User{ID: 1, Email: "new@hlcup.com"}))
+
+	s.SetUpsert(true)
+	assert.NoError(t, s.CreateUsers(ctx, []User{{ID: 1, Email: "new@hlcup.com"}, {ID: 3, Email: "u3@hlcup.com"}}))
+	assert.Equal(t, ErrDup, s.CreateUser(ctx, &User{ID: 1, Email: "u2@hlcup.com"}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "NewPlace"}))
+	assert.NoError(t, s.CreateVisits(ctx, []Visit{{ID: 1, UserID: 2, LocationID: 2, VisitedAt: 200, Mark: 5}}))
+	s.SetUpsert(false)
+
+	var u User
+	assert.NoError(t, s.GetUser(ctx, 1, &u))
+	assert.Equal(t, "new@hlcup.com", u.Email)
+	assert.Equal(t, ErrDup, s.CreateUser(ctx, &User{ID: 4, Email: "new@hlcup.com"}))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 4, Email: "u1@hlcup.com"}))
+	var l Location
+	assert.NoError(t, s.GetLocation(ctx, 1, &l))
+	assert.Equal(t, "NewPlace", l.Place)
+
+	var c StoreCounts
+	assert.NoError(t, s.Count(ctx, &c))
+	assert.Equal(t, StoreCounts{Users: 4, Locations: 2, Visits: 1}, c)
+
+	// visit is moved to the new user and location
+	var visits []UserVisit
+	_, err := s.GetUserVisits(ctx, 1, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	assert.Empty(t, visits)
+	_, err = s.GetUserVisits(ctx, 2, &UserVisitsQuery{}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, []UserVisit{{Mark: 5, VisitedAt: 200, Place: "Place2"}}, visits)
+}
+
+func benchmarkMixedAccess(b *testing.B, shards int) {
+	ctx := context.Background()
+	const (
+		users     = 10000
+		locations = 1000
+		visits    = 100000
+	)
+	s := NewShardedMemoryStore(shards)
+	for i := uint(1); i <= users; i++ {
+		s.CreateUser(ctx, &User{ID: i, Email: fmt.Sprintf("u%d@hlcup.com", i), Gender: "m"})
+	}
+	for i := uint(1); i <= locations; i++ {
+		s.CreateLocation(ctx, &Location{ID: i, Place: "Place", Country: "Russia"})
+	}
+	for i := uint(1); i <= visits; i++ {
+		s.CreateVisit(ctx, &Visit{ID: i, UserID: i%users + 1, LocationID: i%locations + 1, VisitedAt: int64(i), Mark: int(i % 6)})
+	}
+
+	var seed int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		rnd := rand.New(rand.NewSource(atomic.AddInt64(&seed, 1)))
+		var (
+			u  User
+			l  Location
+			v  Visit
+			uv []UserVisit
+		)
+		for pb.Next() {
+			id := uint(rnd.Intn(users) + 1)
+			switch op := rnd.Intn(100); {
+			case op < 30:
+				s.GetUser(ctx, id, &u)
+			case op < 50:
+				s.GetLocation(ctx, id%locations+1, &l)
+			case op < 70:
+				s.GetVisit(ctx, id, &v)
+			case op < 85:
+				s.GetUserVisits(ctx, id, &UserVisitsQuery{}, &uv)
+			case op < 90:
+				s.GetLocationAvg(ctx, id%locations+1, &LocationAvgQuery{})
+			case op < 95:
+				s.UpdateUser(ctx, id, &User{ID: id, Email: fmt.Sprintf("u%d@hlcup.com", id), Gender: "f"})
+			default:
+				s.UpdateVisit(ctx, id, &Visit{ID: id, UserID: id%users + 1, LocationID: id%locations + 1, VisitedAt: int64(id), Mark: rnd.Intn(6)})
+			}
+		}
+	})
+}
+
+// benchmarkImport creates users with sequential ids in a store without
+// preallocated room, so it measures slice growth
+func benchmarkImport(b *testing.B, growth float64) {
+	const users = 100000
+	ctx := context.Background()
+	batch := make([]User, users)
+	for i := range batch {
+		batch[i] = User{ID: uint(i + 1), Email: fmt.Sprintf("u%d@hlcup.com", i+1)}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		s := NewMemoryStoreWithOptions(MemoryStoreOptions{Shards: defaultMemoryShards, Growth: growth})
+		s.CreateUsers(ctx, batch)
+	}
+}
+
+func BenchmarkImportGrowth1_1(b *testing.B) {
+	benchmarkImport(b, 1.1)
+}
+
+func BenchmarkImportGrowth2(b *testing.B) {
+	benchmarkImport(b, 2)
+}
+
+func BenchmarkMixedAccessSingleLock(b *testing.B) {
+	benchmarkMixedAccess(b, 1)
+}
+
+func BenchmarkMixedAccessSharded(b *testing.B) {
+	benchmarkMixedAccess(b, defaultMemoryShards)
+}
+
+// BenchmarkUserVisitsCountry queries visits of a user who travelled a lot
+// but rarely to the requested country
+func BenchmarkUserVisitsCountry(b *testing.B) {
+	const (
+		visits    = 5000
+		locations = 100
+	)
+	ctx := context.Background()
+	s := NewMemoryStore()
+	s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com"})
+	for i := uint(1); i <= locations; i++ {
+		s.CreateLocation(ctx, &Location{ID: i, Place: "Place", Country: fmt.Sprintf("Country%d", i)})
+	}
+	for i := uint(1); i <= visits; i++ {
+		s.CreateVisit(ctx, &Visit{ID: i, UserID: 1, LocationID: i%locations + 1, VisitedAt: int64(i)})
+	}
+	q := &UserVisitsQuery{Country: "Country1"}
+	var uv []UserVisit
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		s.GetUserVisits(ctx, 1, q, &uv)
+	}
+	if len(uv) != visits/locations {
+		b.Fatalf("got %d visits", len(uv))
+	}
+}
+
+// sizes of the dataset shared by read path benchmarks
+const (
+	benchUsers     = 10000
+	benchLocations = 1000
+	benchVisits    = 100000
+	benchCountries = 20
+)
+
+var (
+	benchStoreOnce sync.Once
+	benchStore     *MemoryStore
+)
+
+// seedBenchUsersLocations creates users and locations with attributes
+// drawn from rnd
+func seedBenchUsersLocations(s *MemoryStore, rnd *rand.Rand) {
+	ctx := context.Background()
+	genders := []string{"m", "f"}
+	for i := uint(1); i <= benchUsers; i++ {
+		s.CreateUser(ctx, &User{
+			ID:        i,
+			Email:     fmt.Sprintf("u%d@hlcup.com", i),
+			FirstName: "First",
+			LastName:  "Last",
+			Gender:    genders[rnd.Intn(2)],
+			BirthDate: -631152000 + rnd.Int63n(1577836800), // 1950..2000
+		})
+	}
+	for i := uint(1); i <= benchLocations; i++ {
+		s.CreateLocation(ctx, &Location{
+			ID:       i,
+			Place:    fmt.Sprintf("Place%d", i),
+			Country:  fmt.Sprintf("Country%d", rnd.Intn(benchCountries)),
+			City:     "City",
+			Distance: rnd.Intn(100) + 1,
+		})
+	}
+}
+
+// benchmarkStore returns memory store filled with a dataset generated from
+// a fixed seed, so results are comparable between runs. It is built once
+// and must not be modified by benchmarks.
+func benchmarkStore() *MemoryStore {
+	benchStoreOnce.Do(func() {
+		ctx := context.Background()
+		rnd := rand.New(rand.NewSource(1))
+		s := NewMemoryStore()
+		seedBenchUsersLocations(s, rnd)
+		for i := uint(1); i <= benchVisits; i++ {
+			s.CreateVisit(ctx, &Visit{
+				ID:         i,
+				UserID:     uint(rnd.Intn(benchUsers) + 1),
+				LocationID: uint(rnd.Intn(benchLocations) + 1),
+				VisitedAt:  946684800 + rnd.Int63n(473385600), // 2000..2015
+				Mark:       rnd.Intn(6),
+			})
+		}
+		benchStore = s
+	})
+	return benchStore
+}
+
+func BenchmarkGetUser(b *testing.B) {
+	ctx := context.Background()
+	s := benchmarkStore()
+	var u User
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		s.GetUser(ctx, uint(n%benchUsers+1), &u)
+	}
+}
+
+func benchmarkGetUserVisits(b *testing.B, q *UserVisitsQuery) {
+	ctx := context.Background()
+	s := benchmarkStore()
+	var visits []UserVisit
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		s.GetUserVisits(ctx, uint(n%benchUsers+1), q, &visits)
+	}
+}
+
+func BenchmarkGetUserVisits(b *testing.B) {
+	benchmarkGetUserVisits(b, &UserVisitsQuery{})
+}
+
+func BenchmarkGetUserVisitsFiltered(b *testing.B) {
+	fromDate, toDate, toDistance := int64(1104537600), int64(1262304000), 50 // 2005..2010
+	benchmarkGetUserVisits(b, &UserVisitsQuery{FromDate: &fromDate, ToDate: &toDate, ToDistance: &toDistance})
+}
+
+func BenchmarkGetUserVisitsByCountry(b *testing.B) {
+	benchmarkGetUserVisits(b, &UserVisitsQuery{Country: "Country1"})
+}
+
+func BenchmarkGetUserVisitsFirstPage(b *testing.B) {
+	benchmarkGetUserVisits(b, &UserVisitsQuery{Limit: 2})
+}
+
+func benchmarkGetLocationAvg(b *testing.B, q *LocationAvgQuery) {
+	ctx := context.Background()
+	s := benchmarkStore()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		s.GetLocationAvg(ctx, uint(n%benchLocations+1), q)
+	}
+}
+
+func BenchmarkGetLocationAvg(b *testing.B) {
+	benchmarkGetLocationAvg(b, &LocationAvgQuery{})
+}
+
+func BenchmarkGetLocationAvgByGender(b *testing.B) {
+	benchmarkGetLocationAvg(b, &LocationAvgQuery{Gender: "f"})
+}
+
+func BenchmarkGetLocationAvgByAgeGender(b *testing.B) {
+	fromAge, toAge := 20, 40
+	benchmarkGetLocationAvg(b, &LocationAvgQuery{FromAge: &fromAge, ToAge: &toAge, Gender: "f"})
+}
+
+func BenchmarkCreateVisit(b *testing.B) {
+	ctx := context.Background()
+	rnd := rand.New(rand.NewSource(1))
+	s := NewMemoryStore()
+	seedBenchUsersLocations(s, rnd)
+	visits := make([]Visit, b.N)
+	for i := range visits {
+		visits[i] = Visit{
+			ID:         uint(i + 1),
+			UserID:     uint(rnd.Intn(benchUsers) + 1),
+			LocationID: uint(rnd.Intn(benchLocations) + 1),
+			VisitedAt:  946684800 + rnd.Int63n(473385600),
+			Mark:       rnd.Intn(6),
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := range visits {
+		if err := s.CreateVisit(ctx, &visits[i]); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
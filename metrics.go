@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+// precomputed status code labels to keep observe allocation-free
+var statusLabels [500]string
+
+func init() {
+	for i := range statusLabels {
+		statusLabels[i] = strconv.Itoa(i + 100)
+	}
+}
+
+func statusLabel(code int) string {
+	if code >= 100 && code < 600 {
+		return statusLabels[code-100]
+	}
+	return strconv.Itoa(code)
+}
+
+type metrics struct {
+	requests  *prometheus.CounterVec
+	durations [routesCount]prometheus.Observer
+	handler   fasthttp.RequestHandler
+}
+
+func newMetrics() *metrics {
+	registry := prometheus.NewRegistry()
+	requests := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "hlcup_requests_total",
+		Help: "Number of processed requests by route and status code.",
+	}, []string{"route", "code"})
+	durations := prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "hlcup_request_duration_seconds",
+		Help:    "Request handling duration by route.",
+		Buckets: []float64{.00001, .000025, .00005, .0001, .00025, .0005, .001, .0025, .005, .01, .05, .1},
+	}, []string{"route"})
+	registry.MustRegister(requests, durations)
+
+	m := &metrics{
+		requests: requests,
+		handler:  fasthttpadaptor.NewFastHTTPHandler(promhttp.HandlerFor(registry, promhttp.HandlerOpts{})),
+	}
+	for r := route(0); r < routesCount; r++ {
+		m.durations[r] = durations.WithLabelValues(r.String())
+	}
+	return m
+}
+
+func (m *metrics) observe(r route, code int, d time.Duration) {
+	m.requests.WithLabelValues(r.String(), statusLabel(code)).Inc()
+	m.durations[r].Observe(d.Seconds())
+}
+
+func (m *metrics) serve(ctx *fasthttp.RequestCtx) {
+	m.handler(ctx)
+}
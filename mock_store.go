@@ -1,69 +1,136 @@
 package main
 
-import "github.com/stretchr/testify/mock"
+import (
+	"context"
+
+	"github.com/stretchr/testify/mock"
+)
 
 type MockStore struct {
 	mock.Mock
 }
 
-func (m *MockStore) CreateUser(u *User) error {
+func (m *MockStore) CreateUser(_ context.Context, u *User) error {
 	return m.Called(u).Error(0)
 }
 
-func (m *MockStore) CreateUsers(us []User) error {
+func (m *MockStore) CreateUsers(_ context.Context, us []User) error {
 	return m.Called(us).Error(0)
 }
 
-func (m *MockStore) UpdateUser(id uint, u *User) error {
+func (m *MockStore) UpdateUser(_ context.Context, id uint, u *User) error {
 	return m.Called(id, u).Error(0)
 }
 
-func (m *MockStore) GetUser(id uint, u *User) error {
+func (m *MockStore) GetUser(_ context.Context, id uint, u *User) error {
 	return m.Called(id, u).Error(0)
 }
 
-func (m *MockStore) GetUserVisits(id uint, q *UserVisitsQuery, visits *[]UserVisit) error {
-	return m.Called(id, q, visits).Error(0)
+func (m *MockStore) GetUsers(_ context.Context, ids []uint, users *[]User) error {
+	return m.Called(ids, users).Error(0)
+}
+
+func (m *MockStore) GetUserVisits(_ context.Context, id uint, q *UserVisitsQuery, visits *[]UserVisit) (int, error) {
+	args := m.Called(id, q, visits)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *MockStore) GetUserAvg(_ context.Context, id uint, q *UserVisitsQuery) (float64, error) {
+	args := m.Called(id, q)
+	avg, _ := args.Get(0).(float64)
+	return avg, args.Error(1)
+}
+
+func (m *MockStore) DeleteUser(_ context.Context, id uint) error {
+	return m.Called(id).Error(0)
 }
 
-func (m *MockStore) CreateLocation(l *Location) error {
+func (m *MockStore) CreateLocation(_ context.Context, l *Location) error {
 	return m.Called(l).Error(0)
 }
 
-func (m *MockStore) CreateLocations(ls []Location) error {
+func (m *MockStore) CreateLocations(_ context.Context, ls []Location) error {
 	return m.Called(ls).Error(0)
 }
 
-func (m *MockStore) UpdateLocation(id uint, l *Location) error {
+func (m *MockStore) UpdateLocation(_ context.Context, id uint, l *Location) error {
 	return m.Called(id, l).Error(0)
 }
 
-func (m *MockStore) GetLocation(id uint, l *Location) error {
+func (m *MockStore) GetLocation(_ context.Context, id uint, l *Location) error {
 	return m.Called(id, l).Error(0)
 }
 
-func (m *MockStore) GetLocationAvg(id uint, q *LocationAvgQuery) (float64, error) {
+func (m *MockStore) GetLocationAvg(_ context.Context, id uint, q *LocationAvgQuery) (float64, int, error) {
 	args := m.Called(id, q)
 	avg, _ := args.Get(0).(float64)
-	return avg, args.Error(1)
+	return avg, args.Int(1), args.Error(2)
+}
+
+func (m *MockStore) GetLocationHistogram(_ context.Context, id uint, q *LocationAvgQuery, h *MarkHistogram) error {
+	return m.Called(id, q, h).Error(0)
+}
+
+func (m *MockStore) GetLocationAvgByAge(_ context.Context, id uint, q *LocationAvgQuery, buckets []AgeBucket) error {
+	return m.Called(id, q, buckets).Error(0)
+}
+
+func (m *MockStore) GetLocationVisitors(_ context.Context, id uint, q *LocationVisitorsQuery, users *[]uint) error {
+	return m.Called(id, q, users).Error(0)
+}
+
+func (m *MockStore) DeleteLocation(_ context.Context, id uint) error {
+	return m.Called(id).Error(0)
 }
 
-func (m *MockStore) CreateVisit(v *Visit) error {
+func (m *MockStore) CreateVisit(_ context.Context, v *Visit) error {
 	return m.Called(v).Error(0)
 }
 
-func (m *MockStore) CreateVisits(vs []Visit) error {
+func (m *MockStore) CreateVisits(_ context.Context, vs []Visit) error {
 	return m.Called(vs).Error(0)
 }
 
-func (m *MockStore) UpdateVisit(id uint, v *Visit) error {
+func (m *MockStore) UpdateVisit(_ context.Context, id uint, v *Visit) error {
 	return m.Called(id, v).Error(0)
 }
 
-func (m *MockStore) GetVisit(id uint, v *Visit) error {
+func (m *MockStore) UpdateVisits(_ context.Context, vs []Visit) []error {
+	return m.Called(vs).Get(0).([]error)
+}
+
+func (m *MockStore) GetVisit(_ context.Context, id uint, v *Visit) error {
 	return m.Called(id, v).Error(0)
 }
 
-func (m *MockStore) Clear() error {
+func (m *MockStore) QueryVisits(_ context.Context, q *VisitsQuery, visits *[]Visit) error {
+	return m.Called(q, visits).Error(0)
+}
+
+func (m *MockStore) DeleteVisit(_ context.Context, id uint) error {
+	return m.Called(id).Error(0)
+}
+
+func (m *MockStore) Count(_ context.Context, c *StoreCounts) error {
+	return m.Called(c).Error(0)
+}
+
+func (m *MockStore) EachUser(_ context.Context, f func(u *User) bool) error {
+	return m.Called(f).Error(0)
+}
+
+func (m *MockStore) EachLocation(_ context.Context, f func(l *Location) bool) error {
+	return m.Called(f).Error(0)
+}
+
+func (m *MockStore) EachVisit(_ context.Context, f func(v *Visit) bool) error {
+	return m.Called(f).Error(0)
+}
+
+func (m *MockStore) Ping(_ context.Context) error {
+	return m.Called().Error(0)
+}
+
+func (m *MockStore) Clear(_ context.Context) error {
 	return m.Called().Error(0)
 }
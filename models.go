@@ -4,9 +4,14 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/buger/jsonparser"
+	"github.com/mailru/easyjson/jlexer"
+	"github.com/mailru/easyjson/jwriter"
 )
 
 //easyjson:json
@@ -14,7 +19,7 @@ type User struct {
 	ID        uint   `json:"id" bson:"_id"`
 	FirstName string `json:"first_name" bson:"f"`
 	LastName  string `json:"last_name" bson:"l"`
-	Email     string `json:"email" bson:"e"`
+	Email     string `json:"email" bson:"e,omitempty"` // blank emails are skipped by unique index
 	Gender    string `json:"gender" bson:"g"`
 	BirthDate int64  `json:"birth_date" bson:"b"`
 }
@@ -25,7 +30,7 @@ type Location struct {
 	City     string `json:"city" bson:"ci"`
 	Country  string `json:"country" bson:"co"`
 	Place    string `json:"place" bson:"p"`
-	Distance int    `json:"distance" bson:"d"`
+	Distance int    `json:"distance" bson:"d"` // in kilometers
 }
 
 //easyjson:json
@@ -51,21 +56,74 @@ type FileData struct {
 	Visits    []Visit    `json:"visits"`
 }
 
+// metersPerMile is the exact length of international mile
+const metersPerMile = 1609344
+
+// milesToKm converts distance threshold in miles to whole kilometers.
+// Kilometers are rounded down for lower bound and up for upper bound, so
+// the exclusive comparison with integer distance gives the same result as
+// comparison in miles would.
+func milesToKm(mi int, roundUp bool) int {
+	m := int64(mi) * metersPerMile
+	km := m / 1000000
+	if rem := m % 1000000; rem != 0 {
+		if roundUp && rem > 0 {
+			km++
+		} else if !roundUp && rem < 0 {
+			km--
+		}
+	}
+	return int(km)
+}
+
+// UserVisitsQuery bounds are exclusive: FromDate < visited_at < ToDate and
+// FromDistance < distance < ToDistance, ToDistanceInclusive makes the latter
+// distance <= ToDistance. Distance requires exact match.
+// Offset and Limit select a page of matching visits, zero Limit means no limit.
+// Visits are ordered by visited_at ascending unless Desc is set.
 type UserVisitsQuery struct {
-	FromDate   *int64
-	ToDate     *int64
-	Country    string
-	ToDistance *int
+	FromDate            *int64
+	ToDate              *int64
+	Country             string
+	FromDistance        *int
+	ToDistance          *int
+	ToDistanceInclusive bool
+	Distance            *int
+	Offset              int
+	Limit               int
+	Desc                bool
+	WithTotal           bool // total of matching visits is requested
 }
 
+// matchDistance reports whether location distance d passes distance
+// filters of the query
+func (q *UserVisitsQuery) matchDistance(d int) bool {
+	if q.Distance != nil && d != *q.Distance {
+		return false
+	}
+	if q.FromDistance != nil && d <= *q.FromDistance {
+		return false
+	}
+	if q.ToDistance != nil && (d > *q.ToDistance || d == *q.ToDistance && !q.ToDistanceInclusive) {
+		return false
+	}
+	return true
+}
+
+// LocationAvgQuery bounds are exclusive: only visits with FromDate < visited_at < ToDate
+// and FromMark < mark < ToMark by users with FromAge < age < ToAge are taken into account.
 type LocationAvgQuery struct {
 	FromDate *int64
 	ToDate   *int64
 	FromAge  *int
 	ToAge    *int
 	Gender   string
+	FromMark *int
+	ToMark   *int
 }
 
+// FromBirth returns exclusive lower bound of user birth date derived from ToAge:
+// user is younger than ToAge years iff BirthDate > FromBirth.
 func (q LocationAvgQuery) FromBirth() *int64 {
 	if q.ToAge == nil {
 		return nil
@@ -74,6 +132,8 @@ func (q LocationAvgQuery) FromBirth() *int64 {
 	return &from
 }
 
+// ToBirth returns exclusive upper bound of user birth date derived from FromAge:
+// user is older than FromAge years iff BirthDate < ToBirth.
 func (q LocationAvgQuery) ToBirth() *int64 {
 	if q.FromAge == nil {
 		return nil
@@ -82,9 +142,150 @@ func (q LocationAvgQuery) ToBirth() *int64 {
 	return &to
 }
 
+// MarkHistogram holds number of visits for every mark
+type MarkHistogram [6]int
+
+func (h *MarkHistogram) add(mark int) {
+	if mark >= 0 && mark < len(h) {
+		h[mark]++
+	}
+}
+
+// MarshalEasyJSON encodes histogram as object keyed by mark
+func (h MarkHistogram) MarshalEasyJSON(w *jwriter.Writer) {
+	w.RawByte('{')
+	for mark, n := range h {
+		if mark > 0 {
+			w.RawByte(',')
+		}
+		w.RawByte('"')
+		w.Int(mark)
+		w.RawString(`":`)
+		w.Int(n)
+	}
+	w.RawByte('}')
+}
+
+// UnmarshalEasyJSON decodes histogram object keyed by mark
+func (h *MarkHistogram) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	l.Delim('{')
+	for !l.IsDelim('}') {
+		key := l.UnsafeString()
+		l.WantColon()
+		mark, err := strconv.Atoi(key)
+		if err != nil || mark < 0 || mark >= len(h) {
+			l.AddError(fmt.Errorf("invalid mark %q", key))
+			return
+		}
+		h[mark] = l.Int()
+		l.WantComma()
+	}
+	l.Delim('}')
+}
+
+// AgeBucket holds average mark of visitors aged From..To full years
+// inclusive. The last bucket has no upper bound, its To is nil.
+//
+//easyjson:json
+type AgeBucket struct {
+	From int     `json:"from"`
+	To   *int    `json:"to,omitempty"`
+	Avg  float64 `json:"avg"`
+}
+
+// lower bounds of age buckets in location avg grouped by age
+var defaultAgeBuckets = []int{0, 18, 35, 50}
+
+// newAgeBuckets makes buckets starting at ascending ages froms
+func newAgeBuckets(froms []int) []AgeBucket {
+	buckets := make([]AgeBucket, len(froms))
+	for i, from := range froms {
+		buckets[i].From = from
+		if i+1 < len(froms) {
+			to := froms[i+1] - 1
+			buckets[i].To = &to
+		}
+	}
+	return buckets
+}
+
+// ageBirthBounds returns the latest birth date of visitors for every bucket:
+// user is at least From years old iff BirthDate <= bound.
+func ageBirthBounds(buckets []AgeBucket, now time.Time) []int64 {
+	bounds := make([]int64, len(buckets))
+	for i, b := range buckets {
+		bounds[i] = now.AddDate(-b.From, 0, 0).Unix()
+	}
+	return bounds
+}
+
+// ageBucketsAvg accumulates visit marks into age buckets of visitors
+type ageBucketsAvg struct {
+	buckets  []AgeBucket
+	bounds   []int64
+	sum, cnt []int
+}
+
+func newAgeBucketsAvg(buckets []AgeBucket, now time.Time) *ageBucketsAvg {
+	return &ageBucketsAvg{
+		buckets: buckets,
+		bounds:  ageBirthBounds(buckets, now),
+		sum:     make([]int, len(buckets)),
+		cnt:     make([]int, len(buckets)),
+	}
+}
+
+func (a *ageBucketsAvg) add(mark int, birthDate int64) {
+	// the oldest matching bucket, users born in future match none
+	for i := len(a.bounds) - 1; i >= 0; i-- {
+		if birthDate <= a.bounds[i] {
+			a.sum[i] += mark
+			a.cnt[i]++
+			return
+		}
+	}
+}
+
+// done sets average marks of buckets
+func (a *ageBucketsAvg) done() {
+	for i := range a.buckets {
+		a.buckets[i].Avg = 0
+		if a.cnt[i] > 0 {
+			a.buckets[i].Avg = float64(a.sum[i]) / float64(a.cnt[i])
+		}
+	}
+}
+
+// LocationVisitorsQuery bounds are exclusive: only visits with
+// FromDate < visited_at < ToDate are taken into account.
+type LocationVisitorsQuery struct {
+	FromDate *int64
+	ToDate   *int64
+}
+
+// VisitsQuery selects visits of the user and/or the location, at least
+// one of UserID and LocationID must be set. Date bounds are exclusive:
+// FromDate < visited_at < ToDate. Offset and Limit select a page of matching
+// visits ordered by visited_at and id, zero Limit means no limit.
+type VisitsQuery struct {
+	UserID     uint
+	LocationID uint
+	FromDate   *int64
+	ToDate     *int64
+	Offset     int
+	Limit      int
+}
+
+//easyjson:json
+type UsersResult struct {
+	Users []User `json:"users"`
+}
+
 //easyjson:json
 type UserVisitsResult struct {
-	Visits []UserVisit `json:"visits"`
+	Visits    []UserVisit `json:"visits"`
+	Total     *int        `json:"total,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
 }
 
 //easyjson:json
@@ -92,180 +293,495 @@ type LocationAvgResult struct {
 	Avg float64 `json:"avg"`
 }
 
+//easyjson:json
+type LocationAvgByAgeResult struct {
+	Buckets []AgeBucket `json:"buckets"`
+}
+
+//easyjson:json
+type VisitsResult struct {
+	Visits []Visit `json:"visits"`
+}
+
+//easyjson:json
+type LocationVisitorsResult struct {
+	Users []uint `json:"users"`
+}
+
+//easyjson:json
+type LocationHistogramResult struct {
+	Histogram MarkHistogram `json:"histogram"`
+}
+
+//easyjson:json
+type ChangedResult struct {
+	IDs     []uint `json:"ids"`
+	Version uint64 `json:"version"`
+}
+
+// StoreCounts holds number of entities kept in store
+type StoreCounts struct {
+	Users     int
+	Locations int
+	Visits    int
+}
+
+//easyjson:json
+type StatsResult struct {
+	Users      int    `json:"users"`
+	Locations  int    `json:"locations"`
+	Visits     int    `json:"visits"`
+	Alloc      uint64 `json:"alloc"`
+	TotalAlloc uint64 `json:"total_alloc"`
+	Sys        uint64 `json:"sys"`
+	NumGC      uint64 `json:"num_gc"`
+	// id samples, present only when requested with sample parameter
+	UserIDs     []uint `json:"user_ids,omitempty"`
+	LocationIDs []uint `json:"location_ids,omitempty"`
+	VisitIDs    []uint `json:"visit_ids,omitempty"`
+}
+
+//easyjson:json
+type UpdateStatus struct {
+	ID     uint   `json:"id"`
+	Status int    `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Code   string `json:"code,omitempty"`
+}
+
+//easyjson:json
+type UpdateVisitsResult struct {
+	Results []UpdateStatus `json:"results"`
+}
+
+//easyjson:json
+type ErrorResult struct {
+	Error string `json:"error"`
+	Code  string `json:"code,omitempty"`
+	Index *int   `json:"index,omitempty"`
+}
+
+// strictFields makes unmarshalers reject unknown object keys
+// instead of silently ignoring them.
+var strictFields bool
+
+// lenientNumbers makes unmarshalers accept numeric fields encoded as JSON
+// strings, e.g. "id":"1". By default such values are rejected, so a client
+// sending strings learns about it rather than relying on coercion.
+var lenientNumbers bool
+
+// camelFields makes responses use camelCase field names, e.g. firstName
+// instead of first_name, unless request has X-Field-Case header
+var camelFields bool
+
+// camelKeys returns copy of compact JSON body with snake_case object keys
+// converted to camelCase. String values are left intact.
+func camelKeys(body []byte) []byte {
+	out := make([]byte, 0, len(body))
+	for i := 0; i < len(body); i++ {
+		if body[i] != '"' {
+			out = append(out, body[i])
+			continue
+		}
+		// find closing quote
+		end := i + 1
+		for ; end < len(body) && body[end] != '"'; end++ {
+			if body[end] == '\\' {
+				end++
+			}
+		}
+		if end >= len(body) {
+			return append(out, body[i:]...)
+		}
+		next := end + 1
+		for next < len(body) && (body[next] == ' ' || body[next] == '\n') {
+			next++
+		}
+		if next == len(body) || body[next] != ':' {
+			out = append(out, body[i:end+1]...)
+			i = end
+			continue
+		}
+		out = append(out, '"')
+		for j := i + 1; j < end; j++ {
+			if body[j] == '_' && j > i+1 && j+1 < end && body[j+1] >= 'a' && body[j+1] <= 'z' {
+				out = append(out, body[j+1]-'a'+'A')
+				j++
+				continue
+			}
+			out = append(out, body[j])
+		}
+		out = append(out, '"')
+		i = end
+	}
+	return out
+}
+
+var (
+	errQuotedNumber = errors.New("number expected, got string")
+	errNotNumber    = errors.New("number expected")
+)
+
+// parseNumber parses integer field value of type vt. Quoted numbers are
+// accepted only in lenient mode.
+func parseNumber(value []byte, vt jsonparser.ValueType) (int64, error) {
+	switch {
+	case vt == jsonparser.Number:
+	case vt == jsonparser.String && lenientNumbers:
+	case vt == jsonparser.String:
+		return 0, errQuotedNumber
+	default:
+		return 0, errNotNumber
+	}
+	return jsonparser.ParseInt(value)
+}
+
+var (
+	errNotString   = errors.New("string expected")
+	errInvalidUTF8 = errors.New("invalid UTF-8")
+	errNegativeID  = errors.New("negative id")
+)
+
+// parseString parses string field value of type vt, other types aren't
+// converted to string
+func parseString(value []byte, vt jsonparser.ValueType) (string, error) {
+	if vt != jsonparser.String {
+		return "", errNotString
+	}
+	s, err := jsonparser.ParseString(value)
+	if err != nil {
+		return "", err
+	}
+	if !utf8.ValidString(s) {
+		return "", errInvalidUTF8
+	}
+	return s, nil
+}
+
+// parseID parses id field value of type vt like parseNumber, negative ids
+// are rejected
+func parseID(value []byte, vt jsonparser.ValueType) (uint, error) {
+	id, err := parseNumber(value, vt)
+	if err != nil {
+		return 0, err
+	}
+	if id < 0 {
+		return 0, errNegativeID
+	}
+	return uint(id), nil
+}
+
 // Custom unmarshalers
+
+// UnmarshalData sets user fields present in JSON object b. Partial update
+// relies on it: body is unmarshaled onto the stored user, so absent fields
+// keep their values and present ones are replaced. Every field is required,
+// hence explicit null is an error rather than a way to clear the field.
+// Changing id is not detected here, stores reject it with ErrUpdateID.
+// With all set b must contain every field, as create requires.
+// Field names are accepted both in snake_case and camelCase.
 func (u *User) UnmarshalData(b []byte, all bool) error {
-	var fieldsCount int
+	var fields uint // bit per present field, repeated and unknown keys don't count
 	err := jsonparser.ObjectEach(b, func(key []byte, value []byte, vt jsonparser.ValueType, offset int) error {
 		if vt == jsonparser.Null {
 			return errors.New("null type")
 		}
 		if bytes.Equal(key, []byte("id")) {
-			if id, err := jsonparser.ParseInt(value); err == nil {
-				u.ID = uint(id)
+			fields |= 1 << 0
+			if id, err := parseID(value, vt); err == nil {
+				u.ID = id
 			} else {
 				return fmt.Errorf("invalid id: %v", err)
 			}
-		} else if bytes.Equal(key, []byte("first_name")) {
-			if s, err := jsonparser.ParseString(value); err == nil {
+		} else if bytes.Equal(key, []byte("first_name")) || bytes.Equal(key, []byte("firstName")) {
+			fields |= 1 << 1
+			if s, err := parseString(value, vt); err == nil {
 				u.FirstName = s
 			} else {
 				return fmt.Errorf("invalid first name: %v", err)
 			}
-		} else if bytes.Equal(key, []byte("last_name")) {
-			if s, err := jsonparser.ParseString(value); err == nil {
+		} else if bytes.Equal(key, []byte("last_name")) || bytes.Equal(key, []byte("lastName")) {
+			fields |= 1 << 2
+			if s, err := parseString(value, vt); err == nil {
 				u.LastName = s
 			} else {
 				return fmt.Errorf("invalid last name: %v", err)
 			}
 		} else if bytes.Equal(key, []byte("email")) {
-			if s, err := jsonparser.ParseString(value); err == nil {
+			fields |= 1 << 3
+			if s, err := parseString(value, vt); err == nil {
 				u.Email = s
 			} else {
 				return fmt.Errorf("invalid email: %v", err)
 			}
 		} else if bytes.Equal(key, []byte("gender")) {
-			if s, err := jsonparser.ParseString(value); err == nil {
+			fields |= 1 << 4
+			if s, err := parseString(value, vt); err == nil {
 				u.Gender = s
 			} else {
 				return fmt.Errorf("invalid gender: %v", err)
 			}
-		} else if bytes.Equal(key, []byte("birth_date")) {
-			if ts, err := jsonparser.ParseInt(value); err == nil {
+		} else if bytes.Equal(key, []byte("birth_date")) || bytes.Equal(key, []byte("birthDate")) {
+			fields |= 1 << 5
+			if ts, err := parseNumber(value, vt); err == nil {
 				u.BirthDate = ts
 			} else {
 				return errors.New("invalid birth date")
 			}
+		} else if strictFields {
+			return fmt.Errorf("unknown field %q", key)
 		}
-		fieldsCount++
 		return nil
 	})
 	if err != nil {
 		return err
 	}
-	if all && fieldsCount < 6 {
-		return errors.New("missing required fields")
+	if all && fields != 1<<6-1 {
+		return ErrValidationMissingFields
 	}
 	return nil
 }
 
+// UnmarshalData sets location fields present in JSON object b, see
+// User.UnmarshalData for update semantics.
 func (l *Location) UnmarshalData(b []byte, all bool) error {
-	var fieldsCount int
+	var fields uint
 	err := jsonparser.ObjectEach(b, func(key []byte, value []byte, vt jsonparser.ValueType, offset int) error {
 		if vt == jsonparser.Null {
 			return errors.New("null type")
 		}
 		if bytes.Equal(key, []byte("id")) {
-			if id, err := jsonparser.ParseInt(value); err == nil {
-				l.ID = uint(id)
+			fields |= 1 << 0
+			if id, err := parseID(value, vt); err == nil {
+				l.ID = id
 			} else {
 				return fmt.Errorf("invalid id: %v", err)
 			}
 		} else if bytes.Equal(key, []byte("city")) {
-			if s, err := jsonparser.ParseString(value); err == nil {
+			fields |= 1 << 1
+			if s, err := parseString(value, vt); err == nil {
 				l.City = s
 			} else {
 				return fmt.Errorf("invalid city: %v", err)
 			}
 		} else if bytes.Equal(key, []byte("country")) {
-			if s, err := jsonparser.ParseString(value); err == nil {
+			fields |= 1 << 2
+			if s, err := parseString(value, vt); err == nil {
 				l.Country = s
 			} else {
 				return fmt.Errorf("invalid country: %v", err)
 			}
 		} else if bytes.Equal(key, []byte("place")) {
-			if s, err := jsonparser.ParseString(value); err == nil {
+			fields |= 1 << 3
+			if s, err := parseString(value, vt); err == nil {
 				l.Place = s
 			} else {
 				return fmt.Errorf("invalid place: %v", err)
 			}
 		} else if bytes.Equal(key, []byte("distance")) {
-			if d, err := jsonparser.ParseInt(value); err == nil {
+			fields |= 1 << 4
+			if d, err := parseNumber(value, vt); err == nil {
 				l.Distance = int(d)
 			} else {
 				return fmt.Errorf("invalid distance: %v", err)
 			}
+		} else if strictFields {
+			return fmt.Errorf("unknown field %q", key)
 		}
-		fieldsCount++
 		return nil
 	})
 	if err != nil {
 		return err
 	}
-	if all && fieldsCount < 5 {
-		return errors.New("missing required fields")
+	if all && fields != 1<<5-1 {
+		return ErrValidationMissingFields
 	}
 	return nil
 }
 
+// UnmarshalData sets visit fields present in JSON object b, see
+// User.UnmarshalData for update semantics.
 func (v *Visit) UnmarshalData(b []byte, all bool) error {
-	var fieldsCount int
+	var fields uint
 	err := jsonparser.ObjectEach(b, func(key []byte, value []byte, vt jsonparser.ValueType, offset int) error {
 		if vt == jsonparser.Null {
 			return errors.New("null type")
 		}
 		if bytes.Equal(key, []byte("id")) {
-			if id, err := jsonparser.ParseInt(value); err == nil {
-				v.ID = uint(id)
+			fields |= 1 << 0
+			if id, err := parseID(value, vt); err == nil {
+				v.ID = id
 			} else {
 				return fmt.Errorf("invalid id: %v", err)
 			}
 		} else if bytes.Equal(key, []byte("user")) {
-			if id, err := jsonparser.ParseInt(value); err == nil {
-				v.UserID = uint(id)
+			fields |= 1 << 1
+			if id, err := parseID(value, vt); err == nil {
+				v.UserID = id
 			} else {
 				return fmt.Errorf("invalid user id: %v", err)
 			}
 		} else if bytes.Equal(key, []byte("location")) {
-			if id, err := jsonparser.ParseInt(value); err == nil {
-				v.LocationID = uint(id)
+			fields |= 1 << 2
+			if id, err := parseID(value, vt); err == nil {
+				v.LocationID = id
 			} else {
 				return fmt.Errorf("invalid location id: %v", err)
 			}
-		} else if bytes.Equal(key, []byte("visited_at")) {
-			if ts, err := jsonparser.ParseInt(value); err == nil {
+		} else if bytes.Equal(key, []byte("visited_at")) || bytes.Equal(key, []byte("visitedAt")) {
+			fields |= 1 << 3
+			if ts, err := parseNumber(value, vt); err == nil {
 				v.VisitedAt = ts
 			} else {
 				return fmt.Errorf("invalid visited_at: %v", err)
 			}
 		} else if bytes.Equal(key, []byte("mark")) {
-			if mark, err := jsonparser.ParseInt(value); err == nil {
+			fields |= 1 << 4
+			if mark, err := parseNumber(value, vt); err == nil {
 				v.Mark = int(mark)
 			} else {
 				return fmt.Errorf("invalid mark: %v", err)
 			}
+		} else if strictFields {
+			return fmt.Errorf("unknown field %q", key)
 		}
-		fieldsCount++
 		return nil
 	})
 	if err != nil {
 		return err
 	}
-	if all && fieldsCount < 5 {
-		return errors.New("missing required fields")
+	if all && fields != 1<<5-1 {
+		return ErrValidationMissingFields
 	}
 	return nil
 }
 
+// Allowed range of user birth date (unix timestamps, inclusive).
+// Defaults are 1900-01-01 00:00:00 UTC and the process start time.
+var (
+	minBirthDate int64 = -2208988800
+	maxBirthDate       = time.Now().Unix()
+)
+
+// Allowed range of visit time (unix timestamps, inclusive).
+var (
+	minVisitedAt int64 = 946684800
+	maxVisitedAt int64 = 1420070400
+)
+
+// genders lists allowed user gender codes
+var genders = []string{"m", "f"}
+
+// validGender reports whether g is one of allowed gender codes
+func validGender(g string) bool {
+	for _, code := range genders {
+		if g == code {
+			return true
+		}
+	}
+	return false
+}
+
+// parseGenders parses comma separated list of gender codes
+func parseGenders(list string) ([]string, error) {
+	var codes []string
+	for _, code := range strings.Split(list, ",") {
+		code = strings.TrimSpace(code)
+		if code == "" {
+			return nil, fmt.Errorf("empty gender code in %q", list)
+		}
+		codes = append(codes, code)
+	}
+	return codes, nil
+}
+
+// ValidationError is a violated validation rule. Code is stable and meant
+// for programmatic handling, Message describes the rule for humans.
+type ValidationError struct {
+	Code    string
+	Message string
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// Validation errors, one per rule
+var (
+	ErrValidationMissingFields = &ValidationError{"missing_fields", "missing required fields"}
+	ErrValidationID            = &ValidationError{"invalid_id", "invalid id"}
+	ErrValidationEmail         = &ValidationError{"invalid_email", "invalid email"}
+	ErrValidationFirstName     = &ValidationError{"invalid_first_name", "invalid first_name"}
+	ErrValidationLastName      = &ValidationError{"invalid_last_name", "invalid last_name"}
+	ErrValidationGender        = &ValidationError{"invalid_gender", "invalid gender"}
+	ErrValidationBirthDate     = &ValidationError{"invalid_birth_date", "invalid birth_date"}
+	ErrValidationPlace         = &ValidationError{"invalid_place", "invalid place"}
+	ErrValidationCountry       = &ValidationError{"invalid_country", "invalid country"}
+	ErrValidationCity          = &ValidationError{"invalid_city", "invalid city"}
+	ErrValidationDistance      = &ValidationError{"invalid_distance", "invalid distance"}
+	ErrValidationLocation      = &ValidationError{"invalid_location", "invalid location"}
+	ErrValidationUser          = &ValidationError{"invalid_user", "invalid user"}
+	ErrValidationVisitedAt     = &ValidationError{"invalid_visited_at", "invalid visited_at"}
+	ErrValidationMark          = &ValidationError{"invalid_mark", "invalid mark"}
+)
+
 // Validators
-func (u User) Validate() bool {
-	return u.ID > 0 &&
-		len(u.Email) > 0 && len(u.Email) < 100 &&
-		len(u.FirstName) > 0 && len(u.LastName) < 50 &&
-		len(u.LastName) > 0 && len(u.LastName) < 50 &&
-		(u.Gender == "m" || u.Gender == "f")
-}
-
-func (l Location) Validate() bool {
-	return l.ID > 0 &&
-		len(l.Place) > 0 &&
-		len(l.Country) > 0 && len(l.Country) < 50 &&
-		len(l.City) > 0 && len(l.City) < 50 &&
-		l.Distance > 0
-}
-
-func (v Visit) Validate() bool {
-	return v.ID > 0 &&
-		v.LocationID > 0 &&
-		v.UserID > 0 &&
-		v.Mark >= 0 && v.Mark <= 5
+
+// Validate returns *ValidationError of the first invalid user field or nil
+// for a valid user.
+func (u User) Validate() error {
+	switch {
+	case u.ID == 0:
+		return ErrValidationID
+	case len(u.Email) == 0 || len(u.Email) >= 100:
+		return ErrValidationEmail
+	case len(u.FirstName) == 0 || len(u.FirstName) >= 50:
+		return ErrValidationFirstName
+	case len(u.LastName) == 0 || len(u.LastName) >= 50:
+		return ErrValidationLastName
+	case !validGender(u.Gender):
+		return ErrValidationGender
+	case u.BirthDate < minBirthDate || u.BirthDate > maxBirthDate:
+		return ErrValidationBirthDate
+	}
+	return nil
+}
+
+// Validate returns *ValidationError of the first invalid location field or
+// nil for a valid location.
+func (l Location) Validate() error {
+	switch {
+	case l.ID == 0:
+		return ErrValidationID
+	case len(l.Place) == 0:
+		return ErrValidationPlace
+	case len(l.Country) == 0 || len(l.Country) >= 50:
+		return ErrValidationCountry
+	case len(l.City) == 0 || len(l.City) >= 50:
+		return ErrValidationCity
+	case l.Distance <= 0:
+		return ErrValidationDistance
+	}
+	return nil
+}
+
+// Validate returns *ValidationError of the first invalid visit field or nil
+// for a valid visit. Visit is valid if it was made between minVisitedAt and
+// maxVisitedAt. By default these are 2000-01-01 and 2015-01-01 00:00:00 UTC
+// (inclusive). Mark is from 0 to 5 inclusive: 0 is a valid mark, it is
+// counted in averages and has its own histogram bucket.
+func (v Visit) Validate() error {
+	switch {
+	case v.ID == 0:
+		return ErrValidationID
+	case v.LocationID == 0:
+		return ErrValidationLocation
+	case v.UserID == 0:
+		return ErrValidationUser
+	case v.VisitedAt < minVisitedAt || v.VisitedAt > maxVisitedAt:
+		return ErrValidationVisitedAt
+	case v.Mark < 0 || v.Mark > 5:
+		return ErrValidationMark
+	}
+	return nil
 }
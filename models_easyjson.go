@@ -152,6 +152,18 @@ func easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup11(in *jlexer.Lexer, out *U
 				}
 				in.Delim(']')
 			}
+		case "total":
+			if in.IsNull() {
+				in.Skip()
+				out.Total = nil
+			} else {
+				if out.Total == nil {
+					out.Total = new(int)
+				}
+				*out.Total = int(in.Int())
+			}
+		case "truncated":
+			out.Truncated = bool(in.Bool())
 		default:
 			in.SkipRecursive()
 		}
@@ -183,6 +195,26 @@ func easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup11(out *jwriter.Writer, in
 		}
 		out.RawByte(']')
 	}
+	if in.Total != nil {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"total\":")
+		if in.Total == nil {
+			out.RawString("null")
+		} else {
+			out.Int(int(*in.Total))
+		}
+	}
+	if in.Truncated {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"truncated\":")
+		out.Bool(bool(in.Truncated))
+	}
 	out.RawByte('}')
 }
 
@@ -730,3 +762,1198 @@ func (v *FileData) UnmarshalJSON(data []byte) error {
 func (v *FileData) UnmarshalEasyJSON(l *jlexer.Lexer) {
 	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup16(l, v)
 }
+func easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup17(in *jlexer.Lexer, out *ErrorResult) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "error":
+			out.Error = string(in.String())
+		case "code":
+			out.Code = string(in.String())
+		case "index":
+			if in.IsNull() {
+				in.Skip()
+				out.Index = nil
+			} else {
+				if out.Index == nil {
+					out.Index = new(int)
+				}
+				*out.Index = int(in.Int())
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup17(out *jwriter.Writer, in ErrorResult) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"error\":")
+	out.String(string(in.Error))
+	if in.Code != "" {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"code\":")
+		out.String(string(in.Code))
+	}
+	if in.Index != nil {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"index\":")
+		if in.Index == nil {
+			out.RawString("null")
+		} else {
+			out.Int(int(*in.Index))
+		}
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v ErrorResult) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup17(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v ErrorResult) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup17(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *ErrorResult) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup17(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *ErrorResult) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup17(l, v)
+}
+func easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup18(in *jlexer.Lexer, out *StatsResult) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "users":
+			out.Users = int(in.Int())
+		case "locations":
+			out.Locations = int(in.Int())
+		case "visits":
+			out.Visits = int(in.Int())
+		case "alloc":
+			out.Alloc = uint64(in.Uint64())
+		case "total_alloc":
+			out.TotalAlloc = uint64(in.Uint64())
+		case "sys":
+			out.Sys = uint64(in.Uint64())
+		case "num_gc":
+			out.NumGC = uint64(in.Uint64())
+		case "user_ids":
+			if in.IsNull() {
+				in.Skip()
+				out.UserIDs = nil
+			} else {
+				in.Delim('[')
+				if out.UserIDs == nil {
+					if !in.IsDelim(']') {
+						out.UserIDs = make([]uint, 0, 8)
+					} else {
+						out.UserIDs = []uint{}
+					}
+				} else {
+					out.UserIDs = (out.UserIDs)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v47 uint
+					v47 = uint(in.Uint())
+					out.UserIDs = append(out.UserIDs, v47)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "location_ids":
+			if in.IsNull() {
+				in.Skip()
+				out.LocationIDs = nil
+			} else {
+				in.Delim('[')
+				if out.LocationIDs == nil {
+					if !in.IsDelim(']') {
+						out.LocationIDs = make([]uint, 0, 8)
+					} else {
+						out.LocationIDs = []uint{}
+					}
+				} else {
+					out.LocationIDs = (out.LocationIDs)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v48 uint
+					v48 = uint(in.Uint())
+					out.LocationIDs = append(out.LocationIDs, v48)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "visit_ids":
+			if in.IsNull() {
+				in.Skip()
+				out.VisitIDs = nil
+			} else {
+				in.Delim('[')
+				if out.VisitIDs == nil {
+					if !in.IsDelim(']') {
+						out.VisitIDs = make([]uint, 0, 8)
+					} else {
+						out.VisitIDs = []uint{}
+					}
+				} else {
+					out.VisitIDs = (out.VisitIDs)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v49 uint
+					v49 = uint(in.Uint())
+					out.VisitIDs = append(out.VisitIDs, v49)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup18(out *jwriter.Writer, in StatsResult) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"users\":")
+	out.Int(int(in.Users))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"locations\":")
+	out.Int(int(in.Locations))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"visits\":")
+	out.Int(int(in.Visits))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"alloc\":")
+	out.Uint64(uint64(in.Alloc))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"total_alloc\":")
+	out.Uint64(uint64(in.TotalAlloc))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"sys\":")
+	out.Uint64(uint64(in.Sys))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"num_gc\":")
+	out.Uint64(uint64(in.NumGC))
+	if len(in.UserIDs) != 0 {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"user_ids\":")
+		{
+			out.RawByte('[')
+			for v50, v51 := range in.UserIDs {
+				if v50 > 0 {
+					out.RawByte(',')
+				}
+				out.Uint(uint(v51))
+			}
+			out.RawByte(']')
+		}
+	}
+	if len(in.LocationIDs) != 0 {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"location_ids\":")
+		{
+			out.RawByte('[')
+			for v52, v53 := range in.LocationIDs {
+				if v52 > 0 {
+					out.RawByte(',')
+				}
+				out.Uint(uint(v53))
+			}
+			out.RawByte(']')
+		}
+	}
+	if len(in.VisitIDs) != 0 {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"visit_ids\":")
+		{
+			out.RawByte('[')
+			for v54, v55 := range in.VisitIDs {
+				if v54 > 0 {
+					out.RawByte(',')
+				}
+				out.Uint(uint(v55))
+			}
+			out.RawByte(']')
+		}
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v StatsResult) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup18(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v StatsResult) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup18(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *StatsResult) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup18(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *StatsResult) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup18(l, v)
+}
+func easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup19(in *jlexer.Lexer, out *LocationVisitorsResult) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "users":
+			if in.IsNull() {
+				in.Skip()
+				out.Users = nil
+			} else {
+				in.Delim('[')
+				if out.Users == nil {
+					if !in.IsDelim(']') {
+						out.Users = make([]uint, 0, 8)
+					} else {
+						out.Users = []uint{}
+					}
+				} else {
+					out.Users = (out.Users)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v14 uint
+					v14 = uint(in.Uint())
+					out.Users = append(out.Users, v14)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup19(out *jwriter.Writer, in LocationVisitorsResult) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"users\":")
+	if in.Users == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v15, v16 := range in.Users {
+			if v15 > 0 {
+				out.RawByte(',')
+			}
+			out.Uint(uint(v16))
+		}
+		out.RawByte(']')
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v LocationVisitorsResult) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup19(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v LocationVisitorsResult) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup19(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *LocationVisitorsResult) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup19(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *LocationVisitorsResult) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup19(l, v)
+}
+func easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup20(in *jlexer.Lexer, out *LocationHistogramResult) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "histogram":
+			(out.Histogram).UnmarshalEasyJSON(in)
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup20(out *jwriter.Writer, in LocationHistogramResult) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"histogram\":")
+	(in.Histogram).MarshalEasyJSON(out)
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v LocationHistogramResult) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup20(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v LocationHistogramResult) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup20(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *LocationHistogramResult) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup20(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *LocationHistogramResult) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup20(l, v)
+}
+func easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup21(in *jlexer.Lexer, out *UsersResult) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "users":
+			if in.IsNull() {
+				in.Skip()
+				out.Users = nil
+			} else {
+				in.Delim('[')
+				if out.Users == nil {
+					if !in.IsDelim(']') {
+						out.Users = make([]User, 0, 1)
+					} else {
+						out.Users = []User{}
+					}
+				} else {
+					out.Users = (out.Users)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v17 User
+					(v17).UnmarshalEasyJSON(in)
+					out.Users = append(out.Users, v17)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup21(out *jwriter.Writer, in UsersResult) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"users\":")
+	if in.Users == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v18, v19 := range in.Users {
+			if v18 > 0 {
+				out.RawByte(',')
+			}
+			(v19).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v UsersResult) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup21(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v UsersResult) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup21(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *UsersResult) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup21(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *UsersResult) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup21(l, v)
+}
+func easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup22(in *jlexer.Lexer, out *AgeBucket) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "from":
+			out.From = int(in.Int())
+		case "to":
+			if in.IsNull() {
+				in.Skip()
+				out.To = nil
+			} else {
+				if out.To == nil {
+					out.To = new(int)
+				}
+				*out.To = int(in.Int())
+			}
+		case "avg":
+			out.Avg = float64(in.Float64())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup22(out *jwriter.Writer, in AgeBucket) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"from\":")
+	out.Int(int(in.From))
+	if in.To != nil {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"to\":")
+		if in.To == nil {
+			out.RawString("null")
+		} else {
+			out.Int(int(*in.To))
+		}
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"avg\":")
+	out.Float64(float64(in.Avg))
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v AgeBucket) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup22(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v AgeBucket) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup22(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *AgeBucket) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup22(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *AgeBucket) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup22(l, v)
+}
+func easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup23(in *jlexer.Lexer, out *LocationAvgByAgeResult) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "buckets":
+			if in.IsNull() {
+				in.Skip()
+				out.Buckets = nil
+			} else {
+				in.Delim('[')
+				if out.Buckets == nil {
+					if !in.IsDelim(']') {
+						out.Buckets = make([]AgeBucket, 0, 2)
+					} else {
+						out.Buckets = []AgeBucket{}
+					}
+				} else {
+					out.Buckets = (out.Buckets)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v20 AgeBucket
+					(v20).UnmarshalEasyJSON(in)
+					out.Buckets = append(out.Buckets, v20)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup23(out *jwriter.Writer, in LocationAvgByAgeResult) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"buckets\":")
+	if in.Buckets == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v21, v22 := range in.Buckets {
+			if v21 > 0 {
+				out.RawByte(',')
+			}
+			(v22).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v LocationAvgByAgeResult) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup23(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v LocationAvgByAgeResult) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup23(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *LocationAvgByAgeResult) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup23(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *LocationAvgByAgeResult) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup23(l, v)
+}
+func easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup24(in *jlexer.Lexer, out *UpdateStatus) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "id":
+			out.ID = uint(in.Uint())
+		case "status":
+			out.Status = int(in.Int())
+		case "error":
+			out.Error = string(in.String())
+		case "code":
+			out.Code = string(in.String())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup24(out *jwriter.Writer, in UpdateStatus) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"id\":")
+	out.Uint(uint(in.ID))
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"status\":")
+	out.Int(int(in.Status))
+	if in.Error != "" {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"error\":")
+		out.String(string(in.Error))
+	}
+	if in.Code != "" {
+		if !first {
+			out.RawByte(',')
+		}
+		first = false
+		out.RawString("\"code\":")
+		out.String(string(in.Code))
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v UpdateStatus) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup24(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v UpdateStatus) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup24(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *UpdateStatus) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup24(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *UpdateStatus) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup24(l, v)
+}
+func easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup25(in *jlexer.Lexer, out *UpdateVisitsResult) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "results":
+			if in.IsNull() {
+				in.Skip()
+				out.Results = nil
+			} else {
+				in.Delim('[')
+				if out.Results == nil {
+					if !in.IsDelim(']') {
+						out.Results = make([]UpdateStatus, 0, 2)
+					} else {
+						out.Results = []UpdateStatus{}
+					}
+				} else {
+					out.Results = (out.Results)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v23 UpdateStatus
+					(v23).UnmarshalEasyJSON(in)
+					out.Results = append(out.Results, v23)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup25(out *jwriter.Writer, in UpdateVisitsResult) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"results\":")
+	if in.Results == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v24, v25 := range in.Results {
+			if v24 > 0 {
+				out.RawByte(',')
+			}
+			(v25).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v UpdateVisitsResult) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup25(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v UpdateVisitsResult) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup25(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *UpdateVisitsResult) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup25(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *UpdateVisitsResult) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup25(l, v)
+}
+func easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup26(in *jlexer.Lexer, out *ChangedResult) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "ids":
+			if in.IsNull() {
+				in.Skip()
+				out.IDs = nil
+			} else {
+				in.Delim('[')
+				if out.IDs == nil {
+					if !in.IsDelim(']') {
+						out.IDs = make([]uint, 0, 8)
+					} else {
+						out.IDs = []uint{}
+					}
+				} else {
+					out.IDs = (out.IDs)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v41 uint
+					v41 = uint(in.Uint())
+					out.IDs = append(out.IDs, v41)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		case "version":
+			out.Version = uint64(in.Uint64())
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup26(out *jwriter.Writer, in ChangedResult) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"ids\":")
+	if in.IDs == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v42, v43 := range in.IDs {
+			if v42 > 0 {
+				out.RawByte(',')
+			}
+			out.Uint(uint(v43))
+		}
+		out.RawByte(']')
+	}
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"version\":")
+	out.Uint64(uint64(in.Version))
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v ChangedResult) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup26(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v ChangedResult) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup26(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *ChangedResult) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup26(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *ChangedResult) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup26(l, v)
+}
+func easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup27(in *jlexer.Lexer, out *VisitsResult) {
+	isTopLevel := in.IsStart()
+	if in.IsNull() {
+		if isTopLevel {
+			in.Consumed()
+		}
+		in.Skip()
+		return
+	}
+	in.Delim('{')
+	for !in.IsDelim('}') {
+		key := in.UnsafeString()
+		in.WantColon()
+		if in.IsNull() {
+			in.Skip()
+			in.WantComma()
+			continue
+		}
+		switch key {
+		case "visits":
+			if in.IsNull() {
+				in.Skip()
+				out.Visits = nil
+			} else {
+				in.Delim('[')
+				if out.Visits == nil {
+					if !in.IsDelim(']') {
+						out.Visits = make([]Visit, 0, 1)
+					} else {
+						out.Visits = []Visit{}
+					}
+				} else {
+					out.Visits = (out.Visits)[:0]
+				}
+				for !in.IsDelim(']') {
+					var v44 Visit
+					(v44).UnmarshalEasyJSON(in)
+					out.Visits = append(out.Visits, v44)
+					in.WantComma()
+				}
+				in.Delim(']')
+			}
+		default:
+			in.SkipRecursive()
+		}
+		in.WantComma()
+	}
+	in.Delim('}')
+	if isTopLevel {
+		in.Consumed()
+	}
+}
+func easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup27(out *jwriter.Writer, in VisitsResult) {
+	out.RawByte('{')
+	first := true
+	_ = first
+	if !first {
+		out.RawByte(',')
+	}
+	first = false
+	out.RawString("\"visits\":")
+	if in.Visits == nil && (out.Flags&jwriter.NilSliceAsEmpty) == 0 {
+		out.RawString("null")
+	} else {
+		out.RawByte('[')
+		for v45, v46 := range in.Visits {
+			if v45 > 0 {
+				out.RawByte(',')
+			}
+			(v46).MarshalEasyJSON(out)
+		}
+		out.RawByte(']')
+	}
+	out.RawByte('}')
+}
+
+// MarshalJSON supports json.Marshaler interface
+func (v VisitsResult) MarshalJSON() ([]byte, error) {
+	w := jwriter.Writer{}
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup27(&w, v)
+	return w.Buffer.BuildBytes(), w.Error
+}
+
+// MarshalEasyJSON supports easyjson.Marshaler interface
+func (v VisitsResult) MarshalEasyJSON(w *jwriter.Writer) {
+	easyjsonD2b7633eEncodeGithubComZerodivisi0nHlcup27(w, v)
+}
+
+// UnmarshalJSON supports json.Unmarshaler interface
+func (v *VisitsResult) UnmarshalJSON(data []byte) error {
+	r := jlexer.Lexer{Data: data}
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup27(&r, v)
+	return r.Error()
+}
+
+// UnmarshalEasyJSON supports easyjson.Unmarshaler interface
+func (v *VisitsResult) UnmarshalEasyJSON(l *jlexer.Lexer) {
+	easyjsonD2b7633eDecodeGithubComZerodivisi0nHlcup27(l, v)
+}
@@ -0,0 +1,72 @@
+//go:build go1.18
+// +build go1.18
+
+package main
+
+import (
+	"testing"
+
+	"github.com/mailru/easyjson"
+)
+
+// unmarshalData is implemented by entities with custom unmarshalers
+type unmarshalData interface {
+	easyjson.Marshaler
+	UnmarshalData(b []byte, all bool) error
+}
+
+// fuzzUnmarshalData checks unmarshaler of the entity made by newEntity
+// doesn't panic on arbitrary input and a successfully parsed entity
+// survives marshal and unmarshal unchanged
+func fuzzUnmarshalData(f *testing.F, seeds []string, newEntity func() unmarshalData) {
+	for _, seed := range seeds {
+		f.Add([]byte(seed), false)
+		f.Add([]byte(seed), true)
+	}
+	f.Fuzz(func(t *testing.T, b []byte, all bool) {
+		e := newEntity()
+		if e.UnmarshalData(b, all) != nil {
+			return
+		}
+		data, err := easyjson.Marshal(e)
+		if err != nil {
+			t.Fatalf("marshal %q: %v", b, err)
+		}
+		parsed := newEntity()
+		if err := parsed.UnmarshalData(data, true); err != nil {
+			t.Fatalf("unmarshal %q marshaled from %q: %v", data, b, err)
+		}
+		if again, _ := easyjson.Marshal(parsed); string(again) != string(data) {
+			t.Fatalf("round trip of %q: %q != %q", b, again, data)
+		}
+	})
+}
+
+func FuzzUnmarshalUser(f *testing.F) {
+	fuzzUnmarshalData(f, []string{
+		`{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`,
+		`{"id":5,"email":"u5@hlcup.com","first_name":"Юзер","last_name":"\"Quoted\"","gender":"f","birth_date":-500000000}`,
+		`{"id":1,"firstName":"A","lastName":"B","birthDate":100}`,
+		`{"id":"1","email":null}`,
+		`{"email":"new@hlcup.com"}`,
+		`{}`,
+	}, func() unmarshalData { return new(User) })
+}
+
+func FuzzUnmarshalLocation(f *testing.F) {
+	fuzzUnmarshalData(f, []string{
+		`{"id":1,"place":"P","country":"C","city":"C","distance":1}`,
+		`{"id":2,"place":"Place\n2","country":"France","city":"Paris","distance":20}`,
+		`{"distance":"10"}`,
+		`{"city":`,
+	}, func() unmarshalData { return new(Location) })
+}
+
+func FuzzUnmarshalVisit(f *testing.F) {
+	fuzzUnmarshalData(f, []string{
+		`{"id":1,"user":1,"location":1,"visited_at":1268006400,"mark":1}`,
+		`{"id":2,"user":1,"location":2,"visitedAt":200,"mark":4}`,
+		`{"mark":[5]}`,
+		`{"user":{"id":1}}`,
+	}, func() unmarshalData { return new(Visit) })
+}
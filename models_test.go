@@ -0,0 +1,346 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/mailru/easyjson"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+)
+
+func TestUnmarshalUnknownFields(t *testing.T) {
+	defer func() { strictFields = false }()
+	tt := []struct {
+		name string
+		data string
+		v    interface {
+			UnmarshalData(b []byte, all bool) error
+		}
+	}{
+		{"User", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birthdate":0}`, &User{}},
+		{"Location", `{"id":1,"place":"P","country":"C","city":"C","dist":1}`, &Location{}},
+		{"Visit", `{"id":1,"user":1,"location":1,"visited_at":1,"marks":1}`, &Visit{}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			strictFields = false
+			assert.NoError(t, tc.v.UnmarshalData([]byte(tc.data), false))
+
+			strictFields = true
+			err := tc.v.UnmarshalData([]byte(tc.data), false)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), "unknown field")
+			}
+		})
+	}
+
+	strictFields = true
+	err := (&User{}).UnmarshalData([]byte(`{"birthdate":0}`), false)
+	assert.EqualError(t, err, `unknown field "birthdate"`)
+	assert.NoError(t, (&User{}).UnmarshalData([]byte(`{"birth_date":0}`), false))
+
+	srv := NewServer(new(MockStore))
+	ctx := doRequest(srv.handler, "POST", "/users/new", `{"birthdate":0}`)
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+}
+
+func TestUnmarshalQuotedNumbers(t *testing.T) {
+	defer func() { lenientNumbers = false }()
+	tt := []struct {
+		name string
+		data string
+		v    interface {
+			UnmarshalData(b []byte, all bool) error
+		}
+		expected interface{}
+		err      string
+	}{
+		{"User", `{"id":"1","birth_date":"-100"}`, &User{}, &User{ID: 1, BirthDate: -100}, "invalid id: number expected, got string"},
+		{"UserBirthDate", `{"id":1,"birth_date":"-100"}`, &User{}, &User{ID: 1, BirthDate: -100}, "invalid birth date"},
+		{"Location", `{"id":"2","distance":"10"}`, &Location{}, &Location{ID: 2, Distance: 10}, "invalid id: number expected, got string"},
+		{"LocationDistance", `{"id":2,"distance":"10"}`, &Location{}, &Location{ID: 2, Distance: 10}, "invalid distance: number expected, got string"},
+		{"Visit", `{"id":"3","user":"4","location":"5","visited_at":"100","mark":"4"}`, &Visit{}, &Visit{ID: 3, UserID: 4, LocationID: 5, VisitedAt: 100, Mark: 4}, "invalid id: number expected, got string"},
+		{"VisitUser", `{"id":3,"user":"4"}`, &Visit{}, &Visit{ID: 3, UserID: 4}, "invalid user id: number expected, got string"},
+		{"VisitLocation", `{"location":"5"}`, &Visit{}, &Visit{LocationID: 5}, "invalid location id: number expected, got string"},
+		{"VisitVisitedAt", `{"visited_at":"100"}`, &Visit{}, &Visit{VisitedAt: 100}, "invalid visited_at: number expected, got string"},
+		{"VisitMark", `{"mark":"4"}`, &Visit{}, &Visit{Mark: 4}, "invalid mark: number expected, got string"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			lenientNumbers = false
+			assert.EqualError(t, tc.v.UnmarshalData([]byte(tc.data), false), tc.err)
+
+			lenientNumbers = true
+			if assert.NoError(t, tc.v.UnmarshalData([]byte(tc.data), false)) {
+				assert.Equal(t, tc.expected, tc.v)
+			}
+		})
+	}
+
+	for _, lenient := range []bool{false, true} {
+		lenientNumbers = lenient
+		// plain numbers are always accepted
+		var v Visit
+		assert.NoError(t, v.UnmarshalData([]byte(`{"id":3,"user":4,"location":5,"visited_at":100,"mark":4}`), true))
+		assert.Equal(t, Visit{ID: 3, UserID: 4, LocationID: 5, VisitedAt: 100, Mark: 4}, v)
+		// non numeric values are never accepted
+		if err := v.UnmarshalData([]byte(`{"id":"abc"}`), false); assert.Error(t, err) {
+			assert.Contains(t, err.Error(), "invalid id: ")
+		}
+		assert.EqualError(t, v.UnmarshalData([]byte(`{"mark":true}`), false), "invalid mark: number expected")
+		assert.EqualError(t, v.UnmarshalData([]byte(`{"user":[1]}`), false), "invalid user id: number expected")
+	}
+
+	srv := NewServer(new(MockStore))
+	srv.EnableErrorBody()
+	lenientNumbers = false
+	ctx := doRequest(srv.handler, "POST", "/visits/new", `{"id":"1","user":1,"location":1,"visited_at":1268006400,"mark":5}`)
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+	assert.Equal(t, `{"error":"invalid id: number expected, got string"}`, string(ctx.Response.Body()))
+}
+
+func TestUnmarshalCamelCase(t *testing.T) {
+	strictFields = true
+	defer func() { strictFields = false }()
+	var u User
+	assert.NoError(t, u.UnmarshalData([]byte(`{"id":1,"email":"a@b.c","firstName":"A","lastName":"B","gender":"m","birthDate":-100}`), true))
+	assert.Equal(t, User{ID: 1, Email: "a@b.c", FirstName: "A", LastName: "B", Gender: "m", BirthDate: -100}, u)
+	assert.NoError(t, u.UnmarshalData([]byte(`{"first_name":"C","lastName":"D"}`), false))
+	assert.Equal(t, "C", u.FirstName)
+	assert.Equal(t, "D", u.LastName)
+
+	var v Visit
+	assert.NoError(t, v.UnmarshalData([]byte(`{"id":1,"user":2,"location":3,"visitedAt":100,"mark":4}`), true))
+	assert.Equal(t, Visit{ID: 1, UserID: 2, LocationID: 3, VisitedAt: 100, Mark: 4}, v)
+	assert.EqualError(t, v.UnmarshalData([]byte(`{"VisitedAt":100}`), false), `unknown field "VisitedAt"`)
+}
+
+func TestCamelKeys(t *testing.T) {
+	tt := []struct {
+		body     string
+		expected string
+	}{
+		{`{"id":1,"first_name":"A_b","birth_date":0}`, `{"id":1,"firstName":"A_b","birthDate":0}`},
+		{`{"visits":[{"mark":1,"visited_at":2,"place":"first_name"}]}`, `{"visits":[{"mark":1,"visitedAt":2,"place":"first_name"}]}`},
+		{`{"place":"\"a_b\":","num_gc":1}`, `{"place":"\"a_b\":","numGc":1}`},
+		{`{"a_1":[],"_x":{},"y_":"z"}`, `{"a_1":[],"_x":{},"y_":"z"}`},
+		{"{\n  \"total_alloc\": 1\n}", "{\n  \"totalAlloc\": 1\n}"},
+		{`["a_b"]`, `["a_b"]`},
+		{`{}`, `{}`},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.expected, string(camelKeys([]byte(tc.body))), tc.body)
+	}
+}
+
+func TestMilesToKm(t *testing.T) {
+	tt := []struct {
+		mi          int
+		floor, ceil int
+	}{
+		{0, 0, 0},
+		{1, 1, 2},
+		{10, 16, 17},
+		{15625, 25146, 25146}, // exactly 25146 km
+		{-10, -17, -16},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.floor, milesToKm(tc.mi, false), "floor %d", tc.mi)
+		assert.Equal(t, tc.ceil, milesToKm(tc.mi, true), "ceil %d", tc.mi)
+	}
+}
+
+func TestUserValidateBirthDate(t *testing.T) {
+	defer func(min, max int64) { minBirthDate, maxBirthDate = min, max }(minBirthDate, maxBirthDate)
+	minBirthDate, maxBirthDate = -2208988800, 1500000000
+
+	tt := []struct {
+		name      string
+		birthDate int64
+		valid     bool
+	}{
+		{"Epoch", 0, true},
+		{"Min", -2208988800, true},
+		{"BeforeMin", -2208988801, false},
+		{"Max", 1500000000, true},
+		{"AfterMax", 1500000001, false},
+		{"FarFuture", 1 << 40, false},
+		{"FarPast", -1 << 40, false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			u := User{ID: 1, Email: "a@b.c", FirstName: "A", LastName: "B", Gender: "m", BirthDate: tc.birthDate}
+			assert.Equal(t, tc.valid, u.Validate() == nil)
+		})
+	}
+}
+
+func TestUserValidateGender(t *testing.T) {
+	defer func(prev []string) { genders = prev }(genders)
+	u := User{ID: 1, Email: "a@b.c", FirstName: "A", LastName: "B", Gender: "m"}
+	for _, g := range []string{"m", "f"} {
+		u.Gender = g
+		assert.NoError(t, u.Validate(), g)
+	}
+	for _, g := range []string{"u", "", "M", "mf"} {
+		u.Gender = g
+		assert.Equal(t, ErrValidationGender, u.Validate(), g)
+	}
+
+	genders = []string{"m", "f", "u"}
+	u.Gender = "u"
+	assert.NoError(t, u.Validate())
+	u.Gender = "x"
+	assert.Equal(t, ErrValidationGender, u.Validate())
+}
+
+func TestParseGenders(t *testing.T) {
+	codes, err := parseGenders("m,f")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"m", "f"}, codes)
+	codes, err = parseGenders(" m , f, x ")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"m", "f", "x"}, codes)
+	_, err = parseGenders("")
+	assert.Error(t, err)
+	_, err = parseGenders("m,,f")
+	assert.Error(t, err)
+}
+
+func TestVisitValidateVisitedAt(t *testing.T) {
+	tt := []struct {
+		name      string
+		visitedAt int64
+		valid     bool
+	}{
+		{"Min", 946684800, true},
+		{"BeforeMin", 946684799, false},
+		{"Max", 1420070400, true},
+		{"AfterMax", 1420070401, false},
+		{"Inside", 1268006400, true},
+		{"Zero", 0, false},
+		{"Negative", -1, false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			v := Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: tc.visitedAt, Mark: 3}
+			assert.Equal(t, tc.valid, v.Validate() == nil)
+		})
+	}
+}
+
+func TestVisitValidateMark(t *testing.T) {
+	tt := []struct {
+		name  string
+		mark  int
+		valid bool
+	}{
+		{"Negative", -1, false},
+		{"Zero", 0, true},
+		{"Max", 5, true},
+		{"AfterMax", 6, false},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			v := Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 1268006400, Mark: tc.mark}
+			assert.Equal(t, tc.valid, v.Validate() == nil)
+		})
+	}
+}
+
+func TestValidationError(t *testing.T) {
+	user := User{ID: 1, Email: "a@b.c", FirstName: "A", LastName: "B", Gender: "m"}
+	location := Location{ID: 1, Place: "P", Country: "C", City: "C", Distance: 1}
+	visit := Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: minVisitedAt, Mark: 5}
+	tt := []struct {
+		name string
+		v    interface {
+			Validate() error
+		}
+		err  string
+		code string
+	}{
+		{"ValidUser", user, "", ""},
+		{"UserID", func(u User) User { u.ID = 0; return u }(user), "invalid id", "invalid_id"},
+		{"UserEmail", func(u User) User { u.Email = ""; return u }(user), "invalid email", "invalid_email"},
+		{"UserFirstName", func(u User) User { u.FirstName = strings.Repeat("a", 50); return u }(user), "invalid first_name", "invalid_first_name"},
+		{"UserMaxFirstName", func(u User) User { u.FirstName = strings.Repeat("a", 49); return u }(user), "", ""},
+		{"UserLastName", func(u User) User { u.LastName = strings.Repeat("a", 50); return u }(user), "invalid last_name", "invalid_last_name"},
+		{"UserMaxLastName", func(u User) User { u.LastName = strings.Repeat("a", 49); return u }(user), "", ""},
+		{"UserGender", func(u User) User { u.Gender = "x"; return u }(user), "invalid gender", "invalid_gender"},
+		{"UserBirthDate", func(u User) User { u.BirthDate = minBirthDate - 1; return u }(user), "invalid birth_date", "invalid_birth_date"},
+		{"ValidLocation", location, "", ""},
+		{"LocationPlace", func(l Location) Location { l.Place = ""; return l }(location), "invalid place", "invalid_place"},
+		{"LocationCountry", func(l Location) Location { l.Country = strings.Repeat("a", 50); return l }(location), "invalid country", "invalid_country"},
+		{"LocationCity", func(l Location) Location { l.City = ""; return l }(location), "invalid city", "invalid_city"},
+		{"LocationLongCity", func(l Location) Location { l.City = strings.Repeat("a", 50); return l }(location), "invalid city", "invalid_city"},
+		{"LocationDistance", func(l Location) Location { l.Distance = 0; return l }(location), "invalid distance", "invalid_distance"},
+		{"ValidVisit", visit, "", ""},
+		{"VisitLocation", func(v Visit) Visit { v.LocationID = 0; return v }(visit), "invalid location", "invalid_location"},
+		{"VisitUser", func(v Visit) Visit { v.UserID = 0; return v }(visit), "invalid user", "invalid_user"},
+		{"VisitVisitedAt", func(v Visit) Visit { v.VisitedAt = maxVisitedAt + 1; return v }(visit), "invalid visited_at", "invalid_visited_at"},
+		{"VisitMark", func(v Visit) Visit { v.Mark = -1; return v }(visit), "invalid mark", "invalid_mark"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.v.Validate()
+			if tc.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			if assert.IsType(t, &ValidationError{}, err) {
+				assert.Equal(t, tc.err, err.Error())
+				assert.Equal(t, tc.code, err.(*ValidationError).Code)
+			}
+		})
+	}
+}
+
+func TestUnmarshalMistypedFields(t *testing.T) {
+	tt := []struct {
+		name string
+		data string
+		v    interface {
+			UnmarshalData(b []byte, all bool) error
+		}
+		err string
+	}{
+		{"UserEmail", `{"email":123}`, &User{}, "invalid email: string expected"},
+		{"UserGender", `{"gender":["m"]}`, &User{}, "invalid gender: string expected"},
+		{"UserFirstName", "{\"first_name\":\"A\x81\"}", &User{}, "invalid first name: invalid UTF-8"},
+		{"UserID", `{"id":-1}`, &User{}, "invalid id: negative id"},
+		{"LocationCity", `{"city":true}`, &Location{}, "invalid city: string expected"},
+		{"LocationID", `{"id":-2}`, &Location{}, "invalid id: negative id"},
+		{"VisitUser", `{"user":-4}`, &Visit{}, "invalid user id: negative id"},
+		{"VisitLocation", `{"location":-5}`, &Visit{}, "invalid location id: negative id"},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.EqualError(t, tc.v.UnmarshalData([]byte(tc.data), false), tc.err)
+		})
+	}
+
+	// repeated and unknown keys don't make up for missing fields
+	var u User
+	err := u.UnmarshalData([]byte(`{"id":1,"id":1,"email":"a@b.c","first_name":"A","last_name":"B","x":0}`), true)
+	assert.Equal(t, ErrValidationMissingFields, err)
+	var l Location
+	err = l.UnmarshalData([]byte(`{"id":1,"place":"P","country":"C","city":"C","city":"D"}`), true)
+	assert.Equal(t, ErrValidationMissingFields, err)
+	var v Visit
+	err = v.UnmarshalData([]byte(`{"id":1,"user":1,"location":1,"visited_at":1,"mark_":1}`), true)
+	assert.Equal(t, ErrValidationMissingFields, err)
+}
+
+func TestMarkHistogramJSON(t *testing.T) {
+	h := MarkHistogram{1, 0, 2, 0, 0, 5}
+	data, err := easyjson.Marshal(&LocationHistogramResult{Histogram: h})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"histogram":{"0":1,"1":0,"2":2,"3":0,"4":0,"5":5}}`, string(data))
+
+	var result LocationHistogramResult
+	assert.NoError(t, easyjson.Unmarshal(data, &result))
+	assert.Equal(t, h, result.Histogram)
+	assert.Error(t, easyjson.Unmarshal([]byte(`{"histogram":{"6":1}}`), &result))
+}
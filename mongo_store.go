@@ -1,6 +1,17 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 )
@@ -8,14 +19,175 @@ import (
 type sessionFunc func(s *mgo.Session) error
 
 type MongoStore struct {
-	s *mgo.Session
+	s       *mgo.Session
+	cascade bool
+	retry   retryPolicy
+	breaker *circuitBreaker
+
+	// importSession has its own write concern, operations use it instead
+	// of s while importing is set
+	importSession *mgo.Session
+	importing     bool
+
+	// maxQueryTime limits aggregations run by queries, 0 is unlimited
+	maxQueryTime time.Duration
+}
+
+// mongoRetryBackoff is the delay before the first retry, it doubles with
+// every next attempt
+const mongoRetryBackoff = 10 * time.Millisecond
+
+// retryPolicy retries operations failed with transient errors using
+// exponential backoff. Zero policy makes a single attempt.
+type retryPolicy struct {
+	MaxRetries int           // max number of retries after the first attempt
+	MaxTime    time.Duration // max total time spent on retries, 0 is unlimited
+	Backoff    time.Duration // delay before the first retry
+}
+
+// do calls f until it succeeds, fails with non transient error or retry
+// budget is exhausted
+func (p retryPolicy) do(ctx context.Context, f func() error) error {
+	start := time.Now()
+	backoff := p.Backoff
+	for retries := 0; ; retries++ {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		err := f()
+		if err == nil || !isTransientMongoError(err) || retries >= p.MaxRetries {
+			return err
+		}
+		if p.MaxTime > 0 && time.Since(start)+backoff > p.MaxTime {
+			return err
+		}
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// isTransientMongoError reports whether operation failed with network error
+// and may succeed on retry
+func isTransientMongoError(err error) bool {
+	switch err {
+	case nil, ErrDup, ErrNotFound, ErrHasVisits, ErrUpdateID:
+		return false
+	case io.EOF, io.ErrUnexpectedEOF:
+		return true
+	}
+	if _, ok := err.(net.Error); ok {
+		return true
+	}
+	msg := err.Error()
+	for _, s := range []string{"connection reset", "broken pipe", "i/o timeout", "no reachable servers", "EOF"} {
+		if strings.Contains(msg, s) {
+			return true
+		}
+	}
+	return false
+}
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+var breakerStateNames = [...]string{"closed", "open", "half-open"}
+
+func (s breakerState) String() string {
+	return breakerStateNames[s]
+}
+
+// circuitBreaker stops calling the database after Threshold consecutive
+// operations failed with transient errors. Open breaker rejects operations
+// for Cooldown, then it is half-open: a single probe operation is let
+// through, its success closes the breaker and failure opens it again.
+// Zero Threshold disables the breaker. It is safe for concurrent use.
+type circuitBreaker struct {
+	Threshold int
+	Cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+// allow reports whether operation may be started, the caller must report
+// its result with done
+func (b *circuitBreaker) allow() bool {
+	if b.Threshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.Cooldown {
+		b.setState(breakerHalfOpen)
+	}
+	switch b.state {
+	case breakerOpen:
+		return false
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+	}
+	return true
+}
+
+// done records result of operation allowed by allow
+func (b *circuitBreaker) done(err error) {
+	if b.Threshold <= 0 {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	probe := b.probing
+	b.probing = false
+	switch {
+	case err == context.Canceled || err == context.DeadlineExceeded:
+		// says nothing about the database, next operation probes it again
+	case isTransientMongoError(err):
+		b.failures++
+		if probe || (b.state == breakerClosed && b.failures >= b.Threshold) {
+			b.openedAt = time.Now()
+			b.setState(breakerOpen)
+		}
+	default:
+		b.failures = 0
+		if probe {
+			b.setState(breakerClosed)
+		}
+	}
+}
+
+// setState switches the breaker state, called with mu held
+func (b *circuitBreaker) setState(state breakerState) {
+	if b.state == state {
+		return
+	}
+	if state == breakerOpen {
+		log.Warnf("Mongo circuit breaker is open after %d failures, retry in %v", b.failures, b.Cooldown)
+	} else {
+		log.Infof("Mongo circuit breaker is %s", state)
+	}
+	b.state = state
 }
 
 func NewMongoStore(s *mgo.Session) (*MongoStore, error) {
-	if err := usersCollection(s).EnsureIndex(mgo.Index{
-		Key:    []string{"e"},
-		Unique: true,
-	}); err != nil {
+	store := &MongoStore{s: s, retry: retryPolicy{Backoff: mongoRetryBackoff}, breaker: &circuitBreaker{}}
+	if err := store.SetUniqueEmail(true); err != nil {
 		return nil, err
 	}
 	if err := visitsCollection(s).EnsureIndexKey("u", "v"); err != nil {
@@ -24,20 +196,145 @@ func NewMongoStore(s *mgo.Session) (*MongoStore, error) {
 	if err := visitsCollection(s).EnsureIndexKey("l", "v"); err != nil {
 		return nil, err
 	}
-	return &MongoStore{s}, nil
+	return store, nil
+}
+
+// SetUniqueEmail switches the unique user email constraint, it is on by
+// default. The constraint is a unique sparse index and blank emails are
+// not stored, so they are never considered duplicates. Turning it on fails
+// if existing users share an email.
+func (s *MongoStore) SetUniqueEmail(unique bool) error {
+	users := usersCollection(s.s)
+	// index options can't be changed in place, so it is recreated
+	if err := users.DropIndex("e"); err != nil && !strings.Contains(err.Error(), "not found") {
+		return err
+	}
+	if !unique {
+		return nil
+	}
+	err := users.EnsureIndex(mgo.Index{
+		Key:    []string{"e"},
+		Unique: true,
+		Sparse: true,
+	})
+	if mgo.IsDup(err) {
+		return ErrDup
+	}
+	return err
+}
+
+// SetCascade switches delete of users and locations to remove their visits
+// too. Otherwise delete of an entity referenced by visits fails with
+// ErrHasVisits. It must not be called concurrently with other methods.
+func (s *MongoStore) SetCascade(cascade bool) {
+	s.cascade = cascade
+}
+
+// SetRetry configures retries of operations failed with transient network
+// errors. Zero retries disable retrying, zero maxTime doesn't limit total
+// retry time.
+func (s *MongoStore) SetRetry(retries int, maxTime time.Duration) {
+	s.retry.MaxRetries = retries
+	s.retry.MaxTime = maxTime
+}
+
+// SetBreaker configures the circuit breaker: after failures consecutive
+// operations failed with transient errors other operations fail with
+// ErrUnavailable for cooldown. Zero failures disable the breaker. It must
+// not be called concurrently with other methods.
+func (s *MongoStore) SetBreaker(failures int, cooldown time.Duration) {
+	s.breaker = &circuitBreaker{Threshold: failures, Cooldown: cooldown}
+}
+
+// SetWriteConcern sets write concern of all operations, nil safe makes
+// writes unacknowledged. Stronger concern, e.g. majority, survives failover
+// of the primary but every write waits for replication.
+func (s *MongoStore) SetWriteConcern(safe *mgo.Safe) {
+	s.s.SetSafe(safe)
+}
+
+// SetImportWriteConcern sets write concern used in import mode instead of
+// the serving one. Unacknowledged import is the fastest, but failed writes
+// go unnoticed, so the imported data should be verified or reimported.
+func (s *MongoStore) SetImportWriteConcern(safe *mgo.Safe) {
+	if s.importSession != nil {
+		s.importSession.Close()
+	}
+	s.importSession = s.s.Copy()
+	s.importSession.SetSafe(safe)
+}
+
+// SetImportMode switches operations to import write concern if it is set.
+// It must not be called concurrently with other methods.
+func (s *MongoStore) SetImportMode(importing bool) {
+	s.importing = importing
+}
+
+// SetReadPreference sets read preference of all operations. Reads from
+// secondaries offload the primary, but may return stale data, so a client
+// may not see its own recent writes.
+func (s *MongoStore) SetReadPreference(mode mgo.Mode) {
+	s.s.SetMode(mode, true)
+	if s.importSession != nil {
+		s.importSession.SetMode(mode, true)
+	}
+}
+
+// SetMaxQueryTime limits time the database spends on aggregations of a
+// single query, so an expensive one fails with ErrTimeout instead of
+// running indefinitely. Shorter time left before the context deadline
+// takes precedence. Zero maxTime doesn't limit aggregations.
+func (s *MongoStore) SetMaxQueryTime(maxTime time.Duration) {
+	s.maxQueryTime = maxTime
+}
+
+// parseWriteConcern returns safety mode for write concern name or number of
+// nodes acknowledging writes. Nil safe means unacknowledged writes.
+func parseWriteConcern(name string) (*mgo.Safe, error) {
+	switch name {
+	case "unacknowledged":
+		return nil, nil
+	case "acknowledged":
+		return &mgo.Safe{}, nil
+	case "journaled":
+		return &mgo.Safe{J: true}, nil
+	case "majority":
+		return &mgo.Safe{WMode: "majority"}, nil
+	}
+	if w, err := strconv.Atoi(name); err == nil && w > 0 {
+		return &mgo.Safe{W: w}, nil
+	}
+	return nil, fmt.Errorf("invalid write concern %q", name)
+}
+
+var readPreferences = map[string]mgo.Mode{
+	"primary":            mgo.Primary,
+	"primaryPreferred":   mgo.PrimaryPreferred,
+	"secondary":          mgo.Secondary,
+	"secondaryPreferred": mgo.SecondaryPreferred,
+	"nearest":            mgo.Nearest,
+}
+
+// parseReadPreference returns session mode for read preference name
+func parseReadPreference(name string) (mgo.Mode, error) {
+	mode, ok := readPreferences[name]
+	if !ok {
+		return 0, fmt.Errorf("invalid read preference %q", name)
+	}
+	return mode, nil
 }
 
 // User methods
-func (s *MongoStore) CreateUser(u *User) error {
+func (s *MongoStore) CreateUser(ctx context.Context, u *User) error {
 	if u.ID == 0 {
 		return ErrMissingID
 	}
-	return s.withSession(func(s *mgo.Session) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
 		return usersCollection(s).Insert(u)
 	})
 }
 
-func (s *MongoStore) CreateUsers(us []User) error {
+func (s *MongoStore) CreateUsers(ctx context.Context, us []User) error {
 	docs := make([]interface{}, len(us))
 	for i, u := range us {
 		if u.ID == 0 {
@@ -45,7 +342,7 @@ func (s *MongoStore) CreateUsers(us []User) error {
 		}
 		docs[i] = u
 	}
-	return s.withSession(func(s *mgo.Session) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
 		bulk := usersCollection(s).Bulk()
 		bulk.Insert(docs...)
 		_, err := bulk.Run()
@@ -53,23 +350,46 @@ func (s *MongoStore) CreateUsers(us []User) error {
 	})
 }
 
-func (s *MongoStore) UpdateUser(id uint, u *User) error {
+func (s *MongoStore) UpdateUser(ctx context.Context, id uint, u *User) error {
 	if id != u.ID {
 		return ErrUpdateID
 	}
-	return s.withSession(func(s *mgo.Session) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
 		return usersCollection(s).UpdateId(id, u)
 	})
 }
 
-func (s *MongoStore) GetUser(id uint, u *User) error {
-	return s.withSession(func(s *mgo.Session) error {
+func (s *MongoStore) GetUser(ctx context.Context, id uint, u *User) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
 		return usersCollection(s).FindId(id).One(u)
 	})
 }
 
-func (s *MongoStore) GetUserVisits(id uint, q *UserVisitsQuery, visits *[]UserVisit) error {
-	return s.withSession(func(s *mgo.Session) error {
+func (s *MongoStore) GetUsers(ctx context.Context, ids []uint, users *[]User) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
+		var found []User
+		if err := usersCollection(s).Find(bson.M{"_id": bson.M{"$in": ids}}).All(&found); err != nil {
+			return err
+		}
+		byID := make(map[uint]*User, len(found))
+		for i := range found {
+			byID[found[i].ID] = &found[i]
+		}
+		results := make([]User, 0, len(ids))
+		for _, id := range ids {
+			if u := byID[id]; u != nil {
+				results = append(results, *u)
+			}
+		}
+		*users = results
+		return nil
+	})
+}
+
+func (s *MongoStore) GetUserVisits(ctx context.Context, id uint, q *UserVisitsQuery, visits *[]UserVisit) (int, error) {
+	var total int
+	budget := s.maxQueryTime
+	if err := s.withSession(ctx, func(s *mgo.Session) error {
 		// Check users exists
 		c, err := usersCollection(s).FindId(id).Count()
 		if err != nil {
@@ -79,21 +399,85 @@ func (s *MongoStore) GetUserVisits(id uint, q *UserVisitsQuery, visits *[]UserVi
 			return mgo.ErrNotFound
 		}
 		// Query visits
-		return visitsCollection(s).Pipe(userVisitsPipeline(id, q)).All(visits)
+		maxTime := mongoMaxTime(ctx, budget)
+		pipeline := userVisitsPipeline(id, q)
+		if q.Offset == 0 && q.Limit == 0 {
+			if err := newMongoPipe(visitsCollection(s), pipeline, maxTime).All(visits); err != nil {
+				return err
+			}
+			total = len(*visits)
+			return nil
+		}
+		if err := newMongoPipe(visitsCollection(s), pagePipeline(pipeline, q.Offset, q.Limit), maxTime).All(visits); err != nil {
+			return err
+		}
+		if !q.WithTotal {
+			return nil
+		}
+		// Count all matching visits
+		result := bson.M{}
+		err = newMongoPipe(visitsCollection(s), countPipeline(pipeline), maxTime).One(&result)
+		if err == mgo.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		total = result["count"].(int)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return total, nil
+}
+
+func (s *MongoStore) GetUserAvg(ctx context.Context, id uint, q *UserVisitsQuery) (float64, error) {
+	var avg float64
+	budget := s.maxQueryTime
+	if err := s.withSession(ctx, func(s *mgo.Session) error {
+		// Check users exists
+		c, err := usersCollection(s).FindId(id).Count()
+		if err != nil {
+			return err
+		}
+		if c == 0 {
+			return mgo.ErrNotFound
+		}
+		result := bson.M{}
+		err = newMongoPipe(visitsCollection(s), userAvgPipeline(id, q), mongoMaxTime(ctx, budget)).One(&result)
+		if err == mgo.ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		avg = result["avg"].(float64)
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return avg, nil
+}
+
+func (s *MongoStore) DeleteUser(ctx context.Context, id uint) error {
+	cascade := s.cascade
+	return s.withSession(ctx, func(s *mgo.Session) error {
+		if err := deleteVisitsOf(s, usersCollection(s), id, bson.M{"u": id}, cascade); err != nil {
+			return err
+		}
+		return usersCollection(s).RemoveId(id)
 	})
 }
 
 // Location methods
-func (s *MongoStore) CreateLocation(l *Location) error {
+func (s *MongoStore) CreateLocation(ctx context.Context, l *Location) error {
 	if l.ID == 0 {
 		return ErrMissingID
 	}
-	return s.withSession(func(s *mgo.Session) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
 		return locationsCollection(s).Insert(l)
 	})
 }
 
-func (s *MongoStore) CreateLocations(ls []Location) error {
+func (s *MongoStore) CreateLocations(ctx context.Context, ls []Location) error {
 	docs := make([]interface{}, len(ls))
 	for i, l := range ls {
 		if l.ID == 0 {
@@ -101,7 +485,7 @@ func (s *MongoStore) CreateLocations(ls []Location) error {
 		}
 		docs[i] = l
 	}
-	return s.withSession(func(s *mgo.Session) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
 		bulk := locationsCollection(s).Bulk()
 		bulk.Insert(docs...)
 		_, err := bulk.Run()
@@ -109,24 +493,28 @@ func (s *MongoStore) CreateLocations(ls []Location) error {
 	})
 }
 
-func (s *MongoStore) UpdateLocation(id uint, l *Location) error {
+func (s *MongoStore) UpdateLocation(ctx context.Context, id uint, l *Location) error {
 	if id != l.ID {
 		return ErrUpdateID
 	}
-	return s.withSession(func(s *mgo.Session) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
 		return locationsCollection(s).UpdateId(id, l)
 	})
 }
 
-func (s *MongoStore) GetLocation(id uint, l *Location) error {
-	return s.withSession(func(s *mgo.Session) error {
+func (s *MongoStore) GetLocation(ctx context.Context, id uint, l *Location) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
 		return locationsCollection(s).FindId(id).One(l)
 	})
 }
 
-func (s *MongoStore) GetLocationAvg(id uint, q *LocationAvgQuery) (float64, error) {
-	var avg float64
-	if err := s.withSession(func(s *mgo.Session) error {
+func (s *MongoStore) GetLocationAvg(ctx context.Context, id uint, q *LocationAvgQuery) (float64, int, error) {
+	var (
+		avg   float64
+		count int
+	)
+	budget := s.maxQueryTime
+	if err := s.withSession(ctx, func(s *mgo.Session) error {
 		// Check location exists
 		c, err := locationsCollection(s).FindId(id).Count()
 		if err != nil {
@@ -136,31 +524,143 @@ func (s *MongoStore) GetLocationAvg(id uint, q *LocationAvgQuery) (float64, erro
 			return mgo.ErrNotFound
 		}
 		result := bson.M{}
-		err = visitsCollection(s).Pipe(locationAvgPipeline(id, q)).One(&result)
+		err = newMongoPipe(visitsCollection(s), locationAvgPipeline(id, q), mongoMaxTime(ctx, budget)).One(&result)
 		if err == mgo.ErrNotFound {
 			return nil
 		} else if err != nil {
 			return err
 		}
 		avg = result["avg"].(float64)
+		count = result["n"].(int)
 		return nil
 	}); err != nil {
-		return 0, err
+		return 0, 0, err
 	}
-	return avg, nil
+	return avg, count, nil
+}
+
+func (s *MongoStore) GetLocationAvgByAge(ctx context.Context, id uint, q *LocationAvgQuery, buckets []AgeBucket) error {
+	budget := s.maxQueryTime
+	return s.withSession(ctx, func(s *mgo.Session) error {
+		// Check location exists
+		c, err := locationsCollection(s).FindId(id).Count()
+		if err != nil {
+			return err
+		}
+		if c == 0 {
+			return mgo.ErrNotFound
+		}
+		bounds := ageBirthBounds(buckets, time.Now())
+		var result []struct {
+			Lower interface{} `bson:"_id"`
+			Avg   float64     `bson:"avg"`
+		}
+		if err := newMongoPipe(visitsCollection(s), locationAvgByAgePipeline(id, q, bounds), mongoMaxTime(ctx, budget)).All(&result); err != nil {
+			return err
+		}
+		// bucket i has lower bound bounds[i+1]+1, the last one is unbounded
+		index := map[int64]int{math.MinInt64: len(buckets) - 1}
+		for i := 0; i+1 < len(bounds); i++ {
+			index[bounds[i+1]+1] = i
+		}
+		for i := range buckets {
+			buckets[i].Avg = 0
+		}
+		for _, r := range result {
+			// default bucket of users born in future has string id
+			if lower, ok := r.Lower.(int64); ok {
+				if i, ok := index[lower]; ok {
+					buckets[i].Avg = r.Avg
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *MongoStore) GetLocationHistogram(ctx context.Context, id uint, q *LocationAvgQuery, h *MarkHistogram) error {
+	budget := s.maxQueryTime
+	return s.withSession(ctx, func(s *mgo.Session) error {
+		// Check location exists
+		c, err := locationsCollection(s).FindId(id).Count()
+		if err != nil {
+			return err
+		}
+		if c == 0 {
+			return mgo.ErrNotFound
+		}
+		var result []struct {
+			Mark  int `bson:"_id"`
+			Count int `bson:"n"`
+		}
+		pipeline := append(locationVisitsPipeline(id, q), bson.M{"$group": bson.M{"_id": "$m", "n": bson.M{"$sum": 1}}})
+		if err := newMongoPipe(visitsCollection(s), pipeline, mongoMaxTime(ctx, budget)).All(&result); err != nil {
+			return err
+		}
+		*h = MarkHistogram{}
+		for _, r := range result {
+			if r.Mark >= 0 && r.Mark < len(h) {
+				h[r.Mark] = r.Count
+			}
+		}
+		return nil
+	})
+}
+
+// GetLocationVisitors returns ids of users visited the location in ascending order
+func (s *MongoStore) GetLocationVisitors(ctx context.Context, id uint, q *LocationVisitorsQuery, users *[]uint) error {
+	budget := s.maxQueryTime
+	return s.withSession(ctx, func(s *mgo.Session) error {
+		// Check location exists
+		c, err := locationsCollection(s).FindId(id).Count()
+		if err != nil {
+			return err
+		}
+		if c == 0 {
+			return mgo.ErrNotFound
+		}
+		var result []struct {
+			ID uint `bson:"_id"`
+		}
+		if err := newMongoPipe(visitsCollection(s), locationVisitorsPipeline(id, q), mongoMaxTime(ctx, budget)).All(&result); err != nil {
+			return err
+		}
+		ids := make([]uint, len(result))
+		for i, r := range result {
+			ids[i] = r.ID
+		}
+		*users = ids
+		return nil
+	})
+}
+
+func (s *MongoStore) DeleteLocation(ctx context.Context, id uint) error {
+	cascade := s.cascade
+	return s.withSession(ctx, func(s *mgo.Session) error {
+		if err := deleteVisitsOf(s, locationsCollection(s), id, bson.M{"l": id}, cascade); err != nil {
+			return err
+		}
+		return locationsCollection(s).RemoveId(id)
+	})
 }
 
 // Visit methods
-func (s *MongoStore) CreateVisit(v *Visit) error {
+func (s *MongoStore) CreateVisit(ctx context.Context, v *Visit) error {
 	if v.ID == 0 {
 		return ErrMissingID
 	}
-	return s.withSession(func(s *mgo.Session) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
+		if err := checkVisitRefs(s, v); err != nil {
+			return err
+		}
 		return visitsCollection(s).Insert(v)
 	})
 }
 
-func (s *MongoStore) CreateVisits(vs []Visit) error {
+// CreateVisits inserts visits in bulk. Referenced users and locations are
+// not checked here: it is used for data import where they are known
+// to be created beforehand and extra lookups would slow it down a lot.
+func (s *MongoStore) CreateVisits(ctx context.Context, vs []Visit) error {
 	docs := make([]interface{}, len(vs))
 	for i, v := range vs {
 		if v.ID == 0 {
@@ -168,7 +668,7 @@ func (s *MongoStore) CreateVisits(vs []Visit) error {
 		}
 		docs[i] = v
 	}
-	return s.withSession(func(s *mgo.Session) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
 		bulk := visitsCollection(s).Bulk()
 		bulk.Insert(docs...)
 		_, err := bulk.Run()
@@ -176,23 +676,137 @@ func (s *MongoStore) CreateVisits(vs []Visit) error {
 	})
 }
 
-func (s *MongoStore) UpdateVisit(id uint, v *Visit) error {
+func (s *MongoStore) UpdateVisit(ctx context.Context, id uint, v *Visit) error {
 	if id != v.ID {
 		return ErrUpdateID
 	}
-	return s.withSession(func(s *mgo.Session) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
 		return visitsCollection(s).UpdateId(id, v)
 	})
 }
 
-func (s *MongoStore) GetVisit(id uint, v *Visit) error {
-	return s.withSession(func(s *mgo.Session) error {
+func (s *MongoStore) UpdateVisits(ctx context.Context, vs []Visit) []error {
+	errs := make([]error, len(vs))
+	for i := range vs {
+		errs[i] = s.UpdateVisit(ctx, vs[i].ID, &vs[i])
+	}
+	return errs
+}
+
+func (s *MongoStore) GetVisit(ctx context.Context, id uint, v *Visit) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
 		return visitsCollection(s).FindId(id).One(v)
 	})
 }
 
-func (s *MongoStore) Clear() error {
-	return s.withSession(func(s *mgo.Session) error {
+func (s *MongoStore) QueryVisits(ctx context.Context, q *VisitsQuery, visits *[]Visit) error {
+	if q.UserID == 0 && q.LocationID == 0 {
+		return ErrMissingID
+	}
+	return s.withSession(ctx, func(s *mgo.Session) error {
+		query := bson.M{}
+		// Check queried user and location exist
+		if q.UserID != 0 {
+			c, err := usersCollection(s).FindId(q.UserID).Count()
+			if err != nil {
+				return err
+			}
+			if c == 0 {
+				return mgo.ErrNotFound
+			}
+			query["u"] = q.UserID
+		}
+		if q.LocationID != 0 {
+			c, err := locationsCollection(s).FindId(q.LocationID).Count()
+			if err != nil {
+				return err
+			}
+			if c == 0 {
+				return mgo.ErrNotFound
+			}
+			query["l"] = q.LocationID
+		}
+		if tr := timeRangeQuery(q.FromDate, q.ToDate); tr != nil {
+			query["v"] = tr
+		}
+		results := []Visit{}
+		if err := visitsCollection(s).Find(query).Sort("v", "_id").Skip(q.Offset).Limit(q.Limit).All(&results); err != nil {
+			return err
+		}
+		*visits = results
+		return nil
+	})
+}
+
+func (s *MongoStore) DeleteVisit(ctx context.Context, id uint) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
+		return visitsCollection(s).RemoveId(id)
+	})
+}
+
+func (s *MongoStore) Ping(ctx context.Context) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
+		return s.Ping()
+	})
+}
+
+// EachUser calls f for every user until f returns false
+func (s *MongoStore) EachUser(ctx context.Context, f func(u *User) bool) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
+		iter := usersCollection(s).Find(nil).Iter()
+		for {
+			var u User
+			if !iter.Next(&u) || !f(&u) {
+				break
+			}
+		}
+		return iter.Close()
+	})
+}
+
+// EachLocation calls f for every location until f returns false
+func (s *MongoStore) EachLocation(ctx context.Context, f func(l *Location) bool) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
+		iter := locationsCollection(s).Find(nil).Iter()
+		for {
+			var l Location
+			if !iter.Next(&l) || !f(&l) {
+				break
+			}
+		}
+		return iter.Close()
+	})
+}
+
+// EachVisit calls f for every visit until f returns false
+func (s *MongoStore) EachVisit(ctx context.Context, f func(v *Visit) bool) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
+		iter := visitsCollection(s).Find(nil).Iter()
+		for {
+			var v Visit
+			if !iter.Next(&v) || !f(&v) {
+				break
+			}
+		}
+		return iter.Close()
+	})
+}
+
+func (s *MongoStore) Count(ctx context.Context, c *StoreCounts) error {
+	return s.withSession(ctx, func(s *mgo.Session) (err error) {
+		if c.Users, err = usersCollection(s).Count(); err != nil {
+			return err
+		}
+		if c.Locations, err = locationsCollection(s).Count(); err != nil {
+			return err
+		}
+		c.Visits, err = visitsCollection(s).Count()
+		return err
+	})
+}
+
+func (s *MongoStore) Clear(ctx context.Context) error {
+	return s.withSession(ctx, func(s *mgo.Session) error {
 		if _, err := usersCollection(s).RemoveAll(nil); err != nil {
 			return err
 		}
@@ -206,18 +820,174 @@ func (s *MongoStore) Clear() error {
 	})
 }
 
-func (s *MongoStore) withSession(f sessionFunc) error {
-	session := s.s.Clone() // wrap session
-	err := f(session)
-	session.Close()
-	if mgo.IsDup(err) {
-		err = ErrDup
-	} else if err == mgo.ErrNotFound {
-		return ErrNotFound
+func (s *MongoStore) withSession(ctx context.Context, f sessionFunc) error {
+	if !s.breaker.allow() {
+		return ErrUnavailable
 	}
+	base := s.s
+	if s.importing && s.importSession != nil {
+		base = s.importSession
+	}
+	err := s.retry.do(ctx, func() error {
+		session := base.Clone() // wrap session
+		err := f(session)
+		if isTransientMongoError(err) {
+			session.Refresh() // drop broken socket
+		}
+		session.Close()
+		if mgo.IsDup(err) {
+			err = ErrDup
+		} else if err == mgo.ErrNotFound {
+			return ErrNotFound
+		} else if isMaxTimeError(err) {
+			return ErrTimeout
+		}
+		return err
+	})
+	s.breaker.done(err)
 	return err
 }
 
+// mongoExceededTimeLimit is the error code of operation interrupted after
+// its maxTimeMS
+const mongoExceededTimeLimit = 50
+
+func isMaxTimeError(err error) bool {
+	qerr, ok := err.(*mgo.QueryError)
+	return ok && qerr.Code == mongoExceededTimeLimit
+}
+
+// mongoMaxTime returns time limit of query operations: budget or the time
+// left before ctx deadline if it is shorter. Zero means no limit.
+func mongoMaxTime(ctx context.Context, budget time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return budget
+	}
+	left := time.Until(deadline)
+	if left < time.Millisecond {
+		left = time.Millisecond // zero maxTimeMS would be unlimited
+	}
+	if budget > 0 && budget < left {
+		return budget
+	}
+	return left
+}
+
+// mongoPipe is an aggregation pipeline with maxTimeMS option mgo Pipe lacks
+type mongoPipe struct {
+	c        *mgo.Collection
+	pipeline []bson.M
+	maxTime  time.Duration
+}
+
+func newMongoPipe(c *mgo.Collection, pipeline []bson.M, maxTime time.Duration) *mongoPipe {
+	return &mongoPipe{c: c, pipeline: pipeline, maxTime: maxTime}
+}
+
+type aggregateCmd struct {
+	Aggregate string   `bson:"aggregate"`
+	Pipeline  []bson.M `bson:"pipeline"`
+	Cursor    bson.M   `bson:"cursor"`
+	MaxTimeMS int64    `bson:"maxTimeMS,omitempty"`
+}
+
+// command returns aggregate command running the pipeline
+func (p *mongoPipe) command() aggregateCmd {
+	cmd := aggregateCmd{
+		Aggregate: p.c.Name,
+		Pipeline:  p.pipeline,
+		Cursor:    bson.M{},
+	}
+	if p.maxTime > 0 {
+		cmd.MaxTimeMS = int64(p.maxTime / time.Millisecond)
+		if cmd.MaxTimeMS == 0 {
+			cmd.MaxTimeMS = 1
+		}
+	}
+	return cmd
+}
+
+// Iter runs the pipeline like mgo Pipe.Iter does
+func (p *mongoPipe) Iter() *mgo.Iter {
+	// cursor is bound to the server, which eventual session doesn't keep
+	session := p.c.Database.Session.Clone()
+	defer session.Close()
+	if session.Mode() == mgo.Eventual {
+		session.SetMode(mgo.Monotonic, false)
+	}
+	c := p.c.With(session)
+
+	var result struct {
+		Cursor struct {
+			FirstBatch []bson.Raw `bson:"firstBatch"`
+			ID         int64      `bson:"id"`
+		} `bson:"cursor"`
+	}
+	err := c.Database.Run(p.command(), &result)
+	return c.NewIter(p.c.Database.Session, result.Cursor.FirstBatch, result.Cursor.ID, err)
+}
+
+func (p *mongoPipe) All(result interface{}) error {
+	return p.Iter().All(result)
+}
+
+// One unmarshals the first pipeline result, it fails with mgo.ErrNotFound
+// if there are no results
+func (p *mongoPipe) One(result interface{}) error {
+	iter := p.Iter()
+	if iter.Next(result) {
+		return iter.Close()
+	}
+	if err := iter.Err(); err != nil {
+		return err
+	}
+	return mgo.ErrNotFound
+}
+
+// deleteVisitsOf removes visits matching query of the existing owner if
+// cascade is set, otherwise it fails with ErrHasVisits if there are any
+func deleteVisitsOf(s *mgo.Session, owners *mgo.Collection, id uint, query bson.M, cascade bool) error {
+	c, err := owners.FindId(id).Count()
+	if err != nil {
+		return err
+	}
+	if c == 0 {
+		return mgo.ErrNotFound
+	}
+	if cascade {
+		_, err = visitsCollection(s).RemoveAll(query)
+		return err
+	}
+	c, err = visitsCollection(s).Find(query).Limit(1).Count()
+	if err != nil {
+		return err
+	}
+	if c > 0 {
+		return ErrHasVisits
+	}
+	return nil
+}
+
+// checkVisitRefs ensures that user and location referenced by visit exist
+func checkVisitRefs(s *mgo.Session, v *Visit) error {
+	c, err := usersCollection(s).FindId(v.UserID).Count()
+	if err != nil {
+		return err
+	}
+	if c == 0 {
+		return mgo.ErrNotFound
+	}
+	c, err = locationsCollection(s).FindId(v.LocationID).Count()
+	if err != nil {
+		return err
+	}
+	if c == 0 {
+		return mgo.ErrNotFound
+	}
+	return nil
+}
+
 func usersCollection(s *mgo.Session) *mgo.Collection {
 	return s.DB("").C("users")
 }
@@ -240,13 +1010,24 @@ func userVisitsPipeline(id uint, q *UserVisitsQuery) []bson.M {
 	if q.Country != "" {
 		filterStage["loc.co"] = q.Country
 	}
-	if q.ToDistance != nil {
-		filterStage["loc.d"] = bson.M{"$lt": q.ToDistance}
+	if q.Distance != nil {
+		filterStage["loc.d"] = *q.Distance
+	} else if dr := intRangeQuery(q.FromDistance, q.ToDistance); dr != nil {
+		if q.ToDistanceInclusive && q.ToDistance != nil {
+			delete(dr, "$lt")
+			dr["$lte"] = *q.ToDistance
+		}
+		filterStage["loc.d"] = dr
+	}
+
+	order := 1
+	if q.Desc {
+		order = -1
 	}
 
 	return []bson.M{
 		{"$match": matchStage},                                                                          // filter by user
-		{"$sort": bson.M{"v": 1}},                                                                       // ascending order
+		{"$sort": bson.D{{Name: "v", Value: order}, {Name: "_id", Value: order}}},                       // ascending or descending order, ties broken by id for stable paging
 		{"$lookup": bson.M{"from": "locations", "localField": "l", "foreignField": "_id", "as": "loc"}}, // join location
 		{"$unwind": "$loc"},                                           // unwind location array
 		{"$match": filterStage},                                       // filter results by country and distance
@@ -254,17 +1035,48 @@ func userVisitsPipeline(id uint, q *UserVisitsQuery) []bson.M {
 	}
 }
 
+// userAvgPipeline averages marks of user visits matching the query
+func userAvgPipeline(id uint, q *UserVisitsQuery) []bson.M {
+	groupStage := bson.M{"_id": "_", "avg": bson.M{"$avg": "$m"}}
+	return append(userVisitsPipeline(id, q), bson.M{"$group": groupStage})
+}
+
+// pagePipeline extends pipeline with offset and limit stages
+func pagePipeline(pipeline []bson.M, offset, limit int) []bson.M {
+	result := append([]bson.M{}, pipeline...)
+	if offset > 0 {
+		result = append(result, bson.M{"$skip": offset})
+	}
+	if limit > 0 {
+		result = append(result, bson.M{"$limit": limit})
+	}
+	return result
+}
+
+// countPipeline extends pipeline with stage counting its documents
+func countPipeline(pipeline []bson.M) []bson.M {
+	result := append([]bson.M{}, pipeline...)
+	return append(result, bson.M{"$group": bson.M{"_id": nil, "count": bson.M{"$sum": 1}}})
+}
+
 func locationAvgPipeline(id uint, q *LocationAvgQuery) []bson.M {
+	groupStage := bson.M{"_id": "_", "avg": bson.M{"$avg": "$m"}, "n": bson.M{"$sum": 1}}
+	return append(locationVisitsPipeline(id, q), bson.M{"$group": groupStage})
+}
+
+// locationVisitsPipeline selects location visits matching the query
+func locationVisitsPipeline(id uint, q *LocationAvgQuery) []bson.M {
 	matchStage := bson.M{"l": id}
 	if tr := timeRangeQuery(q.FromDate, q.ToDate); tr != nil {
 		matchStage["v"] = tr
 	}
+	if mr := intRangeQuery(q.FromMark, q.ToMark); mr != nil {
+		matchStage["m"] = mr
+	}
 
-	groupStage := bson.M{"_id": "_", "avg": bson.M{"$avg": "$m"}}
 	if q.FromAge == nil && q.ToAge == nil && q.Gender == "" {
 		return []bson.M{
 			{"$match": matchStage},
-			{"$group": groupStage},
 		}
 	}
 
@@ -282,10 +1094,62 @@ func locationAvgPipeline(id uint, q *LocationAvgQuery) []bson.M {
 		{"$lookup": bson.M{"from": "users", "localField": "u", "foreignField": "_id", "as": "user"}},
 		{"$unwind": "$user"},
 		{"$match": filterStage},
-		{"$group": groupStage},
 	}
 }
 
+// locationAvgByAgePipeline averages marks grouped by visitor birth date
+// into buckets, bounds are the latest birth dates of every age bucket
+func locationAvgByAgePipeline(id uint, q *LocationAvgQuery, bounds []int64) []bson.M {
+	pipeline := locationVisitsPipeline(id, q)
+	if len(pipeline) == 1 {
+		// no users filter, lookup them anyway
+		pipeline = append(pipeline,
+			bson.M{"$lookup": bson.M{"from": "users", "localField": "u", "foreignField": "_id", "as": "user"}},
+			bson.M{"$unwind": "$user"},
+		)
+	}
+	// $bucket boundaries are ascending, lower one is inclusive
+	boundaries := []interface{}{int64(math.MinInt64)}
+	for i := len(bounds) - 1; i >= 0; i-- {
+		boundaries = append(boundaries, bounds[i]+1)
+	}
+	return append(pipeline, bson.M{"$bucket": bson.M{
+		"groupBy":    "$user.b",
+		"boundaries": boundaries,
+		"default":    "future",
+		"output":     bson.M{"avg": bson.M{"$avg": "$m"}},
+	}})
+}
+
+func locationVisitorsPipeline(id uint, q *LocationVisitorsQuery) []bson.M {
+	matchStage := bson.M{"l": id}
+	if tr := timeRangeQuery(q.FromDate, q.ToDate); tr != nil {
+		matchStage["v"] = tr
+	}
+	return []bson.M{
+		{"$match": matchStage},          // filter by location
+		{"$group": bson.M{"_id": "$u"}}, // distinct users
+		{"$lookup": bson.M{"from": "users", "localField": "_id", "foreignField": "_id", "as": "user"}},
+		{"$match": bson.M{"user": bson.M{"$ne": []interface{}{}}}}, // skip deleted users
+		{"$project": bson.M{"_id": 1}},
+		{"$sort": bson.M{"_id": 1}},
+	}
+}
+
+func intRangeQuery(from, to *int) bson.M {
+	if from == nil && to == nil {
+		return nil
+	}
+	query := bson.M{}
+	if from != nil {
+		query["$gt"] = *from
+	}
+	if to != nil {
+		query["$lt"] = *to
+	}
+	return query
+}
+
 func timeRangeQuery(from, to *int64) bson.M {
 	if from != nil && to != nil {
 		return bson.M{
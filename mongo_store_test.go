@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/valyala/fasthttp"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// testMongoStore connects to database specified by HLCUP_TEST_MONGO_URL
+// environment variable. Test is skipped if variable is not set.
+func testMongoStore(t *testing.T) *MongoStore {
+	ctx := context.Background()
+	url := os.Getenv("HLCUP_TEST_MONGO_URL")
+	if url == "" {
+		t.Skip("HLCUP_TEST_MONGO_URL is not set")
+	}
+	session, err := mgo.DialWithTimeout(url, 5*time.Second)
+	if err != nil {
+		t.Fatalf("could not connect to mongo: %v", err)
+	}
+	s, err := NewMongoStore(session)
+	if err != nil {
+		session.Close()
+		t.Fatalf("could not create store: %v", err)
+	}
+	if err := s.Clear(ctx); err != nil {
+		session.Close()
+		t.Fatalf("could not clear store: %v", err)
+	}
+	return s
+}
+
+func TestMongoCreateOrphanVisit(t *testing.T) {
+	ctx := context.Background()
+	s := testMongoStore(t)
+	defer s.s.Close()
+
+	visit := Visit{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 1000, Mark: 3}
+	assert.Equal(t, ErrNotFound, s.CreateVisit(ctx, &visit))
+
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "test@example.com"}))
+	assert.Equal(t, ErrNotFound, s.CreateVisit(ctx, &visit))
+
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1}))
+	assert.NoError(t, s.CreateVisit(ctx, &visit))
+	assert.NoError(t, s.Clear(ctx))
+}
+
+func TestRetryPolicy(t *testing.T) {
+	ctx := context.Background()
+	p := retryPolicy{MaxRetries: 3, MaxTime: time.Second, Backoff: time.Millisecond}
+
+	// fails twice then succeeds
+	calls := 0
+	assert.NoError(t, p.do(ctx, func() error {
+		calls++
+		if calls <= 2 {
+			return io.EOF
+		}
+		return nil
+	}))
+	assert.Equal(t, 3, calls)
+
+	// retries are exhausted
+	calls = 0
+	assert.Equal(t, io.EOF, p.do(ctx, func() error {
+		calls++
+		return io.EOF
+	}))
+	assert.Equal(t, 4, calls)
+
+	// non transient errors are returned immediately
+	for _, err := range []error{ErrDup, ErrNotFound, ErrHasVisits, errors.New("invalid query")} {
+		calls = 0
+		assert.Equal(t, err, p.do(ctx, func() error {
+			calls++
+			return err
+		}))
+		assert.Equal(t, 1, calls, err.Error())
+	}
+
+	// total retry time is limited
+	calls = 0
+	p = retryPolicy{MaxRetries: 100, MaxTime: 50 * time.Millisecond, Backoff: 10 * time.Millisecond}
+	start := time.Now()
+	assert.Equal(t, io.EOF, p.do(ctx, func() error {
+		calls++
+		return io.EOF
+	}))
+	assert.True(t, time.Since(start) < 50*time.Millisecond)
+	assert.Equal(t, 3, calls) // after 10ms and 20ms backoff
+
+	// canceled context stops retrying
+	cctx, cancel := context.WithCancel(ctx)
+	calls = 0
+	assert.Equal(t, io.EOF, p.do(cctx, func() error {
+		calls++
+		cancel()
+		return io.EOF
+	}))
+	assert.Equal(t, 1, calls)
+
+	// zero policy makes a single attempt
+	calls = 0
+	assert.Equal(t, io.EOF, retryPolicy{}.do(ctx, func() error {
+		calls++
+		return io.EOF
+	}))
+	assert.Equal(t, 1, calls)
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	b := &circuitBreaker{Threshold: 3, Cooldown: 20 * time.Millisecond}
+	fail := func() {
+		assert.True(t, b.allow())
+		b.done(io.EOF)
+	}
+
+	// non transient errors reset failure count
+	fail()
+	fail()
+	assert.True(t, b.allow())
+	b.done(ErrNotFound)
+	fail()
+	fail()
+	assert.Equal(t, breakerClosed, b.state)
+
+	// trips open
+	fail()
+	assert.Equal(t, breakerOpen, b.state)
+	assert.False(t, b.allow())
+
+	// a single probe after cooldown, its failure opens the breaker again
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, b.allow())
+	assert.False(t, b.allow())
+	b.done(io.EOF)
+	assert.Equal(t, breakerOpen, b.state)
+	assert.False(t, b.allow())
+
+	// canceled probe lets the next operation probe
+	time.Sleep(20 * time.Millisecond)
+	assert.True(t, b.allow())
+	b.done(context.Canceled)
+	assert.Equal(t, breakerHalfOpen, b.state)
+
+	// successful probe closes it
+	assert.True(t, b.allow())
+	b.done(nil)
+	assert.Equal(t, breakerClosed, b.state)
+	assert.True(t, b.allow())
+	b.done(nil)
+
+	// zero threshold disables the breaker
+	b = &circuitBreaker{}
+	for i := 0; i < 10; i++ {
+		fail()
+	}
+
+	// open breaker fails fast without touching the session
+	s := &MongoStore{breaker: &circuitBreaker{Threshold: 1, Cooldown: time.Minute, state: breakerOpen, openedAt: time.Now()}}
+	assert.Equal(t, ErrUnavailable, s.GetUser(context.Background(), 1, &User{}))
+}
+
+func TestIsTransientMongoError(t *testing.T) {
+	assert.True(t, isTransientMongoError(io.EOF))
+	assert.True(t, isTransientMongoError(&net.OpError{Op: "read", Err: errors.New("connection reset by peer")}))
+	assert.True(t, isTransientMongoError(errors.New("no reachable servers")))
+	assert.True(t, isTransientMongoError(errors.New("read tcp 127.0.0.1:27017: i/o timeout")))
+	assert.False(t, isTransientMongoError(nil))
+	assert.False(t, isTransientMongoError(ErrDup))
+	assert.False(t, isTransientMongoError(ErrNotFound))
+	assert.False(t, isTransientMongoError(mgo.ErrNotFound))
+	assert.False(t, isTransientMongoError(errors.New("Closed explicitly")))
+}
+
+func TestParseWriteConcern(t *testing.T) {
+	tt := []struct {
+		name string
+		safe *mgo.Safe
+	}{
+		{"unacknowledged", nil},
+		{"acknowledged", &mgo.Safe{}},
+		{"journaled", &mgo.Safe{J: true}},
+		{"majority", &mgo.Safe{WMode: "majority"}},
+		{"2", &mgo.Safe{W: 2}},
+	}
+	for _, tc := range tt {
+		safe, err := parseWriteConcern(tc.name)
+		assert.NoError(t, err, tc.name)
+		assert.Equal(t, tc.safe, safe, tc.name)
+	}
+	for _, name := range []string{"", "0", "-1", "all"} {
+		_, err := parseWriteConcern(name)
+		assert.EqualError(t, err, "invalid write concern \""+name+"\"")
+	}
+}
+
+func TestParseReadPreference(t *testing.T) {
+	mode, err := parseReadPreference("nearest")
+	assert.NoError(t, err)
+	assert.Equal(t, mgo.Nearest, mode)
+	mode, err = parseReadPreference("primary")
+	assert.NoError(t, err)
+	assert.Equal(t, mgo.Primary, mode)
+	_, err = parseReadPreference("Nearest")
+	assert.EqualError(t, err, `invalid read preference "Nearest"`)
+}
+
+func TestUserVisitsPipelineDistance(t *testing.T) {
+	from, to := 10, 20
+	filter := func(q *UserVisitsQuery) interface{} {
+		return userVisitsPipeline(1, q)[4]["$match"].(bson.M)["loc.d"]
+	}
+	assert.Equal(t, bson.M{"$gt": 10, "$lt": 20}, filter(&UserVisitsQuery{FromDistance: &from, ToDistance: &to}))
+	assert.Equal(t, bson.M{"$gt": 10, "$lte": 20}, filter(&UserVisitsQuery{FromDistance: &from, ToDistance: &to, ToDistanceInclusive: true}))
+	assert.Equal(t, bson.M{"$gt": 10}, filter(&UserVisitsQuery{FromDistance: &from, ToDistanceInclusive: true}))
+}
+
+func TestUserVisitsPipelineOrder(t *testing.T) {
+	sort := func(q *UserVisitsQuery) interface{} {
+		return userVisitsPipeline(1, q)[1]["$sort"]
+	}
+	assert.Equal(t, bson.D{{Name: "v", Value: 1}, {Name: "_id", Value: 1}}, sort(&UserVisitsQuery{}))
+	assert.Equal(t, bson.D{{Name: "v", Value: -1}, {Name: "_id", Value: -1}}, sort(&UserVisitsQuery{Desc: true}))
+}
+
+func TestMongoPipeMaxTime(t *testing.T) {
+	c := &mgo.Collection{Name: "visits"}
+	pipeline := locationAvgPipeline(1, &LocationAvgQuery{})
+	cmd := newMongoPipe(c, pipeline, 1500*time.Millisecond).command()
+	assert.Equal(t, "visits", cmd.Aggregate)
+	assert.Equal(t, pipeline, cmd.Pipeline)
+	assert.Equal(t, int64(1500), cmd.MaxTimeMS)
+	assert.Equal(t, int64(1), newMongoPipe(c, pipeline, time.Microsecond).command().MaxTimeMS)
+
+	// no limit is omitted from the command
+	data, err := bson.Marshal(newMongoPipe(c, pipeline, 0).command())
+	assert.NoError(t, err)
+	var doc bson.M
+	assert.NoError(t, bson.Unmarshal(data, &doc))
+	assert.NotContains(t, doc, "maxTimeMS")
+	assert.Contains(t, doc, "cursor")
+}
+
+func TestMongoMaxTime(t *testing.T) {
+	assert.Equal(t, 2*time.Second, mongoMaxTime(context.Background(), 2*time.Second))
+	assert.Equal(t, time.Duration(0), mongoMaxTime(context.Background(), 0))
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	assert.Equal(t, time.Millisecond, mongoMaxTime(ctx, time.Millisecond))
+	maxTime := mongoMaxTime(ctx, time.Minute)
+	assert.True(t, maxTime > 0 && maxTime <= time.Second, maxTime)
+	maxTime = mongoMaxTime(ctx, 0)
+	assert.True(t, maxTime > 0 && maxTime <= time.Second, maxTime)
+
+	ctx, cancel = context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	assert.Equal(t, time.Millisecond, mongoMaxTime(ctx, time.Minute))
+
+	assert.True(t, isMaxTimeError(&mgo.QueryError{Code: mongoExceededTimeLimit, Message: "operation exceeded time limit"}))
+	assert.False(t, isMaxTimeError(&mgo.QueryError{Code: 2}))
+	assert.False(t, isMaxTimeError(errors.New("operation exceeded time limit")))
+	assert.Equal(t, fasthttp.StatusGatewayTimeout, dbErrorStatus(ErrTimeout))
+}
+
+func TestMongoSessionConcern(t *testing.T) {
+	ctx := context.Background()
+	s := testMongoStore(t)
+	defer s.s.Close()
+	sessionSafe := func() (safe *mgo.Safe, mode mgo.Mode) {
+		assert.NoError(t, s.withSession(ctx, func(session *mgo.Session) error {
+			safe, mode = session.Safe(), session.Mode()
+			return nil
+		}))
+		return
+	}
+
+	s.SetWriteConcern(&mgo.Safe{WMode: "majority"})
+	s.SetImportWriteConcern(nil)
+	s.SetReadPreference(mgo.PrimaryPreferred)
+	safe, mode := sessionSafe()
+	assert.Equal(t, &mgo.Safe{WMode: "majority"}, safe)
+	assert.Equal(t, mgo.PrimaryPreferred, mode)
+
+	s.SetImportMode(true)
+	safe, mode = sessionSafe()
+	assert.Nil(t, safe)
+	assert.Equal(t, mgo.PrimaryPreferred, mode)
+	assert.NoError(t, s.CreateUsers(ctx, []User{{ID: 1, Email: "u1@hlcup.com"}}))
+
+	s.SetImportMode(false)
+	safe, _ = sessionSafe()
+	assert.Equal(t, &mgo.Safe{WMode: "majority"}, safe)
+	assert.NoError(t, s.Clear(ctx))
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+
+	"github.com/buger/jsonparser"
+	"github.com/valyala/fasthttp"
+)
+
+type route int
+
+const (
+	routeUnknown route = iota
+	routeMethodNotAllowed
+	routeCreateUser
+	routeUpdateUser
+	routeReplaceUser
+	routeGetUser
+	routeGetUsers
+	routeGetUserVisits
+	routeGetUserAvg
+	routeGetChangedUsers
+	routeDeleteUser
+	routeCreateLocation
+	routeUpdateLocation
+	routeReplaceLocation
+	routeGetLocation
+	routeGetLocationAvg
+	routeGetLocationHistogram
+	routeGetLocationVisitors
+	routeGetChangedLocations
+	routeDeleteLocation
+	routeCreateVisit
+	routeCreateVisits
+	routeUpdateVisit
+	routeReplaceVisit
+	routeUpdateVisits
+	routeGetVisit
+	routeQueryVisits
+	routeGetChangedVisits
+	routeDeleteVisit
+	routeMetrics
+	routeStats
+	routeAdminClear
+	routeAdminExport
+	routeAdminRebuildIndexes
+	routePreflight
+	routeLive
+	routeReady
+	routeLoading
+	routeUnknownQuery
+	routesCount
+)
+
+var routeNames = [routesCount]string{
+	routeUnknown:              "unknown",
+	routeMethodNotAllowed:     "methodNotAllowed",
+	routeCreateUser:           "createUser",
+	routeUpdateUser:           "updateUser",
+	routeReplaceUser:          "replaceUser",
+	routeGetUser:              "getUser",
+	routeGetUsers:             "getUsers",
+	routeGetUserVisits:        "getUserVisits",
+	routeGetUserAvg:           "getUserAvg",
+	routeGetChangedUsers:      "getChangedUsers",
+	routeDeleteUser:           "deleteUser",
+	routeCreateLocation:       "createLocation",
+	routeUpdateLocation:       "updateLocation",
+	routeReplaceLocation:      "replaceLocation",
+	routeGetLocation:          "getLocation",
+	routeGetLocationAvg:       "getLocationAvg",
+	routeGetLocationHistogram: "getLocationHistogram",
+	routeGetLocationVisitors:  "getLocationVisitors",
+	routeGetChangedLocations:  "getChangedLocations",
+	routeDeleteLocation:       "deleteLocation",
+	routeCreateVisit:          "createVisit",
+	routeCreateVisits:         "createVisits",
+	routeUpdateVisit:          "updateVisit",
+	routeReplaceVisit:         "replaceVisit",
+	routeUpdateVisits:         "updateVisits",
+	routeGetVisit:             "getVisit",
+	routeQueryVisits:          "queryVisits",
+	routeGetChangedVisits:     "getChangedVisits",
+	routeDeleteVisit:          "deleteVisit",
+	routeMetrics:              "metrics",
+	routeStats:                "stats",
+	routeAdminClear:           "adminClear",
+	routeAdminExport:          "adminExport",
+	routeAdminRebuildIndexes:  "adminRebuildIndexes",
+	routePreflight:            "preflight",
+	routeLive:                 "live",
+	routeReady:                "ready",
+	routeLoading:              "loading",
+	routeUnknownQuery:         "unknownQuery",
+}
+
+func (r route) String() string {
+	return routeNames[r]
+}
+
+// resource is a set of endpoints sharing the same path
+type resource struct {
+	get    route
+	post   route
+	put    route // full replace, omitted fields get zero values
+	patch  route // JSON merge patch, the same as partial update with POST
+	delete route
+	allow  string   // value for Allow header
+	query  []string // query parameters known to get route, nil if not checked
+}
+
+// query parameters of user visits and location stats endpoints
+var (
+	userVisitsQuery        = []string{"fromDate", "toDate", "country", "fromDistance", "toDistance", "toDistanceInclusive", "distance", "unit", "order", "offset", "limit", "withTotal"}
+	userAvgQuery           = []string{"fromDate", "toDate", "country", "fromDistance", "toDistance", "toDistanceInclusive", "distance", "unit"}
+	locationHistogramQuery = []string{"fromDate", "toDate", "fromAge", "toAge", "gender", "fromMark", "toMark"}
+	locationAvgQuery       = append([]string{"groupBy", "nullEmpty"}, locationHistogramQuery...)
+	locationVisitorsQuery  = []string{"fromDate", "toDate"}
+	visitsQuery            = []string{"user", "location", "fromDate", "toDate", "offset", "limit"}
+	changedQuery           = []string{"since"}
+)
+
+var (
+	newUserResource           = &resource{post: routeCreateUser}
+	userResource              = &resource{get: routeGetUser, post: routeUpdateUser, put: routeReplaceUser, patch: routeUpdateUser, delete: routeDeleteUser, query: []string{}}
+	usersResource             = &resource{get: routeGetUsers, query: []string{"ids"}}
+	userVisitsResource        = &resource{get: routeGetUserVisits, query: userVisitsQuery}
+	userAvgResource           = &resource{get: routeGetUserAvg, query: userAvgQuery}
+	changedUsersResource      = &resource{get: routeGetChangedUsers, query: changedQuery}
+	newLocationResource       = &resource{post: routeCreateLocation}
+	locationResource          = &resource{get: routeGetLocation, post: routeUpdateLocation, put: routeReplaceLocation, patch: routeUpdateLocation, delete: routeDeleteLocation, query: []string{}}
+	locationAvgResource       = &resource{get: routeGetLocationAvg, query: locationAvgQuery}
+	locationHistogramResource = &resource{get: routeGetLocationHistogram, query: locationHistogramQuery}
+	locationVisitorsResource  = &resource{get: routeGetLocationVisitors, query: locationVisitorsQuery}
+	changedLocationsResource  = &resource{get: routeGetChangedLocations, query: changedQuery}
+	newVisitResource          = &resource{post: routeCreateVisit}
+	visitsResource            = &resource{get: routeQueryVisits, query: visitsQuery}
+	bulkVisitsResource        = &resource{post: routeCreateVisits}
+	bulkUpdateVisitsResource  = &resource{post: routeUpdateVisits}
+	changedVisitsResource     = &resource{get: routeGetChangedVisits, query: changedQuery}
+	visitResource             = &resource{get: routeGetVisit, post: routeUpdateVisit, put: routeReplaceVisit, patch: routeUpdateVisit, delete: routeDeleteVisit, query: []string{}}
+	metricsResource           = &resource{get: routeMetrics}
+	statsResource             = &resource{get: routeStats}
+	adminClearResource        = &resource{post: routeAdminClear}
+	adminExportResource       = &resource{post: routeAdminExport}
+	adminRebuildResource      = &resource{post: routeAdminRebuildIndexes}
+	liveResource              = &resource{get: routeLive}
+	readyResource             = &resource{get: routeReady}
+)
+
+func init() {
+	for _, res := range []*resource{
+		newUserResource, userResource, usersResource, userVisitsResource, userAvgResource, changedUsersResource,
+		newLocationResource, locationResource, locationAvgResource,
+		locationHistogramResource, locationVisitorsResource, changedLocationsResource,
+		newVisitResource, visitsResource, bulkVisitsResource, bulkUpdateVisitsResource, changedVisitsResource, visitResource,
+		metricsResource, statsResource, adminClearResource, adminExportResource, adminRebuildResource,
+		liveResource, readyResource,
+	} {
+		var methods []string
+		if res.get != routeUnknown {
+			methods = append(methods, "GET", "HEAD")
+		}
+		if res.post != routeUnknown {
+			methods = append(methods, "POST")
+		}
+		if res.put != routeUnknown {
+			methods = append(methods, "PUT")
+		}
+		if res.patch != routeUnknown {
+			methods = append(methods, "PATCH")
+		}
+		if res.delete != routeUnknown {
+			methods = append(methods, "DELETE")
+		}
+		res.allow = strings.Join(methods, ", ")
+	}
+}
+
+// matchResource resolves request path to the resource regardless of method.
+// Single trailing slash is ignored, paths of unexpected shape match nothing.
+func matchResource(path []byte) *resource {
+	var segs [3][]byte
+	n := splitPath(path, segs[:])
+	if n < 1 {
+		return nil
+	}
+	switch string(segs[0]) {
+	case "users":
+		switch {
+		case n == 1:
+			return usersResource
+		case n == 2 && string(segs[1]) == "new":
+			return newUserResource
+		case n == 2 && string(segs[1]) == "changed":
+			return changedUsersResource
+		case n == 2:
+			return userResource
+		case n == 3 && string(segs[2]) == "visits":
+			return userVisitsResource
+		case n == 3 && string(segs[2]) == "avg":
+			return userAvgResource
+		}
+	case "locations":
+		switch {
+		case n == 2 && string(segs[1]) == "new":
+			return newLocationResource
+		case n == 2 && string(segs[1]) == "changed":
+			return changedLocationsResource
+		case n == 2:
+			return locationResource
+		case n == 3 && string(segs[2]) == "avg":
+			return locationAvgResource
+		case n == 3 && string(segs[2]) == "histogram":
+			return locationHistogramResource
+		case n == 3 && string(segs[2]) == "visitors":
+			return locationVisitorsResource
+		}
+	case "visits":
+		switch {
+		case n == 1:
+			return visitsResource
+		case n == 2 && string(segs[1]) == "new":
+			return newVisitResource
+		case n == 2 && string(segs[1]) == "bulk":
+			return bulkVisitsResource
+		case n == 2 && string(segs[1]) == "bulk-update":
+			return bulkUpdateVisitsResource
+		case n == 2 && string(segs[1]) == "changed":
+			return changedVisitsResource
+		case n == 2:
+			return visitResource
+		}
+	case "admin":
+		switch {
+		case n == 2 && string(segs[1]) == "clear":
+			return adminClearResource
+		case n == 2 && string(segs[1]) == "export":
+			return adminExportResource
+		case n == 2 && string(segs[1]) == "rebuild-indexes":
+			return adminRebuildResource
+		}
+	case "metrics":
+		if n == 1 {
+			return metricsResource
+		}
+	case "stats":
+		if n == 1 {
+			return statsResource
+		}
+	case "live":
+		if n == 1 {
+			return liveResource
+		}
+	case "ready":
+		if n == 1 {
+			return readyResource
+		}
+	}
+	return nil
+}
+
+// unknownQueryKey returns the first query parameter which is neither in known
+// list nor common to all endpoints, or empty string if there is none
+func unknownQueryKey(args *fasthttp.Args, known []string) string {
+	var unknown string
+	args.VisitAll(func(key, _ []byte) {
+		if unknown != "" || string(key) == "pretty" {
+			return
+		}
+		for _, k := range known {
+			if string(key) == k {
+				return
+			}
+		}
+		unknown = string(key)
+	})
+	return unknown
+}
+
+var errInvalidPath = errors.New("invalid path")
+
+// pathID parses entity id, the second segment of request path
+func pathID(path []byte) (int64, error) {
+	var segs [3][]byte
+	if splitPath(path, segs[:]) < 2 {
+		return 0, errInvalidPath
+	}
+	return jsonparser.ParseInt(segs[1])
+}
+
+// splitPath splits path into segments without allocations. Single trailing
+// slash is ignored. It returns number of segments or -1 if there are more
+// than len(segs) of them or some are empty.
+func splitPath(path []byte, segs [][]byte) int {
+	if len(path) > 1 && path[len(path)-1] == '/' {
+		path = path[:len(path)-1]
+	}
+	n := 0
+	for len(path) > 0 {
+		if path[0] != '/' || n == len(segs) {
+			return -1
+		}
+		path = path[1:]
+		i := bytes.IndexByte(path, '/')
+		if i < 0 {
+			i = len(path)
+		}
+		if i == 0 {
+			return -1
+		}
+		segs[n] = path[:i]
+		n++
+		path = path[i:]
+	}
+	return n
+}
+
+// matchRoute resolves request method and path to the endpoint. Known path
+// requested with unsupported method resolves to routeMethodNotAllowed.
+func matchRoute(ctx *fasthttp.RequestCtx) (route, *resource) {
+	res := matchResource(ctx.Path())
+	if res == nil {
+		return routeUnknown, nil
+	}
+	r := routeUnknown
+	if ctx.IsGet() || ctx.IsHead() {
+		r = res.get
+	} else if ctx.IsPost() {
+		r = res.post
+	} else if ctx.IsPut() {
+		r = res.put
+	} else if ctx.IsPatch() {
+		r = res.patch
+	} else if ctx.IsDelete() {
+		r = res.delete
+	}
+	if r == routeUnknown {
+		return routeMethodNotAllowed, res
+	}
+	return r, res
+}
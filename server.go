@@ -1,10 +1,18 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"hash/fnv"
+	"io"
 	"math"
+	"math/rand"
 	"runtime"
+	"runtime/debug"
+	"strconv"
 	"sync/atomic"
 	"time"
 
@@ -16,11 +24,24 @@ import (
 
 var emptyResponseBody = []byte("{}\n")
 
+// precomputed bodies of common empty results
+var (
+	emptyVisitsBody = []byte(`{"visits":[]}`)
+	zeroAvgBody     = []byte(`{"avg":0}`)
+	nullAvgBody     = []byte(`{"avg":null}`)
+)
+
 var (
 	ErrMissingID = errors.New("missing id")
 	ErrNotFound  = errors.New("not found")
 	ErrUpdateID  = errors.New("id field cannot be changed")
 	ErrDup       = errors.New("duplicate key error")
+	ErrHasVisits = errors.New("entity is referenced by visits")
+	// ErrUnavailable is returned without trying to reach the database
+	// known to be down
+	ErrUnavailable = errors.New("database is unavailable")
+	// ErrTimeout is returned by query which exceeded its time limit
+	ErrTimeout = errors.New("query time limit exceeded")
 )
 
 // rating stages for GC
@@ -31,107 +52,455 @@ var stages = []uint32{
 	150150 + 40000 + 630000,
 }
 
+// Store methods take request context as the first parameter. Long running
+// queries give up with ctx.Err() once the context is done. Server cancels
+// the context when request timeout (see Server.SetTimeout) expires or on
+// shutdown. Client disconnects are not detected by fasthttp, so they don't
+// cancel the context.
 type Store interface {
 	// User methods
-	CreateUser(u *User) error
-	CreateUsers(us []User) error
-	UpdateUser(id uint, u *User) error
-	GetUser(id uint, u *User) error
-	GetUserVisits(id uint, q *UserVisitsQuery, visits *[]UserVisit) error
+	CreateUser(ctx context.Context, u *User) error
+	CreateUsers(ctx context.Context, us []User) error
+	UpdateUser(ctx context.Context, id uint, u *User) error
+	GetUser(ctx context.Context, id uint, u *User) error
+	// GetUsers finds users in ids order, missing ids are skipped
+	GetUsers(ctx context.Context, ids []uint, users *[]User) error
+	// GetUserVisits returns total number of matching visits besides the
+	// page. Stores may skip counting and return zero unless q.WithTotal
+	// is set.
+	GetUserVisits(ctx context.Context, id uint, q *UserVisitsQuery, visits *[]UserVisit) (int, error)
+	// GetUserAvg returns average mark of user visits matching the query,
+	// Offset, Limit and order are ignored
+	GetUserAvg(ctx context.Context, id uint, q *UserVisitsQuery) (float64, error)
+	DeleteUser(ctx context.Context, id uint) error
 
 	// Location methods
-	CreateLocation(l *Location) error
-	CreateLocations(ls []Location) error
-	UpdateLocation(id uint, l *Location) error
-	GetLocation(id uint, l *Location) error
-	GetLocationAvg(id uint, q *LocationAvgQuery) (float64, error)
+	CreateLocation(ctx context.Context, l *Location) error
+	CreateLocations(ctx context.Context, ls []Location) error
+	UpdateLocation(ctx context.Context, id uint, l *Location) error
+	GetLocation(ctx context.Context, id uint, l *Location) error
+	// GetLocationAvg returns average mark of location visits matching the
+	// query and their count, zero avg if there are none
+	GetLocationAvg(ctx context.Context, id uint, q *LocationAvgQuery) (float64, int, error)
+	// GetLocationAvgByAge sets Avg of every bucket to average mark of
+	// visitors of that age
+	GetLocationAvgByAge(ctx context.Context, id uint, q *LocationAvgQuery, buckets []AgeBucket) error
+	GetLocationHistogram(ctx context.Context, id uint, q *LocationAvgQuery, h *MarkHistogram) error
+	GetLocationVisitors(ctx context.Context, id uint, q *LocationVisitorsQuery, users *[]uint) error
+	DeleteLocation(ctx context.Context, id uint) error
 
 	// Visit methods
-	CreateVisit(v *Visit) error
-	CreateVisits(vs []Visit) error
-	UpdateVisit(id uint, v *Visit) error
-	GetVisit(id uint, v *Visit) error
+	CreateVisit(ctx context.Context, v *Visit) error
+	CreateVisits(ctx context.Context, vs []Visit) error
+	UpdateVisit(ctx context.Context, id uint, v *Visit) error
+	// UpdateVisits updates every visit independently, the result holds
+	// error of every update, nil for successful ones
+	UpdateVisits(ctx context.Context, vs []Visit) []error
+	GetVisit(ctx context.Context, id uint, v *Visit) error
+	// QueryVisits finds visits matching the query, it fails with
+	// ErrNotFound if the queried user or location doesn't exist
+	QueryVisits(ctx context.Context, q *VisitsQuery, visits *[]Visit) error
+	DeleteVisit(ctx context.Context, id uint) error
+
+	// Count entities in the database
+	Count(ctx context.Context, c *StoreCounts) error
 
-	// Clear the entire databasec
-	Clear() error
+	// EachUser, EachLocation and EachVisit call f for every entity of the
+	// kind until f returns false. Order of entities is not specified.
+	EachUser(ctx context.Context, f func(u *User) bool) error
+	EachLocation(ctx context.Context, f func(l *Location) bool) error
+	EachVisit(ctx context.Context, f func(v *Visit) bool) error
+
+	// Ping checks the database is reachable
+	Ping(ctx context.Context) error
+
+	// Clear the entire database
+	Clear(ctx context.Context) error
 }
 
 type Server struct {
-	store Store
-	stage int
-	qcnt  uint32
+	store   Store
+	metrics *metrics
+	stage   uint32
+	qcnt    uint32
+
+	compress        bool
+	compressMinSize int
+	maxBodySize     int
+	accessLog       bool
+	admin           bool
+	avgPrecision    int
+	nullEmptyAvg    bool
+	maxVisits       int
+	timeout         time.Duration
+	concurrency     int
+	readTimeout     time.Duration
+	writeTimeout    time.Duration
+	errorBody       bool
+	textErrors      bool
+	strictQuery     bool
+	corsOrigin      string
+	http2           bool
+	loading         int32
 }
 
+// default limit for request body size
+const defaultMaxBodySize = 1024 * 1024
+
+// default number of decimal places in location average
+const defaultAvgPrecision = 5
+
 func NewServer(store Store) *Server {
 	return &Server{
-		store: store,
+		store:        store,
+		metrics:      newMetrics(),
+		maxBodySize:  defaultMaxBodySize,
+		avgPrecision: defaultAvgPrecision,
 	}
 }
 
 func (s *Server) Listen(addr string) error {
-	return fasthttp.ListenAndServe(addr, s.handler)
+	if s.http2 {
+		return s.h2cServer(addr).ListenAndServe()
+	}
+	return s.httpServer().ListenAndServe(addr)
+}
+
+// SetMaxBodySize limits request body size. Larger requests are rejected
+// with 413 status code before reaching handler.
+func (s *Server) SetMaxBodySize(size int) {
+	s.maxBodySize = size
+}
+
+// SetTimeout limits request handling time. Requests not handled in time
+// are answered with 503 status code. Store calls get a context with the
+// same deadline, so handler gives up together with the response. Zero
+// timeout disables the limit.
+func (s *Server) SetTimeout(timeout time.Duration) {
+	s.timeout = timeout
+}
+
+// SetConcurrency limits number of connections served at once, connections
+// beyond the limit are answered with 503 status code and closed. Zero means
+// fasthttp default limit. Keep-alive connection occupies its slot while it
+// is open, even when idle, so the limit is effectively the number of client
+// connections. Create and update handlers close connection after response,
+// so POST requests release their slots immediately. The limit is not
+// applied to h2c server.
+func (s *Server) SetConcurrency(n int) {
+	s.concurrency = n
+}
+
+// SetIOTimeouts limits time of reading full request, including waiting for
+// the next request on keep-alive connection, and time of writing response.
+// Zero timeout disables the limit.
+func (s *Server) SetIOTimeouts(read, write time.Duration) {
+	s.readTimeout = read
+	s.writeTimeout = write
+}
+
+func (s *Server) httpServer() *fasthttp.Server {
+	handler := fasthttp.RequestHandler(s.handler)
+	if s.timeout > 0 {
+		handler = fasthttp.TimeoutWithCodeHandler(handler, s.timeout,
+			"Request timeout", fasthttp.StatusServiceUnavailable)
+	}
+	return &fasthttp.Server{
+		Handler:            handler,
+		MaxRequestBodySize: s.maxBodySize,
+		ErrorHandler:       errorHandler,
+		Concurrency:        s.concurrency,
+		ReadTimeout:        s.readTimeout,
+		WriteTimeout:       s.writeTimeout,
+	}
+}
+
+// GC target percentage during warm-up, half of Go default. Warm-up garbage
+// is short-lived and pauses don't matter yet, so frequent collections keep
+// heap close to live data size before serving starts
+const warmUpGCPercent = 50
+
+// default GC target percentage during serving, collections are rare
+// there to keep tail latency low
+const defaultServingGCPercent = 400
+
+// EnableStageGC switches to serving phase GC policy. Automatic GC target is
+// set to gcPercent, negative value disables automatic collection. Besides,
+// full collection is forced between rating stages: 100ms after number of
+// served requests reaches the next boundary from stages. It is meant to be
+// called once, after warm-up is done, requests are counted from zero.
+func (s *Server) EnableStageGC(gcPercent int) {
+	debug.SetGCPercent(gcPercent)
+	atomic.StoreUint32(&s.qcnt, 0)
+	atomic.StoreUint32(&s.stage, 1)
+}
+
+// EnableCompression turns on gzip/deflate encoding of response bodies not
+// shorter than minSize bytes for clients sending Accept-Encoding header.
+func (s *Server) EnableCompression(minSize int) {
+	s.compress = true
+	s.compressMinSize = minSize
+}
+
+// SetAvgPrecision sets number of decimal places location average is rounded to.
+func (s *Server) SetAvgPrecision(places int) {
+	s.avgPrecision = places
+}
+
+// EnableNullEmptyAvg makes location average of no matching visits null
+// instead of 0 by default, so clients can tell it from the genuine zero.
+// Requests choose the response with nullEmpty=1 or nullEmpty=0 anyway.
+func (s *Server) EnableNullEmptyAvg() {
+	s.nullEmptyAvg = true
 }
 
-func (s *Server) EnableStageGC() {
-	s.stage = 1
-	s.qcnt = 0
+// SetMaxVisits limits number of visits returned by user visits request, zero
+// means no limit. Longer results are truncated and marked as such.
+func (s *Server) SetMaxVisits(n int) {
+	s.maxVisits = n
+}
+
+// EnableAccessLog turns on logging of every served request.
+func (s *Server) EnableAccessLog() {
+	s.accessLog = true
+}
+
+// EnableErrorBody turns on JSON body describing the error in 400 responses
+// to invalid create and update requests.
+func (s *Server) EnableErrorBody() {
+	s.errorBody = true
+}
+
+// EnableTextErrors turns on short text/plain messages in 4xx and 5xx
+// responses to clients sending Accept: text/plain. Validation failures are
+// described, other errors get the status text. JSON clients are not affected.
+func (s *Server) EnableTextErrors() {
+	s.textErrors = true
+}
+
+// EnableStrictQuery turns on rejecting read requests with query parameters
+// unknown to the endpoint. Response body names the first unknown parameter.
+func (s *Server) EnableStrictQuery() {
+	s.strictQuery = true
+}
+
+// EnableCORS turns on answering preflight OPTIONS requests and adds
+// Access-Control-Allow-Origin header with the given origin to responses.
+func (s *Server) EnableCORS(origin string) {
+	s.corsOrigin = origin
+}
+
+// SetLoading marks server as loading data. Meanwhile only probes, stats and
+// metrics are served, other requests get 503 status code, and /ready
+// reports the server is not ready. Safe to call while serving.
+func (s *Server) SetLoading(loading bool) {
+	var v int32
+	if loading {
+		v = 1
+	}
+	atomic.StoreInt32(&s.loading, v)
+}
+
+// EnableAdmin turns on administrative endpoints.
+func (s *Server) EnableAdmin() {
+	s.admin = true
 }
 
 func (s *Server) handler(ctx *fasthttp.RequestCtx) {
-	path := ctx.Path()
-	if ctx.IsPost() {
-		if bytes.Equal(path, []byte("/users/new")) {
-			s.createUser(ctx)
-		} else if bytes.HasPrefix(path, []byte("/users/")) {
-			s.updateUser(ctx)
-		} else if bytes.Equal(path, []byte("/locations/new")) {
-			s.createLocation(ctx)
-		} else if bytes.HasPrefix(path, []byte("/locations/")) {
-			s.updateLocation(ctx)
-		} else if bytes.Equal(path, []byte("/visits/new")) {
-			s.createVisit(ctx)
-		} else if bytes.HasPrefix(path, []byte("/visits/")) {
-			s.updateVisit(ctx)
-		} else {
-			ctx.SetStatusCode(fasthttp.StatusNotFound)
-		}
-	} else if ctx.IsGet() {
-		if bytes.HasPrefix(path, []byte("/users/")) {
-			if bytes.HasSuffix(path, []byte("/visits")) {
-				s.getUserVisits(ctx)
-			} else {
-				s.getUser(ctx)
-			}
-		} else if bytes.HasPrefix(path, []byte("/locations/")) {
-			if bytes.HasSuffix(path, []byte("/avg")) {
-				s.getLocationAvg(ctx)
-			} else {
-				s.getLocation(ctx)
+	start := time.Now()
+	if s.accessLog {
+		defer func() {
+			size := -1 // streamed body size is unknown
+			if !ctx.Response.IsBodyStream() {
+				size = len(ctx.Response.Body())
 			}
-		} else if bytes.HasPrefix(path, []byte("/visits/")) {
-			s.getVisit(ctx)
-		} else {
-			ctx.SetStatusCode(fasthttp.StatusNotFound)
-		}
-	} else {
-		ctx.SetStatusCode(fasthttp.StatusNotFound)
+			log.WithFields(log.Fields{
+				"method":   string(ctx.Method()),
+				"path":     string(ctx.Path()),
+				"status":   ctx.Response.StatusCode(),
+				"size":     size,
+				"duration": time.Since(start),
+			}).Info("Request served")
+		}()
+	}
+	r, res := matchRoute(ctx)
+	if !s.admin && (res == adminClearResource || res == adminExportResource || res == adminRebuildResource) {
+		r, res = routeUnknown, nil
+	}
+	if s.corsOrigin != "" && r == routeMethodNotAllowed && ctx.IsOptions() {
+		r = routePreflight
 	}
+	if atomic.LoadInt32(&s.loading) != 0 && res != liveResource && res != readyResource &&
+		res != statsResource && res != metricsResource {
+		r = routeLoading
+	}
+	if s.strictQuery && res != nil && r == res.get && res.query != nil &&
+		unknownQueryKey(ctx.QueryArgs(), res.query) != "" {
+		r = routeUnknownQuery
+	}
+	s.serveRoute(ctx, r, res)
+	if s.textErrors {
+		textError(ctx)
+	}
+	if s.corsOrigin != "" {
+		ctx.Response.Header.Set("Access-Control-Allow-Origin", s.corsOrigin)
+	}
+	if s.compress {
+		s.compressResponse(ctx)
+	}
+	if ctx.IsHead() {
+		headResponse(ctx)
+	}
+	s.metrics.observe(r, ctx.Response.StatusCode(), time.Since(start))
 
-	if s.stage > 0 && s.stage < len(stages) {
+	if stage := atomic.LoadUint32(&s.stage); stage > 0 && stage < uint32(len(stages)) {
 		num := atomic.AddUint32(&s.qcnt, 1)
-		maxNum := stages[s.stage]
+		maxNum := stages[stage]
 		if num == maxNum {
 			time.AfterFunc(100*time.Millisecond, func() {
-				s.runGC()
-				s.stage++
+				s.runGC(stage)
+				atomic.AddUint32(&s.stage, 1)
 			})
 		}
 	}
 }
 
-func (s *Server) runGC() {
+// storeContextKey is the user value key of context passed to store methods
+type storeContextKey struct{}
+
+// shutdownContext passes on cancellation of request context on server
+// shutdown, but not its values. Deadline timer of derived context looks
+// up parent values from another goroutine, and RequestCtx user values are
+// not safe for concurrent use.
+type shutdownContext struct {
+	context.Context
+}
+
+func (shutdownContext) Value(key interface{}) interface{} {
+	return nil
+}
+
+// storeContext returns context passed to store methods. It carries request
+// deadline when server timeout is set.
+func storeContext(ctx *fasthttp.RequestCtx) context.Context {
+	if sctx, ok := ctx.UserValue(storeContextKey{}).(context.Context); ok {
+		return sctx
+	}
+	return ctx
+}
+
+// serveRoute runs handler of route r. A panicking handler is recovered
+// with 500 response, so the rest of the request pipeline still runs and
+// the client gets a status instead of a dropped connection.
+func (s *Server) serveRoute(ctx *fasthttp.RequestCtx, r route, res *resource) {
+	if s.timeout > 0 {
+		// store gives up at the same time the timeout handler answers with
+		// 503, so abandoned handlers don't keep running in background
+		sctx, cancel := context.WithTimeout(shutdownContext{ctx}, s.timeout)
+		defer cancel()
+		ctx.SetUserValue(storeContextKey{}, sctx)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			log.WithFields(log.Fields{
+				"method": string(ctx.Method()),
+				"path":   string(ctx.Path()),
+				"panic":  p,
+			}).Errorf("Handler panic\n%s", debug.Stack())
+			ctx.Response.Reset()
+			ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+			jsonResponse(ctx, &ErrorResult{Error: "internal server error"})
+		}
+	}()
+	switch r {
+	case routeCreateUser:
+		s.createUser(ctx)
+	case routeUpdateUser:
+		s.updateUser(ctx, false)
+	case routeReplaceUser:
+		s.updateUser(ctx, true)
+	case routeGetUser:
+		s.getUser(ctx)
+	case routeGetUsers:
+		s.getUsers(ctx)
+	case routeGetUserVisits:
+		s.getUserVisits(ctx)
+	case routeGetUserAvg:
+		s.getUserAvg(ctx)
+	case routeGetChangedUsers:
+		s.getChanged(ctx, ChangeTracker.ChangedUsers)
+	case routeDeleteUser:
+		s.deleteUser(ctx)
+	case routeCreateLocation:
+		s.createLocation(ctx)
+	case routeUpdateLocation:
+		s.updateLocation(ctx, false)
+	case routeReplaceLocation:
+		s.updateLocation(ctx, true)
+	case routeGetLocation:
+		s.getLocation(ctx)
+	case routeGetLocationAvg:
+		s.getLocationAvg(ctx)
+	case routeGetLocationHistogram:
+		s.getLocationHistogram(ctx)
+	case routeGetLocationVisitors:
+		s.getLocationVisitors(ctx)
+	case routeGetChangedLocations:
+		s.getChanged(ctx, ChangeTracker.ChangedLocations)
+	case routeDeleteLocation:
+		s.deleteLocation(ctx)
+	case routeCreateVisit:
+		s.createVisit(ctx)
+	case routeCreateVisits:
+		s.createVisits(ctx)
+	case routeUpdateVisit:
+		s.updateVisit(ctx, false)
+	case routeReplaceVisit:
+		s.updateVisit(ctx, true)
+	case routeUpdateVisits:
+		s.updateVisits(ctx)
+	case routeGetVisit:
+		s.getVisit(ctx)
+	case routeQueryVisits:
+		s.queryVisits(ctx)
+	case routeGetChangedVisits:
+		s.getChanged(ctx, ChangeTracker.ChangedVisits)
+	case routeDeleteVisit:
+		s.deleteVisit(ctx)
+	case routeMetrics:
+		s.metrics.serve(ctx)
+	case routeStats:
+		s.getStats(ctx)
+	case routeAdminClear:
+		s.clear(ctx)
+	case routeAdminExport:
+		s.export(ctx)
+	case routeAdminRebuildIndexes:
+		s.rebuildIndexes(ctx)
+	case routeLive:
+		emptyResponse(ctx)
+	case routeReady:
+		s.ready(ctx)
+	case routeLoading:
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+	case routeUnknownQuery:
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		jsonResponse(ctx, &ErrorResult{Error: "unknown query parameter " + unknownQueryKey(ctx.QueryArgs(), res.query)})
+	case routePreflight:
+		ctx.Response.Header.Set("Access-Control-Allow-Methods", res.allow+", OPTIONS")
+		ctx.Response.Header.Set("Access-Control-Allow-Headers", "Content-Type")
+		ctx.SetStatusCode(fasthttp.StatusNoContent)
+	case routeMethodNotAllowed:
+		ctx.Response.Header.Set("Allow", res.allow)
+		ctx.SetStatusCode(fasthttp.StatusMethodNotAllowed)
+	default:
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+	}
+}
+
+func (s *Server) runGC(stage uint32) {
 	start := time.Now()
-	log.Infof("Start GC for stage %d", s.stage)
+	log.Infof("Start GC for stage %d", stage)
 	runtime.GC()
 	log.Infof("GC done in %v", time.Now().Sub(start))
 	printMemoryStats()
@@ -142,42 +511,50 @@ func (s *Server) createUser(ctx *fasthttp.RequestCtx) {
 	var user User
 	ctx.SetConnectionClose()
 	if err := user.UnmarshalData(ctx.PostBody(), true); err != nil {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		s.badRequest(ctx, err)
 		return
 	}
-	if !user.Validate() {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+	if err := user.Validate(); err != nil {
+		s.badRequest(ctx, err)
 		return
 	}
-	if err := s.store.CreateUser(&user); err != nil {
+	if err := s.store.CreateUser(storeContext(ctx), &user); err != nil {
 		handleDbError(ctx, err)
 		return
 	}
 	emptyResponse(ctx)
 }
 
-func (s *Server) updateUser(ctx *fasthttp.RequestCtx) {
+// updateUser merges fields present in body into the stored user. With
+// replace the user is replaced entirely: omitted fields get zero values.
+func (s *Server) updateUser(ctx *fasthttp.RequestCtx, replace bool) {
 	ctx.SetConnectionClose()
-	id, err := jsonparser.ParseInt(ctx.Path()[7:])
+	id, err := pathID(ctx.Path())
 	if err != nil {
 		ctx.SetStatusCode(fasthttp.StatusNotFound)
 		return
 	}
 	var user User
-	// check user exists first
-	if err := s.store.GetUser(uint(id), &user); err != nil {
-		handleDbError(ctx, err)
-		return
+	// check user exists first, replacement is built from scratch
+	if !replace {
+		if err := s.store.GetUser(storeContext(ctx), uint(id), &user); err != nil {
+			handleDbError(ctx, err)
+			return
+		}
 	}
 	if err := user.UnmarshalData(ctx.PostBody(), false); err != nil {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		s.badRequest(ctx, err)
 		return
 	}
-	if !user.Validate() {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+	if replace && user.ID != uint(id) {
+		s.badRequest(ctx, errPathIDMismatch)
+		return
+	}
+	if err := user.Validate(); err != nil {
+		s.badRequest(ctx, err)
 		return
 	}
-	if err := s.store.UpdateUser(uint(id), &user); err != nil {
+	if err := s.store.UpdateUser(storeContext(ctx), uint(id), &user); err != nil {
 		handleDbError(ctx, err)
 		return
 	}
@@ -185,21 +562,37 @@ func (s *Server) updateUser(ctx *fasthttp.RequestCtx) {
 }
 
 func (s *Server) getUser(ctx *fasthttp.RequestCtx) {
-	id, err := jsonparser.ParseInt(ctx.Path()[7:])
+	id, err := pathID(ctx.Path())
 	if err != nil {
 		ctx.SetStatusCode(fasthttp.StatusNotFound)
 		return
 	}
 	var user User
-	if err := s.store.GetUser(uint(id), &user); err != nil {
+	if err := s.store.GetUser(storeContext(ctx), uint(id), &user); err != nil {
+		handleDbError(ctx, err)
+		return
+	}
+	entityResponse(ctx, &user)
+}
+
+// getUsers returns users listed in ids query parameter, e.g. ids=1,2,3.
+// Users are returned in the same order, ids of missing users are omitted.
+func (s *Server) getUsers(ctx *fasthttp.RequestCtx) {
+	ids, ok := parseIDs(ctx.QueryArgs().Peek("ids"), maxUsersBatch)
+	if !ok {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	var users []User
+	if err := s.store.GetUsers(storeContext(ctx), ids, &users); err != nil {
 		handleDbError(ctx, err)
 		return
 	}
-	jsonResponse(ctx, &user)
+	jsonResponse(ctx, &UsersResult{Users: users})
 }
 
 func (s *Server) getUserVisits(ctx *fasthttp.RequestCtx) {
-	id, err := jsonparser.ParseInt(ctx.Path()[7 : len(ctx.Path())-7])
+	id, err := pathID(ctx.Path())
 	if err != nil {
 		ctx.SetStatusCode(fasthttp.StatusNotFound)
 		return
@@ -209,15 +602,115 @@ func (s *Server) getUserVisits(ctx *fasthttp.RequestCtx) {
 		ctx.SetStatusCode(fasthttp.StatusBadRequest)
 		return
 	}
+	// one extra visit is requested to know whether result is truncated
+	capped := s.maxVisits > 0 && (query.Limit == 0 || query.Limit > s.maxVisits)
+	if capped {
+		query.Limit = s.maxVisits + 1
+	}
 	var visits []UserVisit
-	if err := s.store.GetUserVisits(uint(id), &query, &visits); err != nil {
+	total, err := s.store.GetUserVisits(storeContext(ctx), uint(id), &query, &visits)
+	if err != nil {
 		handleDbError(ctx, err)
 		return
 	}
+	truncated := capped && len(visits) > s.maxVisits
+	if truncated {
+		visits = visits[:s.maxVisits]
+	}
 	if len(visits) == 0 {
+		if !query.WithTotal {
+			staticResponse(ctx, emptyVisitsBody)
+			return
+		}
 		visits = make([]UserVisit, 0)
 	}
-	jsonResponse(ctx, &UserVisitsResult{visits})
+	result := UserVisitsResult{Visits: visits, Truncated: truncated}
+	if query.WithTotal {
+		result.Total = &total
+	}
+	if len(visits) >= streamVisitsMin && !prettyRequested(ctx) && !camelRequested(ctx) {
+		ctx.SetContentType("application/json; charset=utf-8")
+		ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+			if err := writeUserVisits(w, &result); err != nil {
+				log.Errorf("Failed to write user visits: %v", err)
+			}
+		})
+		return
+	}
+	jsonResponse(ctx, &result)
+}
+
+// streamVisitsMin is the number of user visits starting from which the
+// response is streamed in chunks rather than marshaled into single buffer.
+// Streamed bodies aren't compressed.
+const streamVisitsMin = 1000
+
+// writeUserVisits writes result to w visit by visit in the same format as
+// UserVisitsResult marshaler does
+func writeUserVisits(w io.Writer, result *UserVisitsResult) error {
+	if _, err := io.WriteString(w, `{"visits":[`); err != nil {
+		return err
+	}
+	for i := range result.Visits {
+		if i > 0 {
+			if _, err := io.WriteString(w, ","); err != nil {
+				return err
+			}
+		}
+		if _, err := easyjson.MarshalToWriter(&result.Visits[i], w); err != nil {
+			return err
+		}
+	}
+	suffix := []byte("]")
+	if result.Total != nil {
+		suffix = append(suffix, `,"total":`...)
+		suffix = strconv.AppendInt(suffix, int64(*result.Total), 10)
+	}
+	if result.Truncated {
+		suffix = append(suffix, `,"truncated":true`...)
+	}
+	suffix = append(suffix, '}')
+	_, err := w.Write(suffix)
+	return err
+}
+
+func (s *Server) getUserAvg(ctx *fasthttp.RequestCtx) {
+	id, err := pathID(ctx.Path())
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+	var query UserVisitsQuery
+	if !parseUserVisitsQuery(ctx.QueryArgs(), &query) {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	avg, err := s.store.GetUserAvg(storeContext(ctx), uint(id), &query)
+	if err != nil {
+		handleDbError(ctx, err)
+		return
+	}
+	result := LocationAvgResult{
+		Avg: roundAvg(avg, s.avgPrecision),
+	}
+	if result.Avg == 0 {
+		staticResponse(ctx, zeroAvgBody)
+		return
+	}
+	jsonResponse(ctx, &result)
+}
+
+func (s *Server) deleteUser(ctx *fasthttp.RequestCtx) {
+	id, err := pathID(ctx.Path())
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+	if err := s.store.DeleteUser(storeContext(ctx), uint(id)); err != nil {
+		handleDbError(ctx, err)
+		return
+	}
+	emptyResponse(ctx)
 }
 
 // Locations endpoints
@@ -225,42 +718,49 @@ func (s *Server) createLocation(ctx *fasthttp.RequestCtx) {
 	var location Location
 	ctx.SetConnectionClose()
 	if err := location.UnmarshalData(ctx.PostBody(), true); err != nil {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		s.badRequest(ctx, err)
 		return
 	}
-	if !location.Validate() {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+	if err := location.Validate(); err != nil {
+		s.badRequest(ctx, err)
 		return
 	}
-	if err := s.store.CreateLocation(&location); err != nil {
+	if err := s.store.CreateLocation(storeContext(ctx), &location); err != nil {
 		handleDbError(ctx, err)
 		return
 	}
 	emptyResponse(ctx)
 }
 
-func (s *Server) updateLocation(ctx *fasthttp.RequestCtx) {
+// updateLocation merges or replaces location like updateUser
+func (s *Server) updateLocation(ctx *fasthttp.RequestCtx, replace bool) {
 	ctx.SetConnectionClose()
-	id, err := jsonparser.ParseInt(ctx.Path()[11:])
+	id, err := pathID(ctx.Path())
 	if err != nil {
 		ctx.SetStatusCode(fasthttp.StatusNotFound)
 		return
 	}
 	var location Location
-	// check location exists first
-	if err := s.store.GetLocation(uint(id), &location); err != nil {
-		handleDbError(ctx, err)
-		return
+	// check location exists first, replacement is built from scratch
+	if !replace {
+		if err := s.store.GetLocation(storeContext(ctx), uint(id), &location); err != nil {
+			handleDbError(ctx, err)
+			return
+		}
 	}
 	if err := location.UnmarshalData(ctx.PostBody(), false); err != nil {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		s.badRequest(ctx, err)
 		return
 	}
-	if !location.Validate() {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+	if replace && location.ID != uint(id) {
+		s.badRequest(ctx, errPathIDMismatch)
+		return
+	}
+	if err := location.Validate(); err != nil {
+		s.badRequest(ctx, err)
 		return
 	}
-	if err := s.store.UpdateLocation(uint(id), &location); err != nil {
+	if err := s.store.UpdateLocation(storeContext(ctx), uint(id), &location); err != nil {
 		handleDbError(ctx, err)
 		return
 	}
@@ -268,21 +768,21 @@ func (s *Server) updateLocation(ctx *fasthttp.RequestCtx) {
 }
 
 func (s *Server) getLocation(ctx *fasthttp.RequestCtx) {
-	id, err := jsonparser.ParseInt(ctx.Path()[11:])
+	id, err := pathID(ctx.Path())
 	if err != nil {
 		ctx.SetStatusCode(fasthttp.StatusNotFound)
 		return
 	}
 	var location Location
-	if err := s.store.GetLocation(uint(id), &location); err != nil {
+	if err := s.store.GetLocation(storeContext(ctx), uint(id), &location); err != nil {
 		handleDbError(ctx, err)
 		return
 	}
-	jsonResponse(ctx, &location)
+	entityResponse(ctx, &location)
 }
 
 func (s *Server) getLocationAvg(ctx *fasthttp.RequestCtx) {
-	id, err := jsonparser.ParseInt(ctx.Path()[11 : len(ctx.Path())-4])
+	id, err := pathID(ctx.Path())
 	if err != nil {
 		ctx.SetStatusCode(fasthttp.StatusNotFound)
 		return
@@ -292,97 +792,685 @@ func (s *Server) getLocationAvg(ctx *fasthttp.RequestCtx) {
 		ctx.SetStatusCode(fasthttp.StatusBadRequest)
 		return
 	}
-	avg, err := s.store.GetLocationAvg(uint(id), &query)
+	switch string(ctx.QueryArgs().Peek("groupBy")) {
+	case "":
+	case "age":
+		s.getLocationAvgByAge(ctx, uint(id), &query)
+		return
+	default:
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	nullEmpty := s.nullEmptyAvg
+	switch string(ctx.QueryArgs().Peek("nullEmpty")) {
+	case "":
+	case "0", "false":
+		nullEmpty = false
+	case "1", "true":
+		nullEmpty = true
+	default:
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	avg, count, err := s.store.GetLocationAvg(storeContext(ctx), uint(id), &query)
 	if err != nil {
 		handleDbError(ctx, err)
 		return
 	}
+	if count == 0 && nullEmpty {
+		staticResponse(ctx, nullAvgBody)
+		return
+	}
 	result := LocationAvgResult{
-		Avg: math.Floor(avg*100000+0.5) / 100000,
+		Avg: roundAvg(avg, s.avgPrecision),
+	}
+	if result.Avg == 0 {
+		staticResponse(ctx, zeroAvgBody)
+		return
 	}
 	jsonResponse(ctx, &result)
 }
 
+func (s *Server) getLocationAvgByAge(ctx *fasthttp.RequestCtx, id uint, query *LocationAvgQuery) {
+	buckets := newAgeBuckets(defaultAgeBuckets)
+	if err := s.store.GetLocationAvgByAge(storeContext(ctx), id, query, buckets); err != nil {
+		handleDbError(ctx, err)
+		return
+	}
+	for i := range buckets {
+		buckets[i].Avg = roundAvg(buckets[i].Avg, s.avgPrecision)
+	}
+	jsonResponse(ctx, &LocationAvgByAgeResult{Buckets: buckets})
+}
+
+func (s *Server) getLocationHistogram(ctx *fasthttp.RequestCtx) {
+	id, err := pathID(ctx.Path())
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+	var query LocationAvgQuery
+	if !parseLocationAvgQuery(ctx.QueryArgs(), &query) {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	var result LocationHistogramResult
+	if err := s.store.GetLocationHistogram(storeContext(ctx), uint(id), &query, &result.Histogram); err != nil {
+		handleDbError(ctx, err)
+		return
+	}
+	jsonResponse(ctx, &result)
+}
+
+func (s *Server) getLocationVisitors(ctx *fasthttp.RequestCtx) {
+	id, err := pathID(ctx.Path())
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+	var query LocationVisitorsQuery
+	if !parseLocationVisitorsQuery(ctx.QueryArgs(), &query) {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	var users []uint
+	if err := s.store.GetLocationVisitors(storeContext(ctx), uint(id), &query, &users); err != nil {
+		handleDbError(ctx, err)
+		return
+	}
+	jsonResponse(ctx, &LocationVisitorsResult{Users: users})
+}
+
+func (s *Server) queryVisits(ctx *fasthttp.RequestCtx) {
+	var query VisitsQuery
+	if !parseVisitsQuery(ctx.QueryArgs(), &query) {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	var visits []Visit
+	if err := s.store.QueryVisits(storeContext(ctx), &query, &visits); err != nil {
+		handleDbError(ctx, err)
+		return
+	}
+	jsonResponse(ctx, &VisitsResult{Visits: visits})
+}
+
+// changedFunc is a ChangeTracker method listing changed entities of a kind
+type changedFunc func(t ChangeTracker, ctx context.Context, since uint64, ids *[]uint) (uint64, error)
+
+// getChanged returns ids of entities created or updated after version given
+// in since query parameter along with the current version. Stores not
+// tracking changes respond with 501 status code.
+func (s *Server) getChanged(ctx *fasthttp.RequestCtx, changed changedFunc) {
+	tracker, ok := s.store.(ChangeTracker)
+	if !ok {
+		ctx.SetStatusCode(fasthttp.StatusNotImplemented)
+		return
+	}
+	var since uint64
+	if val := ctx.QueryArgs().Peek("since"); len(val) > 0 {
+		var err error
+		if since, err = strconv.ParseUint(string(val), 10, 64); err != nil {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+	}
+	var result ChangedResult
+	version, err := changed(tracker, storeContext(ctx), since, &result.IDs)
+	if err != nil {
+		handleDbError(ctx, err)
+		return
+	}
+	result.Version = version
+	jsonResponse(ctx, &result)
+}
+
+func (s *Server) deleteLocation(ctx *fasthttp.RequestCtx) {
+	id, err := pathID(ctx.Path())
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+	if err := s.store.DeleteLocation(storeContext(ctx), uint(id)); err != nil {
+		handleDbError(ctx, err)
+		return
+	}
+	emptyResponse(ctx)
+}
+
 // Visits endpoints
 func (s *Server) createVisit(ctx *fasthttp.RequestCtx) {
 	var visit Visit
 	ctx.SetConnectionClose()
 	if err := visit.UnmarshalData(ctx.PostBody(), true); err != nil {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		s.badRequest(ctx, err)
 		return
 	}
-	if !visit.Validate() {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+	if err := visit.Validate(); err != nil {
+		s.badRequest(ctx, err)
 		return
 	}
-	if err := s.store.CreateVisit(&visit); err != nil {
+	if err := s.store.CreateVisit(storeContext(ctx), &visit); err != nil {
 		handleDbError(ctx, err)
 		return
 	}
 	emptyResponse(ctx)
 }
 
-func (s *Server) updateVisit(ctx *fasthttp.RequestCtx) {
+// createVisits inserts all visits from {"visits":[...]} body. Every visit is
+// validated before insert, so nothing is stored if any of them is invalid.
+func (s *Server) createVisits(ctx *fasthttp.RequestCtx) {
 	ctx.SetConnectionClose()
-	id, err := jsonparser.ParseInt(ctx.Path()[8:])
+	var visits []Visit
+	badIdx := -1
+	var badErr error
+	_, err := jsonparser.ArrayEach(ctx.PostBody(), func(value []byte, vt jsonparser.ValueType, offset int, err error) {
+		if badIdx >= 0 {
+			return
+		}
+		var visit Visit
+		badErr = visit.UnmarshalData(value, true)
+		if badErr == nil {
+			badErr = visit.Validate()
+		}
+		if badErr != nil {
+			badIdx = len(visits)
+			return
+		}
+		visits = append(visits, visit)
+	}, "visits")
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	if badIdx >= 0 {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		jsonResponse(ctx, &ErrorResult{Error: "invalid visit", Code: validationCode(badErr), Index: &badIdx})
+		return
+	}
+	if len(visits) > 0 {
+		if err := s.store.CreateVisits(storeContext(ctx), visits); err != nil {
+			handleDbError(ctx, err)
+			return
+		}
+	}
+	emptyResponse(ctx)
+}
+
+// updateVisit merges or replaces visit like updateUser
+func (s *Server) updateVisit(ctx *fasthttp.RequestCtx, replace bool) {
+	ctx.SetConnectionClose()
+	id, err := pathID(ctx.Path())
 	if err != nil {
 		ctx.SetStatusCode(fasthttp.StatusNotFound)
 		return
 	}
 	var visit Visit
-	// check location exists first
-	if err := s.store.GetVisit(uint(id), &visit); err != nil {
-		handleDbError(ctx, err)
-		return
+	// check visit exists first, replacement is built from scratch
+	if !replace {
+		if err := s.store.GetVisit(storeContext(ctx), uint(id), &visit); err != nil {
+			handleDbError(ctx, err)
+			return
+		}
 	}
 	if err := visit.UnmarshalData(ctx.PostBody(), false); err != nil {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		s.badRequest(ctx, err)
 		return
 	}
-	if !visit.Validate() {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+	if replace && visit.ID != uint(id) {
+		s.badRequest(ctx, errPathIDMismatch)
 		return
 	}
-	if err := s.store.UpdateVisit(uint(id), &visit); err != nil {
+	if err := visit.Validate(); err != nil {
+		s.badRequest(ctx, err)
+		return
+	}
+	if err := s.store.UpdateVisit(storeContext(ctx), uint(id), &visit); err != nil {
 		handleDbError(ctx, err)
 		return
 	}
 	emptyResponse(ctx)
 }
 
+// updateVisits applies partial updates of many visits, every update has
+// the same semantics as single visit update and carries visit id. Updates
+// are best-effort: valid ones are applied regardless of failed ones, and
+// response holds status of every update in request order.
+func (s *Server) updateVisits(ctx *fasthttp.RequestCtx) {
+	ctx.SetConnectionClose()
+	var (
+		results []UpdateStatus
+		visits  []Visit
+		indexes []int // result index of every visit
+	)
+	_, err := jsonparser.ArrayEach(ctx.PostBody(), func(value []byte, vt jsonparser.ValueType, offset int, err error) {
+		results = append(results, s.mergeVisitUpdate(ctx, value, &visits))
+		if results[len(results)-1].Status == fasthttp.StatusOK {
+			indexes = append(indexes, len(results)-1)
+		}
+	}, "updates")
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+		return
+	}
+	if len(visits) > 0 {
+		for i, err := range s.store.UpdateVisits(storeContext(ctx), visits) {
+			if err != nil {
+				results[indexes[i]].setDbError(err)
+			}
+		}
+	}
+	if results == nil {
+		results = []UpdateStatus{}
+	}
+	jsonResponse(ctx, &UpdateVisitsResult{Results: results})
+}
+
+// setDbError sets status code for store error, only client errors are
+// described
+func (st *UpdateStatus) setDbError(err error) {
+	st.Status = dbErrorStatus(err)
+	if st.Status < fasthttp.StatusInternalServerError {
+		st.Error = err.Error()
+	}
+}
+
+// mergeVisitUpdate applies update to the stored visit and appends it to
+// visits if the result is valid
+func (s *Server) mergeVisitUpdate(ctx *fasthttp.RequestCtx, update []byte, visits *[]Visit) UpdateStatus {
+	id, err := jsonparser.GetInt(update, "id")
+	if err != nil || id <= 0 {
+		return UpdateStatus{Status: fasthttp.StatusBadRequest, Error: ErrValidationID.Message, Code: ErrValidationID.Code}
+	}
+	status := UpdateStatus{ID: uint(id), Status: fasthttp.StatusOK}
+	var visit Visit
+	if err := s.store.GetVisit(storeContext(ctx), uint(id), &visit); err != nil {
+		status.setDbError(err)
+		return status
+	}
+	if err := visit.UnmarshalData(update, false); err != nil {
+		status.Status = fasthttp.StatusBadRequest
+		status.Error = err.Error()
+		status.Code = validationCode(err)
+		return status
+	}
+	if err := visit.Validate(); err != nil {
+		status.Status = fasthttp.StatusBadRequest
+		status.Error = err.Error()
+		status.Code = validationCode(err)
+		return status
+	}
+	*visits = append(*visits, visit)
+	return status
+}
+
 func (s *Server) getVisit(ctx *fasthttp.RequestCtx) {
-	id, err := jsonparser.ParseInt(ctx.Path()[8:])
+	id, err := pathID(ctx.Path())
 	if err != nil {
 		ctx.SetStatusCode(fasthttp.StatusNotFound)
 		return
 	}
 	var visit Visit
-	if err := s.store.GetVisit(uint(id), &visit); err != nil {
+	if err := s.store.GetVisit(storeContext(ctx), uint(id), &visit); err != nil {
+		handleDbError(ctx, err)
+		return
+	}
+	entityResponse(ctx, &visit)
+}
+
+func (s *Server) deleteVisit(ctx *fasthttp.RequestCtx) {
+	id, err := pathID(ctx.Path())
+	if err != nil {
+		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return
+	}
+	if err := s.store.DeleteVisit(storeContext(ctx), uint(id)); err != nil {
 		handleDbError(ctx, err)
 		return
 	}
-	jsonResponse(ctx, &visit)
+	emptyResponse(ctx)
+}
+
+func (s *Server) compressResponse(ctx *fasthttp.RequestCtx) {
+	if ctx.Response.IsBodyStream() {
+		return // don't read streamed body into memory
+	}
+	body := ctx.Response.Body()
+	if len(body) == 0 || len(body) < s.compressMinSize {
+		return
+	}
+	if ctx.Request.Header.HasAcceptEncoding("gzip") {
+		ctx.Response.SetBody(fasthttp.AppendGzipBytes(nil, body))
+		ctx.Response.Header.Set("Content-Encoding", "gzip")
+	} else if ctx.Request.Header.HasAcceptEncoding("deflate") {
+		ctx.Response.SetBody(fasthttp.AppendDeflateBytes(nil, body))
+		ctx.Response.Header.Set("Content-Encoding", "deflate")
+	}
+}
+
+// maximum number of ids of each kind sampled by stats endpoint
+const maxStatsSample = 100000
+
+// Stats endpoint. With sample=N query parameter it also lists up to N
+// random ids of every entity kind, warm-up and load test use them since
+// ids are not necessarily sequential.
+func (s *Server) getStats(ctx *fasthttp.RequestCtx) {
+	sample := 0
+	if val := ctx.QueryArgs().Peek("sample"); len(val) > 0 {
+		i, err := jsonparser.ParseInt(val)
+		if err != nil || i < 0 || i > maxStatsSample {
+			ctx.SetStatusCode(fasthttp.StatusBadRequest)
+			return
+		}
+		sample = int(i)
+	}
+	var counts StoreCounts
+	if err := s.store.Count(storeContext(ctx), &counts); err != nil {
+		handleDbError(ctx, err)
+		return
+	}
+	users, locations, visits := newIDSample(sample), newIDSample(sample), newIDSample(sample)
+	if sample > 0 {
+		sctx := storeContext(ctx)
+		err := s.store.EachUser(sctx, func(u *User) bool { users.add(u.ID); return true })
+		if err == nil {
+			err = s.store.EachLocation(sctx, func(l *Location) bool { locations.add(l.ID); return true })
+		}
+		if err == nil {
+			err = s.store.EachVisit(sctx, func(v *Visit) bool { visits.add(v.ID); return true })
+		}
+		if err != nil {
+			handleDbError(ctx, err)
+			return
+		}
+	}
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	result := StatsResult{
+		Users:      counts.Users,
+		Locations:  counts.Locations,
+		Visits:     counts.Visits,
+		Alloc:      m.Alloc,
+		TotalAlloc: m.TotalAlloc,
+		Sys:        m.Sys,
+		NumGC:      uint64(m.NumGC),
+
+		UserIDs:     users.ids,
+		LocationIDs: locations.ids,
+		VisitIDs:    visits.ids,
+	}
+	jsonResponse(ctx, &result)
+}
+
+// idSample keeps up to n ids picked uniformly from all ids added
+// (reservoir sampling)
+type idSample struct {
+	ids  []uint
+	n    int
+	seen int
+}
+
+func newIDSample(n int) *idSample {
+	return &idSample{n: n}
+}
+
+func (s *idSample) add(id uint) {
+	s.seen++
+	if len(s.ids) < s.n {
+		s.ids = append(s.ids, id)
+	} else if i := rand.Intn(s.seen); i < s.n {
+		s.ids[i] = id
+	}
+}
+
+// ready responds with 503 status code while data is loading or the store
+// is unreachable
+func (s *Server) ready(ctx *fasthttp.RequestCtx) {
+	if atomic.LoadInt32(&s.loading) != 0 {
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		return
+	}
+	if err := s.store.Ping(storeContext(ctx)); err != nil {
+		log.Warnf("Store is unreachable: %v", err)
+		ctx.SetStatusCode(fasthttp.StatusServiceUnavailable)
+		return
+	}
+	emptyResponse(ctx)
+}
+
+// Admin endpoints
+func (s *Server) clear(ctx *fasthttp.RequestCtx) {
+	if err := s.store.Clear(storeContext(ctx)); err != nil {
+		handleDbError(ctx, err)
+		return
+	}
+	emptyResponse(ctx)
+}
+
+// export streams zip archive of data files with all entities, it can be
+// loaded back as data path. The archive is written after the handler
+// returns, so a store error results in truncated archive and is only logged.
+func (s *Server) export(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("application/zip")
+	ctx.Response.Header.Set("Content-Disposition", `attachment; filename="data.zip"`)
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		if err := exportData(context.Background(), s.store, w); err != nil {
+			log.Errorf("Failed to export data: %v", err)
+		}
+	})
+}
+
+// rebuildIndexes re-derives visit indexes of the store. Stores not keeping
+// own indexes respond with 501 status code.
+func (s *Server) rebuildIndexes(ctx *fasthttp.RequestCtx) {
+	rebuilder, ok := s.store.(IndexRebuilder)
+	if !ok {
+		ctx.SetStatusCode(fasthttp.StatusNotImplemented)
+		return
+	}
+	indexed, orphaned := rebuilder.RebuildIndexes()
+	log.Infof("Rebuilt indexes of %d visits, %d orphaned visits left out", indexed, orphaned)
+	emptyResponse(ctx)
+}
+
+// errorHandler handles request reading errors
+func errorHandler(ctx *fasthttp.RequestCtx, err error) {
+	if err == fasthttp.ErrBodyTooLarge {
+		ctx.SetStatusCode(fasthttp.StatusRequestEntityTooLarge)
+	} else {
+		ctx.SetStatusCode(fasthttp.StatusBadRequest)
+	}
+	ctx.SetConnectionClose()
+}
+
+// roundAvg rounds avg half up to the given number of decimal places
+func roundAvg(avg float64, places int) float64 {
+	pow := math.Pow10(places)
+	return math.Floor(avg*pow+0.5) / pow
+}
+
+var errPathIDMismatch = errors.New("id doesn't match path")
+
+// badRequest responds with 400 status code. The error message and code of
+// validation error are sent in the body only if error bodies are enabled.
+func (s *Server) badRequest(ctx *fasthttp.RequestCtx, err error) {
+	ctx.SetStatusCode(fasthttp.StatusBadRequest)
+	if s.textErrors && textRequested(ctx) {
+		textResponse(ctx, err.Error())
+		return
+	}
+	if s.errorBody {
+		jsonResponse(ctx, &ErrorResult{Error: err.Error(), Code: validationCode(err)})
+	}
+}
+
+// validationCode returns code of *ValidationError or empty string for other
+// errors
+func validationCode(err error) string {
+	if verr, ok := err.(*ValidationError); ok {
+		return verr.Code
+	}
+	return ""
 }
 
 func handleDbError(ctx *fasthttp.RequestCtx, err error) {
+	ctx.SetStatusCode(dbErrorStatus(err))
+}
+
+// dbErrorStatus returns response status code for store error
+func dbErrorStatus(err error) int {
 	if err == ErrNotFound {
-		ctx.SetStatusCode(fasthttp.StatusNotFound)
+		return fasthttp.StatusNotFound
+	} else if err == ErrHasVisits {
+		return fasthttp.StatusConflict
 	} else if err == ErrMissingID || err == ErrUpdateID || err == ErrDup {
-		ctx.SetStatusCode(fasthttp.StatusBadRequest)
-	} else {
-		log.Errorf("Database error: %v", err)
-		ctx.SetStatusCode(fasthttp.StatusInternalServerError)
+		return fasthttp.StatusBadRequest
+	} else if err == context.Canceled || err == context.DeadlineExceeded || err == ErrUnavailable {
+		return fasthttp.StatusServiceUnavailable
+	} else if err == ErrTimeout {
+		return fasthttp.StatusGatewayTimeout
 	}
+	log.Errorf("Database error: %v", err)
+	return fasthttp.StatusInternalServerError
 }
 
 func jsonResponse(ctx *fasthttp.RequestCtx, body easyjson.Marshaler) {
+	if prettyRequested(ctx) || camelRequested(ctx) {
+		data, _ := easyjson.Marshal(body)
+		staticResponse(ctx, data)
+		return
+	}
 	ctx.SetContentType("application/json; charset=utf-8")
 	easyjson.MarshalToWriter(body, ctx)
 }
 
+// headResponse drops body of the response to HEAD request keeping its
+// Content-Length. Length of streamed body is unknown, so it is just dropped.
+func headResponse(ctx *fasthttp.RequestCtx) {
+	if !ctx.Response.IsBodyStream() {
+		ctx.Response.Header.SetContentLength(len(ctx.Response.Body()))
+	}
+	ctx.Response.ResetBody()
+}
+
 func emptyResponse(ctx *fasthttp.RequestCtx) {
+	staticResponse(ctx, emptyResponseBody)
+}
+
+// staticResponse writes precomputed JSON body
+func staticResponse(ctx *fasthttp.RequestCtx, body []byte) {
 	ctx.SetContentType("application/json; charset=utf-8")
-	ctx.Write(emptyResponseBody)
+	if camelRequested(ctx) {
+		body = camelKeys(body)
+	}
+	if prettyRequested(ctx) {
+		prettyResponse(ctx, body)
+		return
+	}
+	ctx.Write(body)
+}
+
+var textMediaType = []byte("text/plain")
+
+// textRequested reports whether client accepts plain text
+func textRequested(ctx *fasthttp.RequestCtx) bool {
+	return bytes.Contains(ctx.Request.Header.Peek("Accept"), textMediaType)
+}
+
+func textResponse(ctx *fasthttp.RequestCtx, msg string) {
+	ctx.SetContentType("text/plain; charset=utf-8")
+	ctx.SetBodyString(msg + "\n")
+}
+
+// textError describes error response without body in plain text for
+// clients accepting it
+func textError(ctx *fasthttp.RequestCtx) {
+	status := ctx.Response.StatusCode()
+	if status < 400 || len(ctx.Response.Body()) > 0 || ctx.Response.IsBodyStream() ||
+		!textRequested(ctx) {
+		return
+	}
+	textResponse(ctx, fasthttp.StatusMessage(status))
+}
+
+var prettyMediaType = []byte("application/json+pretty")
+
+// prettyRequested reports whether client asked for indented JSON for
+// debugging with ?pretty=1 or Accept: application/json+pretty
+func prettyRequested(ctx *fasthttp.RequestCtx) bool {
+	return ctx.QueryArgs().GetUintOrZero("pretty") == 1 ||
+		bytes.Contains(ctx.Request.Header.Peek("Accept"), prettyMediaType)
+}
+
+var (
+	camelCase = []byte("camel")
+	snakeCase = []byte("snake")
+)
+
+// camelRequested reports whether response fields should be named in
+// camelCase according to X-Field-Case header or the default
+func camelRequested(ctx *fasthttp.RequestCtx) bool {
+	fieldCase := ctx.Request.Header.Peek("X-Field-Case")
+	switch {
+	case bytes.EqualFold(fieldCase, camelCase):
+		return true
+	case bytes.EqualFold(fieldCase, snakeCase):
+		return false
+	}
+	return camelFields
+}
+
+// prettyResponse writes indented copy of compact JSON body. easyjson
+// can't indent, so the body is re-indented after marshaling.
+func prettyResponse(ctx *fasthttp.RequestCtx, body []byte) {
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, body, "", "  "); err != nil {
+		ctx.Write(body)
+		return
+	}
+	ctx.Write(buf.Bytes())
+}
+
+// entityResponse writes entity body like jsonResponse. ETag is computed only
+// for requests with If-None-Match header, so regular requests pay nothing.
+// Matching ETag results in 304 Not Modified with empty body.
+func entityResponse(ctx *fasthttp.RequestCtx, body easyjson.Marshaler) {
+	jsonResponse(ctx, body)
+	ifNoneMatch := ctx.Request.Header.Peek("If-None-Match")
+	if len(ifNoneMatch) == 0 {
+		return
+	}
+	etag := bodyETag(ctx.Response.Body())
+	if etagMatch(ifNoneMatch, etag) {
+		ctx.NotModified()
+	}
+	ctx.Response.Header.SetBytesV("ETag", etag)
+}
+
+// bodyETag returns strong entity tag built from FNV-1a hash of the body
+func bodyETag(body []byte) []byte {
+	h := fnv.New64a()
+	h.Write(body)
+	etag := make([]byte, 0, 18)
+	etag = append(etag, '"')
+	etag = strconv.AppendUint(etag, h.Sum64(), 16)
+	return append(etag, '"')
+}
+
+// etagMatch checks If-None-Match header value against etag
+func etagMatch(ifNoneMatch, etag []byte) bool {
+	for _, tag := range bytes.Split(ifNoneMatch, []byte(",")) {
+		tag = bytes.TrimSpace(tag)
+		if bytes.Equal(tag, []byte("*")) {
+			return true
+		}
+		// weak comparison
+		tag = bytes.TrimPrefix(tag, []byte("W/"))
+		if bytes.Equal(tag, etag) {
+			return true
+		}
+	}
+	return false
 }
 
 func parseUserVisitsQuery(args *fasthttp.Args, q *UserVisitsQuery) bool {
@@ -401,6 +1489,14 @@ func parseUserVisitsQuery(args *fasthttp.Args, q *UserVisitsQuery) bool {
 		q.ToDate = &ts
 	}
 	q.Country = string(args.Peek("country"))
+	if val := args.Peek("fromDistance"); len(val) > 0 {
+		i, err := jsonparser.ParseInt(val)
+		if err != nil {
+			return false
+		}
+		ii := int(i)
+		q.FromDistance = &ii
+	}
 	if val := args.Peek("toDistance"); len(val) > 0 {
 		i, err := jsonparser.ParseInt(val)
 		if err != nil {
@@ -409,6 +1505,64 @@ func parseUserVisitsQuery(args *fasthttp.Args, q *UserVisitsQuery) bool {
 		ii := int(i)
 		q.ToDistance = &ii
 	}
+	switch string(args.Peek("toDistanceInclusive")) {
+	case "", "0", "false":
+	case "1", "true":
+		q.ToDistanceInclusive = true
+	default:
+		return false
+	}
+	if val := args.Peek("distance"); len(val) > 0 {
+		i, err := jsonparser.ParseInt(val)
+		if err != nil {
+			return false
+		}
+		ii := int(i)
+		q.Distance = &ii
+	}
+	if val := args.Peek("order"); len(val) > 0 {
+		switch string(val) {
+		case "asc": // default order
+		case "desc":
+			q.Desc = true
+		default:
+			return false
+		}
+	}
+	if val := args.Peek("offset"); len(val) > 0 {
+		i, err := jsonparser.ParseInt(val)
+		if err != nil || i < 0 {
+			return false
+		}
+		q.Offset = int(i)
+	}
+	if val := args.Peek("limit"); len(val) > 0 {
+		i, err := jsonparser.ParseInt(val)
+		if err != nil || i < 0 {
+			return false
+		}
+		q.Limit = int(i)
+	}
+	q.WithTotal = args.GetUintOrZero("withTotal") == 1
+	// distance filters are given in kilometers unless unit=mi
+	switch string(args.Peek("unit")) {
+	case "", "km":
+	case "mi":
+		if q.Distance != nil {
+			return false // exact match has no whole km equivalent
+		}
+		if q.FromDistance != nil {
+			km := milesToKm(*q.FromDistance, false)
+			q.FromDistance = &km
+		}
+		if q.ToDistance != nil {
+			// whole km d < x holds for d < ceil(x), d <= x for d <= floor(x)
+			km := milesToKm(*q.ToDistance, !q.ToDistanceInclusive)
+			q.ToDistance = &km
+		}
+	default:
+		return false
+	}
 
 	return true
 }
@@ -445,8 +1599,126 @@ func parseLocationAvgQuery(args *fasthttp.Args, q *LocationAvgQuery) bool {
 		q.ToAge = &ii
 	}
 	q.Gender = string(args.Peek("gender"))
-	if q.Gender != "" && q.Gender != "m" && q.Gender != "f" {
+	if q.Gender != "" && !validGender(q.Gender) {
+		return false
+	}
+	if val := args.Peek("fromMark"); len(val) > 0 {
+		i, err := jsonparser.ParseInt(val)
+		if err != nil || i < 0 || i > 5 {
+			return false
+		}
+		ii := int(i)
+		q.FromMark = &ii
+	}
+	if val := args.Peek("toMark"); len(val) > 0 {
+		i, err := jsonparser.ParseInt(val)
+		if err != nil || i < 0 || i > 5 {
+			return false
+		}
+		ii := int(i)
+		q.ToMark = &ii
+	}
+	return true
+}
+
+// max number of ids in a single batch request
+const maxUsersBatch = 1000
+
+// parseIDs parses comma separated list of positive ids. It fails on empty
+// list or if there are more than max ids.
+func parseIDs(val []byte, max int) ([]uint, bool) {
+	if len(val) == 0 || bytes.Count(val, []byte(",")) >= max {
+		return nil, false
+	}
+	var ids []uint
+	for len(val) > 0 {
+		var part []byte
+		if i := bytes.IndexByte(val, ','); i >= 0 {
+			part, val = val[:i], val[i+1:]
+			if len(val) == 0 {
+				return nil, false
+			}
+		} else {
+			part, val = val, nil
+		}
+		id, err := jsonparser.ParseInt(part)
+		if err != nil || id <= 0 {
+			return nil, false
+		}
+		ids = append(ids, uint(id))
+	}
+	return ids, true
+}
+
+// max number of visits returned by visits query, it is the default limit
+const maxQueryVisits = 1000
+
+// parseVisitsQuery requires user or location id, limit is capped to
+// maxQueryVisits
+func parseVisitsQuery(args *fasthttp.Args, q *VisitsQuery) bool {
+	for _, param := range []struct {
+		name string
+		id   *uint
+	}{{"user", &q.UserID}, {"location", &q.LocationID}} {
+		if val := args.Peek(param.name); len(val) > 0 {
+			id, err := jsonparser.ParseInt(val)
+			if err != nil || id <= 0 {
+				return false
+			}
+			*param.id = uint(id)
+		}
+	}
+	if q.UserID == 0 && q.LocationID == 0 {
 		return false
 	}
+	if val := args.Peek("fromDate"); len(val) > 0 {
+		ts, err := jsonparser.ParseInt(val)
+		if err != nil {
+			return false
+		}
+		q.FromDate = &ts
+	}
+	if val := args.Peek("toDate"); len(val) > 0 {
+		ts, err := jsonparser.ParseInt(val)
+		if err != nil {
+			return false
+		}
+		q.ToDate = &ts
+	}
+	if val := args.Peek("offset"); len(val) > 0 {
+		i, err := jsonparser.ParseInt(val)
+		if err != nil || i < 0 {
+			return false
+		}
+		q.Offset = int(i)
+	}
+	q.Limit = maxQueryVisits
+	if val := args.Peek("limit"); len(val) > 0 {
+		i, err := jsonparser.ParseInt(val)
+		if err != nil || i <= 0 {
+			return false
+		}
+		if i < maxQueryVisits {
+			q.Limit = int(i)
+		}
+	}
+	return true
+}
+
+func parseLocationVisitorsQuery(args *fasthttp.Args, q *LocationVisitorsQuery) bool {
+	if val := args.Peek("fromDate"); len(val) > 0 {
+		ts, err := jsonparser.ParseInt(val)
+		if err != nil {
+			return false
+		}
+		q.FromDate = &ts
+	}
+	if val := args.Peek("toDate"); len(val) > 0 {
+		ts, err := jsonparser.ParseInt(val)
+		if err != nil {
+			return false
+		}
+		q.ToDate = &ts
+	}
 	return true
 }
@@ -1,12 +1,23 @@
 package main
 
 import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime/debug"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/mailru/easyjson"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
@@ -23,6 +34,7 @@ func TestHandlers(t *testing.T) {
 	}
 	tt := []struct {
 		name         string
+		method       string
 		path         string
 		request      string
 		query        string
@@ -114,7 +126,7 @@ func TestHandlers(t *testing.T) {
 							LastName:  "LastName",
 							Email:     "foo@bar.com",
 							Gender:    "m",
-							BirthDate: &[]int64{time.Unix(100000, 0).Unix()}[0],
+							BirthDate: time.Unix(100000, 0).Unix(),
 						}
 					},
 				},
@@ -126,7 +138,7 @@ func TestHandlers(t *testing.T) {
 						LastName:  "LastName",
 						Email:     "foo@bar.com",
 						Gender:    "m",
-						BirthDate: &[]int64{time.Unix(100000, 0).Unix()}[0],
+						BirthDate: time.Unix(100000, 0).Unix(),
 					}},
 					returnArgs: []interface{}{nil},
 				},
@@ -193,7 +205,7 @@ func TestHandlers(t *testing.T) {
 							LastName:  "LastName",
 							Email:     "foo@bar.com",
 							Gender:    "m",
-							BirthDate: &[]int64{time.Unix(100000, 0).Unix()}[0],
+							BirthDate: time.Unix(100000, 0).Unix(),
 						}
 					},
 				},
@@ -224,7 +236,7 @@ func TestHandlers(t *testing.T) {
 							LastName:  "User",
 							Email:     "foo@bar.com",
 							Gender:    "m",
-							BirthDate: &[]int64{time.Unix(100000, 0).Unix()}[0],
+							BirthDate: time.Unix(100000, 0).Unix(),
 						}
 					},
 				},
@@ -247,7 +259,7 @@ func TestHandlers(t *testing.T) {
 							LastName:  "User",
 							Email:     "foo@bar.com",
 							Gender:    "m",
-							BirthDate: &[]int64{time.Unix(100000, 0).Unix()}[0],
+							BirthDate: time.Unix(100000, 0).Unix(),
 						}
 					},
 				},
@@ -270,6 +282,67 @@ func TestHandlers(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:       "GetUser/Unavailable",
+			path:       "/users/1",
+			statusCode: fasthttp.StatusServiceUnavailable,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetUser",
+					args:       []interface{}{uint(1), mock.AnythingOfType("*main.User")},
+					returnArgs: []interface{}{ErrUnavailable},
+				},
+			},
+		},
+		{
+			name:     "GetUsers",
+			path:     "/users",
+			query:    "?ids=3,1,2",
+			response: `{"users":[{"id":3,"first_name":"","last_name":"","email":"u3@hlcup.com","gender":"","birth_date":0},{"id":1,"first_name":"","last_name":"","email":"u1@hlcup.com","gender":"","birth_date":0}]}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetUsers",
+					args:       []interface{}{[]uint{3, 1, 2}, mock.AnythingOfType("*[]main.User")},
+					returnArgs: []interface{}{nil},
+					run: func(args mock.Arguments) {
+						*args.Get(1).(*[]User) = []User{{ID: 3, Email: "u3@hlcup.com"}, {ID: 1, Email: "u1@hlcup.com"}}
+					},
+				},
+			},
+		},
+		{
+			name:     "GetUsers/NotFound",
+			path:     "/users",
+			query:    "?ids=5",
+			response: `{"users":[]}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetUsers",
+					args:       []interface{}{[]uint{5}, mock.AnythingOfType("*[]main.User")},
+					returnArgs: []interface{}{nil},
+					run: func(args mock.Arguments) {
+						*args.Get(1).(*[]User) = []User{}
+					},
+				},
+			},
+		},
+		{
+			name:       "GetUsers/MissingIDs",
+			path:       "/users",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "GetUsers/InvalidIDs",
+			path:       "/users",
+			query:      "?ids=1,a",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "GetUsers/TooManyIDs",
+			path:       "/users",
+			query:      "?ids=" + strings.Repeat("1,", maxUsersBatch) + "1",
+			statusCode: fasthttp.StatusBadRequest,
+		},
 		{
 			name:     "GetUserVisits",
 			path:     "/users/1/visits",
@@ -278,7 +351,7 @@ func TestHandlers(t *testing.T) {
 				{
 					method:     "GetUserVisits",
 					args:       []interface{}{uint(1), mock.AnythingOfType("*main.UserVisitsQuery"), mock.AnythingOfType("*[]main.UserVisit")},
-					returnArgs: []interface{}{nil},
+					returnArgs: []interface{}{2, nil},
 					run: func(args mock.Arguments) {
 						visits := args.Get(2).(*[]UserVisit)
 						*visits = []UserVisit{
@@ -310,7 +383,7 @@ func TestHandlers(t *testing.T) {
 				{
 					method:     "GetUserVisits",
 					args:       []interface{}{uint(999), mock.AnythingOfType("*main.UserVisitsQuery"), mock.AnythingOfType("*[]main.UserVisit")},
-					returnArgs: []interface{}{ErrNotFound},
+					returnArgs: []interface{}{0, ErrNotFound},
 				},
 			},
 		},
@@ -322,7 +395,7 @@ func TestHandlers(t *testing.T) {
 				{
 					method:     "GetUserVisits",
 					args:       []interface{}{uint(2), mock.AnythingOfType("*main.UserVisitsQuery"), mock.AnythingOfType("*[]main.UserVisit")},
-					returnArgs: []interface{}{nil},
+					returnArgs: []interface{}{0, nil},
 				},
 			},
 		},
@@ -337,10 +410,88 @@ func TestHandlers(t *testing.T) {
 					args: []interface{}{uint(1),
 						&UserVisitsQuery{FromDate: &[]int64{time.Unix(53636439, 0).Unix()}[0]},
 						mock.AnythingOfType("*[]main.UserVisit")},
-					returnArgs: []interface{}{nil},
+					returnArgs: []interface{}{0, nil},
+				},
+			},
+		},
+		{
+			name:     "GetUserVisits/WithDistanceRange",
+			path:     "/users/1/visits",
+			query:    "?fromDistance=10&toDistance=20",
+			response: `{"visits":[]}`,
+			storeMethods: []StoreMethod{
+				{
+					method: "GetUserVisits",
+					args: []interface{}{uint(1),
+						&UserVisitsQuery{FromDistance: &[]int{10}[0], ToDistance: &[]int{20}[0]},
+						mock.AnythingOfType("*[]main.UserVisit")},
+					returnArgs: []interface{}{0, nil},
+				},
+			},
+		},
+		{
+			name:     "GetUserVisits/WithDistance",
+			path:     "/users/1/visits",
+			query:    "?distance=15",
+			response: `{"visits":[]}`,
+			storeMethods: []StoreMethod{
+				{
+					method: "GetUserVisits",
+					args: []interface{}{uint(1),
+						&UserVisitsQuery{Distance: &[]int{15}[0]},
+						mock.AnythingOfType("*[]main.UserVisit")},
+					returnArgs: []interface{}{0, nil},
+				},
+			},
+		},
+		{
+			name:     "GetUserVisits/WithDistanceRangeInMiles",
+			path:     "/users/1/visits",
+			query:    "?fromDistance=10&toDistance=20&unit=mi",
+			response: `{"visits":[]}`,
+			storeMethods: []StoreMethod{
+				{
+					method: "GetUserVisits",
+					args: []interface{}{uint(1),
+						&UserVisitsQuery{FromDistance: &[]int{16}[0], ToDistance: &[]int{33}[0]},
+						mock.AnythingOfType("*[]main.UserVisit")},
+					returnArgs: []interface{}{0, nil},
+				},
+			},
+		},
+		{
+			name:     "GetUserVisits/WithDistanceRangeInKm",
+			path:     "/users/1/visits",
+			query:    "?fromDistance=10&toDistance=20&unit=km",
+			response: `{"visits":[]}`,
+			storeMethods: []StoreMethod{
+				{
+					method: "GetUserVisits",
+					args: []interface{}{uint(1),
+						&UserVisitsQuery{FromDistance: &[]int{10}[0], ToDistance: &[]int{20}[0]},
+						mock.AnythingOfType("*[]main.UserVisit")},
+					returnArgs: []interface{}{0, nil},
 				},
 			},
 		},
+		{
+			name:       "GetUserVisits/WithExactDistanceInMiles",
+			path:       "/users/1/visits",
+			query:      "?distance=10&unit=mi",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "GetUserVisits/WithInvalidUnit",
+			path:       "/users/1/visits",
+			query:      "?toDistance=10&unit=ft",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "GetUserVisits/WithInvalidFromDistance",
+			path:       "/users/1/visits",
+			query:      "?fromDistance=abc",
+			statusCode: fasthttp.StatusBadRequest,
+		},
 		{
 			name:       "GetUserVisits/WithInvalidQuery",
 			path:       "/users/1/visits",
@@ -356,10 +507,125 @@ func TestHandlers(t *testing.T) {
 				{
 					method:     "GetUserVisits",
 					args:       []interface{}{uint(1), &UserVisitsQuery{}, mock.AnythingOfType("*[]main.UserVisit")},
+					returnArgs: []interface{}{0, nil},
+				},
+			},
+		},
+		{
+			name:     "GetUserVisits/WithTotal",
+			path:     "/users/1/visits?offset=1&limit=1&withTotal=1",
+			response: `{"visits":[{"mark":3,"visited_at":20732957,"place":"Another Place"}],"total":3}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetUserVisits",
+					args:       []interface{}{uint(1), &UserVisitsQuery{Offset: 1, Limit: 1, WithTotal: true}, mock.AnythingOfType("*[]main.UserVisit")},
+					returnArgs: []interface{}{3, nil},
+					run: func(args mock.Arguments) {
+						*args.Get(2).(*[]UserVisit) = []UserVisit{{Mark: 3, VisitedAt: 20732957, Place: "Another Place"}}
+					},
+				},
+			},
+		},
+		{
+			name:     "GetUserVisits/PageWithoutTotal",
+			path:     "/users/1/visits?offset=1&limit=1&withTotal=0",
+			response: `{"visits":[{"mark":3,"visited_at":20732957,"place":"Another Place"}]}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetUserVisits",
+					args:       []interface{}{uint(1), &UserVisitsQuery{Offset: 1, Limit: 1}, mock.AnythingOfType("*[]main.UserVisit")},
+					returnArgs: []interface{}{0, nil},
+					run: func(args mock.Arguments) {
+						*args.Get(2).(*[]UserVisit) = []UserVisit{{Mark: 3, VisitedAt: 20732957, Place: "Another Place"}}
+					},
+				},
+			},
+		},
+		{
+			name:     "GetUserVisits/OrderDesc",
+			path:     "/users/1/visits?order=desc",
+			response: `{"visits":[{"mark":3,"visited_at":20732957,"place":"Another Place"},{"mark":5,"visited_at":5000000,"place":"First Place"}]}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetUserVisits",
+					args:       []interface{}{uint(1), &UserVisitsQuery{Desc: true}, mock.AnythingOfType("*[]main.UserVisit")},
+					returnArgs: []interface{}{2, nil},
+					run: func(args mock.Arguments) {
+						*args.Get(2).(*[]UserVisit) = []UserVisit{
+							{Mark: 3, VisitedAt: 20732957, Place: "Another Place"},
+							{Mark: 5, VisitedAt: 5000000, Place: "First Place"},
+						}
+					},
+				},
+			},
+		},
+		{
+			name:     "GetUserVisits/OrderAsc",
+			path:     "/users/1/visits?order=asc",
+			response: `{"visits":[]}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetUserVisits",
+					args:       []interface{}{uint(1), &UserVisitsQuery{}, mock.AnythingOfType("*[]main.UserVisit")},
+					returnArgs: []interface{}{0, nil},
+				},
+			},
+		},
+		{
+			name:       "GetUserVisits/InvalidOrder",
+			path:       "/users/1/visits?order=random",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "GetUserVisits/InvalidLimit",
+			path:       "/users/1/visits?limit=-1",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:     "DeleteUser",
+			method:   "DELETE",
+			path:     "/users/1",
+			response: "{}\n",
+			storeMethods: []StoreMethod{
+				{
+					method:     "DeleteUser",
+					args:       []interface{}{uint(1)},
 					returnArgs: []interface{}{nil},
 				},
 			},
 		},
+		{
+			name:       "DeleteUser/InvalidID",
+			method:     "DELETE",
+			path:       "/users/a",
+			statusCode: fasthttp.StatusNotFound,
+		},
+		{
+			name:       "DeleteUser/NotFound",
+			method:     "DELETE",
+			path:       "/users/2",
+			statusCode: fasthttp.StatusNotFound,
+			storeMethods: []StoreMethod{
+				{
+					method:     "DeleteUser",
+					args:       []interface{}{uint(2)},
+					returnArgs: []interface{}{ErrNotFound},
+				},
+			},
+		},
+		{
+			name:       "DeleteUser/HasVisits",
+			method:     "DELETE",
+			path:       "/users/3",
+			statusCode: fasthttp.StatusConflict,
+			storeMethods: []StoreMethod{
+				{
+					method:     "DeleteUser",
+					args:       []interface{}{uint(3)},
+					returnArgs: []interface{}{ErrHasVisits},
+				},
+			},
+		},
 		//------------------------------
 		// Location endpoints tests
 		//------------------------------
@@ -424,7 +690,7 @@ func TestHandlers(t *testing.T) {
 							Country:  "Russia",
 							City:     "Moscow",
 							Place:    "Some Place",
-							Distance: &[]int{150}[0],
+							Distance: 150,
 						}
 					},
 				},
@@ -437,7 +703,7 @@ func TestHandlers(t *testing.T) {
 							Country:  "Russia",
 							City:     "Moscow",
 							Place:    "Another place",
-							Distance: &[]int{150}[0],
+							Distance: 150,
 						}},
 					returnArgs: []interface{}{nil},
 				},
@@ -506,7 +772,7 @@ func TestHandlers(t *testing.T) {
 							Country:  "Russia",
 							City:     "Moscow",
 							Place:    "Some Place",
-							Distance: &[]int{150}[0],
+							Distance: 150,
 						}
 					},
 				},
@@ -529,7 +795,7 @@ func TestHandlers(t *testing.T) {
 							Country:  "Russia",
 							City:     "Moscow",
 							Place:    "Some Place",
-							Distance: &[]int{150}[0],
+							Distance: 150,
 						}
 					},
 				},
@@ -556,7 +822,7 @@ func TestHandlers(t *testing.T) {
 							Country:  "Russia",
 							City:     "Moscow",
 							Place:    "Some Place",
-							Distance: &[]int{150}[0],
+							Distance: 150,
 						}
 					},
 				},
@@ -587,10 +853,96 @@ func TestHandlers(t *testing.T) {
 				{
 					method:     "GetLocationAvg",
 					args:       []interface{}{uint(1), &LocationAvgQuery{}},
-					returnArgs: []interface{}{4.375, nil},
+					returnArgs: []interface{}{4.375, 8, nil},
+				},
+			},
+		},
+		{
+			name:     "GetLocationAvg/GroupByAge",
+			path:     "/locations/1/avg",
+			query:    "?groupBy=age&gender=f",
+			response: `{"buckets":[{"from":0,"to":17,"avg":0},{"from":18,"to":34,"avg":3.33333},{"from":35,"to":49,"avg":4},{"from":50,"avg":1.5}]}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetLocationAvgByAge",
+					args:       []interface{}{uint(1), &LocationAvgQuery{Gender: "f"}, newAgeBuckets(defaultAgeBuckets)},
+					returnArgs: []interface{}{nil},
+					run: func(args mock.Arguments) {
+						buckets := args.Get(2).([]AgeBucket)
+						buckets[1].Avg = 10.0 / 3
+						buckets[2].Avg = 4
+						buckets[3].Avg = 1.5
+					},
+				},
+			},
+		},
+		{
+			name:     "GetUserAvg",
+			path:     "/users/1/avg",
+			query:    "?fromDate=100&country=Russia&toDistance=50",
+			response: `{"avg":3.33333}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetUserAvg",
+					args:       []interface{}{uint(1), &UserVisitsQuery{FromDate: &[]int64{100}[0], Country: "Russia", ToDistance: &[]int{50}[0]}},
+					returnArgs: []interface{}{10.0 / 3, nil},
 				},
 			},
 		},
+		{
+			name:     "GetUserAvg/Zero",
+			path:     "/users/1/avg",
+			response: `{"avg":0}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetUserAvg",
+					args:       []interface{}{uint(1), &UserVisitsQuery{}},
+					returnArgs: []interface{}{0.0, nil},
+				},
+			},
+		},
+		{
+			name:       "GetUserAvg/NotFound",
+			path:       "/users/999/avg",
+			statusCode: fasthttp.StatusNotFound,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetUserAvg",
+					args:       []interface{}{uint(999), &UserVisitsQuery{}},
+					returnArgs: []interface{}{0, ErrNotFound},
+				},
+			},
+		},
+		{
+			name:       "GetUserAvg/InvalidID",
+			path:       "/users/a/avg",
+			statusCode: fasthttp.StatusNotFound,
+		},
+		{
+			name:       "GetUserAvg/WithInvalidQuery",
+			path:       "/users/1/avg",
+			query:      "?toDistance=a",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "GetLocationAvg/GroupByAgeNotFound",
+			path:       "/locations/999/avg",
+			query:      "?groupBy=age",
+			statusCode: fasthttp.StatusNotFound,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetLocationAvgByAge",
+					args:       []interface{}{uint(999), &LocationAvgQuery{}, newAgeBuckets(defaultAgeBuckets)},
+					returnArgs: []interface{}{ErrNotFound},
+				},
+			},
+		},
+		{
+			name:       "GetLocationAvg/InvalidGroupBy",
+			path:       "/locations/1/avg",
+			query:      "?groupBy=gender",
+			statusCode: fasthttp.StatusBadRequest,
+		},
 		{
 			name:       "GetLocationAvg/InvalidID",
 			path:       "/locations/a/avg",
@@ -604,7 +956,7 @@ func TestHandlers(t *testing.T) {
 				{
 					method:     "GetLocationAvg",
 					args:       []interface{}{uint(999), &LocationAvgQuery{}},
-					returnArgs: []interface{}{0, ErrNotFound},
+					returnArgs: []interface{}{0, 0, ErrNotFound},
 				},
 			},
 		},
@@ -617,7 +969,7 @@ func TestHandlers(t *testing.T) {
 				{
 					method:     "GetLocationAvg",
 					args:       []interface{}{uint(1), &LocationAvgQuery{FromAge: &[]int{30}[0], ToAge: &[]int{40}[0], Gender: "m"}},
-					returnArgs: []interface{}{2.664, nil},
+					returnArgs: []interface{}{2.664, 8, nil},
 				},
 			},
 		},
@@ -628,47 +980,267 @@ func TestHandlers(t *testing.T) {
 			statusCode: fasthttp.StatusBadRequest,
 		},
 		{
-			name:     "GetLocationAvg/WithUnknownQuery",
-			path:     "/locations/200/avg",
-			query:    "?unknown=value",
-			response: `{"avg":0}`,
+			name:     "GetLocationAvg/WithMarks",
+			path:     "/locations/1/avg",
+			query:    "?fromMark=0&toMark=5",
+			response: `{"avg":3}`,
 			storeMethods: []StoreMethod{
 				{
 					method:     "GetLocationAvg",
-					args:       []interface{}{uint(200), &LocationAvgQuery{}},
-					returnArgs: []interface{}{0, nil},
+					args:       []interface{}{uint(1), &LocationAvgQuery{FromMark: &[]int{0}[0], ToMark: &[]int{5}[0]}},
+					returnArgs: []interface{}{3.0, 8, nil},
 				},
 			},
 		},
 		{
-			name:     "GetLocationAvg/Rounding",
-			path:     "/locations/15/avg",
-			response: `{"avg":2.65217}`,
+			name:     "GetLocationHistogram",
+			path:     "/locations/1/histogram",
+			query:    "?gender=f&fromMark=1",
+			response: `{"histogram":{"0":0,"1":0,"2":3,"3":0,"4":1,"5":7}}`,
 			storeMethods: []StoreMethod{
 				{
-					method:     "GetLocationAvg",
-					args:       []interface{}{uint(15), &LocationAvgQuery{}},
-					returnArgs: []interface{}{2.652173913043478, nil},
+					method:     "GetLocationHistogram",
+					args:       []interface{}{uint(1), &LocationAvgQuery{Gender: "f", FromMark: &[]int{1}[0]}, mock.AnythingOfType("*main.MarkHistogram")},
+					returnArgs: []interface{}{nil},
+					run: func(args mock.Arguments) {
+						*args.Get(2).(*MarkHistogram) = MarkHistogram{0, 0, 3, 0, 1, 7}
+					},
 				},
 			},
 		},
 		{
-			name:       "GetLocationAvg/ValidateQuery",
-			path:       "/locations/15/avg",
-			query:      "?gender=asd",
-			statusCode: fasthttp.StatusBadRequest,
-		},
-		//-------------------------------
-		// Visit endpoints tests
-		//-------------------------------
-		{
-			name:     "CreateVisit",
-			path:     "/visits/new",
-			request:  `{"id":100,"user":1,"location":15,"visited_at":1268006400,"mark":5}`,
-			response: "{}\n",
+			name:     "GetLocationHistogram/Empty",
+			path:     "/locations/1/histogram",
+			response: `{"histogram":{"0":0,"1":0,"2":0,"3":0,"4":0,"5":0}}`,
 			storeMethods: []StoreMethod{
 				{
-					method:     "CreateVisit",
+					method:     "GetLocationHistogram",
+					args:       []interface{}{uint(1), &LocationAvgQuery{}, mock.AnythingOfType("*main.MarkHistogram")},
+					returnArgs: []interface{}{nil},
+				},
+			},
+		},
+		{
+			name:       "GetLocationHistogram/NotFound",
+			path:       "/locations/999/histogram",
+			statusCode: fasthttp.StatusNotFound,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetLocationHistogram",
+					args:       []interface{}{uint(999), &LocationAvgQuery{}, mock.AnythingOfType("*main.MarkHistogram")},
+					returnArgs: []interface{}{ErrNotFound},
+				},
+			},
+		},
+		{
+			name:       "GetLocationHistogram/WithInvalidQuery",
+			path:       "/locations/1/histogram",
+			query:      "?gender=x",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:     "GetLocationVisitors",
+			path:     "/locations/1/visitors",
+			query:    "?fromDate=100&toDate=200",
+			response: `{"users":[2,5]}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetLocationVisitors",
+					args:       []interface{}{uint(1), &LocationVisitorsQuery{FromDate: &[]int64{100}[0], ToDate: &[]int64{200}[0]}, mock.AnythingOfType("*[]uint")},
+					returnArgs: []interface{}{nil},
+					run: func(args mock.Arguments) {
+						*args.Get(2).(*[]uint) = []uint{2, 5}
+					},
+				},
+			},
+		},
+		{
+			name:     "GetLocationVisitors/Empty",
+			path:     "/locations/1/visitors",
+			response: `{"users":[]}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetLocationVisitors",
+					args:       []interface{}{uint(1), &LocationVisitorsQuery{}, mock.AnythingOfType("*[]uint")},
+					returnArgs: []interface{}{nil},
+					run: func(args mock.Arguments) {
+						*args.Get(2).(*[]uint) = []uint{}
+					},
+				},
+			},
+		},
+		{
+			name:       "GetLocationVisitors/NotFound",
+			path:       "/locations/999/visitors",
+			statusCode: fasthttp.StatusNotFound,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetLocationVisitors",
+					args:       []interface{}{uint(999), &LocationVisitorsQuery{}, mock.AnythingOfType("*[]uint")},
+					returnArgs: []interface{}{ErrNotFound},
+				},
+			},
+		},
+		{
+			name:       "GetLocationVisitors/InvalidID",
+			path:       "/locations/a/visitors",
+			statusCode: fasthttp.StatusNotFound,
+		},
+		{
+			name:       "GetLocationVisitors/WithInvalidQuery",
+			path:       "/locations/1/visitors",
+			query:      "?fromDate=a",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "GetLocationAvg/WithInvalidFromMark",
+			path:       "/locations/1/avg",
+			query:      "?fromMark=-1",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "GetLocationAvg/WithInvalidToMark",
+			path:       "/locations/1/avg",
+			query:      "?toMark=6",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "GetLocationAvg/WithNonNumericMark",
+			path:       "/locations/1/avg",
+			query:      "?fromMark=a",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "GetLocationHistogram/WithInvalidFromMark",
+			path:       "/locations/1/histogram",
+			query:      "?fromMark=6",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "GetLocationHistogram/WithInvalidToMark",
+			path:       "/locations/1/histogram",
+			query:      "?toMark=-1",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:     "GetLocationAvg/WithUnknownQuery",
+			path:     "/locations/200/avg",
+			query:    "?unknown=value",
+			response: `{"avg":0}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetLocationAvg",
+					args:       []interface{}{uint(200), &LocationAvgQuery{}},
+					returnArgs: []interface{}{0, 0, nil},
+				},
+			},
+		},
+		{
+			name:     "GetLocationAvg/NullEmpty",
+			path:     "/locations/200/avg",
+			query:    "?nullEmpty=1",
+			response: `{"avg":null}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetLocationAvg",
+					args:       []interface{}{uint(200), &LocationAvgQuery{}},
+					returnArgs: []interface{}{0, 0, nil},
+				},
+			},
+		},
+		{
+			name:     "GetLocationAvg/NullEmptyWithVisits",
+			path:     "/locations/201/avg",
+			query:    "?nullEmpty=true",
+			response: `{"avg":0}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetLocationAvg",
+					args:       []interface{}{uint(201), &LocationAvgQuery{}},
+					returnArgs: []interface{}{0, 3, nil},
+				},
+			},
+		},
+		{
+			name:       "GetLocationAvg/InvalidNullEmpty",
+			path:       "/locations/200/avg",
+			query:      "?nullEmpty=yes",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:     "GetLocationAvg/Rounding",
+			path:     "/locations/15/avg",
+			response: `{"avg":2.65217}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetLocationAvg",
+					args:       []interface{}{uint(15), &LocationAvgQuery{}},
+					returnArgs: []interface{}{2.652173913043478, 8, nil},
+				},
+			},
+		},
+		{
+			name:       "GetLocationAvg/ValidateQuery",
+			path:       "/locations/15/avg",
+			query:      "?gender=asd",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:     "DeleteLocation",
+			method:   "DELETE",
+			path:     "/locations/1",
+			response: "{}\n",
+			storeMethods: []StoreMethod{
+				{
+					method:     "DeleteLocation",
+					args:       []interface{}{uint(1)},
+					returnArgs: []interface{}{nil},
+				},
+			},
+		},
+		{
+			name:       "DeleteLocation/InvalidID",
+			method:     "DELETE",
+			path:       "/locations/a",
+			statusCode: fasthttp.StatusNotFound,
+		},
+		{
+			name:       "DeleteLocation/NotFound",
+			method:     "DELETE",
+			path:       "/locations/2",
+			statusCode: fasthttp.StatusNotFound,
+			storeMethods: []StoreMethod{
+				{
+					method:     "DeleteLocation",
+					args:       []interface{}{uint(2)},
+					returnArgs: []interface{}{ErrNotFound},
+				},
+			},
+		},
+		{
+			name:       "DeleteLocation/HasVisits",
+			method:     "DELETE",
+			path:       "/locations/3",
+			statusCode: fasthttp.StatusConflict,
+			storeMethods: []StoreMethod{
+				{
+					method:     "DeleteLocation",
+					args:       []interface{}{uint(3)},
+					returnArgs: []interface{}{ErrHasVisits},
+				},
+			},
+		},
+		//-------------------------------
+		// Visit endpoints tests
+		//-------------------------------
+		{
+			name:     "CreateVisit",
+			path:     "/visits/new",
+			request:  `{"id":100,"user":1,"location":15,"visited_at":1268006400,"mark":5}`,
+			response: "{}\n",
+			storeMethods: []StoreMethod{
+				{
+					method:     "CreateVisit",
 					args:       []interface{}{mock.AnythingOfType("*main.Visit")},
 					returnArgs: []interface{}{nil},
 				},
@@ -686,6 +1258,31 @@ func TestHandlers(t *testing.T) {
 			request:    `{"mark":-10}`,
 			statusCode: fasthttp.StatusBadRequest,
 		},
+		{
+			name:       "CreateVisit/NegativeMark",
+			path:       "/visits/new",
+			request:    `{"id":100,"user":1,"location":15,"visited_at":1268006400,"mark":-10}`,
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "CreateVisit/TooHighMark",
+			path:       "/visits/new",
+			request:    `{"id":100,"user":1,"location":15,"visited_at":1268006400,"mark":6}`,
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:     "CreateVisit/ZeroMark",
+			path:     "/visits/new",
+			request:  `{"id":100,"user":1,"location":15,"visited_at":1268006400,"mark":0}`,
+			response: "{}\n",
+			storeMethods: []StoreMethod{
+				{
+					method:     "CreateVisit",
+					args:       []interface{}{&Visit{ID: 100, UserID: 1, LocationID: 15, VisitedAt: 1268006400, Mark: 0}},
+					returnArgs: []interface{}{nil},
+				},
+			},
+		},
 		{
 			name:       "CreateVisit/WithNullField",
 			path:       "/visits/new",
@@ -705,6 +1302,41 @@ func TestHandlers(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:     "CreateVisits",
+			path:     "/visits/bulk",
+			request:  `{"visits":[{"id":1,"user":1,"location":1,"visited_at":1268006400,"mark":4},{"id":2,"user":1,"location":2,"visited_at":1268006500,"mark":3}]}`,
+			response: "{}\n",
+			storeMethods: []StoreMethod{
+				{
+					method: "CreateVisits",
+					args: []interface{}{[]Visit{
+						{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 1268006400, Mark: 4},
+						{ID: 2, UserID: 1, LocationID: 2, VisitedAt: 1268006500, Mark: 3},
+					}},
+					returnArgs: []interface{}{nil},
+				},
+			},
+		},
+		{
+			name:       "CreateVisits/ValidationError",
+			path:       "/visits/bulk",
+			request:    `{"visits":[{"id":1,"user":1,"location":1,"visited_at":1268006400,"mark":4},{"id":2,"user":1,"location":2,"visited_at":1268006500,"mark":-10}]}`,
+			response:   `{"error":"invalid visit","code":"invalid_mark","index":1}`,
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:     "CreateVisits/Empty",
+			path:     "/visits/bulk",
+			request:  `{"visits":[]}`,
+			response: "{}\n",
+		},
+		{
+			name:       "CreateVisits/InvalidBody",
+			path:       "/visits/bulk",
+			request:    `{"visits":{bad-json}}`,
+			statusCode: fasthttp.StatusBadRequest,
+		},
 		{
 			name:     "UpdateVisit",
 			path:     "/visits/100",
@@ -721,8 +1353,8 @@ func TestHandlers(t *testing.T) {
 							ID:         100,
 							UserID:     1,
 							LocationID: 15,
-							VisitedAt:  &[]int64{time.Unix(1268006400, 0).Unix()}[0],
-							Mark:       &[]int{2}[0],
+							VisitedAt:  time.Unix(1268006400, 0).Unix(),
+							Mark:       2,
 						}
 					},
 				},
@@ -734,8 +1366,8 @@ func TestHandlers(t *testing.T) {
 							ID:         100,
 							UserID:     1,
 							LocationID: 15,
-							VisitedAt:  &[]int64{time.Unix(1268006400, 0).Unix()}[0],
-							Mark:       &[]int{4}[0],
+							VisitedAt:  time.Unix(1268006400, 0).Unix(),
+							Mark:       4,
 						}},
 					returnArgs: []interface{}{nil},
 				},
@@ -803,8 +1435,8 @@ func TestHandlers(t *testing.T) {
 							ID:         99,
 							UserID:     1,
 							LocationID: 72,
-							VisitedAt:  &[]int64{time.Unix(1268006400, 0).Unix()}[0],
-							Mark:       &[]int{2}[0],
+							VisitedAt:  time.Unix(1268006400, 0).Unix(),
+							Mark:       2,
 						}
 					},
 				},
@@ -826,8 +1458,8 @@ func TestHandlers(t *testing.T) {
 							ID:         1,
 							UserID:     1,
 							LocationID: 72,
-							VisitedAt:  &[]int64{time.Unix(1268006400, 0).Unix()}[0],
-							Mark:       &[]int{2}[0],
+							VisitedAt:  time.Unix(1268006400, 0).Unix(),
+							Mark:       2,
 						}
 					},
 				},
@@ -838,6 +1470,69 @@ func TestHandlers(t *testing.T) {
 				},
 			},
 		},
+		{
+			name:     "UpdateVisits",
+			path:     "/visits/bulk-update",
+			request:  `{"updates":[{"id":1,"mark":4},{"id":2,"mark":0,"user":2}]}`,
+			response: `{"results":[{"id":1,"status":200},{"id":2,"status":200}]}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetVisit",
+					args:       []interface{}{mock.AnythingOfType("uint"), mock.AnythingOfType("*main.Visit")},
+					returnArgs: []interface{}{nil},
+					run: func(args mock.Arguments) {
+						id := args.Get(0).(uint)
+						*args.Get(1).(*Visit) = Visit{ID: id, UserID: 1, LocationID: 1, VisitedAt: 1000000000, Mark: 2}
+					},
+				},
+				{
+					method: "UpdateVisits",
+					args: []interface{}{[]Visit{
+						{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 1000000000, Mark: 4},
+						{ID: 2, UserID: 2, LocationID: 1, VisitedAt: 1000000000, Mark: 0},
+					}},
+					returnArgs: []interface{}{[]error{nil, nil}},
+				},
+			},
+		},
+		{
+			name:    "UpdateVisits/PartialFailure",
+			path:    "/visits/bulk-update",
+			request: `{"updates":[{"id":1,"mark":4},{"id":2,"mark":3},{"id":3,"mark":9},{"id":4,"location":5},{"mark":1},{"id":1,"user":null}]}`,
+			response: `{"results":[{"id":1,"status":200},{"id":2,"status":404,"error":"not found"},` +
+				`{"id":3,"status":400,"error":"invalid mark","code":"invalid_mark"},{"id":4,"status":404,"error":"not found"},` +
+				`{"id":0,"status":400,"error":"invalid id","code":"invalid_id"},{"id":1,"status":400,"error":"null type"}]}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "GetVisit",
+					args:       []interface{}{uint(2), mock.AnythingOfType("*main.Visit")},
+					returnArgs: []interface{}{ErrNotFound},
+				},
+				{
+					method:     "GetVisit",
+					args:       []interface{}{mock.AnythingOfType("uint"), mock.AnythingOfType("*main.Visit")},
+					returnArgs: []interface{}{nil},
+					run: func(args mock.Arguments) {
+						id := args.Get(0).(uint)
+						*args.Get(1).(*Visit) = Visit{ID: id, UserID: 1, LocationID: 1, VisitedAt: 1000000000, Mark: 2}
+					},
+				},
+				{
+					method: "UpdateVisits",
+					args: []interface{}{[]Visit{
+						{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 1000000000, Mark: 4},
+						{ID: 4, UserID: 1, LocationID: 5, VisitedAt: 1000000000, Mark: 2},
+					}},
+					returnArgs: []interface{}{[]error{nil, ErrNotFound}},
+				},
+			},
+		},
+		{
+			name:       "UpdateVisits/InvalidBody",
+			path:       "/visits/bulk-update",
+			request:    `{"updates":{"id":1}}`,
+			statusCode: fasthttp.StatusBadRequest,
+		},
 		{
 			name:     "GetVisit",
 			path:     "/visits/99",
@@ -853,8 +1548,8 @@ func TestHandlers(t *testing.T) {
 							ID:         99,
 							UserID:     1,
 							LocationID: 72,
-							VisitedAt:  &[]int64{time.Unix(378654317, 0).Unix()}[0],
-							Mark:       &[]int{2}[0],
+							VisitedAt:  time.Unix(378654317, 0).Unix(),
+							Mark:       2,
 						}
 					},
 				},
@@ -877,41 +1572,159 @@ func TestHandlers(t *testing.T) {
 				},
 			},
 		},
-	}
-	// Disable logging
-	logrus.SetOutput(ioutil.Discard)
-	ln := fasthttputil.NewInmemoryListener()
-	defer ln.Close()
-	srv := NewServer(nil)
-	go fasthttp.Serve(ln, srv.handler)
-	for _, tc := range tt {
-		t.Run(tc.name, func(t *testing.T) {
-			// new store for each test
-			store := new(MockStore)
-			srv.store = store
-			for _, sm := range tc.storeMethods {
-				c := store.On(sm.method, sm.args...).Return(sm.returnArgs...)
-				if sm.run != nil {
-					c.Run(sm.run)
-				}
-			}
-
-			req := fasthttp.AcquireRequest()
-			req.SetRequestURI("http://localhost" + tc.path + tc.query)
-			if tc.request != "" {
-				req.Header.SetMethod("POST")
-				req.SetBodyString(tc.request)
-			}
-
-			res := fasthttp.AcquireResponse()
-			client := fasthttp.Client{
-				Dial: func(_ string) (net.Conn, error) { return ln.Dial() },
-			}
-
-			if err := client.Do(req, res); err != nil {
-				t.Fatalf("could not send request: %v", err)
-			}
-
+		{
+			name:     "QueryVisits",
+			path:     "/visits",
+			query:    "?user=1&location=5&fromDate=100&toDate=300&offset=1&limit=2",
+			response: `{"visits":[{"id":7,"user":1,"location":5,"visited_at":200,"mark":3}]}`,
+			storeMethods: []StoreMethod{
+				{
+					method: "QueryVisits",
+					args: []interface{}{
+						&VisitsQuery{UserID: 1, LocationID: 5, FromDate: &[]int64{100}[0], ToDate: &[]int64{300}[0], Offset: 1, Limit: 2},
+						mock.AnythingOfType("*[]main.Visit")},
+					returnArgs: []interface{}{nil},
+					run: func(args mock.Arguments) {
+						*args.Get(1).(*[]Visit) = []Visit{{ID: 7, UserID: 1, LocationID: 5, VisitedAt: 200, Mark: 3}}
+					},
+				},
+			},
+		},
+		{
+			name:     "QueryVisits/LocationCapped",
+			path:     "/visits",
+			query:    "?location=5&limit=5000",
+			response: `{"visits":[]}`,
+			storeMethods: []StoreMethod{
+				{
+					method:     "QueryVisits",
+					args:       []interface{}{&VisitsQuery{LocationID: 5, Limit: maxQueryVisits}, mock.AnythingOfType("*[]main.Visit")},
+					returnArgs: []interface{}{nil},
+					run: func(args mock.Arguments) {
+						*args.Get(1).(*[]Visit) = []Visit{}
+					},
+				},
+			},
+		},
+		{
+			name:       "QueryVisits/NotFound",
+			path:       "/visits",
+			query:      "?user=3",
+			statusCode: fasthttp.StatusNotFound,
+			storeMethods: []StoreMethod{
+				{
+					method:     "QueryVisits",
+					args:       []interface{}{&VisitsQuery{UserID: 3, Limit: maxQueryVisits}, mock.AnythingOfType("*[]main.Visit")},
+					returnArgs: []interface{}{ErrNotFound},
+				},
+			},
+		},
+		{
+			name:       "QueryVisits/NoOwner",
+			path:       "/visits",
+			query:      "?fromDate=100",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "QueryVisits/InvalidUser",
+			path:       "/visits",
+			query:      "?user=0",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "QueryVisits/InvalidLocation",
+			path:       "/visits",
+			query:      "?user=1&location=a",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "QueryVisits/InvalidDate",
+			path:       "/visits",
+			query:      "?user=1&toDate=a",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "QueryVisits/InvalidLimit",
+			path:       "/visits",
+			query:      "?user=1&limit=0",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:       "QueryVisits/InvalidOffset",
+			path:       "/visits",
+			query:      "?user=1&offset=-1",
+			statusCode: fasthttp.StatusBadRequest,
+		},
+		{
+			name:     "DeleteVisit",
+			method:   "DELETE",
+			path:     "/visits/1",
+			response: "{}\n",
+			storeMethods: []StoreMethod{
+				{
+					method:     "DeleteVisit",
+					args:       []interface{}{uint(1)},
+					returnArgs: []interface{}{nil},
+				},
+			},
+		},
+		{
+			name:       "DeleteVisit/InvalidID",
+			method:     "DELETE",
+			path:       "/visits/a",
+			statusCode: fasthttp.StatusNotFound,
+		},
+		{
+			name:       "DeleteVisit/NotFound",
+			method:     "DELETE",
+			path:       "/visits/2",
+			statusCode: fasthttp.StatusNotFound,
+			storeMethods: []StoreMethod{
+				{
+					method:     "DeleteVisit",
+					args:       []interface{}{uint(2)},
+					returnArgs: []interface{}{ErrNotFound},
+				},
+			},
+		},
+	}
+	// Disable logging
+	logrus.SetOutput(ioutil.Discard)
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	srv := NewServer(nil)
+	go srv.httpServer().Serve(ln)
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			// new store for each test
+			store := new(MockStore)
+			srv.store = store
+			for _, sm := range tc.storeMethods {
+				c := store.On(sm.method, sm.args...).Return(sm.returnArgs...)
+				if sm.run != nil {
+					c.Run(sm.run)
+				}
+			}
+
+			req := fasthttp.AcquireRequest()
+			req.SetRequestURI("http://localhost" + tc.path + tc.query)
+			if tc.request != "" {
+				req.Header.SetMethod("POST")
+				req.SetBodyString(tc.request)
+			}
+			if tc.method != "" {
+				req.Header.SetMethod(tc.method)
+			}
+
+			res := fasthttp.AcquireResponse()
+			client := fasthttp.Client{
+				Dial: func(_ string) (net.Conn, error) { return ln.Dial() },
+			}
+
+			if err := client.Do(req, res); err != nil {
+				t.Fatalf("could not send request: %v", err)
+			}
+
 			statusCode := tc.statusCode
 			if statusCode == 0 {
 				statusCode = fasthttp.StatusOK
@@ -932,3 +1745,1392 @@ func TestHandlers(t *testing.T) {
 		})
 	}
 }
+
+func TestMaxBodySize(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	srv := NewServer(new(MockStore))
+	srv.SetMaxBodySize(64)
+	go srv.httpServer().Serve(ln)
+
+	client := fasthttp.Client{
+		Dial: func(_ string) (net.Conn, error) { return ln.Dial() },
+	}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(res)
+
+	req.SetRequestURI("http://localhost/users/new")
+	req.Header.SetMethod("POST")
+	req.SetBodyString(`{"id":1,"first_name":"` + strings.Repeat("a", 100) + `"}`)
+	if err := client.Do(req, res); err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	assert.Equal(t, fasthttp.StatusRequestEntityTooLarge, res.StatusCode())
+}
+
+// blockingStore blocks GetLocationAvg of location 3 until its context is
+// done and reports the context, other calls go to the mock
+type blockingStore struct {
+	*MockStore
+	done chan context.Context
+}
+
+func (s *blockingStore) GetLocationAvg(ctx context.Context, id uint, q *LocationAvgQuery) (float64, int, error) {
+	if id != 3 {
+		return s.MockStore.GetLocationAvg(ctx, id, q)
+	}
+	<-ctx.Done()
+	s.done <- ctx
+	return 0, 0, ctx.Err()
+}
+
+func TestTimeout(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	store := new(MockStore)
+	store.On("GetLocationAvg", uint(1), mock.AnythingOfType("*main.LocationAvgQuery")).
+		Return(3.0, 1, nil).After(200 * time.Millisecond)
+	store.On("GetLocationAvg", uint(2), mock.AnythingOfType("*main.LocationAvgQuery")).
+		Return(3.0, 1, nil)
+	blocking := &blockingStore{MockStore: store, done: make(chan context.Context, 1)}
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	srv := NewServer(blocking)
+	srv.SetTimeout(50 * time.Millisecond)
+	go srv.httpServer().Serve(ln)
+
+	client := fasthttp.Client{
+		Dial: func(_ string) (net.Conn, error) { return ln.Dial() },
+	}
+	code, _, err := client.Get(nil, "http://localhost/locations/1/avg")
+	assert.NoError(t, err)
+	assert.Equal(t, fasthttp.StatusServiceUnavailable, code)
+	code, body, err := client.Get(nil, "http://localhost/locations/2/avg")
+	assert.NoError(t, err)
+	assert.Equal(t, fasthttp.StatusOK, code)
+	assert.Equal(t, `{"avg":3}`, strings.TrimSpace(string(body)))
+
+	// store call blocked on context gives up together with the response
+	code, _, err = client.Get(nil, "http://localhost/locations/3/avg")
+	assert.NoError(t, err)
+	assert.Equal(t, fasthttp.StatusServiceUnavailable, code)
+	select {
+	case ctx := <-blocking.done:
+		assert.Equal(t, context.DeadlineExceeded, ctx.Err())
+	case <-time.After(time.Second):
+		t.Fatal("store call did not return after timeout")
+	}
+}
+
+func TestStoreContext(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	store := &blockingStore{MockStore: new(MockStore), done: make(chan context.Context, 1)}
+	srv := NewServer(store)
+	srv.SetTimeout(20 * time.Millisecond)
+
+	// handler itself gives up on deadline, without the timeout wrapper
+	ctx := doRequest(srv.handler, "GET", "/locations/3/avg", "")
+	assert.Equal(t, fasthttp.StatusServiceUnavailable, ctx.Response.StatusCode())
+	sctx := <-store.done
+	assert.Equal(t, context.DeadlineExceeded, sctx.Err())
+	_, ok := sctx.Deadline()
+	assert.True(t, ok)
+
+	// the deadline rather than query budget limits mongo queries
+	assert.True(t, mongoMaxTime(sctx, 5*time.Second) <= 20*time.Millisecond)
+
+	// without timeout store gets request context cancelled on shutdown only
+	srv.SetTimeout(0)
+	store.MockStore.On("GetLocationAvg", uint(1), mock.AnythingOfType("*main.LocationAvgQuery")).
+		Return(3.0, 1, nil)
+	ctx = doRequest(srv.handler, "GET", "/locations/1/avg", "")
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, context.Context(ctx), storeContext(ctx))
+}
+
+func TestConnLimits(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	srv := NewServer(NewMemoryStore())
+	srv.SetConcurrency(1)
+	srv.SetIOTimeouts(time.Second, 2*time.Second)
+	hs := srv.httpServer()
+	assert.Equal(t, 1, hs.Concurrency)
+	assert.Equal(t, time.Second, hs.ReadTimeout)
+	assert.Equal(t, 2*time.Second, hs.WriteTimeout)
+	h2 := srv.h2cServer(":0")
+	assert.Equal(t, time.Second, h2.ReadTimeout)
+	assert.Equal(t, 2*time.Second, h2.WriteTimeout)
+
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	go hs.Serve(ln)
+	status := func(conn net.Conn) int {
+		var res fasthttp.Response
+		if err := res.Read(bufio.NewReader(conn)); err != nil {
+			t.Fatalf("could not read response: %v", err)
+		}
+		return res.StatusCode()
+	}
+
+	// keep-alive connection holds the only slot
+	conn1, err := ln.Dial()
+	assert.NoError(t, err)
+	defer conn1.Close()
+	_, err = conn1.Write([]byte("GET /live HTTP/1.1\r\nHost: localhost\r\n\r\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, fasthttp.StatusOK, status(conn1))
+
+	// the next connection is rejected without reading request
+	conn2, err := ln.Dial()
+	assert.NoError(t, err)
+	defer conn2.Close()
+	assert.Equal(t, fasthttp.StatusServiceUnavailable, status(conn2))
+}
+
+func TestEnableStageGC(t *testing.T) {
+	srv := NewServer(new(MockStore))
+	assert.Equal(t, uint32(0), srv.stage)
+	srv.qcnt = 10
+
+	prev := debug.SetGCPercent(100)
+	defer debug.SetGCPercent(prev)
+	srv.EnableStageGC(300)
+	assert.Equal(t, uint32(1), srv.stage)
+	assert.Equal(t, uint32(0), srv.qcnt)
+	assert.Equal(t, 300, debug.SetGCPercent(100))
+
+	doRequest(srv.handler, "GET", "/nonsense", "")
+	assert.Equal(t, uint32(1), srv.qcnt)
+}
+
+func TestMetrics(t *testing.T) {
+	store := new(MockStore)
+	store.On("GetUser", uint(1), mock.AnythingOfType("*main.User")).Return(nil)
+	store.On("GetUser", uint(2), mock.AnythingOfType("*main.User")).Return(ErrNotFound)
+	srv := NewServer(store)
+
+	doRequest(srv.handler, "GET", "/users/1", "")
+	doRequest(srv.handler, "GET", "/users/1", "")
+	doRequest(srv.handler, "GET", "/users/2", "")
+	doRequest(srv.handler, "GET", "/nonsense", "")
+
+	assert.Equal(t, 2.0, testutil.ToFloat64(srv.metrics.requests.WithLabelValues("getUser", "200")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(srv.metrics.requests.WithLabelValues("getUser", "404")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(srv.metrics.requests.WithLabelValues("unknown", "404")))
+
+	ctx := doRequest(srv.handler, "GET", "/metrics", "")
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	body := string(ctx.Response.Body())
+	assert.Contains(t, body, `hlcup_requests_total{code="200",route="getUser"} 2`)
+	assert.Contains(t, body, `hlcup_request_duration_seconds_count{route="getUser"} 3`)
+}
+
+func TestStats(t *testing.T) {
+	srv := NewServer(NewMemoryStore())
+	getStats := func() StatsResult {
+		ctx := doRequest(srv.handler, "GET", "/stats", "")
+		assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+		var stats StatsResult
+		assert.NoError(t, stats.UnmarshalJSON(ctx.Response.Body()))
+		return stats
+	}
+
+	ctx := doRequest(srv.handler, "GET", "/stats", "")
+	for _, key := range []string{"users", "locations", "visits", "alloc", "total_alloc", "sys", "num_gc"} {
+		assert.Contains(t, string(ctx.Response.Body()), `"`+key+`":`)
+	}
+	stats := getStats()
+	assert.Equal(t, 0, stats.Users)
+	assert.Equal(t, 0, stats.Locations)
+	assert.Equal(t, 0, stats.Visits)
+	assert.NotZero(t, stats.Sys)
+
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`)
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":1,"place":"P","country":"C","city":"C","distance":1}`)
+	doRequest(srv.handler, "POST", "/visits/new", `{"id":1,"user":1,"location":1,"visited_at":1268006400,"mark":1}`)
+	stats = getStats()
+	assert.Equal(t, 1, stats.Users)
+	assert.Equal(t, 1, stats.Locations)
+	assert.Equal(t, 1, stats.Visits)
+
+	doRequest(srv.handler, "DELETE", "/visits/1", "")
+	assert.Equal(t, 0, getStats().Visits)
+	assert.NotContains(t, string(doRequest(srv.handler, "GET", "/stats", "").Response.Body()), "user_ids")
+
+	// sample lists ids of sparse set
+	for _, id := range []int{5, 70, 900} {
+		doRequest(srv.handler, "POST", "/users/new", fmt.Sprintf(`{"id":%d,"email":"u%d@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`, id, id))
+	}
+	ctx = doRequest(srv.handler, "GET", "/stats?sample=10", "")
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.NoError(t, stats.UnmarshalJSON(ctx.Response.Body()))
+	assert.ElementsMatch(t, []uint{1, 5, 70, 900}, stats.UserIDs)
+	assert.Equal(t, []uint{1}, stats.LocationIDs)
+	assert.Empty(t, stats.VisitIDs)
+	ctx = doRequest(srv.handler, "GET", "/stats?sample=2", "")
+	stats = StatsResult{}
+	assert.NoError(t, stats.UnmarshalJSON(ctx.Response.Body()))
+	assert.Len(t, stats.UserIDs, 2)
+	assert.Subset(t, []uint{1, 5, 70, 900}, stats.UserIDs)
+	for _, val := range []string{"-1", "x", "100001"} {
+		ctx = doRequest(srv.handler, "GET", "/stats?sample="+val, "")
+		assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode(), val)
+	}
+}
+
+func TestParseIDs(t *testing.T) {
+	tt := []struct {
+		val string
+		ids []uint
+		ok  bool
+	}{
+		{"1", []uint{1}, true},
+		{"3,1,3", []uint{3, 1, 3}, true},
+		{"1,2,3", []uint{1, 2, 3}, true},
+		{"1,2,3,4", nil, false},
+		{"", nil, false},
+		{"1,", nil, false},
+		{",1", nil, false},
+		{"1,,2", nil, false},
+		{"0", nil, false},
+		{"-1", nil, false},
+		{"1.5", nil, false},
+	}
+	for _, tc := range tt {
+		ids, ok := parseIDs([]byte(tc.val), 3)
+		assert.Equal(t, tc.ok, ok, tc.val)
+		assert.Equal(t, tc.ids, ids, tc.val)
+	}
+}
+
+func TestPathShape(t *testing.T) {
+	srv := NewServer(NewMemoryStore())
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`)
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":1,"place":"P","country":"C","city":"C","distance":1}`)
+	doRequest(srv.handler, "POST", "/visits/new", `{"id":1,"user":1,"location":1,"visited_at":1268006400,"mark":1}`)
+
+	tt := []struct {
+		path       string
+		statusCode int
+	}{
+		{"/users/1", fasthttp.StatusOK},
+		{"/users/1/", fasthttp.StatusOK},
+		{"/users/1/visits/", fasthttp.StatusOK},
+		{"/users/1/avg/", fasthttp.StatusOK},
+		{"/locations/1/avg/", fasthttp.StatusOK},
+		{"/locations/1/histogram/", fasthttp.StatusOK},
+		{"/visits/1/", fasthttp.StatusOK},
+		{"/stats/", fasthttp.StatusOK},
+		// fasthttp collapses repeated slashes
+		{"/users/1//", fasthttp.StatusOK},
+		{"/users//1", fasthttp.StatusOK},
+		{"/users/1/2", fasthttp.StatusNotFound},
+		{"/users/1/visits/2", fasthttp.StatusNotFound},
+		{"/locations/1/avg/1", fasthttp.StatusNotFound},
+		{"/visits/1/visits", fasthttp.StatusNotFound},
+		{"/locations", fasthttp.StatusNotFound},
+		{"/", fasthttp.StatusNotFound},
+	}
+	for _, tc := range tt {
+		ctx := doRequest(srv.handler, "GET", tc.path, "")
+		assert.Equal(t, tc.statusCode, ctx.Response.StatusCode(), tc.path)
+	}
+}
+
+func TestPathID(t *testing.T) {
+	id, err := pathID([]byte("/users/12/visits"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12), id)
+	id, err = pathID([]byte("/visits/7/"))
+	assert.NoError(t, err)
+	assert.Equal(t, int64(7), id)
+	_, err = pathID([]byte("/visits/a"))
+	assert.Error(t, err)
+	_, err = pathID([]byte("/visits"))
+	assert.Error(t, err)
+	_, err = pathID([]byte("/visits//"))
+	assert.Error(t, err)
+	_, err = pathID([]byte("//visits/1"))
+	assert.Error(t, err)
+}
+
+func TestProbes(t *testing.T) {
+	store := new(MockStore)
+	srv := NewServer(store)
+	status := func(method, path string) int {
+		return doRequest(srv.handler, method, path, "").Response.StatusCode()
+	}
+
+	// up but loading data
+	srv.SetLoading(true)
+	assert.Equal(t, fasthttp.StatusOK, status("GET", "/live"))
+	assert.Equal(t, fasthttp.StatusServiceUnavailable, status("GET", "/ready"))
+	assert.Equal(t, fasthttp.StatusServiceUnavailable, status("GET", "/users/1"))
+	assert.Equal(t, fasthttp.StatusServiceUnavailable, status("POST", "/users/new"))
+	assert.Equal(t, fasthttp.StatusServiceUnavailable, status("GET", "/nonsense"))
+	assert.Equal(t, fasthttp.StatusOK, status("GET", "/metrics"))
+	store.On("Count", mock.AnythingOfType("*main.StoreCounts")).Return(nil)
+	assert.Equal(t, fasthttp.StatusOK, status("GET", "/stats"))
+
+	// loaded
+	srv.SetLoading(false)
+	store.On("Ping").Return(nil).Once()
+	assert.Equal(t, fasthttp.StatusOK, status("GET", "/live"))
+	assert.Equal(t, fasthttp.StatusOK, status("GET", "/ready"))
+	assert.Equal(t, fasthttp.StatusMethodNotAllowed, status("POST", "/ready"))
+	assert.Equal(t, fasthttp.StatusNotFound, status("GET", "/nonsense"))
+
+	// store is unreachable
+	store.On("Ping").Return(errors.New("no reachable servers"))
+	assert.Equal(t, fasthttp.StatusOK, status("GET", "/live"))
+	assert.Equal(t, fasthttp.StatusServiceUnavailable, status("GET", "/ready"))
+	store.AssertExpectations(t)
+}
+
+func TestPartialUpdate(t *testing.T) {
+	// PATCH is an alias for POST update
+	for _, method := range []string{"POST", "PATCH"} {
+		t.Run(method, func(t *testing.T) {
+			testPartialUpdate(t, method)
+		})
+	}
+}
+
+func testPartialUpdate(t *testing.T, method string) {
+	srv := NewServer(NewMemoryStore())
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`)
+	doRequest(srv.handler, "POST", "/users/new", `{"id":2,"email":"b@b.c","first_name":"B","last_name":"B","gender":"f","birth_date":0}`)
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":1,"place":"P","country":"C","city":"C","distance":1}`)
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":2,"place":"P2","country":"C2","city":"C2","distance":2}`)
+	doRequest(srv.handler, "POST", "/visits/new", `{"id":1,"user":1,"location":1,"visited_at":1268006400,"mark":1}`)
+
+	tt := []struct {
+		name     string
+		path     string
+		update   string
+		expected easyjson.Marshaler
+	}{
+		{
+			name:     "User",
+			path:     "/users/1",
+			update:   `{"email":"new@b.c","birth_date":100}`,
+			expected: &User{ID: 1, Email: "new@b.c", FirstName: "A", LastName: "B", Gender: "m", BirthDate: 100},
+		},
+		{
+			name:     "Location",
+			path:     "/locations/1",
+			update:   `{"city":"New","distance":10}`,
+			expected: &Location{ID: 1, Place: "P", Country: "C", City: "New", Distance: 10},
+		},
+		{
+			name:     "Visit",
+			path:     "/visits/1",
+			update:   `{"location":2,"mark":5}`,
+			expected: &Visit{ID: 1, UserID: 1, LocationID: 2, VisitedAt: 1268006400, Mark: 5},
+		},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			expected, err := easyjson.Marshal(tc.expected)
+			assert.NoError(t, err)
+			get := func() string {
+				ctx := doRequest(srv.handler, "GET", tc.path, "")
+				assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+				return string(ctx.Response.Body())
+			}
+
+			// absent fields are kept, present ones are replaced
+			ctx := doRequest(srv.handler, method, tc.path, tc.update)
+			assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+			assert.Equal(t, string(expected), get())
+
+			// empty object changes nothing, the same id is allowed
+			ctx = doRequest(srv.handler, method, tc.path, `{}`)
+			assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+			ctx = doRequest(srv.handler, method, tc.path, `{"id":1}`)
+			assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+			assert.Equal(t, string(expected), get())
+
+			// rejected updates leave entity untouched
+			for _, body := range []string{`{"id":2}`, `{"id":2,"mark":0,"city":"X","email":"x@b.c"}`, `{"id":null}`} {
+				ctx = doRequest(srv.handler, method, tc.path, body)
+				assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode(), body)
+			}
+			assert.Equal(t, string(expected), get())
+		})
+	}
+}
+
+func TestChangedEndpoints(t *testing.T) {
+	srv := NewServer(NewMemoryStore())
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":100}`)
+	doRequest(srv.handler, "POST", "/users/new", `{"id":2,"email":"b@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":100}`)
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":1,"place":"P","country":"C","city":"C","distance":1}`)
+	doRequest(srv.handler, "POST", "/visits/new", `{"id":1,"user":1,"location":1,"visited_at":1268006400,"mark":5}`)
+	doRequest(srv.handler, "POST", "/users/1", `{"first_name":"X"}`)
+
+	for _, tc := range []struct {
+		path       string
+		statusCode int
+		response   string
+	}{
+		{"/users/changed", fasthttp.StatusOK, `{"ids":[1,2],"version":5}`},
+		{"/users/changed?since=2", fasthttp.StatusOK, `{"ids":[1],"version":5}`},
+		{"/users/changed?since=5", fasthttp.StatusOK, `{"ids":[],"version":5}`},
+		{"/locations/changed?since=2", fasthttp.StatusOK, `{"ids":[1],"version":5}`},
+		{"/visits/changed/", fasthttp.StatusOK, `{"ids":[1],"version":5}`},
+		{"/visits/changed?since=4", fasthttp.StatusOK, `{"ids":[],"version":5}`},
+		{"/users/changed?since=-1", fasthttp.StatusBadRequest, ""},
+		{"/users/changed?since=a", fasthttp.StatusBadRequest, ""},
+	} {
+		ctx := doRequest(srv.handler, "GET", tc.path, "")
+		assert.Equal(t, tc.statusCode, ctx.Response.StatusCode(), tc.path)
+		assert.Equal(t, tc.response, string(ctx.Response.Body()), tc.path)
+	}
+	ctx := doRequest(srv.handler, "POST", "/users/changed", `{}`)
+	assert.Equal(t, fasthttp.StatusMethodNotAllowed, ctx.Response.StatusCode())
+
+	// other stores don't track changes
+	srv = NewServer(new(MockStore))
+	ctx = doRequest(srv.handler, "GET", "/users/changed?since=1", "")
+	assert.Equal(t, fasthttp.StatusNotImplemented, ctx.Response.StatusCode())
+}
+
+func TestStrictQuery(t *testing.T) {
+	srv := NewServer(NewMemoryStore())
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":100}`)
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":1,"place":"P","country":"C","city":"C","distance":1}`)
+
+	// unknown parameters are ignored by default
+	for _, path := range []string{"/users/1/visits?unknown=1", "/locations/1/avg?unknown=1", "/users/1?unknown=1"} {
+		assert.Equal(t, fasthttp.StatusOK, doRequest(srv.handler, "GET", path, "").Response.StatusCode(), path)
+	}
+
+	srv.EnableStrictQuery()
+	for _, tc := range []struct {
+		path     string
+		status   int
+		response string
+	}{
+		{"/users/1/visits?fromDate=1&toDate=2&country=C&fromDistance=1&toDistance=2&distance=1&unit=km&order=desc&offset=0&limit=1&withTotal=1", fasthttp.StatusOK, ""},
+		{"/users/1/visits?unknown=1", fasthttp.StatusBadRequest, `{"error":"unknown query parameter unknown"}`},
+		{"/users/1/visits?limit=1&todate=2", fasthttp.StatusBadRequest, `{"error":"unknown query parameter todate"}`},
+		{"/users/1/avg?fromDate=1&toDate=2&country=C&fromDistance=1&toDistance=2&distance=1&unit=km", fasthttp.StatusOK, ""},
+		{"/users/1/avg?limit=1", fasthttp.StatusBadRequest, `{"error":"unknown query parameter limit"}`},
+		{"/users?ids=1&pretty=1", fasthttp.StatusOK, ""},
+		{"/users?ids=1&id=2", fasthttp.StatusBadRequest, `{"error":"unknown query parameter id"}`},
+		{"/users/1", fasthttp.StatusOK, ""},
+		{"/users/1?fields=email", fasthttp.StatusBadRequest, `{"error":"unknown query parameter fields"}`},
+		{"/locations/1?x=1", fasthttp.StatusBadRequest, `{"error":"unknown query parameter x"}`},
+		{"/locations/1/avg?fromDate=1&toDate=2&fromAge=1&toAge=2&gender=m&fromMark=1&toMark=2&groupBy=age", fasthttp.StatusOK, ""},
+		{"/locations/1/avg?gender=m&genre=f", fasthttp.StatusBadRequest, `{"error":"unknown query parameter genre"}`},
+		{"/locations/1/histogram?gender=m", fasthttp.StatusOK, ""},
+		{"/locations/1/histogram?groupBy=age", fasthttp.StatusBadRequest, `{"error":"unknown query parameter groupBy"}`},
+		{"/locations/1/visitors?fromDate=1&toDate=2", fasthttp.StatusOK, ""},
+		{"/locations/1/visitors?limit=1", fasthttp.StatusBadRequest, `{"error":"unknown query parameter limit"}`},
+		{"/visits?user=1&location=1&fromDate=1&toDate=2&offset=0&limit=1", fasthttp.StatusOK, ""},
+		{"/visits?user=1&mark=1", fasthttp.StatusBadRequest, `{"error":"unknown query parameter mark"}`},
+		{"/metrics?nocache=1", fasthttp.StatusOK, ""}, // service endpoints aren't checked
+	} {
+		ctx := doRequest(srv.handler, "GET", tc.path, "")
+		assert.Equal(t, tc.status, ctx.Response.StatusCode(), tc.path)
+		if tc.response != "" {
+			assert.Equal(t, tc.response, string(ctx.Response.Body()), tc.path)
+		}
+	}
+
+	// only read requests are checked
+	ctx := doRequest(srv.handler, "POST", "/users/1?unknown=1", `{"first_name":"X"}`)
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+}
+
+func TestReplace(t *testing.T) {
+	srv := NewServer(NewMemoryStore())
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":100}`)
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":1,"place":"P","country":"C","city":"C","distance":1}`)
+	doRequest(srv.handler, "POST", "/visits/new", `{"id":1,"user":1,"location":1,"visited_at":1268006400,"mark":5}`)
+	get := func(path string) string {
+		ctx := doRequest(srv.handler, "GET", path, "")
+		assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+		return string(ctx.Response.Body())
+	}
+	status := func(method, path, body string) int {
+		return doRequest(srv.handler, method, path, body).Response.StatusCode()
+	}
+
+	// POST keeps omitted mark, PUT resets it
+	assert.Equal(t, fasthttp.StatusOK, status("POST", "/visits/1", `{"id":1,"user":1,"location":1,"visited_at":1268006401}`))
+	assert.Equal(t, `{"id":1,"user":1,"location":1,"visited_at":1268006401,"mark":5}`, get("/visits/1"))
+	assert.Equal(t, fasthttp.StatusOK, status("PUT", "/visits/1", `{"id":1,"user":1,"location":1,"visited_at":1268006402}`))
+	assert.Equal(t, `{"id":1,"user":1,"location":1,"visited_at":1268006402,"mark":0}`, get("/visits/1"))
+
+	// the same for user birth date
+	assert.Equal(t, fasthttp.StatusOK, status("POST", "/users/1", `{"first_name":"X"}`))
+	assert.Equal(t, `{"id":1,"first_name":"X","last_name":"B","email":"a@b.c","gender":"m","birth_date":100}`, get("/users/1"))
+	assert.Equal(t, fasthttp.StatusOK, status("PUT", "/users/1", `{"id":1,"email":"a@b.c","first_name":"Y","last_name":"B","gender":"m"}`))
+	assert.Equal(t, `{"id":1,"first_name":"Y","last_name":"B","email":"a@b.c","gender":"m","birth_date":0}`, get("/users/1"))
+
+	// replacement is validated as a whole and must keep id
+	for _, tc := range []struct {
+		path string
+		body string
+	}{
+		{"/visits/1", `{"mark":3}`},
+		{"/visits/1", `{"user":1,"location":1,"visited_at":1268006400,"mark":3}`},
+		{"/visits/1", `{"id":2,"user":1,"location":1,"visited_at":1268006400,"mark":3}`},
+		{"/locations/1", `{"id":1,"place":"P","country":"C","city":"New"}`},
+		{"/locations/1", `{"id":1,"place":"P","country":"C","city":"New","distance":null}`},
+	} {
+		assert.Equal(t, fasthttp.StatusBadRequest, status("PUT", tc.path, tc.body), tc.body)
+	}
+	assert.Equal(t, `{"id":1,"user":1,"location":1,"visited_at":1268006402,"mark":0}`, get("/visits/1"))
+	assert.Equal(t, `{"id":1,"city":"C","country":"C","place":"P","distance":1}`, get("/locations/1"))
+	assert.Equal(t, fasthttp.StatusOK, status("PUT", "/locations/1", `{"id":1,"place":"P","country":"C","city":"New","distance":2}`))
+	assert.Equal(t, `{"id":1,"city":"New","country":"C","place":"P","distance":2}`, get("/locations/1"))
+
+	// only existing entities are replaced
+	assert.Equal(t, fasthttp.StatusNotFound, status("PUT", "/visits/2", `{"id":2,"user":1,"location":1,"visited_at":1268006400,"mark":3}`))
+	assert.Equal(t, fasthttp.StatusNotFound, status("PUT", "/visits/abc", `{}`))
+}
+
+func TestETag(t *testing.T) {
+	store := new(MockStore)
+	store.On("GetUser", uint(1), mock.AnythingOfType("*main.User")).Return(nil).
+		Run(func(args mock.Arguments) {
+			*args.Get(1).(*User) = User{ID: 1, Email: "test@example.com"}
+		})
+	store.On("GetLocation", uint(1), mock.AnythingOfType("*main.Location")).Return(nil).
+		Run(func(args mock.Arguments) {
+			*args.Get(1).(*Location) = Location{ID: 1, Place: "Place"}
+		})
+	store.On("GetVisit", uint(1), mock.AnythingOfType("*main.Visit")).Return(nil).
+		Run(func(args mock.Arguments) {
+			*args.Get(1).(*Visit) = Visit{ID: 1, Mark: 5}
+		})
+	srv := NewServer(store)
+	request := func(path, ifNoneMatch string) *fasthttp.RequestCtx {
+		var ctx fasthttp.RequestCtx
+		ctx.Request.SetRequestURI(path)
+		if ifNoneMatch != "" {
+			ctx.Request.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		srv.handler(&ctx)
+		return &ctx
+	}
+
+	for _, path := range []string{"/users/1", "/locations/1", "/visits/1"} {
+		t.Run(path, func(t *testing.T) {
+			// no header - no etag
+			ctx := request(path, "")
+			assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+			assert.Empty(t, ctx.Response.Header.Peek("ETag"))
+			body := string(ctx.Response.Body())
+
+			ctx = request(path, `"unknown"`)
+			assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+			assert.Equal(t, body, string(ctx.Response.Body()))
+			etag := string(ctx.Response.Header.Peek("ETag"))
+			assert.NotEmpty(t, etag)
+
+			for _, inm := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+				ctx = request(path, inm)
+				assert.Equal(t, fasthttp.StatusNotModified, ctx.Response.StatusCode(), inm)
+				assert.Empty(t, ctx.Response.Body())
+				assert.Equal(t, etag, string(ctx.Response.Header.Peek("ETag")))
+			}
+		})
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.StandardLogger()
+	out, formatter := logger.Out, logger.Formatter
+	logrus.SetOutput(&buf)
+	logrus.SetFormatter(&logrus.TextFormatter{DisableColors: true, DisableTimestamp: true})
+	defer func() {
+		logrus.SetOutput(out)
+		logrus.SetFormatter(formatter)
+	}()
+
+	store := new(MockStore)
+	store.On("GetUser", uint(1), mock.AnythingOfType("*main.User")).Return(nil)
+	srv := NewServer(store)
+
+	// disabled by default
+	doRequest(srv.handler, "GET", "/users/1", "")
+	assert.Empty(t, buf.String())
+
+	srv.EnableAccessLog()
+	ctx := doRequest(srv.handler, "GET", "/users/1", "")
+	line := buf.String()
+	assert.Equal(t, 1, strings.Count(line, "\n"))
+	assert.Contains(t, line, `msg="Request served"`)
+	assert.Contains(t, line, "method=GET")
+	assert.Contains(t, line, "path=/users/1")
+	assert.Contains(t, line, "status=200")
+	assert.Contains(t, line, fmt.Sprintf("size=%d", len(ctx.Response.Body())))
+	assert.Contains(t, line, "duration=")
+
+	buf.Reset()
+	doRequest(srv.handler, "GET", "/nonsense", "")
+	assert.Contains(t, buf.String(), "status=404")
+}
+
+func TestAdminClear(t *testing.T) {
+	srv := NewServer(NewMemoryStore())
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`)
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":1,"place":"P","country":"C","city":"C","distance":1}`)
+	doRequest(srv.handler, "POST", "/visits/new", `{"id":1,"user":1,"location":1,"visited_at":1268006400,"mark":1}`)
+
+	// disabled by default
+	ctx := doRequest(srv.handler, "POST", "/admin/clear", "")
+	assert.Equal(t, fasthttp.StatusNotFound, ctx.Response.StatusCode())
+	ctx = doRequest(srv.handler, "GET", "/admin/clear", "")
+	assert.Equal(t, fasthttp.StatusNotFound, ctx.Response.StatusCode())
+	ctx = doRequest(srv.handler, "GET", "/users/1", "")
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+
+	srv.EnableAdmin()
+	ctx = doRequest(srv.handler, "POST", "/admin/clear", "")
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, "{}\n", string(ctx.Response.Body()))
+	for _, path := range []string{"/users/1", "/locations/1", "/visits/1", "/users/1/visits", "/locations/1/avg"} {
+		ctx = doRequest(srv.handler, "GET", path, "")
+		assert.Equal(t, fasthttp.StatusNotFound, ctx.Response.StatusCode(), path)
+	}
+
+	store := new(MockStore)
+	store.On("Clear").Return(errors.New("db is down"))
+	srv = NewServer(store)
+	srv.EnableAdmin()
+	ctx = doRequest(srv.handler, "POST", "/admin/clear", "")
+	assert.Equal(t, fasthttp.StatusInternalServerError, ctx.Response.StatusCode())
+}
+
+func TestAdminRebuildIndexes(t *testing.T) {
+	srv := NewServer(NewMemoryStore())
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`)
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":1,"place":"P","country":"C","city":"C","distance":1}`)
+	doRequest(srv.handler, "POST", "/visits/new", `{"id":1,"user":1,"location":1,"visited_at":1268006400,"mark":1}`)
+
+	// disabled by default
+	ctx := doRequest(srv.handler, "POST", "/admin/rebuild-indexes", "")
+	assert.Equal(t, fasthttp.StatusNotFound, ctx.Response.StatusCode())
+
+	srv.EnableAdmin()
+	ctx = doRequest(srv.handler, "GET", "/admin/rebuild-indexes", "")
+	assert.Equal(t, fasthttp.StatusMethodNotAllowed, ctx.Response.StatusCode())
+	ctx = doRequest(srv.handler, "POST", "/admin/rebuild-indexes", "")
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, "{}\n", string(ctx.Response.Body()))
+	ctx = doRequest(srv.handler, "GET", "/users/1/visits", "")
+	assert.Equal(t, `{"visits":[{"mark":1,"visited_at":1268006400,"place":"P"}]}`, string(ctx.Response.Body()))
+
+	// store without own indexes
+	srv = NewServer(new(MockStore))
+	srv.EnableAdmin()
+	ctx = doRequest(srv.handler, "POST", "/admin/rebuild-indexes", "")
+	assert.Equal(t, fasthttp.StatusNotImplemented, ctx.Response.StatusCode())
+}
+
+func TestAdminExport(t *testing.T) {
+	srv := NewServer(NewMemoryStore())
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`)
+
+	// disabled by default
+	ctx := doRequest(srv.handler, "POST", "/admin/export", "")
+	assert.Equal(t, fasthttp.StatusNotFound, ctx.Response.StatusCode())
+
+	srv.EnableAdmin()
+	ctx = doRequest(srv.handler, "GET", "/admin/export", "")
+	assert.Equal(t, fasthttp.StatusMethodNotAllowed, ctx.Response.StatusCode())
+	ctx = doRequest(srv.handler, "POST", "/admin/export", "")
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, "application/zip", string(ctx.Response.Header.ContentType()))
+	assert.True(t, ctx.Response.IsBodyStream())
+	body := ctx.Response.Body()
+	r, err := zip.NewReader(bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		t.Fatalf("invalid archive: %v", err)
+	}
+	var names []string
+	for _, f := range r.File {
+		names = append(names, f.Name)
+	}
+	assert.Equal(t, []string{"users_1.json", "locations_1.json", "visits_1.json"}, names)
+}
+
+func TestRoundAvg(t *testing.T) {
+	tt := []struct {
+		avg      float64
+		places   int
+		expected float64
+	}{
+		{2.652173913043478, 5, 2.65217},
+		{2.652173913043478, 2, 2.65},
+		{2.664, 5, 2.664},
+		{2.664, 2, 2.66},
+		{2.665, 2, 2.67},
+		{3, 2, 3},
+		{0, 5, 0},
+	}
+	for _, tc := range tt {
+		assert.Equal(t, tc.expected, roundAvg(tc.avg, tc.places), "roundAvg(%v, %d)", tc.avg, tc.places)
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	srv := NewServer(new(MockStore))
+	tt := []struct {
+		method     string
+		path       string
+		statusCode int
+		allow      string
+	}{
+		{"TRACE", "/users/1", fasthttp.StatusMethodNotAllowed, "GET, HEAD, POST, PUT, PATCH, DELETE"},
+		{"PUT", "/users/1/visits", fasthttp.StatusMethodNotAllowed, "GET, HEAD"},
+		{"PATCH", "/users/1/visits", fasthttp.StatusMethodNotAllowed, "GET, HEAD"},
+		{"PATCH", "/users/new", fasthttp.StatusMethodNotAllowed, "POST"},
+		{"POST", "/users/1/visits", fasthttp.StatusMethodNotAllowed, "GET, HEAD"},
+		{"GET", "/visits/new", fasthttp.StatusMethodNotAllowed, "POST"},
+		{"DELETE", "/locations/1/avg", fasthttp.StatusMethodNotAllowed, "GET, HEAD"},
+		{"HEAD", "/users/new", fasthttp.StatusMethodNotAllowed, "POST"},
+		{"GET", "/nonsense", fasthttp.StatusNotFound, ""},
+		{"PUT", "/nonsense", fasthttp.StatusNotFound, ""},
+	}
+	for _, tc := range tt {
+		t.Run(tc.method+tc.path, func(t *testing.T) {
+			ctx := doRequest(srv.handler, tc.method, tc.path, "")
+			assert.Equal(t, tc.statusCode, ctx.Response.StatusCode())
+			assert.Equal(t, tc.allow, string(ctx.Response.Header.Peek("Allow")))
+		})
+	}
+}
+
+func TestHTTP2(t *testing.T) {
+	store := new(MockStore)
+	store.On("GetUser", uint(1), mock.AnythingOfType("*main.User")).
+		Return(nil).
+		Run(func(args mock.Arguments) {
+			*args.Get(1).(*User) = User{ID: 1, Email: "a@b.c"}
+		})
+	srv := NewServer(store)
+	srv.EnableHTTP2()
+	ts := httptest.NewUnstartedServer(nil)
+	ts.Config = srv.h2cServer("")
+	ts.Start()
+	defer ts.Close()
+
+	var protocols http.Protocols
+	protocols.SetUnencryptedHTTP2(true)
+	client := http.Client{Transport: &http.Transport{Protocols: &protocols}}
+	res, err := client.Get(ts.URL + "/users/1")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, res.ProtoMajor)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "application/json; charset=utf-8", res.Header.Get("Content-Type"))
+	assert.Contains(t, string(body), `"email":"a@b.c"`)
+
+	res, err = http.Get(ts.URL + "/nonsense")
+	if err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	res.Body.Close()
+	assert.Equal(t, 1, res.ProtoMajor)
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+}
+
+func TestCORS(t *testing.T) {
+	store := new(MockStore)
+	store.On("GetUser", uint(1), mock.AnythingOfType("*main.User")).Return(nil)
+	srv := NewServer(store)
+
+	ctx := doRequest(srv.handler, "OPTIONS", "/users/1", "")
+	assert.Equal(t, fasthttp.StatusMethodNotAllowed, ctx.Response.StatusCode())
+	ctx = doRequest(srv.handler, "GET", "/users/1", "")
+	assert.Empty(t, ctx.Response.Header.Peek("Access-Control-Allow-Origin"))
+
+	srv.EnableCORS("https://example.com")
+	ctx = doRequest(srv.handler, "OPTIONS", "/users/1", "")
+	assert.Equal(t, fasthttp.StatusNoContent, ctx.Response.StatusCode())
+	assert.Equal(t, "https://example.com", string(ctx.Response.Header.Peek("Access-Control-Allow-Origin")))
+	assert.Equal(t, "GET, HEAD, POST, PUT, PATCH, DELETE, OPTIONS", string(ctx.Response.Header.Peek("Access-Control-Allow-Methods")))
+	assert.Equal(t, "Content-Type", string(ctx.Response.Header.Peek("Access-Control-Allow-Headers")))
+	assert.Empty(t, ctx.Response.Body())
+
+	ctx = doRequest(srv.handler, "GET", "/users/1", "")
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, "https://example.com", string(ctx.Response.Header.Peek("Access-Control-Allow-Origin")))
+
+	ctx = doRequest(srv.handler, "OPTIONS", "/nonsense", "")
+	assert.Equal(t, fasthttp.StatusNotFound, ctx.Response.StatusCode())
+}
+
+func TestErrorBody(t *testing.T) {
+	store := new(MockStore)
+	store.On("GetUser", uint(1), mock.AnythingOfType("*main.User")).
+		Return(nil).
+		Run(func(args mock.Arguments) {
+			*args.Get(1).(*User) = User{ID: 1, Email: "a@b.c", FirstName: "A", LastName: "B", Gender: "m"}
+		})
+	srv := NewServer(store)
+
+	invalidUser := `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"x","birth_date":0}`
+	ctx := doRequest(srv.handler, "POST", "/users/new", invalidUser)
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+	assert.Empty(t, ctx.Response.Body())
+
+	srv.EnableErrorBody()
+	tt := []struct {
+		name   string
+		uri    string
+		body   string
+		result string
+	}{
+		{"CreateUser", "/users/new", invalidUser, `{"error":"invalid gender","code":"invalid_gender"}`},
+		{"CreateUserNull", "/users/new", `{"id":null}`, `{"error":"null type"}`},
+		{"CreateUserMissing", "/users/new", `{"id":1}`, `{"error":"missing required fields","code":"missing_fields"}`},
+		{"CreateUserBirthDate", "/users/new", `{"id":2,"email":"b@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":-3000000000}`, `{"error":"invalid birth_date","code":"invalid_birth_date"}`},
+		{"UpdateUser", "/users/1", `{"email":""}`, `{"error":"invalid email","code":"invalid_email"}`},
+		{"CreateLocation", "/locations/new", `{"id":1,"place":"P","country":"C","city":"C","distance":0}`, `{"error":"invalid distance","code":"invalid_distance"}`},
+		{"CreateVisit", "/visits/new", `{"id":1,"user":1,"location":1,"visited_at":1268006400,"mark":6}`, `{"error":"invalid mark","code":"invalid_mark"}`},
+		{"CreateVisitDate", "/visits/new", `{"id":1,"user":1,"location":1,"visited_at":1,"mark":5}`, `{"error":"invalid visited_at","code":"invalid_visited_at"}`},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := doRequest(srv.handler, "POST", tc.uri, tc.body)
+			assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+			assert.Equal(t, tc.result, string(ctx.Response.Body()))
+		})
+	}
+}
+
+func doRequest(h fasthttp.RequestHandler, method, uri, body string) *fasthttp.RequestCtx {
+	var req fasthttp.Request
+	req.Header.SetMethod(method)
+	req.SetRequestURI(uri)
+	if body != "" {
+		req.SetBodyString(body)
+	}
+	// Init attaches fake server, so ctx can be used as context.Context
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, nil, nil)
+	h(&ctx)
+	return &ctx
+}
+
+func TestCompression(t *testing.T) {
+	visits := make([]UserVisit, 100)
+	for i := range visits {
+		visits[i] = UserVisit{Mark: i % 6, VisitedAt: int64(i), Place: "Some place"}
+	}
+	store := new(MockStore)
+	store.On("GetUserVisits", uint(1), mock.AnythingOfType("*main.UserVisitsQuery"), mock.AnythingOfType("*[]main.UserVisit")).
+		Return(len(visits), nil).
+		Run(func(args mock.Arguments) {
+			*args.Get(2).(*[]UserVisit) = visits
+		})
+	store.On("GetUser", uint(1), mock.AnythingOfType("*main.User")).Return(nil)
+	srv := NewServer(store)
+	srv.EnableCompression(512)
+	expected, _ := easyjson.Marshal(&UserVisitsResult{Visits: visits})
+
+	tt := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		encoding       string
+	}{
+		{"Gzip", "/users/1/visits", "gzip, deflate", "gzip"},
+		{"Deflate", "/users/1/visits", "deflate", "deflate"},
+		{"Identity", "/users/1/visits", "", ""},
+		{"SmallBody", "/users/1", "gzip", ""},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var ctx fasthttp.RequestCtx
+			ctx.Request.SetRequestURI(tc.path)
+			if tc.acceptEncoding != "" {
+				ctx.Request.Header.Set("Accept-Encoding", tc.acceptEncoding)
+			}
+			srv.handler(&ctx)
+			assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+			assert.Equal(t, tc.encoding, string(ctx.Response.Header.Peek("Content-Encoding")))
+			if tc.path == "/users/1/visits" {
+				var body []byte
+				var err error
+				switch tc.encoding {
+				case "gzip":
+					body, err = ctx.Response.BodyGunzip()
+				case "deflate":
+					body, err = ctx.Response.BodyInflate()
+				default:
+					body = ctx.Response.Body()
+				}
+				assert.NoError(t, err)
+				assert.Equal(t, string(expected), string(body))
+			}
+		})
+	}
+}
+
+func TestStaticBodies(t *testing.T) {
+	// precomputed bodies must match marshaled results byte to byte
+	body, err := easyjson.Marshal(&UserVisitsResult{Visits: make([]UserVisit, 0)})
+	assert.NoError(t, err)
+	assert.Equal(t, string(body), string(emptyVisitsBody))
+	body, err = easyjson.Marshal(&LocationAvgResult{})
+	assert.NoError(t, err)
+	assert.Equal(t, string(body), string(zeroAvgBody))
+
+	srv := NewServer(NewMemoryStore())
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`)
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":1,"place":"P","country":"C","city":"C","distance":1}`)
+	ctx := doRequest(srv.handler, "GET", "/users/1/visits", "")
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, "application/json; charset=utf-8", string(ctx.Response.Header.ContentType()))
+	assert.Equal(t, `{"visits":[]}`, string(ctx.Response.Body()))
+	ctx = doRequest(srv.handler, "GET", "/users/1/visits?withTotal=1", "")
+	assert.Equal(t, `{"visits":[],"total":0}`, string(ctx.Response.Body()))
+	ctx = doRequest(srv.handler, "GET", "/locations/1/avg", "")
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.Equal(t, "application/json; charset=utf-8", string(ctx.Response.Header.ContentType()))
+	assert.Equal(t, `{"avg":0}`, string(ctx.Response.Body()))
+}
+
+func benchmarkEmptyResult(b *testing.B, uri string) {
+	srv := NewServer(NewMemoryStore())
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`)
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":1,"place":"P","country":"C","city":"C","distance":1}`)
+	var req fasthttp.Request
+	req.Header.SetMethod("GET")
+	req.SetRequestURI(uri)
+	var ctx fasthttp.RequestCtx
+	ctx.Init(&req, nil, nil)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx.Response.Reset()
+		srv.handler(&ctx)
+	}
+}
+
+func BenchmarkEmptyVisits(b *testing.B) {
+	benchmarkEmptyResult(b, "/users/1/visits")
+}
+
+func BenchmarkEmptyVisitsWithTotal(b *testing.B) {
+	benchmarkEmptyResult(b, "/users/1/visits?withTotal=1")
+}
+
+func BenchmarkZeroAvg(b *testing.B) {
+	benchmarkEmptyResult(b, "/locations/1/avg")
+}
+
+func TestCustomGenders(t *testing.T) {
+	defer func(prev []string) { genders = prev }(genders)
+	srv := NewServer(NewMemoryStore())
+	status := func(method, path, body string) int {
+		return doRequest(srv.handler, method, path, body).Response.StatusCode()
+	}
+	user := `{"id":3,"email":"u3@b.c","first_name":"A","last_name":"B","gender":"u","birth_date":0}`
+
+	// default set rejects other codes
+	assert.Equal(t, fasthttp.StatusBadRequest, status("POST", "/users/new", user))
+	assert.Equal(t, fasthttp.StatusBadRequest, status("GET", "/locations/1/avg?gender=u", ""))
+
+	genders = []string{"m", "f", "u"}
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"u1@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`)
+	doRequest(srv.handler, "POST", "/users/new", `{"id":2,"email":"u2@b.c","first_name":"A","last_name":"B","gender":"f","birth_date":0}`)
+	assert.Equal(t, fasthttp.StatusOK, status("POST", "/users/new", user))
+	assert.Equal(t, fasthttp.StatusBadRequest, status("POST", "/users/1", `{"gender":"x"}`))
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":1,"place":"P","country":"C","city":"C","distance":1}`)
+	for i, mark := range []int{1, 3, 5} {
+		body := fmt.Sprintf(`{"id":%d,"user":%d,"location":1,"visited_at":1268006400,"mark":%d}`, i+1, i+1, mark)
+		assert.Equal(t, fasthttp.StatusOK, status("POST", "/visits/new", body))
+	}
+	for query, response := range map[string]string{
+		"":          `{"avg":3}`,
+		"?gender=m": `{"avg":1}`,
+		"?gender=f": `{"avg":3}`,
+		"?gender=u": `{"avg":5}`,
+	} {
+		ctx := doRequest(srv.handler, "GET", "/locations/1/avg"+query, "")
+		assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode(), query)
+		assert.Equal(t, response, string(ctx.Response.Body()), query)
+	}
+	assert.Equal(t, fasthttp.StatusBadRequest, status("GET", "/locations/1/avg?gender=x", ""))
+}
+
+func TestTextErrors(t *testing.T) {
+	srv := NewServer(NewMemoryStore())
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`)
+	request := func(method, uri, accept, body string) *fasthttp.RequestCtx {
+		var req fasthttp.Request
+		req.Header.SetMethod(method)
+		req.SetRequestURI(uri)
+		req.SetBodyString(body)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, nil, nil)
+		srv.handler(&ctx)
+		return &ctx
+	}
+
+	// error bodies are empty by default whatever client accepts
+	ctx := request("GET", "/users/2", "text/plain", "")
+	assert.Equal(t, fasthttp.StatusNotFound, ctx.Response.StatusCode())
+	assert.Empty(t, ctx.Response.Body())
+
+	srv.EnableTextErrors()
+	for _, tc := range []struct {
+		name        string
+		method      string
+		uri         string
+		accept      string
+		body        string
+		statusCode  int
+		contentType string
+		response    string
+	}{
+		{"NotFound", "GET", "/users/2", "text/plain", "", fasthttp.StatusNotFound, "text/plain; charset=utf-8", "Not Found\n"},
+		{"NotFoundJSON", "GET", "/users/2", "application/json", "", fasthttp.StatusNotFound, "", ""},
+		{"NotFoundNoAccept", "GET", "/users/2", "", "", fasthttp.StatusNotFound, "", ""},
+		{"UnknownPath", "GET", "/unknown", "text/plain, */*", "", fasthttp.StatusNotFound, "text/plain; charset=utf-8", "Not Found\n"},
+		{"MethodNotAllowed", "PUT", "/users/1/visits", "text/plain", "", fasthttp.StatusMethodNotAllowed, "text/plain; charset=utf-8", "Method Not Allowed\n"},
+		{"InvalidQuery", "GET", "/users/1/visits?fromDate=a", "text/plain", "", fasthttp.StatusBadRequest, "text/plain; charset=utf-8", "Bad Request\n"},
+		{"InvalidBody", "POST", "/users/new", "text/plain", `{"id":2}`, fasthttp.StatusBadRequest, "text/plain; charset=utf-8", "missing required fields\n"},
+		{"InvalidBodyJSON", "POST", "/users/new", "application/json", `{"id":2}`, fasthttp.StatusBadRequest, "", ""},
+		{"Duplicate", "POST", "/users/new", "text/plain", `{"id":1,"email":"x@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`, fasthttp.StatusBadRequest, "text/plain; charset=utf-8", "Bad Request\n"},
+		{"Success", "GET", "/users/1", "text/plain", "", fasthttp.StatusOK, "application/json; charset=utf-8", `{"id":1,"first_name":"A","last_name":"B","email":"a@b.c","gender":"m","birth_date":0}`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := request(tc.method, tc.uri, tc.accept, tc.body)
+			assert.Equal(t, tc.statusCode, ctx.Response.StatusCode())
+			assert.Equal(t, tc.response, string(ctx.Response.Body()))
+			if tc.contentType != "" {
+				assert.Equal(t, tc.contentType, string(ctx.Response.Header.ContentType()))
+			}
+		})
+	}
+
+	// JSON clients keep getting JSON error bodies
+	srv.EnableErrorBody()
+	ctx = request("POST", "/users/new", "application/json", `{"id":2}`)
+	assert.Equal(t, `{"error":"missing required fields","code":"missing_fields"}`, string(ctx.Response.Body()))
+	ctx = request("POST", "/users/new", "text/plain", `{"id":2}`)
+	assert.Equal(t, "missing required fields\n", string(ctx.Response.Body()))
+}
+
+func TestPrettyResponse(t *testing.T) {
+	srv := NewServer(NewMemoryStore())
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`)
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":1,"place":"P","country":"C","city":"C","distance":1}`)
+	doRequest(srv.handler, "POST", "/visits/new", `{"id":1,"user":1,"location":1,"visited_at":1268006400,"mark":5}`)
+	request := func(uri, accept string) string {
+		var req fasthttp.Request
+		req.SetRequestURI(uri)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, nil, nil)
+		srv.handler(&ctx)
+		assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+		assert.Equal(t, "application/json; charset=utf-8", string(ctx.Response.Header.ContentType()))
+		return string(ctx.Response.Body())
+	}
+
+	// compact by default
+	assert.Equal(t, `{"visits":[{"mark":5,"visited_at":1268006400,"place":"P"}]}`, request("/users/1/visits", ""))
+	assert.Equal(t, `{"avg":5}`, request("/locations/1/avg?pretty=0", ""))
+
+	pretty := "{\n  \"visits\": [\n    {\n      \"mark\": 5,\n      \"visited_at\": 1268006400,\n      \"place\": \"P\"\n    }\n  ]\n}"
+	assert.Equal(t, pretty, request("/users/1/visits?pretty=1", ""))
+	assert.Equal(t, pretty, request("/users/1/visits", "application/json+pretty"))
+	assert.Equal(t, "{\n  \"avg\": 5\n}", request("/locations/1/avg?pretty=1", ""))
+
+	// precomputed bodies are indented as well
+	assert.Equal(t, "{\n  \"visits\": []\n}", request("/users/1/visits?toDate=0&pretty=1", ""))
+}
+
+func TestMaxVisits(t *testing.T) {
+	srv := NewServer(NewMemoryStore())
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`)
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":1,"place":"P","country":"C","city":"C","distance":1}`)
+	addVisit := func(id int) {
+		body := fmt.Sprintf(`{"id":%d,"user":1,"location":1,"visited_at":%d,"mark":%d}`, id, 1000000000+id, id%6)
+		assert.Equal(t, fasthttp.StatusOK, doRequest(srv.handler, "POST", "/visits/new", body).Response.StatusCode())
+	}
+	for id := 1; id <= 3; id++ {
+		addVisit(id)
+	}
+	srv.SetMaxVisits(3)
+
+	// just under the cap
+	body := func(path string) string {
+		ctx := doRequest(srv.handler, "GET", path, "")
+		assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode(), path)
+		return string(ctx.Response.Body())
+	}
+	assert.Equal(t, `{"visits":[{"mark":1,"visited_at":1000000001,"place":"P"},{"mark":2,"visited_at":1000000002,"place":"P"},{"mark":3,"visited_at":1000000003,"place":"P"}]}`,
+		body("/users/1/visits"))
+
+	// just over the cap
+	addVisit(4)
+	assert.Equal(t, `{"visits":[{"mark":1,"visited_at":1000000001,"place":"P"},{"mark":2,"visited_at":1000000002,"place":"P"},{"mark":3,"visited_at":1000000003,"place":"P"}],"truncated":true}`,
+		body("/users/1/visits"))
+	assert.Equal(t, `{"visits":[{"mark":4,"visited_at":1000000004,"place":"P"},{"mark":3,"visited_at":1000000003,"place":"P"},{"mark":2,"visited_at":1000000002,"place":"P"}],"total":4,"truncated":true}`,
+		body("/users/1/visits?order=desc&withTotal=1"))
+	assert.Equal(t, `{"visits":[{"mark":2,"visited_at":1000000002,"place":"P"},{"mark":3,"visited_at":1000000003,"place":"P"},{"mark":4,"visited_at":1000000004,"place":"P"}]}`,
+		body("/users/1/visits?offset=1"))
+
+	// page within the cap is never truncated
+	assert.Equal(t, `{"visits":[{"mark":1,"visited_at":1000000001,"place":"P"},{"mark":2,"visited_at":1000000002,"place":"P"}]}`,
+		body("/users/1/visits?limit=2"))
+	assert.Contains(t, body("/users/1/visits?limit=10"), `"truncated":true`)
+
+	srv.SetMaxVisits(0)
+	assert.NotContains(t, body("/users/1/visits"), "truncated")
+}
+
+func TestFieldCase(t *testing.T) {
+	defer func() { camelFields = false }()
+	srv := NewServer(NewMemoryStore())
+	request := func(method, uri, fieldCase, body string) *fasthttp.RequestCtx {
+		var req fasthttp.Request
+		req.Header.SetMethod(method)
+		req.SetRequestURI(uri)
+		req.SetBodyString(body)
+		if fieldCase != "" {
+			req.Header.Set("X-Field-Case", fieldCase)
+		}
+		var ctx fasthttp.RequestCtx
+		ctx.Init(&req, nil, nil)
+		srv.handler(&ctx)
+		return &ctx
+	}
+
+	// camelCase input
+	ctx := request("POST", "/users/new", "", `{"id":1,"email":"a@b.c","firstName":"A","lastName":"B","gender":"m","birthDate":0}`)
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":1,"place":"P","country":"C","city":"C","distance":1}`)
+	ctx = request("POST", "/visits/new", "camel", `{"id":1,"user":1,"location":1,"visitedAt":1000000000,"mark":4}`)
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+
+	snakeUser := `{"id":1,"first_name":"A","last_name":"B","email":"a@b.c","gender":"m","birth_date":0}`
+	camelUser := `{"id":1,"firstName":"A","lastName":"B","email":"a@b.c","gender":"m","birthDate":0}`
+	assert.Equal(t, snakeUser, string(request("GET", "/users/1", "", "").Response.Body()))
+	assert.Equal(t, camelUser, string(request("GET", "/users/1", "camel", "").Response.Body()))
+	assert.Equal(t, camelUser, string(request("GET", "/users/1", "Camel", "").Response.Body()))
+	assert.Equal(t, `{"visits":[{"mark":4,"visitedAt":1000000000,"place":"P"}]}`,
+		string(request("GET", "/users/1/visits", "camel", "").Response.Body()))
+	assert.Contains(t, string(request("GET", "/users/1?pretty=1", "camel", "").Response.Body()), `"firstName": "A"`)
+
+	// camelCase by default, the header switches back
+	camelFields = true
+	assert.Equal(t, camelUser, string(request("GET", "/users/1", "", "").Response.Body()))
+	assert.Equal(t, snakeUser, string(request("GET", "/users/1", "snake", "").Response.Body()))
+	assert.Contains(t, string(request("GET", "/users/1?pretty=1", "", "").Response.Body()), `"birthDate": 0`)
+}
+
+func TestDistanceUnit(t *testing.T) {
+	srv := NewServer(NewMemoryStore())
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`)
+	// 10 miles is 16.09 km
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":1,"place":"P16","country":"C","city":"C","distance":16}`)
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":2,"place":"P17","country":"C","city":"C","distance":17}`)
+	doRequest(srv.handler, "POST", "/visits/new", `{"id":1,"user":1,"location":1,"visited_at":1000000001,"mark":2}`)
+	doRequest(srv.handler, "POST", "/visits/new", `{"id":2,"user":1,"location":2,"visited_at":1000000002,"mark":4}`)
+
+	for _, tc := range []struct {
+		path     string
+		response string
+	}{
+		{"/users/1/visits?fromDistance=10&unit=mi", `{"visits":[{"mark":4,"visited_at":1000000002,"place":"P17"}]}`},
+		{"/users/1/visits?toDistance=10&unit=mi", `{"visits":[{"mark":2,"visited_at":1000000001,"place":"P16"}]}`},
+		{"/users/1/visits?fromDistance=16&toDistance=18", `{"visits":[{"mark":4,"visited_at":1000000002,"place":"P17"}]}`},
+		{"/users/1/visits?toDistance=10", `{"visits":[]}`},
+		{"/users/1/visits?toDistance=17", `{"visits":[{"mark":2,"visited_at":1000000001,"place":"P16"}]}`},
+		{"/users/1/visits?toDistance=17&toDistanceInclusive=1", `{"visits":[{"mark":2,"visited_at":1000000001,"place":"P16"},{"mark":4,"visited_at":1000000002,"place":"P17"}]}`},
+		{"/users/1/visits?toDistance=17&toDistanceInclusive=false", `{"visits":[{"mark":2,"visited_at":1000000001,"place":"P16"}]}`},
+		{"/users/1/visits?toDistance=10&toDistanceInclusive=true&unit=mi", `{"visits":[{"mark":2,"visited_at":1000000001,"place":"P16"}]}`},
+		{"/users/1/avg?fromDistance=10&unit=mi", `{"avg":4}`},
+		{"/users/1/avg?toDistance=10&unit=mi", `{"avg":2}`},
+		{"/users/1/avg?toDistance=17&toDistanceInclusive=1", `{"avg":3}`},
+	} {
+		ctx := doRequest(srv.handler, "GET", tc.path, "")
+		assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode(), tc.path)
+		assert.Equal(t, tc.response, string(ctx.Response.Body()), tc.path)
+	}
+
+	ctx := doRequest(srv.handler, "GET", "/users/1/visits?toDistance=17&toDistanceInclusive=yes", "")
+	assert.Equal(t, fasthttp.StatusBadRequest, ctx.Response.StatusCode())
+}
+
+func TestWriteUserVisits(t *testing.T) {
+	visits := make([]UserVisit, 5000)
+	for i := range visits {
+		visits[i] = UserVisit{Mark: i % 6, VisitedAt: int64(i) - 100, Place: fmt.Sprintf("Place \"%d\"", i)}
+	}
+	total := 12345
+	for _, result := range []UserVisitsResult{
+		{Visits: visits},
+		{Visits: visits, Total: &total},
+		{Visits: visits, Truncated: true},
+		{Visits: visits[:1], Total: &total, Truncated: true},
+		{Visits: []UserVisit{}},
+	} {
+		expected, _ := easyjson.Marshal(&result)
+		var buf bytes.Buffer
+		assert.NoError(t, writeUserVisits(&buf, &result))
+		assert.Equal(t, string(expected), buf.String())
+	}
+}
+
+func TestStreamUserVisits(t *testing.T) {
+	visits := make([]UserVisit, streamVisitsMin)
+	for i := range visits {
+		visits[i] = UserVisit{Mark: i % 6, VisitedAt: int64(i), Place: "Some place"}
+	}
+	store := new(MockStore)
+	store.On("GetUserVisits", uint(1), mock.AnythingOfType("*main.UserVisitsQuery"), mock.AnythingOfType("*[]main.UserVisit")).
+		Return(len(visits), nil).
+		Run(func(args mock.Arguments) {
+			*args.Get(2).(*[]UserVisit) = visits
+		})
+	srv := NewServer(store)
+
+	total := len(visits)
+	for _, tc := range []struct {
+		path     string
+		expected UserVisitsResult
+	}{
+		{"/users/1/visits", UserVisitsResult{Visits: visits}},
+		{"/users/1/visits?withTotal=1", UserVisitsResult{Visits: visits, Total: &total}},
+	} {
+		ctx := doRequest(srv.handler, "GET", tc.path, "")
+		assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode(), tc.path)
+		assert.True(t, ctx.Response.IsBodyStream(), tc.path)
+		assert.Equal(t, "application/json; charset=utf-8", string(ctx.Response.Header.ContentType()), tc.path)
+		expected, _ := easyjson.Marshal(&tc.expected)
+		assert.Equal(t, string(expected), string(ctx.Response.Body()), tc.path)
+	}
+
+	// pretty output needs the whole body
+	ctx := doRequest(srv.handler, "GET", "/users/1/visits?pretty=1", "")
+	assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode())
+	assert.False(t, ctx.Response.IsBodyStream())
+}
+
+func TestHeadRequest(t *testing.T) {
+	srv := NewServer(NewMemoryStore())
+	doRequest(srv.handler, "POST", "/users/new", `{"id":1,"email":"a@b.c","first_name":"A","last_name":"B","gender":"m","birth_date":0}`)
+	doRequest(srv.handler, "POST", "/locations/new", `{"id":1,"place":"P","country":"C","city":"C","distance":1}`)
+	doRequest(srv.handler, "POST", "/visits/new", `{"id":1,"user":1,"location":1,"visited_at":1268006400,"mark":1}`)
+
+	for _, tc := range []struct {
+		path       string
+		statusCode int
+	}{
+		{"/users/1", fasthttp.StatusOK},
+		{"/locations/1", fasthttp.StatusOK},
+		{"/visits/1", fasthttp.StatusOK},
+		{"/users/1/visits", fasthttp.StatusOK},
+		{"/users/2", fasthttp.StatusNotFound},
+		{"/locations/2", fasthttp.StatusNotFound},
+		{"/visits/2", fasthttp.StatusNotFound},
+		{"/users/a", fasthttp.StatusNotFound},
+	} {
+		get := doRequest(srv.handler, "GET", tc.path, "")
+		ctx := doRequest(srv.handler, "HEAD", tc.path, "")
+		assert.Equal(t, tc.statusCode, ctx.Response.StatusCode(), tc.path)
+		assert.Empty(t, ctx.Response.Body(), tc.path)
+		assert.Equal(t, len(get.Response.Body()), ctx.Response.Header.ContentLength(), tc.path)
+		assert.Equal(t, string(get.Response.Header.ContentType()), string(ctx.Response.Header.ContentType()), tc.path)
+	}
+
+	// server skips body of HEAD response, Content-Length is kept
+	ctx := doRequest(srv.handler, "HEAD", "/users/1", "")
+	ctx.Response.SkipBody = true
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	assert.NoError(t, ctx.Response.Write(w))
+	w.Flush()
+	get := doRequest(srv.handler, "GET", "/users/1", "")
+	assert.Contains(t, buf.String(), fmt.Sprintf("Content-Length: %d\r\n", len(get.Response.Body())))
+	assert.True(t, strings.HasSuffix(buf.String(), "\r\n\r\n"))
+}
+
+func TestPanicRecovery(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	store := new(MockStore)
+	store.On("GetUserVisits", uint(1), mock.AnythingOfType("*main.UserVisitsQuery"), mock.AnythingOfType("*[]main.UserVisit")).
+		Return(0, nil).Run(func(mock.Arguments) { panic("nil location") })
+	store.On("GetUser", uint(1), mock.AnythingOfType("*main.User")).Return(nil)
+	ln := fasthttputil.NewInmemoryListener()
+	defer ln.Close()
+	srv := NewServer(store)
+	go srv.httpServer().Serve(ln)
+
+	client := fasthttp.Client{
+		Dial: func(_ string) (net.Conn, error) { return ln.Dial() },
+	}
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	res := fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseResponse(res)
+
+	req.SetRequestURI("http://localhost/users/1/visits")
+	if err := client.Do(req, res); err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	assert.Equal(t, fasthttp.StatusInternalServerError, res.StatusCode())
+	assert.Equal(t, `{"error":"internal server error"}`, string(res.Body()))
+
+	// the server keeps serving after panic
+	req.SetRequestURI("http://localhost/users/1")
+	if err := client.Do(req, res); err != nil {
+		t.Fatalf("could not send request: %v", err)
+	}
+	assert.Equal(t, fasthttp.StatusOK, res.StatusCode())
+}
+
+func TestNullEmptyAvg(t *testing.T) {
+	store := new(MockStore)
+	store.On("GetLocationAvg", uint(1), mock.AnythingOfType("*main.LocationAvgQuery")).Return(0, 0, nil)
+	store.On("GetLocationAvg", uint(2), mock.AnythingOfType("*main.LocationAvgQuery")).Return(4.5, 2, nil)
+	srv := NewServer(store)
+
+	for _, tc := range []struct {
+		nullEmpty bool
+		path      string
+		response  string
+	}{
+		{false, "/locations/1/avg", `{"avg":0}`},
+		{false, "/locations/1/avg?nullEmpty=0", `{"avg":0}`},
+		{false, "/locations/1/avg?nullEmpty=1", `{"avg":null}`},
+		{false, "/locations/2/avg?nullEmpty=1", `{"avg":4.5}`},
+		{true, "/locations/1/avg", `{"avg":null}`},
+		{true, "/locations/1/avg?nullEmpty=false", `{"avg":0}`},
+		{true, "/locations/2/avg", `{"avg":4.5}`},
+	} {
+		srv.nullEmptyAvg = tc.nullEmpty
+		ctx := doRequest(srv.handler, "GET", tc.path, "")
+		assert.Equal(t, fasthttp.StatusOK, ctx.Response.StatusCode(), tc.path)
+		assert.Equal(t, tc.response, string(ctx.Response.Body()), tc.path)
+	}
+
+	srv.EnableNullEmptyAvg()
+	assert.True(t, srv.nullEmptyAvg)
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// testDateBoundaries checks that fromDate and toDate are exclusive: visits
+// made exactly at the boundary are not taken into account by any query
+func testDateBoundaries(t *testing.T, s Store) {
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUsers(ctx, []User{
+		{ID: 1, Email: "u1@hlcup.com", Gender: "m"},
+		{ID: 2, Email: "u2@hlcup.com", Gender: "f"},
+		{ID: 3, Email: "u3@hlcup.com", Gender: "m"},
+	}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1", Country: "Russia"}))
+	assert.NoError(t, s.CreateVisits(ctx, []Visit{
+		{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 1},
+		{ID: 2, UserID: 2, LocationID: 1, VisitedAt: 200, Mark: 2},
+		{ID: 3, UserID: 3, LocationID: 1, VisitedAt: 300, Mark: 3},
+	}))
+	from, to := int64(100), int64(300)
+
+	var visits []UserVisit
+	_, err := s.GetUserVisits(ctx, 1, &UserVisitsQuery{FromDate: &from}, &visits)
+	assert.NoError(t, err)
+	assert.Empty(t, visits)
+	_, err = s.GetUserVisits(ctx, 3, &UserVisitsQuery{ToDate: &to}, &visits)
+	assert.NoError(t, err)
+	assert.Empty(t, visits)
+
+	avg, _, err := s.GetLocationAvg(ctx, 1, &LocationAvgQuery{FromDate: &from, ToDate: &to})
+	assert.NoError(t, err)
+	assert.Equal(t, 2.0, avg)
+
+	var h MarkHistogram
+	assert.NoError(t, s.GetLocationHistogram(ctx, 1, &LocationAvgQuery{FromDate: &from, ToDate: &to}, &h))
+	assert.Equal(t, MarkHistogram{0, 0, 1, 0, 0, 0}, h)
+
+	var users []uint
+	assert.NoError(t, s.GetLocationVisitors(ctx, 1, &LocationVisitorsQuery{FromDate: &from, ToDate: &to}, &users))
+	assert.Equal(t, []uint{2}, users)
+}
+
+func TestMemoryDateBoundaries(t *testing.T) {
+	testDateBoundaries(t, NewMemoryStore())
+}
+
+func TestBoltDateBoundaries(t *testing.T) {
+	s, cleanup := testBoltStore(t)
+	defer cleanup()
+	testDateBoundaries(t, s)
+}
+
+func TestMongoDateBoundaries(t *testing.T) {
+	s := testMongoStore(t)
+	defer s.s.Close()
+	testDateBoundaries(t, s)
+	assert.NoError(t, s.Clear(context.Background()))
+}
+
+// testDistanceBoundaries checks that toDistance excludes visits to the
+// location exactly at the threshold unless toDistanceInclusive is set
+func testDistanceBoundaries(t *testing.T, s Store) {
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com", Gender: "m"}))
+	assert.NoError(t, s.CreateLocations(ctx, []Location{
+		{ID: 1, Place: "Near", Country: "Russia", Distance: 10},
+		{ID: 2, Place: "Threshold", Country: "Russia", Distance: 20},
+		{ID: 3, Place: "Far", Country: "Russia", Distance: 30},
+	}))
+	assert.NoError(t, s.CreateVisits(ctx, []Visit{
+		{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 1},
+		{ID: 2, UserID: 1, LocationID: 2, VisitedAt: 200, Mark: 2},
+		{ID: 3, UserID: 1, LocationID: 3, VisitedAt: 300, Mark: 3},
+	}))
+	from, to := 10, 20
+
+	var visits []UserVisit
+	_, err := s.GetUserVisits(ctx, 1, &UserVisitsQuery{ToDistance: &to}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, []UserVisit{{Mark: 1, VisitedAt: 100, Place: "Near"}}, visits)
+	_, err = s.GetUserVisits(ctx, 1, &UserVisitsQuery{ToDistance: &to, ToDistanceInclusive: true}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, []UserVisit{{Mark: 1, VisitedAt: 100, Place: "Near"}, {Mark: 2, VisitedAt: 200, Place: "Threshold"}}, visits)
+	_, err = s.GetUserVisits(ctx, 1, &UserVisitsQuery{FromDistance: &from, ToDistance: &to, ToDistanceInclusive: true}, &visits)
+	assert.NoError(t, err)
+	assert.Equal(t, []UserVisit{{Mark: 2, VisitedAt: 200, Place: "Threshold"}}, visits)
+
+	avg, err := s.GetUserAvg(ctx, 1, &UserVisitsQuery{ToDistance: &to})
+	assert.NoError(t, err)
+	assert.Equal(t, 1.0, avg)
+	avg, err = s.GetUserAvg(ctx, 1, &UserVisitsQuery{ToDistance: &to, ToDistanceInclusive: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 1.5, avg)
+}
+
+func TestMemoryDistanceBoundaries(t *testing.T) {
+	testDistanceBoundaries(t, NewMemoryStore())
+}
+
+func TestBoltDistanceBoundaries(t *testing.T) {
+	s, cleanup := testBoltStore(t)
+	defer cleanup()
+	testDistanceBoundaries(t, s)
+}
+
+func TestMongoDistanceBoundaries(t *testing.T) {
+	s := testMongoStore(t)
+	defer s.s.Close()
+	testDistanceBoundaries(t, s)
+	assert.NoError(t, s.Clear(context.Background()))
+}
+
+// testLocationAvgCount checks that location avg reports number of matching
+// visits, so zero average is told from no visits
+func testLocationAvgCount(t *testing.T, s Store) {
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "u1@hlcup.com", Gender: "m"}))
+	assert.NoError(t, s.CreateLocations(ctx, []Location{
+		{ID: 1, Place: "Place1", Country: "Russia"},
+		{ID: 2, Place: "Place2", Country: "Russia"},
+	}))
+	assert.NoError(t, s.CreateVisits(ctx, []Visit{
+		{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 0},
+		{ID: 2, UserID: 1, LocationID: 1, VisitedAt: 200, Mark: 0},
+	}))
+
+	avg, count, err := s.GetLocationAvg(ctx, 1, &LocationAvgQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, avg)
+	assert.Equal(t, 2, count)
+	avg, count, err = s.GetLocationAvg(ctx, 1, &LocationAvgQuery{Gender: "f"})
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, avg)
+	assert.Equal(t, 0, count)
+	avg, count, err = s.GetLocationAvg(ctx, 2, &LocationAvgQuery{})
+	assert.NoError(t, err)
+	assert.Equal(t, 0.0, avg)
+	assert.Equal(t, 0, count)
+	_, _, err = s.GetLocationAvg(ctx, 3, &LocationAvgQuery{})
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestMemoryLocationAvgCount(t *testing.T) {
+	testLocationAvgCount(t, NewMemoryStore())
+}
+
+func TestBoltLocationAvgCount(t *testing.T) {
+	s, cleanup := testBoltStore(t)
+	defer cleanup()
+	testLocationAvgCount(t, s)
+}
+
+func TestMongoLocationAvgCount(t *testing.T) {
+	s := testMongoStore(t)
+	defer s.s.Close()
+	testLocationAvgCount(t, s)
+	assert.NoError(t, s.Clear(context.Background()))
+}
+
+// assertAvgMatchesHistogram runs the same query against location avg and
+// histogram and checks that histogram counts cnt visits with the avg mark
+func assertAvgMatchesHistogram(t *testing.T, s Store, id uint, q LocationAvgQuery, cnt int) {
+	ctx := context.Background()
+	avg, _, err := s.GetLocationAvg(ctx, id, &q)
+	assert.NoError(t, err)
+	var h MarkHistogram
+	assert.NoError(t, s.GetLocationHistogram(ctx, id, &q, &h))
+	var sum, n int
+	for mark, c := range h {
+		sum += mark * c
+		n += c
+	}
+	assert.Equal(t, cnt, n)
+	if n > 0 {
+		assert.Equal(t, float64(sum)/float64(n), avg)
+	} else {
+		assert.Equal(t, 0.0, avg)
+	}
+}
+
+// testMarkFilter checks that fromMark and toMark are exclusive and applied
+// the same way by location avg and histogram
+func testMarkFilter(t *testing.T, s Store) {
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUsers(ctx, []User{
+		{ID: 1, Email: "u1@hlcup.com", Gender: "m"},
+		{ID: 2, Email: "u2@hlcup.com", Gender: "f"},
+	}))
+	assert.NoError(t, s.CreateLocation(ctx, &Location{ID: 1, Place: "Place1", Country: "Russia"}))
+	var visits []Visit
+	for mark := 0; mark <= 5; mark++ {
+		id := uint(mark + 1)
+		visits = append(visits, Visit{ID: id, UserID: id%2 + 1, LocationID: 1, VisitedAt: int64(id * 100), Mark: mark})
+	}
+	assert.NoError(t, s.CreateVisits(ctx, visits))
+
+	mark := func(m int) *int { return &m }
+	from := int64(200)
+	tt := []struct {
+		name  string
+		query LocationAvgQuery
+		cnt   int
+	}{
+		{"All", LocationAvgQuery{}, 6},
+		{"FromMark", LocationAvgQuery{FromMark: mark(3)}, 2},
+		{"ToMark", LocationAvgQuery{ToMark: mark(2)}, 2},
+		{"FromMarkToMark", LocationAvgQuery{FromMark: mark(1), ToMark: mark(4)}, 2},
+		{"Empty", LocationAvgQuery{FromMark: mark(2), ToMark: mark(3)}, 0},
+		{"Gender", LocationAvgQuery{Gender: "f", FromMark: mark(0)}, 2},
+		{"Dates", LocationAvgQuery{FromDate: &from, ToMark: mark(5)}, 3},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			assertAvgMatchesHistogram(t, s, 1, tc.query, tc.cnt)
+		})
+	}
+}
+
+func TestMemoryMarkFilter(t *testing.T) {
+	testMarkFilter(t, NewMemoryStore())
+}
+
+func TestBoltMarkFilter(t *testing.T) {
+	s, cleanup := testBoltStore(t)
+	defer cleanup()
+	testMarkFilter(t, s)
+}
+
+func TestMongoMarkFilter(t *testing.T) {
+	s := testMongoStore(t)
+	defer s.s.Close()
+	testMarkFilter(t, s)
+	assert.NoError(t, s.Clear(context.Background()))
+}
+
+// testUserAvg checks user avg honors date and location filters
+func testUserAvg(t *testing.T, s Store) {
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUsers(ctx, []User{
+		{ID: 1, Email: "u1@hlcup.com", Gender: "m"},
+		{ID: 2, Email: "u2@hlcup.com", Gender: "f"},
+	}))
+	assert.NoError(t, s.CreateLocations(ctx, []Location{
+		{ID: 1, Place: "Place1", Country: "Russia", Distance: 10},
+		{ID: 2, Place: "Place2", Country: "France", Distance: 20},
+	}))
+	assert.NoError(t, s.CreateVisits(ctx, []Visit{
+		{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 5},
+		{ID: 2, UserID: 1, LocationID: 2, VisitedAt: 200, Mark: 2},
+		{ID: 3, UserID: 1, LocationID: 1, VisitedAt: 300, Mark: 4},
+		{ID: 4, UserID: 2, LocationID: 2, VisitedAt: 400, Mark: 1},
+	}))
+
+	from, to, dist := int64(100), int64(300), 20
+	tt := []struct {
+		name  string
+		id    uint
+		query UserVisitsQuery
+		avg   float64
+	}{
+		{"All", 1, UserVisitsQuery{}, 11.0 / 3},
+		{"Dates", 1, UserVisitsQuery{FromDate: &from, ToDate: &to}, 2},
+		{"Country", 1, UserVisitsQuery{Country: "Russia"}, 4.5},
+		{"ToDistance", 1, UserVisitsQuery{ToDistance: &dist}, 4.5},
+		{"Empty", 1, UserVisitsQuery{Country: "Spain"}, 0},
+		{"PageIgnored", 1, UserVisitsQuery{Offset: 1, Limit: 1, Desc: true}, 11.0 / 3},
+		{"OtherUser", 2, UserVisitsQuery{}, 1},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			avg, err := s.GetUserAvg(ctx, tc.id, &tc.query)
+			assert.NoError(t, err)
+			assert.InDelta(t, tc.avg, avg, 1e-9)
+		})
+	}
+	_, err := s.GetUserAvg(ctx, 3, &UserVisitsQuery{})
+	assert.Equal(t, ErrNotFound, err)
+}
+
+func TestMemoryUserAvg(t *testing.T) {
+	testUserAvg(t, NewMemoryStoreWithOptions(MemoryStoreOptions{Shards: 3}))
+}
+
+func TestBoltUserAvg(t *testing.T) {
+	s, cleanup := testBoltStore(t)
+	defer cleanup()
+	testUserAvg(t, s)
+}
+
+func TestMongoUserAvg(t *testing.T) {
+	s := testMongoStore(t)
+	defer s.s.Close()
+	testUserAvg(t, s)
+	assert.NoError(t, s.Clear(context.Background()))
+}
+
+// testQueryVisits checks visits query combining user, location and date
+// filters with paging
+func testQueryVisits(t *testing.T, s Store) {
+	ctx := context.Background()
+	assert.NoError(t, s.CreateUsers(ctx, []User{
+		{ID: 1, Email: "u1@hlcup.com", Gender: "m"},
+		{ID: 2, Email: "u2@hlcup.com", Gender: "f"},
+	}))
+	assert.NoError(t, s.CreateLocations(ctx, []Location{
+		{ID: 1, Place: "Place1", Country: "Russia", Distance: 10},
+		{ID: 2, Place: "Place2", Country: "France", Distance: 20},
+	}))
+	visits := []Visit{
+		{ID: 1, UserID: 1, LocationID: 1, VisitedAt: 100, Mark: 5},
+		{ID: 2, UserID: 1, LocationID: 2, VisitedAt: 200, Mark: 2},
+		{ID: 3, UserID: 1, LocationID: 1, VisitedAt: 300, Mark: 4},
+		{ID: 4, UserID: 2, LocationID: 1, VisitedAt: 300, Mark: 1},
+		{ID: 5, UserID: 2, LocationID: 1, VisitedAt: 50, Mark: 3},
+		{ID: 6, UserID: 1, LocationID: 1, VisitedAt: 400, Mark: 0},
+	}
+	assert.NoError(t, s.CreateVisits(ctx, visits))
+
+	from, to := int64(100), int64(400)
+	tt := []struct {
+		name     string
+		query    VisitsQuery
+		expected []Visit
+	}{
+		{"User", VisitsQuery{UserID: 2}, []Visit{visits[4], visits[3]}},
+		{"Location", VisitsQuery{LocationID: 1}, []Visit{visits[4], visits[0], visits[2], visits[3], visits[5]}},
+		{"UserAndLocation", VisitsQuery{UserID: 1, LocationID: 1}, []Visit{visits[0], visits[2], visits[5]}},
+		{"LocationSmaller", VisitsQuery{UserID: 1, LocationID: 2}, []Visit{visits[1]}},
+		{"UserAndOtherLocation", VisitsQuery{UserID: 2, LocationID: 2}, []Visit{}},
+		{"Dates", VisitsQuery{UserID: 1, LocationID: 1, FromDate: &from, ToDate: &to}, []Visit{visits[2]}},
+		{"LocationDates", VisitsQuery{LocationID: 1, FromDate: &from}, []Visit{visits[2], visits[3], visits[5]}},
+		{"Page", VisitsQuery{LocationID: 1, Offset: 1, Limit: 2}, []Visit{visits[0], visits[2]}},
+		{"PageBeyond", VisitsQuery{UserID: 1, LocationID: 1, Offset: 3}, []Visit{}},
+	}
+	for _, tc := range tt {
+		t.Run(tc.name, func(t *testing.T) {
+			var result []Visit
+			assert.NoError(t, s.QueryVisits(ctx, &tc.query, &result))
+			assert.Equal(t, tc.expected, result)
+		})
+	}
+	var result []Visit
+	assert.Equal(t, ErrNotFound, s.QueryVisits(ctx, &VisitsQuery{UserID: 3}, &result))
+	assert.Equal(t, ErrNotFound, s.QueryVisits(ctx, &VisitsQuery{UserID: 1, LocationID: 3}, &result))
+	assert.Equal(t, ErrNotFound, s.QueryVisits(ctx, &VisitsQuery{UserID: 3, LocationID: 1}, &result))
+	assert.Equal(t, ErrMissingID, s.QueryVisits(ctx, &VisitsQuery{}, &result))
+}
+
+func TestMemoryQueryVisits(t *testing.T) {
+	testQueryVisits(t, NewMemoryStoreWithOptions(MemoryStoreOptions{Shards: 3}))
+}
+
+func TestBoltQueryVisits(t *testing.T) {
+	s, cleanup := testBoltStore(t)
+	defer cleanup()
+	testQueryVisits(t, s)
+}
+
+func TestMongoQueryVisits(t *testing.T) {
+	s := testMongoStore(t)
+	defer s.s.Close()
+	testQueryVisits(t, s)
+	assert.NoError(t, s.Clear(context.Background()))
+}
+
+// testUniqueEmail checks email uniqueness in both modes, blank emails never
+// conflict
+func testUniqueEmail(t *testing.T, s interface {
+	Store
+	uniqueEmailStore
+}) {
+	ctx := context.Background()
+	var u User
+
+	// unique by default
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 1, Email: "a@hlcup.com"}))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 2}))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 3}))
+	assert.Equal(t, ErrDup, s.CreateUser(ctx, &User{ID: 4, Email: "a@hlcup.com"}))
+	assert.Equal(t, ErrDup, s.UpdateUser(ctx, 2, &User{ID: 2, Email: "a@hlcup.com"}))
+	assert.NoError(t, s.UpdateUser(ctx, 1, &User{ID: 1, Email: "b@hlcup.com"}))
+	assert.NoError(t, s.UpdateUser(ctx, 2, &User{ID: 2, Email: "a@hlcup.com"}))
+	assert.NoError(t, s.UpdateUser(ctx, 2, &User{ID: 2}))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 4, Email: "a@hlcup.com"}))
+
+	// duplicates are allowed once uniqueness is off
+	assert.NoError(t, s.SetUniqueEmail(false))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 5, Email: "a@hlcup.com"}))
+	assert.NoError(t, s.UpdateUser(ctx, 2, &User{ID: 2, Email: "a@hlcup.com"}))
+	assert.NoError(t, s.GetUser(ctx, 5, &u))
+	assert.Equal(t, "a@hlcup.com", u.Email)
+	assert.Equal(t, ErrDup, s.SetUniqueEmail(true))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 6, Email: "b@hlcup.com"}))
+
+	// turning it back on requires no duplicates
+	assert.NoError(t, s.DeleteUser(ctx, 5))
+	assert.NoError(t, s.DeleteUser(ctx, 6))
+	assert.NoError(t, s.UpdateUser(ctx, 2, &User{ID: 2}))
+	assert.NoError(t, s.SetUniqueEmail(true))
+	assert.Equal(t, ErrDup, s.CreateUser(ctx, &User{ID: 7, Email: "b@hlcup.com"}))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 7}))
+	assert.NoError(t, s.DeleteUser(ctx, 1))
+	assert.NoError(t, s.CreateUser(ctx, &User{ID: 8, Email: "b@hlcup.com"}))
+}
+
+func TestMemoryUniqueEmail(t *testing.T) {
+	testUniqueEmail(t, NewMemoryStoreWithOptions(MemoryStoreOptions{Shards: 3}))
+}
+
+func TestBoltUniqueEmail(t *testing.T) {
+	s, cleanup := testBoltStore(t)
+	defer cleanup()
+	testUniqueEmail(t, s)
+}
+
+func TestMongoUniqueEmail(t *testing.T) {
+	s := testMongoStore(t)
+	defer s.s.Close()
+	testUniqueEmail(t, s)
+	assert.NoError(t, s.Clear(context.Background()))
+}